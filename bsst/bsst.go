@@ -471,6 +471,9 @@ func (h *BSST) Get(c []multihash.Multihash) ([]int64, error) {
 
 top:
 	for i, k := range keys {
+		// -1 = not found
+		out[i] = -1
+
 		levelBuckets := uint64(h.h.L0Buckets)
 		prevLevelBuckets := uint64(0)
 
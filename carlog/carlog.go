@@ -25,9 +25,14 @@ import (
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
 	pool "github.com/libp2p/go-buffer-pool"
 
 	"github.com/lotus-web3/ribs/bsst"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
+	"github.com/lotus-web3/ribs/ributil/vfs"
 	mh "github.com/multiformats/go-multihash"
 )
 
@@ -41,6 +46,8 @@ const (
 	BsstIndex      = "index.bsst"
 	BsstIndexCanon = "fil.bsst"
 	HashSample     = "sample.mhlist"
+	SamplePoints   = "sample.points"
+	PieceTree      = "piece.tree"
 
 	BlockLog = "blklog.car"
 	FilCar   = "fil.car"
@@ -75,16 +82,19 @@ var placeholderCid = func() cid.Cid {
 type CarLog struct {
 	staging CarStorageProvider
 
+	// fs is used for the head and data files
+	fs vfs.FS
+
 	// index = dir, data = file
 	IndexPath, DataPath string
 
 	// head is a file which contains cbor-map-serialized Head, padded up to head
 	// size
-	head *os.File
+	head vfs.File
 
 	// data contains a log of all written data
 	// [carv1 header][carv1 block...]
-	data *os.File
+	data vfs.File
 
 	// dataPos wraps data file, and keeps track of the current position
 	dataPos *appendCounter
@@ -106,6 +116,7 @@ type CarLog struct {
 	wIdx  WritableIndex
 	rIdx  ReadableIndex // local
 	eIdx  ReadableIndex // external
+	pIdx  ReadableIndex // canonical car index of offloaded carlogs, opened on first use
 
 	// buffers
 	headBuf [HeadSize]byte
@@ -123,6 +134,70 @@ type CarLog struct {
 	pendingReads sync.WaitGroup
 
 	finalizing bool
+
+	// verify makes reads check block data against block hashes
+	verify bool
+}
+
+type options struct {
+	verify bool
+	fs     vfs.FS
+}
+
+type Option func(*options)
+
+// WithVerifyReads makes View, iterate and WriteCar recompute block hashes and
+// compare them with block CIDs. Mismatching blocks are reported as errors
+// wrapping ErrCorrupted.
+func WithVerifyReads(verify bool) Option {
+	return func(o *options) {
+		o.verify = verify
+	}
+}
+
+// WithFS sets the filesystem used for the head and data files, by default the
+// OS filesystem is used
+func WithFS(fs vfs.FS) Option {
+	return func(o *options) {
+		o.fs = fs
+	}
+}
+
+func openOptions(opts []Option) options {
+	o := options{
+		fs: vfs.OS,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// ErrCorrupted is returned by reads which found block data which doesn't
+// match the block CID
+var ErrCorrupted = errors.New("carlog data corrupted")
+
+// verifyBlock checks that data hashes to the multihash of c
+func verifyBlock(c cid.Cid, data []byte) error {
+	dmh, err := mh.Decode(c.Hash())
+	if err != nil {
+		return xerrors.Errorf("decoding multihash of %s: %w", c, err)
+	}
+
+	sum, err := mh.Sum(data, dmh.Code, dmh.Length)
+	if errors.Is(err, mh.ErrSumNotSupported) {
+		// can't verify, all hashes stored by ribs are supported
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("hashing block %s: %w", c, err)
+	}
+
+	if !bytes.Equal(sum, c.Hash()) {
+		return xerrors.Errorf("block %s hashes to %s: %w", c, sum, ErrCorrupted)
+	}
+
+	return nil
 }
 
 // Head is the on-disk head object. CBOR-map-serialized. Must fit in
@@ -152,19 +227,21 @@ type Head struct {
 	LayerOffsets []int64 // byte offsets of the start of each layer
 }
 
-func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncCleanup) (*CarLog, error) {
+func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncCleanup, opts ...Option) (*CarLog, error) {
+	o := openOptions(opts)
+
 	blkLogPath := filepath.Join(dataPath, BlockLog)
 
 	if err := os.Mkdir(indexPath, 0755); err != nil {
 		return nil, xerrors.Errorf("mkdir index path (%s): %w", indexPath, err)
 	}
 
-	headFile, err := os.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC|os.O_CREATE|os.O_EXCL, 0666)
+	headFile, err := o.fs.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return nil, xerrors.Errorf("opening head: %w", err)
 	}
 
-	dataFile, err := os.OpenFile(blkLogPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	dataFile, err := o.fs.OpenFile(blkLogPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return nil, xerrors.Errorf("opening head: %w", err)
 	}
@@ -188,6 +265,7 @@ func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncClean
 
 	// write head file
 	h := &Head{
+		Version:   HeadVersion,
 		Valid:     true,
 		RetiredAt: int64(at),
 		DataStart: int64(at),
@@ -221,6 +299,7 @@ func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncClean
 
 	return &CarLog{
 		staging: staging,
+		fs:      o.fs,
 
 		IndexPath:    indexPath,
 		DataPath:     dataPath,
@@ -235,11 +314,15 @@ func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncClean
 		rIdx: idx,
 
 		writeLru: must.One(lru.New[int64, []byte](writeLRUEntries)),
+
+		verify: o.verify,
 	}, nil
 }
 
-func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanup) (*CarLog, error) {
-	headFile, err := os.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
+func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanup, opts ...Option) (*CarLog, error) {
+	o := openOptions(opts)
+
+	headFile, err := o.fs.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
 	if err != nil {
 		return nil, xerrors.Errorf("opening head: %w", err)
 	}
@@ -259,6 +342,22 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 		return nil, xerrors.Errorf("unmarshal head: %w", err)
 	}
 
+	if h.Version != HeadVersion {
+		// migrations replace the head file
+		if err := headFile.Close(); err != nil {
+			return nil, xerrors.Errorf("close head: %w", err)
+		}
+
+		if err := migrateHead(o.fs, indexPath, dataPath, &h); err != nil {
+			return nil, err
+		}
+
+		headFile, err = o.fs.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
+		if err != nil {
+			return nil, xerrors.Errorf("opening migrated head: %w", err)
+		}
+	}
+
 	blkLogPath := filepath.Join(dataPath, BlockLog)
 
 	if h.Offloaded {
@@ -270,16 +369,19 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 
 		return &CarLog{
 			staging: staging,
+			fs:      o.fs,
 
 			IndexPath: indexPath,
 			DataPath:  dataPath,
 
 			layerOffsets: h.LayerOffsets,
+
+			verify: o.verify,
 		}, nil
 	}
 
 	// open data
-	dataFile, err := os.OpenFile(blkLogPath, os.O_RDWR|os.O_SYNC, 0666)
+	dataFile, err := o.fs.OpenFile(blkLogPath, os.O_RDWR|os.O_SYNC, 0666)
 	noDataFile := os.IsNotExist(err) && h.External && !h.Offloaded // External files may have data available only on external storage before being only available on Filecoin
 	var dataLen int64
 
@@ -307,6 +409,7 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 
 	jb := &CarLog{
 		staging: staging,
+		fs:      o.fs,
 
 		IndexPath: indexPath,
 		DataPath:  dataPath,
@@ -319,6 +422,8 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 		layerOffsets: h.LayerOffsets,
 
 		writeLru: must.One(lru.New[int64, []byte](writeLRUEntries)),
+
+		verify: o.verify,
 	}
 
 	// open index
@@ -484,10 +589,11 @@ func (j *CarLog) truncate(offset, size int64, onRemove TruncCleanup) error {
 		if err := j.wIdx.Del(toTruncate); err != nil {
 			return xerrors.Errorf("deleting multihashes from jbob index: %w", err)
 		}
-	} else {
+	} else if size <= offset {
 		return nil
 	}
 
+	// uncommitted data may be partially written even without index entries
 	if err := j.data.Truncate(offset); err != nil {
 		return xerrors.Errorf("truncating data file: %w", err)
 	}
@@ -844,9 +950,9 @@ func (j *CarLog) View(c []mh.Multihash, cb func(cidx int, found bool, data []byt
 			return xerrors.Errorf("reading entry: %w", err)
 		}
 
-		n, _, err := cid.CidFromBytes(entBuf[:entLen])
+		n, err := j.checkEntry(c[i], off, entBuf[:entLen])
 		if err != nil {
-			return xerrors.Errorf("parsing cid: %w", err)
+			return err
 		}
 
 		// NOTE: THIS callback MAY UNLOCK THE LOG LOCK
@@ -860,6 +966,32 @@ func (j *CarLog) View(c []mh.Multihash, cb func(cidx int, found bool, data []byt
 	return nil
 }
 
+// checkEntry parses the CID of an entry read for hash h, and verifies the entry
+// if verification is enabled. Returns the length of the CID.
+func (j *CarLog) checkEntry(h mh.Multihash, off int64, ent []byte) (int, error) {
+	n, c, err := cid.CidFromBytes(ent)
+	if err != nil {
+		if j.verify {
+			return 0, xerrors.Errorf("parsing cid at offset %d: %s: %w", off, err, ErrCorrupted)
+		}
+		return 0, xerrors.Errorf("parsing cid: %w", err)
+	}
+
+	if !j.verify {
+		return n, nil
+	}
+
+	if !bytes.Equal(c.Hash(), h) {
+		return 0, xerrors.Errorf("entry at offset %d is %s, expected %s: %w", off, c, h, ErrCorrupted)
+	}
+
+	if err := verifyBlock(c, ent[n:]); err != nil {
+		return 0, xerrors.Errorf("entry at offset %d: %w", off, err)
+	}
+
+	return n, nil
+}
+
 func (j *CarLog) viewExternal(c []mh.Multihash, cb func(cidx int, found bool, data []byte) error) error {
 	locs, err := j.eIdx.Get(c)
 
@@ -904,9 +1036,9 @@ func (j *CarLog) viewExternal(c []mh.Multihash, cb func(cidx int, found bool, da
 			return xerrors.Errorf("reading entry: %w", err)
 		}
 
-		n, _, err := cid.CidFromBytes(entBuf[:entLen])
+		n, err := j.checkEntry(c[i], off, entBuf[:entLen])
 		if err != nil {
-			return xerrors.Errorf("parsing cid: %w", err)
+			return err
 		}
 
 		// NOTE: THIS callback MAY UNLOCK THE LOG LOCK
@@ -965,6 +1097,12 @@ func (j *CarLog) iterate(dataEnd int64, cb func(off int64, length uint64, c cid.
 			return xerrors.Errorf("parsing cid: %w", err)
 		}
 
+		if j.verify {
+			if err := verifyBlock(c, entBuf[n:entLen]); err != nil {
+				return xerrors.Errorf("entry at offset %d: %w", off, err)
+			}
+		}
+
 		if err := cb(off, entLen, c, entBuf[n:entLen]); err != nil {
 			return err
 		}
@@ -1077,14 +1215,17 @@ func (j *CarLog) Finalize(ctx context.Context) error {
 				return xerrors.Errorf("drop level index: %w", err)
 			}
 
+			j.idxLk.Unlock()
 			if !hasTop {
-				j.idxLk.Unlock()
-				err := j.genTopCar()
-				j.idxLk.Lock()
-				if err != nil {
+				if err := j.genTopCar(); err != nil {
+					j.idxLk.Lock()
 					return xerrors.Errorf("generating top car: %w", err)
 				}
 			}
+
+			// the canonical car index is built from the car written for
+			// commP, see WithCarIndex
+			j.idxLk.Lock()
 		} else { // s3 offload
 			j.idxLk.Unlock()
 			// top car
@@ -1101,8 +1242,10 @@ func (j *CarLog) Finalize(ctx context.Context) error {
 
 			// dfs bsst
 			iprov := &carIdxSource{
-				entries:   ents,
-				carSource: j.WriteCar,
+				entries: ents,
+				carSource: func(w io.Writer) (int64, cid.Cid, error) {
+					return j.WriteCar(w)
+				},
 			}
 
 			bss, err := CreateBSSTIndex(filepath.Join(j.IndexPath, BsstIndexCanon), iprov)
@@ -1253,6 +1396,14 @@ func (j *CarLog) FinDataReload(ctx context.Context, blkEnts int64, carSz int64)
 		return xerrors.Errorf("cannot load data into non-offloaded jbob")
 	}
 
+	// the canonical index is recreated below
+	if j.pIdx != nil {
+		if err := j.pIdx.Close(); err != nil {
+			return xerrors.Errorf("closing canonical index: %w", err)
+		}
+		j.pIdx = nil
+	}
+
 	// closed head means that we're offloaded, open data file
 	filPath := filepath.Join(j.DataPath, FilCar)
 	df, err := os.OpenFile(filPath, os.O_RDONLY, 0644)
@@ -1322,7 +1473,7 @@ func (j *CarLog) FinDataReload(ctx context.Context, blkEnts int64, carSz int64)
 	// if not-extern: todo
 
 	// reopen head
-	headFile, err := os.OpenFile(filepath.Join(j.IndexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
+	headFile, err := j.fs.OpenFile(filepath.Join(j.IndexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
 	if err != nil {
 		return xerrors.Errorf("opening head: %w", err)
 	}
@@ -1551,8 +1702,194 @@ func (j *CarLog) genTopCar() error {
 
 /* CANONICAL CAR OUTPUT */
 
-// returns car size and root cid
-func (j *CarLog) WriteCar(w io.Writer) (int64, cid.Cid, error) {
+type writeCarOptions struct {
+	carV2    bool
+	carIndex bool
+}
+
+type WriteCarOption func(*writeCarOptions)
+
+// WithCarV2 makes WriteCar output a CARv2 wrapping the canonical CARv1, with
+// a MultihashIndexSorted index appended after the data payload.
+//
+// The CARv1 payload is byte-for-byte the same as the plain WriteCar output,
+// so the PieceCID computed over the payload doesn't change. Deal data must
+// still be the plain CARv1.
+func WithCarV2(v2 bool) WriteCarOption {
+	return func(o *writeCarOptions) {
+		o.carV2 = v2
+	}
+}
+
+// WriteCar writes the canonical, depth-first car, returns car size and root
+// cid. With WithCarV2 the returned size is the size of the whole CARv2.
+func (j *CarLog) WriteCar(w io.Writer, opts ...WriteCarOption) (int64, cid.Cid, error) {
+	var o writeCarOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.carV2 {
+		return j.writeCarV2(w)
+	}
+
+	if o.carIndex {
+		need, err := j.needsCarIndex()
+		if err != nil {
+			return 0, cid.Undef, err
+		}
+		if need {
+			return j.writeCarIndexed(w)
+		}
+	}
+
+	return j.writeCarV1(w, nil)
+}
+
+// writeCarV2 writes the canonical car as a CARv2 payload.
+//
+// The index and the payload size are checked before anything is written, so
+// that failures don't leave a partial CARv2 in w.
+func (j *CarLog) writeCarV2(w io.Writer) (int64, cid.Cid, error) {
+	j.readStateLk.Lock()
+	if len(j.layerOffsets) == 0 {
+		j.readStateLk.Unlock()
+		return 0, cid.Undef, xerrors.Errorf("no layers, finalize first")
+	}
+
+	// the canonical car contains the same blocks as the data file, and the
+	// data file header has the same length as the canonical car header
+	v1Size := j.dataLen
+	j.readStateLk.Unlock()
+
+	idx, err := j.carV2Index(v1Size)
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("building carv2 index: %w", err)
+	}
+
+	if _, err := w.Write(carv2.Pragma); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv2 pragma: %w", err)
+	}
+	if _, err := carv2.NewHeader(uint64(v1Size)).WriteTo(w); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv2 header: %w", err)
+	}
+
+	type carRes struct {
+		root cid.Cid
+		err  error
+	}
+	done := make(chan carRes, 1)
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, root, err := j.writeCarV1(pw, nil)
+		_ = pw.CloseWithError(err)
+		done <- carRes{root: root, err: err}
+	}()
+
+	n, err := io.Copy(w, io.LimitReader(pr, v1Size))
+
+	// stops the car writer if the payload is longer than the header says
+	_ = pr.CloseWithError(xerrors.Errorf("carv1 payload longer than %d bytes", v1Size))
+	res := <-done
+
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv1 payload: %w", err)
+	}
+	if res.err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv1 payload: %w", res.err)
+	}
+	if n != v1Size {
+		return 0, cid.Undef, xerrors.Errorf("carv1 payload size mismatch, header says %d, wrote %d", v1Size, n)
+	}
+
+	in, err := carindex.WriteTo(idx, w)
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv2 index: %w", err)
+	}
+
+	return carv2.PragmaSize + carv2.HeaderSize + v1Size + int64(in), res.root, nil
+}
+
+// carV2Index builds the CARv2 index of the canonical car, and checks that the
+// car is v1Size bytes long. Offsets come from the canonical BSST index when it
+// exists, otherwise they are recorded by generating the car once.
+func (j *CarLog) carV2Index(v1Size int64) (carindex.Index, error) {
+	var records []carindex.Record
+	var end int64
+
+	path := filepath.Join(j.IndexPath, BsstIndexCanon)
+	if _, err := os.Stat(path); err == nil {
+		canon, err := OpenBSSTIndex(path)
+		if err != nil {
+			return nil, xerrors.Errorf("opening canonical bsst index: %w", err)
+		}
+		defer canon.Close() // nolint:errcheck
+
+		// the data file has the same blocks as the canonical car
+		var cids []cid.Cid
+		err = j.iterate(v1Size, func(off int64, length uint64, c cid.Cid, data []byte) error {
+			cids = append(cids, c)
+			return nil
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("listing data file blocks: %w", err)
+		}
+
+		const batch = 4096
+		hashes := make([]mh.Multihash, 0, batch)
+		var lenBuf [binary.MaxVarintLen64]byte
+
+		for at := 0; at < len(cids); at += batch {
+			bc := cids[at:min(at+batch, len(cids))]
+
+			hashes = hashes[:0]
+			for _, c := range bc {
+				hashes = append(hashes, c.Hash())
+			}
+
+			locs, err := canon.Get(hashes)
+			if err != nil {
+				return nil, xerrors.Errorf("getting canonical offsets: %w", err)
+			}
+
+			for i, l := range locs {
+				if l == -1 {
+					return nil, xerrors.Errorf("block %s not in the canonical index", bc[i])
+				}
+
+				off, entLen := fromOffsetLen(l)
+				records = append(records, carindex.Record{Cid: bc[i], Offset: uint64(off)})
+				end = max(end, off+int64(binary.PutUvarint(lenBuf[:], uint64(entLen)))+int64(entLen))
+			}
+		}
+	} else if os.IsNotExist(err) {
+		var err error
+		end, _, err = j.writeCarV1(io.Discard, func(c cid.Cid, off int64) {
+			records = append(records, carindex.Record{Cid: c, Offset: uint64(off)})
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("generating canonical car: %w", err)
+		}
+	} else {
+		return nil, xerrors.Errorf("stat canonical bsst index: %w", err)
+	}
+
+	if end != v1Size {
+		return nil, xerrors.Errorf("carv1 payload size mismatch, expected %d, canonical car is %d bytes", v1Size, end)
+	}
+
+	idx := carindex.NewMultihashSorted()
+	if err := idx.Load(records); err != nil {
+		return nil, xerrors.Errorf("loading records: %w", err)
+	}
+
+	return idx, nil
+}
+
+// writeCarV1 writes the canonical car, calling onBlock (if not nil) with the
+// offset of each block section in the car
+func (j *CarLog) writeCarV1(w io.Writer, onBlock func(c cid.Cid, off int64)) (int64, cid.Cid, error) {
 	// todo support serving from fil.car
 
 	j.readStateLk.Lock()
@@ -1610,6 +1947,16 @@ func (j *CarLog) WriteCar(w io.Writer) (int64, cid.Cid, error) {
 	atLayer := len(layers) - 1
 	var writeNode func(c cid.Cid, data []byte, atLayer int) error
 	writeNode = func(c cid.Cid, data []byte, atLayer int) error {
+		if j.verify {
+			if err := verifyBlock(c, data); err != nil {
+				return xerrors.Errorf("layer %d: %w", atLayer, err)
+			}
+		}
+
+		if onBlock != nil {
+			onBlock(c, sw.s)
+		}
+
 		// write block
 		if err := carutil.LdWrite(w, c.Bytes(), data); err != nil {
 			return xerrors.Errorf("writing node from layer %d: %w", atLayer, err)
@@ -1762,16 +2109,134 @@ func (j *CarLog) HashSample() ([]mh.Multihash, error) {
 	return out, nil
 }
 
+// SaveSamplePoints stores entries covering piece sample points of the
+// canonical car, recorded while the car was written for commP
+func (j *CarLog) SaveSamplePoints(p *piecesample.Points) error {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return xerrors.Errorf("marshaling sample points: %w", err)
+	}
+
+	if err := j.writeIndexFile(SamplePoints, data); err != nil {
+		return xerrors.Errorf("writing sample points: %w", err)
+	}
+	return nil
+}
+
+// SamplePoints returns piece sample points saved with SaveSamplePoints. They
+// are kept after the carlog is offloaded. The error wraps os.ErrNotExist for
+// carlogs without sample points.
+func (j *CarLog) SamplePoints() (*piecesample.Points, error) {
+	data, err := j.readIndexFile(SamplePoints)
+	if err != nil {
+		return nil, xerrors.Errorf("reading sample points: %w", err)
+	}
+
+	var p piecesample.Points
+	if err := p.UnmarshalBinary(data); err != nil {
+		return nil, xerrors.Errorf("decoding sample points: %w", err)
+	}
+	return &p, nil
+}
+
+// SavePieceTree stores the upper levels of the canonical car piece tree,
+// computed while the car was written for commP
+func (j *CarLog) SavePieceTree(t *datasegment.PieceTree) error {
+	data, err := t.MarshalBinary()
+	if err != nil {
+		return xerrors.Errorf("marshaling piece tree: %w", err)
+	}
+
+	if err := j.writeIndexFile(PieceTree, data); err != nil {
+		return xerrors.Errorf("writing piece tree: %w", err)
+	}
+	return nil
+}
+
+// PieceTree returns the piece tree saved with SavePieceTree. It is kept after
+// the carlog is offloaded. The error wraps os.ErrNotExist for carlogs without
+// a piece tree.
+func (j *CarLog) PieceTree() (*datasegment.PieceTree, error) {
+	data, err := j.readIndexFile(PieceTree)
+	if err != nil {
+		return nil, xerrors.Errorf("reading piece tree: %w", err)
+	}
+
+	var t datasegment.PieceTree
+	if err := t.UnmarshalBinary(data); err != nil {
+		return nil, xerrors.Errorf("decoding piece tree: %w", err)
+	}
+	return &t, nil
+}
+
+// writeIndexFile atomically replaces a file in the index directory, so that
+// readers see either the old or the new file after a crash
+func (j *CarLog) writeIndexFile(name string, data []byte) error {
+	path := filepath.Join(j.IndexPath, name)
+	tmpPath := path + ".tmp"
+
+	f, err := j.fs.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return xerrors.Errorf("create temp file: %w", err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("write temp file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("sync temp file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("close temp file: %w", err)
+	}
+
+	if err := j.fs.Rename(tmpPath, path); err != nil {
+		return xerrors.Errorf("rename temp file: %w", err)
+	}
+
+	if err := vfs.SyncDir(j.fs, j.IndexPath); err != nil {
+		return xerrors.Errorf("sync index dir: %w", err)
+	}
+	return nil
+}
+
+func (j *CarLog) readIndexFile(name string) ([]byte, error) {
+	f, err := j.fs.OpenFile(filepath.Join(j.IndexPath, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint:errcheck
+
+	return io.ReadAll(f)
+}
+
 var ErrAlreadyOffloaded = xerrors.Errorf("group already offloaded")
 
 func (j *CarLog) Offload() error {
-	j.readStateLk.Lock()
-
 	// first assert that we're finalized, and it's safe to offload
-	if len(j.layerOffsets) == 0 {
-		j.readStateLk.Unlock()
+	j.readStateLk.Lock()
+	finalized := len(j.layerOffsets) > 0
+	j.readStateLk.Unlock()
+	if !finalized {
 		return xerrors.Errorf("cannot offload in a non-finalized car log")
 	}
+
+	j.idxLk.RLock()
+	offloaded := j.rIdx == nil && j.eIdx == nil
+	j.idxLk.RUnlock()
+	if offloaded {
+		return ErrAlreadyOffloaded
+	}
+
+	// keep block locations in the deal piece, the index is created with
+	// commP, this covers carlogs which didn't get it while data is local
+	if err := j.saveCarIndex(); err != nil {
+		return xerrors.Errorf("saving canonical car index: %w", err)
+	}
+
+	j.readStateLk.Lock()
 	defer j.readStateLk.Unlock()
 
 	j.idxLk.Lock()
@@ -1824,13 +2289,10 @@ func (j *CarLog) Offload() error {
 		return err
 	}
 
-	// remove indexes
+	// remove the data index, the canonical index is kept for CarLocations
 	if err := os.RemoveAll(filepath.Join(j.IndexPath, BsstIndex)); err != nil {
 		return xerrors.Errorf("removing bsst index: %w", err)
 	}
-	if err := os.RemoveAll(filepath.Join(j.IndexPath, BsstIndexCanon)); err != nil {
-		return xerrors.Errorf("removing external bsst index: %w", err)
-	}
 
 	// close the head
 	if err := j.head.Close(); err != nil {
@@ -1857,7 +2319,7 @@ func (j *CarLog) offloadData() error {
 
 	// remove data file
 	blkLogPath := filepath.Join(j.DataPath, BlockLog)
-	if err := os.RemoveAll(blkLogPath); err != nil {
+	if err := j.fs.Remove(blkLogPath); err != nil && !os.IsNotExist(err) {
 		return xerrors.Errorf("removing data file: %w", err)
 	}
 
@@ -1887,6 +2349,13 @@ func (j *CarLog) Close() error {
 	wi := j.wIdx
 	j.rIdx = nil
 	j.wIdx = nil
+	if j.pIdx != nil {
+		if err := j.pIdx.Close(); err != nil {
+			j.idxLk.Unlock()
+			return xerrors.Errorf("closing canonical index: %w", err)
+		}
+		j.pIdx = nil
+	}
 	j.idxLk.Unlock()
 
 	j.pendingReads.Wait() // writes hold idxLk
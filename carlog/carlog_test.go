@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"io/fs"
+	mrand "math/rand"
 	"os"
 	"path/filepath"
 	"sync"
@@ -13,6 +16,10 @@ import (
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	carindex "github.com/ipld/go-car/v2/index"
+	"github.com/lotus-web3/ribs/ributil/vfs"
+	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/xerrors"
@@ -29,7 +36,7 @@ func TestCarLogBasic(t *testing.T) {
 		}
 	})
 
-	jb, err := Create(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), nil)
+	jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
 	require.NoError(t, err)
 
 	b := blocks.NewBlock([]byte("hello world"))
@@ -56,7 +63,7 @@ func TestCarLogBasic(t *testing.T) {
 		return nil
 	}
 
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	// test that we can read the data back out again
@@ -81,7 +88,7 @@ func TestCarLogBasic(t *testing.T) {
 	err = jb.Close()
 	require.NoError(t, err)
 
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View([]multihash.Multihash{h}, func(i int, found bool, b []byte) error {
@@ -113,7 +120,7 @@ func TestCarLogBasic(t *testing.T) {
 
 	require.NoError(t, jb.Close())
 	// test open offloaded
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View([]multihash.Multihash{h}, func(i int, found bool, b []byte) error {
@@ -139,7 +146,7 @@ func TestCarLog3K(t *testing.T) {
 		}
 	})
 
-	jb, err := Create(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), nil)
+	jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
 	require.NoError(t, err)
 
 	const numBlocks = 3000
@@ -191,7 +198,7 @@ func TestCarLog3K(t *testing.T) {
 		return nil
 	}
 
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View(mhList, func(i int, found bool, b []byte) error {
@@ -212,7 +219,7 @@ func TestCarLog3K(t *testing.T) {
 	require.NoError(t, err)
 
 	//require.NoError(t, VerifyCar(filepath.Join(td, "canon.car")))
-	//require.NoError(t, VerifyCar(filepath.Join(td, "data.car")))
+	//require.NoError(t, VerifyCar(td))
 }
 
 /*
@@ -286,7 +293,7 @@ func TestCarStaging(t *testing.T) {
 
 	tsp := &testStagingProvider{}
 
-	jb, err := Create(tsp, filepath.Join(td, "index"), filepath.Join(td, "data.car"), nil)
+	jb, err := Create(tsp, filepath.Join(td, "index"), td, nil)
 	require.NoError(t, err)
 
 	const numBlocks = 3000
@@ -334,7 +341,7 @@ func TestCarStaging(t *testing.T) {
 		return nil
 	}
 
-	jb, err = Open(tsp, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(tsp, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View(mhList, func(i int, found bool, b []byte) error {
@@ -352,10 +359,17 @@ func TestCarStaging(t *testing.T) {
 	})
 	require.Error(t, err)
 
+	// the canonical index is kept
+	locs, err := jb.CarLocations(mhList)
+	require.NoError(t, err)
+	for _, l := range locs {
+		require.GreaterOrEqual(t, l.Offset, int64(0))
+	}
+
 	err = jb.Close()
 	require.NoError(t, err)
 
-	jb, err = Open(tsp, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(tsp, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View(mhList, func(i int, found bool, b []byte) error {
@@ -368,6 +382,207 @@ func TestCarStaging(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCarLogVerifyReads(t *testing.T) {
+	td := t.TempDir()
+	idx := filepath.Join(td, "index")
+
+	jb, err := Create(nil, idx, td, nil, WithVerifyReads(true))
+	require.NoError(t, err)
+
+	const numBlocks = 16
+	blockData := make([][]byte, numBlocks)
+	mhList := make([]multihash.Multihash, numBlocks)
+	blockList := make([]blocks.Block, numBlocks)
+
+	for i := 0; i < numBlocks; i++ {
+		blockData[i] = make([]byte, 64)
+		_, err := rand.Read(blockData[i])
+		require.NoError(t, err)
+
+		b := blocks.NewBlock(blockData[i])
+		mhList[i] = b.Cid().Hash()
+		blockList[i] = b
+	}
+
+	require.NoError(t, jb.Put(mhList, blockList))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(context.TODO()))
+	_, _, err = jb.WriteCar(io.Discard)
+	require.NoError(t, err)
+	require.NoError(t, jb.Close())
+
+	// flip a bit in one block
+	dataFile := filepath.Join(td, BlockLog)
+	data, err := os.ReadFile(dataFile)
+	require.NoError(t, err)
+	at := bytes.Index(data, blockData[3])
+	require.Greater(t, at, 0)
+	data[at] ^= 1
+	require.NoError(t, os.WriteFile(dataFile, data, 0666))
+
+	noTrunc := func(to int64, h []multihash.Multihash) error {
+		require.Fail(t, "not expected")
+		return nil
+	}
+
+	// without verification corrupted data is returned
+	jb, err = Open(nil, idx, td, noTrunc)
+	require.NoError(t, err)
+	err = jb.View(mhList[3:4], func(i int, found bool, b []byte) error {
+		require.True(t, found)
+		require.NotEqual(t, blockData[3], b)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, jb.Close())
+
+	jb, err = Open(nil, idx, td, noTrunc, WithVerifyReads(true))
+	require.NoError(t, err)
+
+	// intact blocks are readable
+	err = jb.View(mhList[:3], func(i int, found bool, b []byte) error {
+		require.True(t, found)
+		require.Equal(t, blockData[i], b)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = jb.View(mhList, func(i int, found bool, b []byte) error {
+		require.Less(t, i, 3)
+		return nil
+	})
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	_, _, err = jb.WriteCar(io.Discard)
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	require.NoError(t, jb.Close())
+}
+
+func TestCarLogHeadVersion(t *testing.T) {
+	td := t.TempDir()
+	idx := filepath.Join(td, "index")
+
+	jb, err := Create(nil, idx, td, nil)
+	require.NoError(t, err)
+
+	b := blocks.NewBlock([]byte("versioned"))
+	require.NoError(t, jb.Put([]multihash.Multihash{b.Cid().Hash()}, []blocks.Block{b}))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+	require.NoError(t, jb.Close())
+
+	noTrunc := func(to int64, h []multihash.Multihash) error {
+		require.Fail(t, "not expected")
+		return nil
+	}
+
+	setVersion := func(v int64) {
+		hb, err := os.ReadFile(filepath.Join(idx, HeadName))
+		require.NoError(t, err)
+
+		var h Head
+		require.NoError(t, h.UnmarshalCBOR(bytes.NewReader(hb)))
+		require.Equal(t, int64(HeadVersion), h.Version)
+
+		h.Version = v
+		require.NoError(t, replaceHead(vfs.OS, idx, &h))
+	}
+
+	// unversioned heads are migrated
+	setVersion(0)
+
+	jb, err = Open(nil, idx, td, noTrunc)
+	require.NoError(t, err)
+
+	h, err := jb.readHead()
+	require.NoError(t, err)
+	require.Equal(t, int64(HeadVersion), h.Version)
+
+	err = jb.View([]multihash.Multihash{b.Cid().Hash()}, func(i int, found bool, data []byte) error {
+		require.True(t, found)
+		require.Equal(t, b.RawData(), data)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, jb.Close())
+
+	// newer heads are refused
+	setVersion(HeadVersion + 1)
+
+	_, err = Open(nil, idx, td, noTrunc)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestCarLogScrub(t *testing.T) {
+	ctx := context.Background()
+	td := t.TempDir()
+
+	jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
+	require.NoError(t, err)
+
+	const numBlocks = 64
+	blockData := make([][]byte, numBlocks)
+	mhList := make([]multihash.Multihash, numBlocks)
+	blockList := make([]blocks.Block, numBlocks)
+
+	for i := 0; i < numBlocks; i++ {
+		blockData[i] = make([]byte, 64)
+		_, err := rand.Read(blockData[i])
+		require.NoError(t, err)
+
+		b := blocks.NewBlock(blockData[i])
+		mhList[i] = b.Cid().Hash()
+		blockList[i] = b
+	}
+
+	var throttled int64
+	throttle := func(ctx context.Context, n int64) error {
+		throttled += n
+		return nil
+	}
+
+	require.NoError(t, jb.Put(mhList, blockList))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+
+	// writable
+	st, err := jb.Scrub(ctx, throttle)
+	require.NoError(t, err)
+	require.Equal(t, int64(numBlocks), st.Blocks)
+	require.Equal(t, int64(numBlocks*64), st.Bytes)
+	require.Greater(t, throttled, st.Bytes)
+
+	// finalized, upper layers are checked too
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(ctx))
+
+	st, err = jb.Scrub(ctx, throttle)
+	require.NoError(t, err)
+	require.Greater(t, st.Blocks, int64(numBlocks))
+
+	// throttle errors stop scrubbing
+	errStop := xerrors.New("stop")
+	_, err = jb.Scrub(ctx, func(context.Context, int64) error {
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+
+	dataFile := filepath.Join(td, BlockLog)
+	data, err := os.ReadFile(dataFile)
+	require.NoError(t, err)
+	data[bytes.Index(data, blockData[10])] ^= 1
+	require.NoError(t, os.WriteFile(dataFile, data, 0666))
+
+	_, err = jb.Scrub(ctx, throttle)
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	require.NoError(t, jb.Close())
+}
+
 var _ CarStorageProvider = (*testStagingProvider)(nil)
 
 type testStagingProvider struct {
@@ -396,6 +611,13 @@ func (t *testStagingProvider) Upload(ctx context.Context, size int64, src func(w
 	return nil
 }
 
+func (t *testStagingProvider) Has(ctx context.Context) (bool, error) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	return len(t.bdata) > 0, nil
+}
+
 func (t *testStagingProvider) ReadCar(ctx context.Context, off, size int64) (io.ReadCloser, error) {
 	t.lk.Lock()
 	defer t.lk.Unlock()
@@ -426,3 +648,294 @@ func (t *testStagingProvider) URL(ctx context.Context) (string, error) {
 }
 
 var _ CarStorageProvider = &testStagingProvider{}
+
+func TestCarLogWriteCarV2(t *testing.T) {
+	td := t.TempDir()
+
+	jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
+	require.NoError(t, err)
+
+	const numBlocks = 3000
+	mhList := make([]multihash.Multihash, numBlocks)
+	blockList := make([]blocks.Block, numBlocks)
+
+	for i := 0; i < numBlocks; i++ {
+		data := make([]byte, 64)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		blockList[i] = blocks.NewBlock(data)
+		mhList[i] = blockList[i].Cid().Hash()
+	}
+
+	require.NoError(t, jb.Put(mhList, blockList))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(context.TODO()))
+
+	// the canonical index is built with commP, index the car from the
+	// recorded data first
+	require.NoFileExists(t, filepath.Join(td, "index", BsstIndexCanon))
+
+	var v1, v2 bytes.Buffer
+
+	v1Size, v1Root, err := jb.WriteCar(&v1)
+	require.NoError(t, err)
+
+	v2Size, v2Root, err := jb.WriteCar(&v2, WithCarV2(true))
+	require.NoError(t, err)
+	require.Equal(t, v1Root, v2Root)
+	require.Equal(t, int64(v2.Len()), v2Size)
+
+	cr, err := carv2.NewReader(bytes.NewReader(v2.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), cr.Version)
+	require.Equal(t, uint64(v1Size), cr.Header.DataSize)
+
+	roots, err := cr.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{v1Root}, roots)
+
+	// the data payload is the canonical carv1
+	dr, err := cr.DataReader()
+	require.NoError(t, err)
+	payload, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, v1.Bytes(), payload)
+
+	ir, err := cr.IndexReader()
+	require.NoError(t, err)
+	idx, err := carindex.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, multicodec.CarMultihashIndexSorted, idx.Codec())
+
+	for _, b := range blockList {
+		off, err := carindex.GetFirst(idx, b.Cid())
+		require.NoError(t, err)
+
+		_, c, err := cid.CidFromReader(bytes.NewReader(payload[off+uint64(varintSize(payload[off:])):]))
+		require.NoError(t, err)
+		require.Equal(t, b.Cid().Hash(), c.Hash())
+	}
+
+	// the index from the canonical bsst is the same as the recorded index
+	require.NoError(t, jb.saveCarIndex())
+	var fromBsst bytes.Buffer
+	_, _, err = jb.WriteCar(&fromBsst, WithCarV2(true))
+	require.NoError(t, err)
+	require.Equal(t, v2.Bytes(), fromBsst.Bytes())
+
+	// nothing is written when the payload size doesn't match
+	jb.dataLen++
+	var bad bytes.Buffer
+	_, _, err = jb.WriteCar(&bad, WithCarV2(true))
+	require.Error(t, err)
+	require.Zero(t, bad.Len())
+	jb.dataLen--
+
+	require.NoError(t, jb.Close())
+}
+
+func varintSize(b []byte) int {
+	_, n := binary.Uvarint(b)
+	return n
+}
+
+func TestCarLogWriteCarRange(t *testing.T) {
+	for _, dup := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dup-%t", dup), func(t *testing.T) {
+			td := t.TempDir()
+
+			jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
+			require.NoError(t, err)
+
+			// enough blocks for two link layers
+			const numBlocks = 5000
+			mhList := make([]multihash.Multihash, numBlocks)
+			blockList := make([]blocks.Block, numBlocks)
+
+			for i := 0; i < numBlocks; i++ {
+				data := make([]byte, 1+mrand.Intn(300))
+				_, err := rand.Read(data)
+				require.NoError(t, err)
+
+				blockList[i] = blocks.NewBlock(data)
+				mhList[i] = blockList[i].Cid().Hash()
+			}
+			if dup {
+				// the first leaf of the second link node is also stored later
+				blockList[arity+500], mhList[arity+500] = blockList[arity], mhList[arity]
+			}
+
+			require.NoError(t, jb.Put(mhList, blockList))
+			_, err = jb.Commit()
+			require.NoError(t, err)
+
+			require.NoError(t, jb.MarkReadOnly())
+			require.NoError(t, jb.Finalize(context.TODO()))
+
+			var full bytes.Buffer
+			carSize, _, err := jb.WriteCar(&full)
+			require.NoError(t, err)
+
+			check := func(off, size int64) {
+				var out bytes.Buffer
+				n, err := jb.WriteCarRange(&out, off, size)
+				require.NoError(t, err)
+				require.Equal(t, size, n)
+				require.True(t, bytes.Equal(full.Bytes()[off:off+size], out.Bytes()), "range %d+%d", off, size)
+			}
+
+			check(0, carSize)
+			check(0, 0)
+			check(carSize-1, 1)
+			check(carSize, 0)
+			for i := 0; i < 100; i++ {
+				off := mrand.Int63n(carSize)
+				check(off, mrand.Int63n(carSize-off+1))
+			}
+
+			_, err = jb.WriteCarRange(io.Discard, carSize-10, 11)
+			require.Error(t, err)
+
+			require.NoError(t, jb.Close())
+		})
+	}
+}
+
+func TestCarLogCarLocations(t *testing.T) {
+	td := t.TempDir()
+	idx := filepath.Join(td, "index")
+
+	jb, err := Create(nil, idx, td, nil)
+	require.NoError(t, err)
+
+	const numBlocks = 5000
+	mhList := make([]multihash.Multihash, numBlocks)
+	blockList := make([]blocks.Block, numBlocks)
+
+	for i := 0; i < numBlocks; i++ {
+		data := make([]byte, 1+mrand.Intn(300))
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		blockList[i] = blocks.NewBlock(data)
+		mhList[i] = blockList[i].Cid().Hash()
+	}
+
+	require.NoError(t, jb.Put(mhList, blockList))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(context.TODO()))
+	require.NoFileExists(t, filepath.Join(idx, BsstIndexCanon))
+
+	// the canonical index is saved from the written car
+	var full bytes.Buffer
+	_, _, err = jb.WriteCar(&full, WithCarIndex(true))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(idx, BsstIndexCanon))
+
+	var plain bytes.Buffer
+	_, _, err = jb.WriteCar(&plain, WithCarIndex(true))
+	require.NoError(t, err)
+	require.Equal(t, full.Bytes(), plain.Bytes())
+
+	missing, err := multihash.Sum([]byte("missing"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	check := func(jb *CarLog) {
+		locs, err := jb.CarLocations(append(mhList, missing))
+		require.NoError(t, err)
+		require.Len(t, locs, numBlocks+1)
+
+		for i, b := range blockList {
+			ent := full.Bytes()[locs[i].Offset : locs[i].Offset+locs[i].Size]
+
+			entLen, n := binary.Uvarint(ent)
+			require.Equal(t, uint64(len(ent)-n), entLen)
+
+			cn, c, err := cid.CidFromBytes(ent[n:])
+			require.NoError(t, err)
+			require.Equal(t, b.Cid().Hash(), c.Hash())
+			require.Equal(t, b.RawData(), ent[n+cn:])
+		}
+
+		require.Equal(t, int64(-1), locs[numBlocks].Offset)
+	}
+
+	// local data
+	check(jb)
+
+	// offloaded
+	require.NoError(t, jb.Offload())
+	check(jb)
+	require.NoError(t, jb.Close())
+
+	jb, err = Open(nil, idx, td, nil)
+	require.NoError(t, err)
+	check(jb)
+	require.NoError(t, jb.Close())
+}
+
+func TestCarLogCarIndexMissing(t *testing.T) {
+	create := func(t *testing.T) (*CarLog, string, []multihash.Multihash) {
+		td := t.TempDir()
+		idx := filepath.Join(td, "index")
+
+		jb, err := Create(nil, idx, td, nil)
+		require.NoError(t, err)
+
+		mhList := make([]multihash.Multihash, 100)
+		blockList := make([]blocks.Block, len(mhList))
+		for i := range blockList {
+			data := make([]byte, 64)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+
+			blockList[i] = blocks.NewBlock(data)
+			mhList[i] = blockList[i].Cid().Hash()
+		}
+
+		require.NoError(t, jb.Put(mhList, blockList))
+		_, err = jb.Commit()
+		require.NoError(t, err)
+
+		require.NoError(t, jb.MarkReadOnly())
+		require.NoError(t, jb.Finalize(context.TODO()))
+		return jb, idx, mhList
+	}
+
+	t.Run("rebuilt on offload", func(t *testing.T) {
+		jb, idx, mhList := create(t)
+		require.NoFileExists(t, filepath.Join(idx, BsstIndexCanon))
+
+		local, err := jb.CarLocations(mhList)
+		require.NoError(t, err)
+
+		require.NoError(t, jb.Offload())
+		require.FileExists(t, filepath.Join(idx, BsstIndexCanon))
+
+		offloaded, err := jb.CarLocations(mhList)
+		require.NoError(t, err)
+		require.Equal(t, local, offloaded)
+		require.NoError(t, jb.Close())
+	})
+
+	t.Run("lost after offload", func(t *testing.T) {
+		jb, idx, mhList := create(t)
+		require.NoError(t, jb.Offload())
+		require.NoError(t, jb.Close())
+		require.NoError(t, os.Remove(filepath.Join(idx, BsstIndexCanon)))
+
+		jb, err := Open(nil, idx, filepath.Dir(idx), nil)
+		require.NoError(t, err)
+		defer jb.Close() // nolint:errcheck
+
+		_, err = jb.CarLocations(mhList)
+		require.ErrorContains(t, err, "without a canonical car index")
+	})
+}
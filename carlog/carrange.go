@@ -0,0 +1,314 @@
+package carlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	carutil "github.com/ipld/go-car/util"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// errNoCarLayout is returned when the canonical car layout can't be derived
+// from the index, e.g. because some leaves are stored more than once
+var errNoCarLayout = errors.New("can't derive canonical car layout")
+
+// errRangeDone stops WriteCar after the requested range was written
+var errRangeDone = errors.New("range written")
+
+// carSegment is a range of the data file
+type carSegment struct {
+	off, size int64
+}
+
+// linkNode is a link block in one of the upper layers of the data file
+type linkNode struct {
+	off, size int64
+	c         cid.Cid
+
+	// links are only kept for layers above the first link layer, nodes in
+	// the first link layer only keep the first and last leaf
+	links       []cid.Cid
+	nlinks      int
+	first, last cid.Cid
+}
+
+// readLinkLayers reads link nodes of all layers above the bottom layer,
+// layers[0] is the first link layer
+func (j *CarLog) readLinkLayers() (layers [][]linkNode, layerOffsets []int64, err error) {
+	j.readStateLk.Lock()
+	if len(j.layerOffsets) == 0 {
+		j.readStateLk.Unlock()
+		return nil, nil, xerrors.Errorf("no layers, finalize first")
+	}
+	layerOffsets = j.layerOffsets
+	dataLen := j.dataLen
+	j.readStateLk.Unlock()
+
+	layers = make([][]linkNode, len(layerOffsets)-1)
+	for i := range layers {
+		start, end := layerOffsets[i+1], dataLen
+		if i+2 < len(layerOffsets) {
+			end = layerOffsets[i+2]
+		}
+
+		br := bufio.NewReaderSize(&readSeekerFromReaderAt{readerAt: j.data, base: start}, 1<<20)
+		for at := start; at < end; {
+			c, data, err := carutil.ReadNode(br)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("reading link node at %d, layer %d: %w", at, i+1, err)
+			}
+
+			var links []cid.Cid
+			if err := cbor.DecodeInto(data, &links); err != nil {
+				return nil, nil, xerrors.Errorf("decoding layer links: %w", err)
+			}
+			if len(links) == 0 {
+				return nil, nil, xerrors.Errorf("link node at %d has no links", at)
+			}
+
+			nd := linkNode{
+				off:    at,
+				size:   int64(carutil.LdSize(c.Bytes(), data)),
+				c:      c,
+				nlinks: len(links),
+			}
+			if i == 0 {
+				nd.first, nd.last = links[0], links[len(links)-1]
+			} else {
+				nd.links = links
+			}
+
+			layers[i] = append(layers[i], nd)
+			at += nd.size
+
+			if at > end {
+				return nil, nil, xerrors.Errorf("link node at %d crosses layer %d end", nd.off, i+1)
+			}
+		}
+	}
+
+	return layers, layerOffsets, nil
+}
+
+// canonicalLayout maps the depth-first canonical car onto the data file.
+//
+// The data file starts with the same header as the canonical car, followed by
+// the bottom layer and the link layers. In the canonical car each node of the
+// first link layer is followed by the leaves it links to, which are stored as
+// a contiguous range of the bottom layer, so the canonical car is a list of
+// link blocks and leaf ranges. Leaf range boundaries come from index lookups
+// of the first and last leaf linked from each node.
+func (j *CarLog) canonicalLayout() ([]carSegment, error) {
+	layers, layerOffsets, err := j.readLinkLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(layers[len(layers)-1]) != 1 {
+		return nil, xerrors.Errorf("expected 1 node in the top layer, got %d", len(layers[len(layers)-1]))
+	}
+
+	// find leaf ranges
+	leafNodes := layers[0]
+	keys := make([]mh.Multihash, 0, len(leafNodes)*2)
+	for _, nd := range leafNodes {
+		keys = append(keys, nd.first.Hash(), nd.last.Hash())
+	}
+
+	j.idxLk.RLock()
+	if j.rIdx == nil {
+		j.idxLk.RUnlock()
+		return nil, xerrors.Errorf("cannot read from closing or offloaded carlog")
+	}
+	locs, err := j.rIdx.Get(keys)
+	j.idxLk.RUnlock()
+	if err != nil {
+		return nil, xerrors.Errorf("getting leaf locations: %w", err)
+	}
+
+	leafRanges := make([]carSegment, len(leafNodes))
+	var lenBuf [binary.MaxVarintLen64]byte
+	for i := range leafNodes {
+		if locs[2*i] == -1 || locs[2*i+1] == -1 {
+			return nil, xerrors.Errorf("leaf of link node %d not in index: %w", i, errNoCarLayout)
+		}
+
+		start, _ := fromOffsetLen(locs[2*i])
+		lastOff, lastLen := fromOffsetLen(locs[2*i+1])
+		end := lastOff + int64(binary.PutUvarint(lenBuf[:], uint64(lastLen))) + int64(lastLen)
+
+		leafRanges[i] = carSegment{off: start, size: end - start}
+	}
+
+	// leaf ranges must tile the bottom layer, if they don't, the index points
+	// at other copies of some leaves
+	expect := layerOffsets[0]
+	for i, lr := range leafRanges {
+		if lr.off != expect || lr.size <= 0 {
+			return nil, xerrors.Errorf("leaf range %d at %d (size %d), expected %d: %w", i, lr.off, lr.size, expect, errNoCarLayout)
+		}
+		expect += lr.size
+	}
+	if expect != layerOffsets[1] {
+		return nil, xerrors.Errorf("leaf ranges end at %d, bottom layer ends at %d: %w", expect, layerOffsets[1], errNoCarLayout)
+	}
+
+	// walk the tree depth-first
+	segs := []carSegment{{off: 0, size: layerOffsets[0]}}
+	cursors := make([]int, len(layers))
+
+	var walk func(layer, idx int) error
+	walk = func(layer, idx int) error {
+		nd := layers[layer][idx]
+		segs = append(segs, carSegment{off: nd.off, size: nd.size})
+
+		if layer == 0 {
+			segs = append(segs, leafRanges[idx])
+			return nil
+		}
+
+		for _, l := range nd.links {
+			ci := cursors[layer-1]
+			if ci >= len(layers[layer-1]) {
+				return xerrors.Errorf("layer %d has less nodes than linked from layer %d", layer, layer+1)
+			}
+			if layers[layer-1][ci].c != l {
+				return xerrors.Errorf("expected cid %s, got %s, layer %d", l, layers[layer-1][ci].c, layer)
+			}
+			cursors[layer-1]++
+
+			if err := walk(layer-1, ci); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	top := len(layers) - 1
+	if err := walk(top, 0); err != nil {
+		return nil, xerrors.Errorf("walking link layers: %w", err)
+	}
+	for i := 0; i < top; i++ {
+		if cursors[i] != len(layers[i]) {
+			return nil, xerrors.Errorf("layer %d has %d nodes, %d linked", i+1, len(layers[i]), cursors[i])
+		}
+	}
+
+	return segs, nil
+}
+
+// WriteCarRange writes size bytes of the canonical car starting at off,
+// without generating the car before off. Returns the number of bytes written.
+//
+// Ranges are copied from the data file as-is, blocks aren't verified even with
+// WithVerifyReads.
+func (j *CarLog) WriteCarRange(w io.Writer, off, size int64) (int64, error) {
+	if off < 0 || size < 0 {
+		return 0, xerrors.Errorf("invalid range %d+%d", off, size)
+	}
+
+	segs, err := j.canonicalLayout()
+	if errors.Is(err, errNoCarLayout) {
+		log.Warnw("writing car range by streaming the canonical car", "index", j.IndexPath, "off", off, "size", size, "reason", err)
+		return j.writeCarRangeStreamed(w, off, size)
+	}
+	if err != nil {
+		return 0, xerrors.Errorf("getting canonical car layout: %w", err)
+	}
+
+	var carSize int64
+	for _, s := range segs {
+		carSize += s.size
+	}
+	if off+size > carSize {
+		return 0, xerrors.Errorf("range %d+%d beyond car size %d", off, size, carSize)
+	}
+
+	var wrote int64
+	for _, s := range segs {
+		if wrote == size {
+			break
+		}
+		if off >= s.size {
+			off -= s.size
+			continue
+		}
+
+		toCopy := s.size - off
+		if toCopy > size-wrote {
+			toCopy = size - wrote
+		}
+
+		n, err := io.Copy(w, io.NewSectionReader(j.data, s.off+off, toCopy))
+		wrote += n
+		if err != nil {
+			return wrote, xerrors.Errorf("copying car data: %w", err)
+		}
+		if n != toCopy {
+			return wrote, xerrors.Errorf("short car data read at %d: %w", s.off+off+n, io.ErrUnexpectedEOF)
+		}
+
+		off = 0
+	}
+
+	return wrote, nil
+}
+
+// writeCarRangeStreamed writes a range of the canonical car by generating the
+// whole car up to the end of the range
+func (j *CarLog) writeCarRangeStreamed(w io.Writer, off, size int64) (int64, error) {
+	rw := &rangeWriter{w: w, skip: off, left: size}
+	if size > 0 {
+		_, _, err := j.WriteCar(rw)
+		if err != nil && !errors.Is(err, errRangeDone) {
+			return rw.wrote, err
+		}
+	}
+
+	if rw.left > 0 {
+		return rw.wrote, xerrors.Errorf("range %d+%d beyond car end", off, size)
+	}
+	return rw.wrote, nil
+}
+
+type rangeWriter struct {
+	w io.Writer
+
+	skip, left int64
+	wrote      int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if r.skip > 0 {
+		if int64(len(p)) <= r.skip {
+			r.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[r.skip:]
+		r.skip = 0
+	}
+
+	if r.left == 0 {
+		return 0, errRangeDone
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+
+	wn, err := r.w.Write(p)
+	r.wrote += int64(wn)
+	r.left -= int64(wn)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
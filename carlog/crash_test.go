@@ -0,0 +1,152 @@
+package carlog
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/lotus-web3/ribs/ributil/vfs/faultfs"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarLogCrashConsistency(t *testing.T) {
+	for seed := int64(0); seed < 64; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			testCarLogCrash(t, seed)
+		})
+	}
+}
+
+func randTestBlock(rng *rand.Rand) blocks.Block {
+	// mostly small blocks, some spanning many sectors
+	size := 1 + rng.Intn(256)
+	if rng.Intn(4) == 0 {
+		size = 1 + rng.Intn(8<<10)
+	}
+
+	data := make([]byte, size)
+	rng.Read(data)
+	return blocks.NewBlock(data)
+}
+
+func testCarLogCrash(t *testing.T, seed int64) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(seed))
+	fs := faultfs.New(seed)
+
+	td := t.TempDir()
+	idx := filepath.Join(td, "index")
+
+	jb, err := Create(nil, idx, td, nil, WithFS(fs))
+	require.NoError(t, err)
+
+	fs.CrashAfter(rng.Int63n(64))
+	if seed%4 == 0 {
+		fs.FailSyncs(0.2)
+	}
+
+	// committed blocks must survive the crash, written blocks may be lost,
+	// but if read, must have the correct data
+	committed := map[string][]byte{}
+	written := map[string][]byte{}
+	var uncommitted []blocks.Block
+
+	put := func(jb *CarLog, n int) error {
+		b := make([]blocks.Block, n)
+		mhs := make([]multihash.Multihash, n)
+		for i := range b {
+			b[i] = randTestBlock(rng)
+			mhs[i] = b[i].Cid().Hash()
+			written[string(mhs[i])] = b[i].RawData()
+		}
+		uncommitted = append(uncommitted, b...)
+
+		return jb.Put(mhs, b)
+	}
+
+	commit := func(jb *CarLog) error {
+		if _, err := jb.Commit(); err != nil {
+			return err
+		}
+
+		for _, blk := range uncommitted {
+			committed[string(blk.Cid().Hash())] = blk.RawData()
+		}
+		uncommitted = nil
+		return nil
+	}
+
+	for i := 0; i < 32; i++ {
+		if err := put(jb, 1+rng.Intn(8)); err != nil {
+			break
+		}
+		if rng.Intn(4) == 0 {
+			// reads flush buffered writes
+			last := uncommitted[len(uncommitted)-1].Cid().Hash()
+			if err := jb.View([]multihash.Multihash{last}, func(int, bool, []byte) error { return nil }); err != nil {
+				break
+			}
+		}
+		if rng.Intn(2) == 0 {
+			if err := commit(jb); err != nil {
+				break
+			}
+		}
+	}
+
+	_ = jb.Close()
+	require.NoError(t, fs.Crash())
+	fs.FailSyncs(0)
+
+	var truncated int
+	jb, err = Open(nil, idx, td, func(to int64, h []multihash.Multihash) error {
+		truncated += len(h)
+		for _, m := range h {
+			require.NotContains(t, committed, string(m), "committed block truncated")
+		}
+		return nil
+	}, WithFS(fs), WithVerifyReads(true))
+	require.NoError(t, err)
+
+	check := func(jb *CarLog) {
+		var mhs []multihash.Multihash
+		for m := range written {
+			mhs = append(mhs, multihash.Multihash(m))
+		}
+
+		err := jb.View(mhs, func(i int, found bool, data []byte) error {
+			exp, isCommitted := committed[string(mhs[i])]
+			if !found {
+				require.False(t, isCommitted, "committed block lost")
+				return nil
+			}
+
+			if !isCommitted {
+				exp = written[string(mhs[i])]
+			}
+			require.Equal(t, exp, data)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	check(jb)
+
+	// the recovered log can be appended to and finalized
+	uncommitted = nil
+	require.NoError(t, put(jb, 4))
+	require.NoError(t, commit(jb))
+	check(jb)
+
+	_, err = jb.Scrub(ctx, func(context.Context, int64) error { return nil })
+	require.NoError(t, err)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(ctx))
+	check(jb)
+
+	require.NoError(t, jb.Close())
+}
@@ -0,0 +1,272 @@
+package carlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// BlockLocation is the location of a block entry (length prefix, CID and data)
+// in the canonical car
+type BlockLocation struct {
+	// Offset is -1 for blocks which aren't in the car
+	Offset int64
+	Size   int64
+}
+
+// CarLocations returns locations of blocks in the canonical car, which is also
+// the payload of the deal piece. Locations stay available after the carlog is
+// offloaded.
+func (j *CarLog) CarLocations(c []mh.Multihash) ([]BlockLocation, error) {
+	j.idxLk.RLock()
+	idx := j.eIdx
+	if idx == nil {
+		idx = j.pIdx
+	}
+	if idx != nil {
+		locs, err := idx.Get(c)
+		j.idxLk.RUnlock()
+		if err != nil {
+			return nil, xerrors.Errorf("getting car locations: %w", err)
+		}
+		return toBlockLocations(locs), nil
+	}
+	local := j.rIdx != nil
+	j.idxLk.RUnlock()
+
+	if local {
+		return j.localCarLocations(c)
+	}
+
+	j.readStateLk.Lock()
+	finalized := len(j.layerOffsets) > 0
+	j.readStateLk.Unlock()
+	if !finalized {
+		return nil, xerrors.Errorf("carlog not finalized")
+	}
+
+	// offloaded, open the canonical index kept by Offload
+	j.idxLk.Lock()
+	defer j.idxLk.Unlock()
+
+	if j.pIdx == nil {
+		idx, err := OpenBSSTIndex(filepath.Join(j.IndexPath, BsstIndexCanon))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, xerrors.Errorf("carlog was offloaded without a canonical car index, car locations need the data to be reloaded: %w", err)
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("opening canonical bsst index: %w", err)
+		}
+		j.pIdx = idx
+	}
+
+	locs, err := j.pIdx.Get(c)
+	if err != nil {
+		return nil, xerrors.Errorf("getting car locations: %w", err)
+	}
+	return toBlockLocations(locs), nil
+}
+
+func toBlockLocations(locs []int64) []BlockLocation {
+	out := make([]BlockLocation, len(locs))
+	var lenBuf [binary.MaxVarintLen64]byte
+
+	for i, l := range locs {
+		if l == -1 {
+			out[i] = BlockLocation{Offset: -1}
+			continue
+		}
+
+		off, entLen := fromOffsetLen(l)
+		out[i] = BlockLocation{
+			Offset: off,
+			Size:   int64(binary.PutUvarint(lenBuf[:], uint64(entLen))) + int64(entLen),
+		}
+	}
+
+	return out
+}
+
+// localCarLocations finds car locations of blocks in the data file by mapping
+// data file offsets through the canonical car layout
+func (j *CarLog) localCarLocations(c []mh.Multihash) ([]BlockLocation, error) {
+	segs, err := j.canonicalLayout()
+	if err != nil {
+		return nil, xerrors.Errorf("getting canonical car layout: %w", err)
+	}
+
+	j.idxLk.RLock()
+	if j.rIdx == nil {
+		j.idxLk.RUnlock()
+		return nil, xerrors.Errorf("cannot read from closing or offloaded carlog")
+	}
+	locs, err := j.rIdx.Get(c)
+	j.idxLk.RUnlock()
+	if err != nil {
+		return nil, xerrors.Errorf("getting value locations: %w", err)
+	}
+
+	// segments sorted by data file offset, with their offset in the car
+	type carSeg struct {
+		carSegment
+		carOff int64
+	}
+	sorted := make([]carSeg, len(segs))
+	var at int64
+	for i, s := range segs {
+		sorted[i] = carSeg{carSegment: s, carOff: at}
+		at += s.size
+	}
+	sort.Slice(sorted, func(i, k int) bool {
+		return sorted[i].off < sorted[k].off
+	})
+
+	out := toBlockLocations(locs)
+	for i := range out {
+		if out[i].Offset == -1 {
+			continue
+		}
+
+		si := sort.Search(len(sorted), func(k int) bool {
+			return sorted[k].off > out[i].Offset
+		}) - 1
+		if si < 0 || out[i].Offset+out[i].Size > sorted[si].off+sorted[si].size {
+			return nil, xerrors.Errorf("block at data offset %d not in the canonical car", out[i].Offset)
+		}
+
+		out[i].Offset = sorted[si].carOff + out[i].Offset - sorted[si].off
+	}
+
+	return out, nil
+}
+
+// WithCarIndex makes WriteCar save the canonical car index from the written
+// car, if the carlog doesn't have it yet, so that indexing doesn't need a
+// separate pass over the data. Ignored with WithCarV2.
+func WithCarIndex(save bool) WriteCarOption {
+	return func(o *writeCarOptions) {
+		o.carIndex = save
+	}
+}
+
+// needsCarIndex checks if the canonical car index of a carlog finalized
+// without staging storage wasn't saved yet
+func (j *CarLog) needsCarIndex() (bool, error) {
+	j.idxLk.RLock()
+	local := j.rIdx != nil && j.eIdx == nil
+	j.idxLk.RUnlock()
+	if !local {
+		// external carlogs have the index already, and offloaded carlogs
+		// can't create it
+		return false, nil
+	}
+
+	f, err := j.fs.OpenFile(filepath.Join(j.IndexPath, BsstIndexCanon), os.O_RDONLY, 0)
+	if err == nil {
+		return false, f.Close()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return false, xerrors.Errorf("checking canonical car index: %w", err)
+	}
+
+	return true, nil
+}
+
+// saveCarIndex writes the canonical car index, if it's missing, while the data
+// is still local. The index is normally saved while computing commP, see
+// WithCarIndex.
+func (j *CarLog) saveCarIndex() error {
+	need, err := j.needsCarIndex()
+	if err != nil || !need {
+		return err
+	}
+
+	_, _, err = j.writeCarIndexed(io.Discard)
+	return err
+}
+
+// writeCarIndexed writes the canonical car to w, and saves the canonical car
+// index built from the written data
+func (j *CarLog) writeCarIndexed(w io.Writer) (int64, cid.Cid, error) {
+	layers, _, err := j.readLinkLayers()
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("reading link layers: %w", err)
+	}
+
+	var ents int64
+	for i, l := range layers {
+		ents += int64(len(l))
+		if i == 0 {
+			for _, nd := range l {
+				ents += int64(nd.nlinks)
+			}
+		}
+	}
+
+	pr, pw := io.Pipe()
+
+	iprov := &carIdxSource{
+		entries: ents,
+		carSource: func(w io.Writer) (int64, cid.Cid, error) {
+			n, err := io.Copy(w, pr)
+			return n, cid.Undef, err
+		},
+	}
+
+	path := filepath.Join(j.IndexPath, BsstIndexCanon)
+	tmpPath := path + ".tmp"
+
+	idxDone := make(chan error, 1)
+	go func() {
+		err := func() error {
+			bss, err := CreateBSSTIndex(tmpPath, iprov)
+			if err != nil {
+				return xerrors.Errorf("write canonical bsst index: %w", err)
+			}
+			if err := bss.Close(); err != nil {
+				return xerrors.Errorf("close canonical bsst index: %w", err)
+			}
+
+			if iprov.statReader == nil {
+				return xerrors.Errorf("no stat reader")
+			}
+			if !iprov.statReader.eof {
+				return xerrors.Errorf("didn't read whole file")
+			}
+			return nil
+		}()
+
+		// unblocks the car writer if indexing stopped early
+		if err != nil {
+			_ = pr.CloseWithError(err)
+		} else {
+			_ = pr.Close()
+		}
+		idxDone <- err
+	}()
+
+	n, root, err := j.writeCarV1(io.MultiWriter(w, pw), nil)
+	_ = pw.CloseWithError(err)
+	idxErr := <-idxDone
+
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	if idxErr != nil {
+		_ = j.fs.Remove(tmpPath)
+		return 0, cid.Undef, xerrors.Errorf("building canonical car index: %w", idxErr)
+	}
+
+	if err := j.fs.Rename(tmpPath, path); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("rename canonical bsst index: %w", err)
+	}
+
+	return n, root, nil
+}
@@ -0,0 +1,175 @@
+package carlog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// scrubIndexBatch is the number of entries checked against the index at once
+const scrubIndexBatch = 1024
+
+// ScrubStats describes data checked by Scrub
+type ScrubStats struct {
+	Blocks int64
+	Bytes  int64
+}
+
+// Scrub reads all committed blocks in the data file, and checks CAR framing,
+// block hashes, and that the index points at each block in the bottom layer.
+// Data problems are returned as errors wrapping ErrCorrupted.
+//
+// throttle is called with the size of each entry before the next entry is
+// read, and can block to limit the IO used by scrubbing.
+func (j *CarLog) Scrub(ctx context.Context, throttle func(ctx context.Context, n int64) error) (ScrubStats, error) {
+	var st ScrubStats
+
+	j.idxLk.RLock()
+	if j.data == nil {
+		j.idxLk.RUnlock()
+		return st, xerrors.Errorf("no local data to scrub")
+	}
+	// the data file is removed on offload after pending reads finish
+	j.pendingReads.Add(1)
+	j.idxLk.RUnlock()
+	defer j.pendingReads.Done()
+
+	h, err := j.readHead()
+	if err != nil {
+		return st, err
+	}
+
+	// bottom layer blocks are indexed, upper layers only contain link blocks
+	idxEnd, end := h.RetiredAt, h.RetiredAt
+	if len(h.LayerOffsets) > 1 {
+		idxEnd = h.LayerOffsets[1]
+
+		fi, err := j.data.Stat()
+		if err != nil {
+			return st, xerrors.Errorf("stat data file: %w", err)
+		}
+		end = fi.Size()
+	}
+
+	type indexed struct {
+		off    int64
+		length int
+		hash   mh.Multihash
+	}
+	var pending []indexed
+
+	checkIndex := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		hashes := make([]mh.Multihash, len(pending))
+		for i, e := range pending {
+			hashes[i] = e.hash
+		}
+
+		j.idxLk.RLock()
+		if j.eIdx != nil || j.rIdx == nil {
+			// external index offsets point into the canonical car
+			j.idxLk.RUnlock()
+			pending = pending[:0]
+			return nil
+		}
+		locs, err := j.rIdx.Get(hashes)
+		j.idxLk.RUnlock()
+		if err != nil {
+			return xerrors.Errorf("getting index entries: %w", err)
+		}
+
+		for i, e := range pending {
+			if locs[i] == -1 {
+				return xerrors.Errorf("block %s at offset %d missing from index: %w", cid.NewCidV1(cid.Raw, e.hash), e.off, ErrCorrupted)
+			}
+
+			// a block written twice in one batch is stored twice, the index
+			// points to one of the copies
+			off, length := fromOffsetLen(locs[i])
+			if length != e.length {
+				return xerrors.Errorf("index entry for block %s at offset %d points to %d (len %d), expected len %d: %w", cid.NewCidV1(cid.Raw, e.hash), e.off, off, length, e.length, ErrCorrupted)
+			}
+		}
+
+		pending = pending[:0]
+		return nil
+	}
+
+	var cbErr error
+	err = j.iterate(end, func(off int64, length uint64, c cid.Cid, data []byte) error {
+		cbErr = func() error {
+			if err := throttle(ctx, int64(length)); err != nil {
+				return err
+			}
+
+			// with verify set, iterate already checked the hash
+			if !j.verify {
+				if err := verifyBlock(c, data); err != nil {
+					return xerrors.Errorf("entry at offset %d: %w", off, err)
+				}
+			}
+
+			st.Blocks++
+			st.Bytes += int64(len(data))
+
+			if off < idxEnd {
+				pending = append(pending, indexed{
+					off:    off,
+					length: int(length),
+					hash:   bytes.Clone(c.Hash()),
+				})
+
+				if len(pending) >= scrubIndexBatch {
+					return checkIndex()
+				}
+			}
+
+			return nil
+		}()
+		return cbErr
+	})
+	if cbErr != nil {
+		return st, cbErr
+	}
+	if err != nil {
+		// the log ends at a committed entry boundary, any framing error is
+		// a data problem
+		if errors.Is(err, ErrCorrupted) {
+			return st, err
+		}
+		return st, xerrors.Errorf("reading data: %s: %w", err, ErrCorrupted)
+	}
+
+	if err := checkIndex(); err != nil {
+		return st, err
+	}
+
+	return st, nil
+}
+
+// readHead reads the on-disk head without modifying it
+func (j *CarLog) readHead() (Head, error) {
+	var h Head
+	var headBuf [HeadSize]byte
+
+	n, err := j.head.ReadAt(headBuf[:], 0)
+	if err != nil {
+		return h, xerrors.Errorf("read head: %w", err)
+	}
+	if n != len(headBuf) {
+		return h, xerrors.Errorf("head mis-sized (%d bytes)", n)
+	}
+
+	if err := h.UnmarshalCBOR(bytes.NewReader(headBuf[:])); err != nil {
+		return h, xerrors.Errorf("unmarshalling head: %w", err)
+	}
+
+	return h, nil
+}
@@ -0,0 +1,118 @@
+package carlog
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/lotus-web3/ribs/ributil/vfs"
+	"golang.org/x/xerrors"
+)
+
+// HeadVersion is the version of the head and data layout written by this code.
+// Older carlogs are migrated in Open, newer carlogs are refused.
+const HeadVersion = 1
+
+// ErrUnsupportedVersion is returned by Open when the carlog was written by a
+// newer version
+var ErrUnsupportedVersion = errors.New("unsupported carlog version")
+
+type headMigration struct {
+	Description string
+
+	// Migrate upgrades the carlog layout by one version. The head is only
+	// written after Migrate succeeds, so Migrate must be safe to re-run after
+	// an interrupted migration.
+	Migrate func(indexPath, dataPath string, h *Head) error
+}
+
+// headMigrations[i] migrates carlogs from version i to i+1
+var headMigrations = []headMigration{
+	{
+		Description: "Set version on heads written before head versioning",
+		Migrate: func(indexPath, dataPath string, h *Head) error {
+			// layout of unversioned carlogs is the same as version 1
+			return nil
+		},
+	},
+}
+
+func init() {
+	if len(headMigrations) != HeadVersion {
+		panic("carlog: head migrations don't match HeadVersion")
+	}
+}
+
+// migrateHead upgrades the carlog to HeadVersion one version at a time,
+// replacing the head file atomically after each step
+func migrateHead(fs vfs.FS, indexPath, dataPath string, h *Head) error {
+	if h.Version > HeadVersion {
+		return xerrors.Errorf("head version %d is newer than supported version %d: %w", h.Version, HeadVersion, ErrUnsupportedVersion)
+	}
+	if h.Version < 0 {
+		return xerrors.Errorf("invalid head version %d: %w", h.Version, ErrUnsupportedVersion)
+	}
+
+	for h.Version < HeadVersion {
+		m := headMigrations[h.Version]
+
+		log.Infow("migrating carlog", "index", indexPath, "from", h.Version, "to", h.Version+1, "migration", m.Description)
+
+		nh := *h
+		if err := m.Migrate(indexPath, dataPath, &nh); err != nil {
+			return xerrors.Errorf("migrating carlog from version %d (%s): %w", h.Version, m.Description, err)
+		}
+		nh.Version = h.Version + 1
+
+		if err := replaceHead(fs, indexPath, &nh); err != nil {
+			return xerrors.Errorf("writing version %d head: %w", nh.Version, err)
+		}
+
+		*h = nh
+	}
+
+	return nil
+}
+
+// replaceHead writes a new head file next to the current one, and renames it
+// over the current head
+func replaceHead(fs vfs.FS, indexPath string, h *Head) error {
+	var buf bytes.Buffer
+	if err := h.MarshalCBOR(&buf); err != nil {
+		return xerrors.Errorf("marshal head: %w", err)
+	}
+	if buf.Len() > HeadSize {
+		return xerrors.Errorf("head too large (%d bytes)", buf.Len())
+	}
+
+	var headBuf [HeadSize]byte
+	copy(headBuf[:], buf.Bytes())
+
+	tmpPath := filepath.Join(indexPath, HeadName+".migrate")
+	f, err := fs.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return xerrors.Errorf("create temp head: %w", err)
+	}
+
+	if _, err := f.Write(headBuf[:]); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("write temp head: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("sync temp head: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("close temp head: %w", err)
+	}
+
+	if err := fs.Rename(tmpPath, filepath.Join(indexPath, HeadName)); err != nil {
+		return xerrors.Errorf("rename temp head: %w", err)
+	}
+
+	if err := vfs.SyncDir(fs, indexPath); err != nil {
+		return xerrors.Errorf("sync index dir: %w", err)
+	}
+	return nil
+}
@@ -3,9 +3,11 @@ package ribs
 import (
 	"context"
 	"io"
+	"slices"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
 	"github.com/multiformats/go-multihash"
 )
 
@@ -18,7 +20,7 @@ const UndefGroupKey = GroupKey(-1)
 type RBS interface {
 	Start() error
 
-	Session(ctx context.Context) Session
+	Session(ctx context.Context, opts ...SessionOption) Session
 	Storage() Storage
 	StorageDiag() RBSDiag
 
@@ -28,9 +30,46 @@ type RBS interface {
 	// StagingStorage manages staged data (full non-replicated data)
 	StagingStorage() RBSStagingStorage
 
+	// Pins manages DAG roots retained by garbage collection
+	Pins() RBSPins
+
 	io.Closer
 }
 
+type SessionOptions struct {
+	// Labels are attached to all groups written to in the session. Sessions
+	// with different labels write to separate groups.
+	Labels map[string]string
+
+	// Namespace isolates data written in the session into separate groups.
+	// Sessions in a namespace can only read data written in that namespace.
+	// The default namespace ("") can read all data.
+	Namespace string
+}
+
+type SessionOption func(*SessionOptions)
+
+// WithSessionLabels attaches labels to groups which the session writes to.
+// Writable groups are only shared by sessions with the same labels, so that
+// group labels describe all data in the group.
+func WithSessionLabels(labels map[string]string) SessionOption {
+	return func(o *SessionOptions) {
+		if o.Labels == nil {
+			o.Labels = map[string]string{}
+		}
+		for k, v := range labels {
+			o.Labels[k] = v
+		}
+	}
+}
+
+// WithNamespace scopes the session to a namespace
+func WithNamespace(ns string) SessionOption {
+	return func(o *SessionOptions) {
+		o.Namespace = ns
+	}
+}
+
 // Batch groups operations, NOT thread safe
 type Batch interface {
 	// View is like See Session.View, and all constraints apply, but with batch
@@ -67,6 +106,16 @@ type Session interface {
 	// -1 means not found
 	GetSize(ctx context.Context, c []multihash.Multihash, cb func([]int32) error) error
 
+	// GetCids reconstructs CIDs of stored blocks. Blocks stored without codec
+	// information are returned as CIDv1 with the raw codec, cid.Undef means
+	// that the block was not found.
+	GetCids(ctx context.Context, c []multihash.Multihash, cb func([]cid.Cid) error) error
+
+	// ListCids lists up to `limit` CIDs of stored blocks with multihashes
+	// greater than `after` (nil lists from the start), in multihash byte order.
+	// `next` is the cursor for the next page, nil when all keys were listed.
+	ListCids(ctx context.Context, after multihash.Multihash, limit int) (cids []cid.Cid, next multihash.Multihash, err error)
+
 	Batch(ctx context.Context) Batch
 }
 
@@ -75,33 +124,204 @@ type Storage interface {
 
 	ReadCar(ctx context.Context, group GroupKey, sz func(int64), out io.Writer) error
 
+	// ReadCarRange writes size bytes of the deal car starting at off, without
+	// reading the part of the car before off
+	ReadCarRange(ctx context.Context, group GroupKey, off, size int64, out io.Writer) error
+
+	// CarLocations returns locations of blocks in the deal car, which is also
+	// the piece payload. Locations are kept after the group is offloaded.
+	CarLocations(ctx context.Context, group GroupKey, c []multihash.Multihash) ([]BlockLocation, error)
+
+	// ReadCarV2 writes the group as a CARv2 with an embedded
+	// MultihashIndexSorted index. The data payload is the same CARv1 as
+	// written by ReadCar. Used for group exports; deal staging keeps using
+	// ReadCar as deal pieces are CARv1.
+	ReadCarV2(ctx context.Context, group GroupKey, out io.Writer) error
+
 	// HashSample returns a sample of hashes from the group saved when the group was finalized
 	HashSample(ctx context.Context, group GroupKey) ([]multihash.Multihash, error)
 
+	// BlockSample returns blocks covering n piece sample points picked with
+	// seed, see piecesample.Seed. Sample points are recorded when commP is
+	// computed, and are kept after the group is offloaded.
+	BlockSample(ctx context.Context, group GroupKey, seed [32]byte, n int) ([]piecesample.Entry, error)
+
+	// ProveBlockSample proves that blocks returned by BlockSample are at their
+	// sample points in the group piece. Group data must be local.
+	ProveBlockSample(ctx context.Context, group GroupKey, seed [32]byte, n int) ([]piecesample.BlockProof, error)
+
 	DescibeGroup(ctx context.Context, group GroupKey) (GroupDesc, error)
 
 	Offload(ctx context.Context, group GroupKey) error
 
 	LoadFilCar(ctx context.Context, group GroupKey, f io.Reader, sz int64) error
 
-	Subscribe(GroupSub)
+	// SetGroupLabels merges labels into group labels, empty values remove labels
+	SetGroupLabels(ctx context.Context, group GroupKey, labels map[string]string) error
+
+	// SetNamespaceQuota limits the amount of data stored in namespace groups,
+	// 0 means no limit
+	SetNamespaceQuota(ctx context.Context, ns string, maxBytes int64) error
+
+	// SubscribeEvents streams group events with sequence numbers greater than
+	// `since`, starting with events recorded in the durable event log. Use
+	// GroupEventSeqLatest to only receive new events.
+	// The channel is closed when ctx is cancelled or the storage is closed.
+	SubscribeEvents(ctx context.Context, since int64, filter GroupEventFilter) (<-chan GroupEvent, error)
+
+	// EventCursor returns the sequence number of the last event handled by
+	// the named subscriber, saved with SetEventCursor, or GroupEventSeqLatest
+	// for new subscribers. Subscribers resume from it after a restart.
+	EventCursor(ctx context.Context, name string) (int64, error)
+	SetEventCursor(ctx context.Context, name string, seq int64) error
+}
+
+// RBSPins is a persistent set of DAG roots. Blocks which are not reachable
+// from any pinned root are removed by GC.
+type RBSPins interface {
+	Pin(ctx context.Context, roots []cid.Cid) error
+	Unpin(ctx context.Context, roots []cid.Cid) error
+	List(ctx context.Context) ([]cid.Cid, error)
+
+	// GC marks all blocks reachable from pinned roots, then unlinks all other
+	// blocks. Blocks written while GC is running are retained.
+	// Only dag-pb, dag-cbor and raw DAGs are supported, GC will fail if a pinned
+	// DAG contains blocks with other codecs.
+	// GC refuses to run when nothing is pinned, unless WithEmptyPinSet is set.
+	GC(ctx context.Context, opts ...GCOption) (GCStats, error)
+}
+
+type GCOptions struct {
+	// AllowEmptyPinSet lets GC unlink all data when no roots are pinned
+	AllowEmptyPinSet bool
+}
+
+type GCOption func(*GCOptions)
+
+// WithEmptyPinSet allows GC to unlink all data when no roots are pinned
+func WithEmptyPinSet() GCOption {
+	return func(o *GCOptions) {
+		o.AllowEmptyPinSet = true
+	}
+}
+
+type GCStats struct {
+	Marked int64
+
+	Unlinked      int64
+	UnlinkedBytes int64
+}
+
+// CarImportProgress describes progress of a CAR import
+type CarImportProgress struct {
+	// Offset is the CAR file offset up to which all blocks are committed, an
+	// interrupted import can be resumed from this offset
+	Offset int64
+
+	// Blocks / Bytes count blocks written to the blockstore
+	Blocks int64
+	Bytes  int64
+
+	// Skipped counts blocks which were already stored
+	Skipped int64
+
+	// Done is set in the last progress update of a successful import
+	Done bool
+
+	// Error is set in the last progress update of a failed import
+	Error string `json:",omitempty"`
 }
 
 type GroupDesc struct {
 	RootCid, PieceCid cid.Cid
 	CarSize           int64
+
+	// PieceCidV2 is the FRC-0069 piece CID, which also encodes the piece and
+	// payload sizes. Undefined for groups without commP.
+	PieceCidV2 cid.Cid
+}
+
+// BlockLocation is the location of a block entry (length prefix, CID and
+// data) in a group deal car
+type BlockLocation struct {
+	// Offset is -1 for blocks which aren't in the group
+	Offset int64
+	Size   int64
 }
 
 type OffloadLoader interface {
 	View(ctx context.Context, g GroupKey, c []multihash.Multihash, cb func(cidx int, data []byte)) error
 }
 
-type GroupSub func(group GroupKey, from, to GroupState)
+// GroupEventSeqLatest can be passed to SubscribeEvents to skip already recorded events
+const GroupEventSeqLatest = int64(-1)
+
+type GroupEventType int
+
+const (
+	// GroupEventStateChange is sent when group state changes
+	GroupEventStateChange GroupEventType = iota
+	GroupEventFinalized
+	GroupEventCommP
+	GroupEventOffloaded
+	GroupEventStagingOffloaded
+	GroupEventReloaded
+	GroupEventFailed
+
+	// GroupEventCorrupted is sent when reading group data found blocks which
+	// don't match their hashes. Sent once per group until the group data is
+	// reloaded.
+	GroupEventCorrupted
+
+	// GroupEventOpened is sent when a group is opened, after a restart or when
+	// the group is first read. To is set to the current group state, so that
+	// subscribers can resume work on groups which didn't change state.
+	GroupEventOpened
+)
+
+type GroupEvent struct {
+	// Seq is the position of the event in the event log, can be used to resume
+	// subscriptions
+	Seq int64
+	// At is the event time in unix milliseconds
+	At int64
+
+	Group GroupKey
+	Type  GroupEventType
+
+	// GroupEventStateChange, To is also set for GroupEventOpened
+	From, To GroupState
+
+	// GroupEventCommP
+	PieceCID string
+
+	// GroupEventFailed, GroupEventCorrupted
+	Error string
+}
+
+// GroupEventFilter selects events delivered to a subscriber, empty fields match everything
+type GroupEventFilter struct {
+	Groups []GroupKey
+	Types  []GroupEventType
+}
+
+func (f GroupEventFilter) Match(ev GroupEvent) bool {
+	if len(f.Groups) > 0 && !slices.Contains(f.Groups, ev.Group) {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, ev.Type) {
+		return false
+	}
+	return true
+}
 
 type RBSDiag interface {
 	Groups() ([]GroupKey, error)
 	GroupMeta(gk GroupKey) (GroupMeta, error)
 
+	// FindGroups lists groups matching the filter
+	FindGroups(ctx context.Context, filter GroupFilter) ([]GroupKey, error)
+
 	TopIndexStats(context.Context) (TopIndexStats, error)
 	GetGroupStats() (*GroupStats, error)
 	GroupIOStats() GroupIOStats
@@ -109,6 +329,14 @@ type RBSDiag interface {
 	WorkerStats() WorkerStats
 }
 
+// GroupFilter selects groups, empty fields match everything
+type GroupFilter struct {
+	// Labels must all be set on the group with matching values
+	Labels map[string]string
+
+	States []GroupState
+}
+
 type WorkerStats struct {
 	Available, InFinalize, InCommP, InReload int64
 	TaskQueue                                int64
@@ -132,6 +360,20 @@ type GroupMeta struct {
 
 	PieceCID, RootCID string
 
+	// PieceCIDv2 is the FRC-0069 form of PieceCID
+	PieceCIDv2 string
+
+	Labels map[string]string
+
+	// Unlinked data is still stored in the group, but not reachable through the
+	// index, compaction can reclaim it
+	UnlinkedBlocks, UnlinkedBytes int64
+
+	// LastScrub is the unix time of the last background data check, 0 if the
+	// group wasn't checked yet. ScrubError is set if the check found problems.
+	LastScrub  int64
+	ScrubError string
+
 	DealCarSize *int64 // todo move to DescribeGroup
 }
 
@@ -142,6 +384,17 @@ type GroupStats struct {
 	OffloadedDataSize    int64
 
 	OpenGroups, OpenWritable int
+
+	Namespaces map[string]NamespaceStats
+}
+
+type NamespaceStats struct {
+	Groups int64
+	Blocks int64
+	Bytes  int64
+
+	// QuotaBytes is the namespace quota, 0 if not limited
+	QuotaBytes int64
 }
 
 type GroupIOStats struct {
@@ -162,7 +415,39 @@ type Index interface {
 	GetGroups(ctx context.Context, mh []multihash.Multihash, cb func(cidx int, gk GroupKey) (more bool, err error)) error
 	GetSizes(ctx context.Context, mh []multihash.Multihash, cb func([]int32) error) error
 
-	AddGroup(ctx context.Context, mh []multihash.Multihash, sizes []int32, group GroupKey) error
+	// AddGroup records that blocks are stored in a group. codecs are optional
+	// (nil, or 0 for individual blocks), and are used to reconstruct block CIDs.
+	AddGroup(ctx context.Context, mh []multihash.Multihash, sizes []int32, codecs []uint64, group GroupKey) error
+
+	// GetCodecs gets CID codecs of blocks, 0 means that the codec is not known
+	GetCodecs(ctx context.Context, mh []multihash.Multihash, cb func([]uint64) error) error
+
+	// AddRefs records that the namespace references the multihashes. Refs
+	// record membership, adding a ref the namespace already holds is a no-op.
+	// cb, if not nil, is called for multihashes which weren't referenced before.
+	AddRefs(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int) error) error
+	// RemoveRefs drops namespace refs, cb is called for multihashes the
+	// namespace referenced, or which have no ref because they were written
+	// before refs were recorded. Dropped refs are kept with a zero count,
+	// marking data unlinked from the namespace.
+	RemoveRefs(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int) error) error
+	// RefCounts gets namespace refs, count is 1 for held refs and 0 for
+	// dropped ones, has is false when the namespace never referenced the multihash
+	RefCounts(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int, count int64, has bool) error) error
+	// Refs lists refs of all namespaces referencing the multihashes
+	Refs(ctx context.Context, mh []multihash.Multihash, cb func(cidx int, ns string, count int64) error) error
+
+	// Remove removes all index entries for the multihashes, including
+	// namespace refs
+	Remove(ctx context.Context, mh []multihash.Multihash) error
+
+	// Hashes iterates over all multihashes in the index, codec is 0 when not known
+	Hashes(ctx context.Context, cb func(mh multihash.Multihash, size int32, codec uint64) error) error
+
+	// ListEntries lists up to `limit` entries with multihashes greater than
+	// `after` (nil lists from the start), in multihash byte order. Fewer than
+	// `limit` entries are only returned at the end of the index.
+	ListEntries(ctx context.Context, after multihash.Multihash, limit int) ([]IndexEntry, error)
 
 	Sync(ctx context.Context) error
 	DropGroup(ctx context.Context, mh []multihash.Multihash, group GroupKey) error
@@ -171,6 +456,14 @@ type Index interface {
 	io.Closer
 }
 
+type IndexEntry struct {
+	Hash multihash.Multihash
+	Size int32
+
+	// Codec is 0 when not known
+	Codec uint64
+}
+
 type GroupState int // todo move to rbstore?
 
 const (
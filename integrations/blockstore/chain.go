@@ -0,0 +1,19 @@
+package ribsbstore
+
+import "time"
+
+// ChainOptions returns options for using the blockstore as a lotus chain
+// blockstore, e.g. as a splitstore cold store or a chain archive.
+//
+// Chain sync and state computation write many small blocks, mostly in large
+// PutMany calls from buffered blockstores, and lotus rarely calls Flush. The
+// writer accepts larger batches, and flushes periodically so that a crash
+// doesn't lose more than a few epochs of data, which lotus can re-sync.
+func ChainOptions() []Option {
+	return []Option{
+		WithQueueSize(4096),
+		WithMaxQueuedBlocks(16384),
+		WithMaxUnflushedBlocks(131072),
+		WithFlushInterval(time.Minute),
+	}
+}
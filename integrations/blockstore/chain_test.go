@@ -0,0 +1,272 @@
+package ribsbstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/actors/builtin"
+	"github.com/filecoin-project/lotus/chain/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChainBlockstore drives the blockstore like lotus does, with the mainnet
+// genesis as the chain segment
+func TestChainBlockstore(t *testing.T) {
+	ctx := context.Background()
+
+	bs := New(ctx, &testRibs{RBS: openTestRibs(t)}, ChainOptions()...)
+	t.Cleanup(func() {
+		require.NoError(t, bs.Close())
+	})
+
+	genesis, stored := importGenesis(t, bs)
+
+	// written blocks are readable before flush
+	var hdr *types.BlockHeader
+	require.NoError(t, bs.View(ctx, genesis, func(data []byte) (err error) {
+		hdr, err = types.DecodeBlock(data)
+		return err
+	}))
+	require.Equal(t, genesis, hdr.Cid())
+
+	require.NoError(t, bs.Flush(ctx))
+
+	// the whole genesis dag is reachable through zero-copy reads
+	seen := map[cid.Cid]struct{}{}
+	var walk func(c cid.Cid)
+	walk = func(c cid.Cid) {
+		if _, ok := ributil.InlineData(c); ok {
+			return
+		}
+		if _, ok := seen[c]; ok {
+			return
+		}
+		if _, ok := stored[cid.NewCidV1(cid.Raw, c.Hash())]; !ok {
+			// links to outside the chain segment, e.g. sector commitments
+			return
+		}
+		seen[c] = struct{}{}
+
+		var links []cid.Cid
+		require.NoError(t, bs.View(ctx, c, func(data []byte) error {
+			require.Equal(t, stored[cid.NewCidV1(cid.Raw, c.Hash())], data)
+			return ributil.BlockLinks(c, data, func(l cid.Cid) {
+				links = append(links, l)
+			})
+		}))
+		for _, l := range links {
+			walk(l)
+		}
+	}
+	walk(genesis)
+	require.Greater(t, len(seen), 1)
+
+	st, err := state.LoadStateTree(cbor.NewCborStore(bs), hdr.ParentStateRoot)
+	require.NoError(t, err)
+
+	var actors int
+	require.NoError(t, st.ForEach(func(address.Address, *types.Actor) error {
+		actors++
+		return nil
+	}))
+	require.NotZero(t, actors)
+
+	keys := func() map[cid.Cid]struct{} {
+		out := map[cid.Cid]struct{}{}
+		require.NoError(t, bs.ForEachKey(func(c cid.Cid) error {
+			out[c] = struct{}{}
+			return nil
+		}))
+		return out
+	}
+
+	all := keys()
+	require.Len(t, all, len(stored))
+
+	// compaction, like splitstore, deletes keys found with ForEachKey
+	var toDelete []cid.Cid
+	for c := range all {
+		if len(toDelete) < len(all)/2 {
+			toDelete = append(toDelete, c)
+		}
+	}
+	require.NoError(t, bs.DeleteMany(ctx, toDelete))
+	require.NoError(t, bs.Flush(ctx))
+
+	require.Len(t, keys(), len(all)-len(toDelete))
+	err = bs.View(ctx, toDelete[0], func([]byte) error { return nil })
+	require.True(t, ipld.IsNotFound(err))
+}
+
+// importGenesis imports the mainnet genesis in PutMany batches, like chain
+// sync, returns the genesis block cid and stored block data by raw cid
+func importGenesis(t *testing.T, bs *Blockstore) (cid.Cid, map[cid.Cid][]byte) {
+	ctx := context.Background()
+
+	cr, err := car.NewCarReader(bytes.NewReader(build.MaybeGenesis()))
+	require.NoError(t, err)
+	require.Len(t, cr.Header.Roots, 1)
+	genesis := cr.Header.Roots[0]
+
+	stored := map[cid.Cid][]byte{}
+	var batch []blocks.Block
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		if _, ok := ributil.InlineData(blk.Cid()); ok {
+			continue
+		}
+
+		stored[cid.NewCidV1(cid.Raw, blk.Cid().Hash())] = blk.RawData()
+		batch = append(batch, blk)
+		if len(batch) == 256 {
+			require.NoError(t, bs.PutMany(ctx, batch))
+			batch = nil
+		}
+	}
+	require.NoError(t, bs.PutMany(ctx, batch))
+
+	return genesis, stored
+}
+
+// TestChainBlockstoreEpochs builds a chain of multi-block tipsets on top of the
+// mainnet genesis, changing state at every epoch, then walks it back from the
+// head like lotus loading tipsets and state
+func TestChainBlockstoreEpochs(t *testing.T) {
+	ctx := context.Background()
+
+	bs := New(ctx, &testRibs{RBS: openTestRibs(t)}, ChainOptions()...)
+	t.Cleanup(func() {
+		require.NoError(t, bs.Close())
+	})
+
+	genesis, _ := importGenesis(t, bs)
+	require.NoError(t, bs.Flush(ctx))
+
+	loadHeader := func(c cid.Cid) *types.BlockHeader {
+		var hdr *types.BlockHeader
+		require.NoError(t, bs.View(ctx, c, func(data []byte) (err error) {
+			hdr, err = types.DecodeBlock(data)
+			return err
+		}))
+		return hdr
+	}
+
+	loadTipSet := func(key types.TipSetKey) *types.TipSet {
+		var hdrs []*types.BlockHeader
+		for _, c := range key.Cids() {
+			hdrs = append(hdrs, loadHeader(c))
+		}
+		ts, err := types.NewTipSet(hdrs)
+		require.NoError(t, err)
+		return ts
+	}
+
+	gen := loadHeader(genesis)
+	cst := cbor.NewCborStore(bs)
+
+	st, err := state.LoadStateTree(cst, gen.ParentStateRoot)
+	require.NoError(t, err)
+	burnt, err := st.GetActor(builtin.BurntFundsActorAddr)
+	require.NoError(t, err)
+	baseBalance := burnt.Balance
+
+	const epochs = 10
+
+	head, err := types.NewTipSet([]*types.BlockHeader{gen})
+	require.NoError(t, err)
+
+	for h := abi.ChainEpoch(1); h <= epochs; h++ {
+		// each epoch burns some funds, state is written like the state
+		// tree is flushed after applying a tipset
+		st, err := state.LoadStateTree(cst, head.ParentState())
+		require.NoError(t, err)
+
+		act, err := st.GetActor(builtin.BurntFundsActorAddr)
+		require.NoError(t, err)
+		act.Balance = big.Add(act.Balance, big.NewInt(int64(h)))
+		require.NoError(t, st.SetActor(builtin.BurntFundsActorAddr, act))
+
+		root, err := st.Flush(ctx)
+		require.NoError(t, err)
+
+		var hdrs []*types.BlockHeader
+		for m := uint64(1000); m < 1002; m++ {
+			miner, err := address.NewIDAddress(m)
+			require.NoError(t, err)
+
+			hdr := *gen
+			hdr.Miner = miner
+			hdr.Ticket = &types.Ticket{VRFProof: []byte{byte(h), byte(m)}}
+			hdr.Parents = head.Cids()
+			hdr.Height = h
+			hdr.ParentStateRoot = root
+			hdr.Timestamp = gen.Timestamp + uint64(h)*build.BlockDelaySecs
+
+			sb, err := hdr.ToStorageBlock()
+			require.NoError(t, err)
+			require.NoError(t, bs.Put(ctx, sb))
+
+			hdrs = append(hdrs, &hdr)
+		}
+
+		head, err = types.NewTipSet(hdrs)
+		require.NoError(t, err)
+
+		// some epochs are only in unflushed groups when walking the chain
+		if h%3 == 0 {
+			require.NoError(t, bs.Flush(ctx))
+		}
+	}
+
+	// walk tipsets back from the head to genesis, reading state at every epoch
+	ts := loadTipSet(head.Key())
+	require.Len(t, ts.Blocks(), 2)
+
+	var walked int
+	for ts.Height() > 0 {
+		h := ts.Height()
+
+		st, err := state.LoadStateTree(cst, ts.ParentState())
+		require.NoError(t, err)
+
+		act, err := st.GetActor(builtin.BurntFundsActorAddr)
+		require.NoError(t, err)
+
+		// balance includes burns from all epochs up to h
+		expect := big.NewInt(int64(h) * int64(h+1) / 2)
+		require.Equal(t, big.Add(baseBalance, expect), act.Balance, "epoch %d", h)
+
+		parent := loadTipSet(ts.Parents())
+		require.Equal(t, h-1, parent.Height())
+		ts = parent
+		walked++
+	}
+
+	require.Equal(t, epochs, walked)
+	require.Equal(t, []cid.Cid{genesis}, ts.Cids())
+
+	// state of older epochs stays readable next to newer state
+	st, err = state.LoadStateTree(cst, gen.ParentStateRoot)
+	require.NoError(t, err)
+	act, err := st.GetActor(builtin.BurntFundsActorAddr)
+	require.NoError(t, err)
+	require.Equal(t, baseBalance, act.Balance)
+}
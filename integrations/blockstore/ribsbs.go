@@ -2,7 +2,7 @@ package ribsbstore
 
 import (
 	"context"
-	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,11 +11,15 @@ import (
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
 	"github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
 )
 
+var log = logging.Logger("ribsbstore")
+
 type Request[P, R any] struct {
 	Param P
 	Resp  chan R
@@ -33,26 +37,137 @@ type Blockstore struct {
 
 	sess ribs.Session
 
-	puts chan Request[[]blocks.Block, error]
+	puts    chan Request[[]blocks.Block, error]
+	deletes chan Request[[]cid.Cid, error]
 
 	flushReq atomic.Int64
 	flushPos atomic.Int64
 
-	flush chan struct{}
+	flush  chan struct{}
+	reopen chan Request[struct{}, error]
+
+	// err is set when a flush fails, all later calls fail with this error
+	errLk sync.Mutex
+	err   error
+
+	opts options
 
 	stop, stopped chan struct{}
 }
 
+type options struct {
+	autoReopen time.Duration
+
+	queueSize          int
+	maxQueuedBlocks    int
+	maxUnflushedBlocks int
+
+	syncPuts      bool
+	groupCommit   time.Duration
+	flushInterval time.Duration
+}
+
+type Option func(*options)
+
+// WithQueueSize sets the number of write requests which can wait for the
+// writer before PutMany and DeleteMany block.
+func WithQueueSize(requests int) Option {
+	return func(o *options) {
+		o.queueSize = requests
+	}
+}
+
+// WithMaxQueuedBlocks sets the max number of blocks from queued requests
+// written to the batch at once.
+func WithMaxQueuedBlocks(blocks int) Option {
+	return func(o *options) {
+		o.maxQueuedBlocks = blocks
+	}
+}
+
+// WithMaxUnflushedBlocks sets the number of written blocks after which the
+// batch is flushed, even if no Flush was requested.
+func WithMaxUnflushedBlocks(blocks int) Option {
+	return func(o *options) {
+		o.maxUnflushedBlocks = blocks
+	}
+}
+
+// WithSyncPuts makes PutMany and DeleteMany return only after the change was
+// flushed to RIBS. Requests queued while the writer is busy are committed
+// together.
+func WithSyncPuts(sync bool) Option {
+	return func(o *options) {
+		o.syncPuts = sync
+	}
+}
+
+// WithGroupCommit is like WithSyncPuts, but after the first unflushed write
+// the writer waits up to the window for more writes, and commits them with a
+// single flush. This trades write latency for fewer, larger flushes.
+func WithGroupCommit(window time.Duration) Option {
+	return func(o *options) {
+		o.syncPuts = true
+		o.groupCommit = window
+	}
+}
+
+// WithFlushInterval makes the writer flush buffered writes periodically. This
+// bounds the amount of acknowledged data which can be lost on a crash when
+// writes aren't synchronous.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.flushInterval = interval
+	}
+}
+
+// WithAutoReopen makes the blockstore leave the poisoned state automatically
+// after the specified time. See Reopen for data loss caveats.
+func WithAutoReopen(after time.Duration) Option {
+	return func(o *options) {
+		o.autoReopen = after
+	}
+}
+
 var _ blockstore.Blockstore = &Blockstore{}
-var _ lotusbstore.Flusher = &Blockstore{}
+var _ lotusbstore.Blockstore = &Blockstore{}
+var _ lotusbstore.BlockstoreIterator = &Blockstore{}
+
+// New creates a Blockstore backed by RIBS.
+//
+// Writes are acknowledged according to the configured durability mode:
+//   - By default (buffered) PutMany and DeleteMany return once the change is
+//     added to the current batch. Changes are durable after a Flush call
+//     returns, or after the batch is flushed because it reached
+//     MaxUnflushedBlocks, or the flush interval passed.
+//   - With WithSyncPuts writes return after the batch containing them is
+//     flushed, so acknowledged writes are durable.
+//   - With WithGroupCommit writes are durable when acknowledged, like with
+//     WithSyncPuts, but flushes happen at most once per commit window.
+//
+// When flushing data to RIBS fails, the blockstore enters a poisoned state in
+// which all calls fail with the flush error, see Err and Reopen. Writes
+// waiting for the failed flush get the error too.
+func New(ctx context.Context, r ribs.RIBS, opts ...Option) *Blockstore {
+	o := options{
+		queueSize:          BlockstoreQueueSize,
+		maxQueuedBlocks:    BlockstoreMaxQueuedBlocks,
+		maxUnflushedBlocks: BlockstoreMaxUnflushedBlocks,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
 
-func New(ctx context.Context, r ribs.RIBS) *Blockstore {
 	b := &Blockstore{
-		r:    r,
-		sess: r.Session(ctx),
-		puts: make(chan Request[[]blocks.Block, error], 640), // todo make this configurable
+		r:       r,
+		sess:    r.Session(ctx),
+		puts:    make(chan Request[[]blocks.Block, error], o.queueSize),
+		deletes: make(chan Request[[]cid.Cid, error], 64),
 
-		flush: make(chan struct{}, 1),
+		flush:  make(chan struct{}, 1),
+		reopen: make(chan Request[struct{}, error]),
+
+		opts: o,
 
 		stop:    make(chan struct{}),
 		stopped: make(chan struct{}),
@@ -62,7 +177,9 @@ func New(ctx context.Context, r ribs.RIBS) *Blockstore {
 	return b
 }
 
+// Defaults for options which aren't set in New
 var (
+	BlockstoreQueueSize          = 640
 	BlockstoreMaxQueuedBlocks    = 640
 	BlockstoreMaxUnflushedBlocks = 10240
 )
@@ -71,18 +188,21 @@ func (b *Blockstore) start(ctx context.Context) {
 	var bt ribs.Batch
 	var unflushed int
 
-	defer func() {
-		if bt != nil {
-			err := bt.Flush(ctx)
-			if err != nil {
-				fmt.Println("failed to flush batch", "error", err) // todo log
-			} else {
-				fmt.Println("flushed batch on close") // todo log
-			}
-		}
+	// writes waiting for a flush, in sync modes
+	var waiting []chan<- error
 
-		close(b.stopped)
-	}()
+	// set when poisoned, and auto-reopen is enabled
+	var reopenTimer <-chan time.Time
+
+	// set when there are writes waiting for a group commit
+	var commitTimer <-chan time.Time
+
+	var flushTick <-chan time.Time
+	if b.opts.flushInterval > 0 {
+		ticker := time.NewTicker(b.opts.flushInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
 
 	flushBatch := func() error {
 		select { // if any requests are queued, consume them
@@ -98,15 +218,85 @@ func (b *Blockstore) start(ctx context.Context) {
 		}
 
 		err := bt.Flush(ctx)
-		if err != nil {
-			fmt.Println("failed to flush batch", "error", err) // todo log
-			// todo PANIK (make all subsequent calls to this blockstore fail)
-			return err
-		}
+
+		// the batch is in an unknown state after a failed flush, so it's
+		// dropped either way
 		unflushed = 0
 		bt = nil
 
-		return nil
+		if err != nil {
+			log.Errorw("failed to flush batch, blockstore poisoned", "error", err)
+			b.poison(err)
+
+			if b.opts.autoReopen > 0 {
+				reopenTimer = time.After(b.opts.autoReopen)
+			}
+
+			err = b.Err()
+		}
+
+		for _, resp := range waiting {
+			resp <- err
+		}
+		waiting = nil
+		commitTimer = nil
+
+		return err
+	}
+
+	defer func() {
+		if bt != nil && b.Err() == nil {
+			if err := flushBatch(); err != nil {
+				log.Errorw("failed to flush batch on close", "error", err)
+			} else {
+				log.Debugw("flushed batch on close")
+			}
+		}
+
+		close(b.stopped)
+	}()
+
+	// written is called after a change is added to the batch, and either
+	// acknowledges the change, or queues it until the batch is flushed
+	written := func(n int, resp ...chan<- error) {
+		unflushed += n
+
+		if b.opts.syncPuts {
+			waiting = append(waiting, resp...)
+
+			if b.opts.groupCommit > 0 && unflushed <= b.opts.maxUnflushedBlocks {
+				if commitTimer == nil {
+					commitTimer = time.After(b.opts.groupCommit)
+				}
+				return
+			}
+
+			// waiting writes are acknowledged by flushBatch
+			_ = flushBatch()
+			return
+		}
+
+		var err error
+		if unflushed > b.opts.maxUnflushedBlocks {
+			err = flushBatch()
+		}
+
+		for _, r := range resp {
+			r <- err
+		}
+	}
+
+	// the failed batch was already dropped in flushBatch, and no writes are
+	// accepted while poisoned, so there is no state to reset besides the error
+	reopen := func() {
+		reopenTimer = nil
+
+		b.errLk.Lock()
+		if b.err != nil {
+			log.Warnw("reopening poisoned blockstore", "error", b.err)
+		}
+		b.err = nil
+		b.errLk.Unlock()
 	}
 
 	for {
@@ -128,7 +318,7 @@ func (b *Blockstore) start(ctx context.Context) {
 					break loop
 				}
 
-				if len(toPut) > BlockstoreMaxQueuedBlocks { // todo make this configurable
+				if len(toPut) > b.opts.maxQueuedBlocks {
 					break
 				}
 			}
@@ -139,6 +329,11 @@ func (b *Blockstore) start(ctx context.Context) {
 				}
 			}
 
+			if err := b.Err(); err != nil {
+				respondAll(err)
+				continue
+			}
+
 			if bt == nil {
 				bt = b.sess.Batch(ctx)
 			}
@@ -149,29 +344,70 @@ func (b *Blockstore) start(ctx context.Context) {
 				continue
 			}
 
-			unflushed += len(toPut)
-			if unflushed > BlockstoreMaxUnflushedBlocks { // todo make this configurable
-				err = flushBatch()
-				if err != nil {
-					respondAll(err) // todo: not perfect but better than blocking all writes (?)
-					continue
-				}
+			written(len(toPut), toRespond...)
+		case req := <-b.deletes:
+			if err := b.Err(); err != nil {
+				req.Resp <- err
+				continue
 			}
 
-			respondAll(nil)
-		case <-b.flush:
-			err := flushBatch()
+			if bt == nil {
+				bt = b.sess.Batch(ctx)
+			}
+
+			// unlinks are applied on flush, puts in the same batch take precedence
+			err := bt.Unlink(ctx, cidsToMhs(req.Param))
 			if err != nil {
-				fmt.Println("failed to flush batch", "error", err) // todo log
-				// todo PANIK (make all subsequent calls to this blockstore fail)
-				return
+				req.Resp <- err
+				continue
 			}
+
+			written(len(req.Param), req.Resp)
+		case <-b.flush:
+			// errors are surfaced to callers through Err
+			_ = flushBatch()
+		case <-commitTimer:
+			_ = flushBatch()
+		case <-flushTick:
+			_ = flushBatch()
+		case req := <-b.reopen:
+			reopen()
+			req.Resp <- nil
+		case <-reopenTimer:
+			reopen()
 		case <-b.stop:
 			return
 		}
 	}
 }
 
+// poison makes all later calls fail with err, until the blockstore is reopened.
+// Only the first error is kept.
+func (b *Blockstore) poison(err error) {
+	b.errLk.Lock()
+	defer b.errLk.Unlock()
+
+	if b.err == nil {
+		b.err = xerrors.Errorf("ribs blockstore failed: %w", err)
+	}
+}
+
+// Err returns the error which poisoned the blockstore, nil if the blockstore
+// is healthy. Can be used in health checks.
+func (b *Blockstore) Err() error {
+	b.errLk.Lock()
+	defer b.errLk.Unlock()
+
+	return b.err
+}
+
+// Reopen clears the poisoned state. Writes which were acknowledged, but not
+// flushed before the failure are lost, so the caller must be able to redo
+// them.
+func (b *Blockstore) Reopen(ctx context.Context) error {
+	return request(ctx, b.reopen, struct{}{})
+}
+
 func cidsToMhs(cids []cid.Cid) []multihash.Multihash {
 	mhs := make([]multihash.Multihash, len(cids))
 	for i, c := range cids {
@@ -180,12 +416,19 @@ func cidsToMhs(cids []cid.Cid) []multihash.Multihash {
 	return mhs
 }
 
+// DeleteBlock removes a block from the blockstore. Like Put, the deletion is
+// only guaranteed to be applied after Flush. If the same block is Put before
+// the deletion is flushed, the Put takes precedence and the block is kept.
 func (b *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
-	bt := b.sess.Batch(ctx)
-	if err := bt.Unlink(ctx, cidsToMhs([]cid.Cid{c})); err != nil {
+	return b.DeleteMany(ctx, []cid.Cid{c})
+}
+
+// DeleteMany removes blocks from the blockstore, see DeleteBlock
+func (b *Blockstore) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	if err := b.Err(); err != nil {
 		return err
 	}
-	return bt.Flush(ctx)
+	return request(ctx, b.deletes, cids)
 }
 
 func (b *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
@@ -200,27 +443,60 @@ func (b *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
 	return true, nil
 }
 
+// Get returns a copy of block data, consumers which don't need to retain the
+// data should use View instead.
 func (b *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
 	var out blocks.Block
 
-	// todo test not found
-	err := b.sess.View(ctx, cidsToMhs([]cid.Cid{c}), func(cidx int, data []byte) {
+	err := b.View(ctx, c, func(data []byte) error {
 		dcopy := make([]byte, len(data))
 		copy(dcopy, data)
 
-		out, _ = blocks.NewBlockWithCid(dcopy, c)
+		var err error
+		out, err = blocks.NewBlockWithCid(dcopy, c)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
-	if out == nil {
-		return nil, ipld.ErrNotFound{Cid: c}
+
+	return out, nil
+}
+
+// View calls cb with block data without copying it. The data is a carlog read
+// buffer, a write cache entry, or a buffer from external storage, so it must
+// not be modified or retained after cb returns.
+func (b *Blockstore) View(ctx context.Context, c cid.Cid, cb func([]byte) error) error {
+	if err := b.Err(); err != nil {
+		return err
+	}
+
+	if data, ok := ributil.InlineData(c); ok {
+		return cb(data)
 	}
 
-	return out, err
+	var found bool
+	var cbErr error
+
+	err := b.sess.View(ctx, cidsToMhs([]cid.Cid{c}), func(cidx int, data []byte) {
+		found = true
+		cbErr = cb(data)
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ipld.ErrNotFound{Cid: c}
+	}
+
+	return cbErr
 }
 
 func (b *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if err := b.Err(); err != nil {
+		return 0, err
+	}
+
 	var r int32
 
 	err := b.sess.GetSize(ctx, cidsToMhs([]cid.Cid{c}), func(sz []int32) error {
@@ -244,25 +520,21 @@ func (b *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
 }
 
 func (b *Blockstore) Put(ctx context.Context, block blocks.Block) error {
-	req := MakeRequest[[]blocks.Block, error]([]blocks.Block{block})
-	select {
-	case b.puts <- req:
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	return b.PutMany(ctx, []blocks.Block{block})
+}
 
-	select {
-	case err := <-req.Resp:
+func (b *Blockstore) PutMany(ctx context.Context, blk []blocks.Block) error {
+	if err := b.Err(); err != nil {
 		return err
-	case <-ctx.Done():
-		return ctx.Err()
 	}
+	return request(ctx, b.puts, blk)
 }
 
-func (b *Blockstore) PutMany(ctx context.Context, blk []blocks.Block) error {
-	req := MakeRequest[[]blocks.Block, error](blk)
+// request sends a request to the writer goroutine, and waits for the response
+func request[P any](ctx context.Context, ch chan Request[P, error], param P) error {
+	req := MakeRequest[P, error](param)
 	select {
-	case b.puts <- req:
+	case ch <- req:
 	case <-ctx.Done():
 		return ctx.Err()
 	}
@@ -275,13 +547,81 @@ func (b *Blockstore) PutMany(ctx context.Context, blk []blocks.Block) error {
 	}
 }
 
+// AllKeysPageSize is the number of keys read from the index at once when
+// enumerating keys
+var AllKeysPageSize = 4096
+
 func (b *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
-	return nil, xerrors.Errorf("too slow")
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make(chan cid.Cid, AllKeysPageSize)
+
+	go func() {
+		defer close(out)
+
+		err := b.forEachKey(ctx, func(c cid.Cid) error {
+			select {
+			case out <- c:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Errorw("listing blockstore keys", "error", err)
+		}
+	}()
+
+	return out, nil
+}
+
+// ForEachKey iterates over all keys in the blockstore; keys written during
+// iteration may or may not be visited.
+//
+// Like in other multihash-keyed blockstores, keys are returned as raw CIDv1,
+// kubo GC relies on this. Use Session.ListCids to get CIDs with original
+// codecs.
+func (b *Blockstore) ForEachKey(cb func(cid.Cid) error) error {
+	return b.forEachKey(context.TODO(), cb)
+}
+
+func (b *Blockstore) forEachKey(ctx context.Context, cb func(cid.Cid) error) error {
+	var after multihash.Multihash
+
+	for {
+		if err := b.Err(); err != nil {
+			return err
+		}
+
+		cids, next, err := b.sess.ListCids(ctx, after, AllKeysPageSize)
+		if err != nil {
+			return xerrors.Errorf("listing keys: %w", err)
+		}
+
+		for _, c := range cids {
+			if err := cb(cid.NewCidV1(cid.Raw, c.Hash())); err != nil {
+				return err
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+		after = next
+	}
 }
 
 func (b *Blockstore) HashOnRead(bool) {}
 
+// Flush waits for all writes accepted before the call to be committed to RIBS.
+// If the blockstore is poisoned, the error which caused it is returned.
 func (b *Blockstore) Flush(ctx context.Context) error {
+	if err := b.Err(); err != nil {
+		return err
+	}
+
 	// note "now"
 	now := b.flushReq.Add(1)
 
@@ -296,7 +636,7 @@ func (b *Blockstore) Flush(ctx context.Context) error {
 	// todo: use a cancellable cond-like thing here
 	for {
 		if b.flushPos.Load() >= now {
-			return nil
+			return b.Err()
 		}
 
 		select {
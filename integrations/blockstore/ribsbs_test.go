@@ -0,0 +1,434 @@
+package ribsbstore
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbstor"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// testRibs is a RIBS without deal-making, backed by a local rbstor
+type testRibs struct {
+	ribs.RBS
+}
+
+func (t *testRibs) Wallet() ribs.Wallet {
+	return nil
+}
+
+func (t *testRibs) DealDiag() ribs.RIBSDiag {
+	return nil
+}
+
+// faultyRibs makes batch flushes fail while failFlush is set, and counts
+// successful flushes
+type faultyRibs struct {
+	testRibs
+	failFlush atomic.Bool
+	flushes   atomic.Int64
+}
+
+var errInjected = errors.New("injected flush failure")
+
+func (f *faultyRibs) Session(ctx context.Context, opts ...ribs.SessionOption) ribs.Session {
+	return &faultySession{Session: f.RBS.Session(ctx, opts...), f: f}
+}
+
+type faultySession struct {
+	ribs.Session
+	f *faultyRibs
+}
+
+func (s *faultySession) Batch(ctx context.Context) ribs.Batch {
+	return &faultyBatch{Batch: s.Session.Batch(ctx), f: s.f}
+}
+
+type faultyBatch struct {
+	ribs.Batch
+	f *faultyRibs
+}
+
+func (b *faultyBatch) Flush(ctx context.Context) error {
+	if b.f.failFlush.Load() {
+		return errInjected
+	}
+	if err := b.Batch.Flush(ctx); err != nil {
+		return err
+	}
+	b.f.flushes.Add(1)
+	return nil
+}
+
+func openTestRibs(t *testing.T) ribs.RBS {
+	r, err := rbstor.Open(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, r.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, r.Close())
+	})
+
+	return r
+}
+
+func openTestBlockstore(t *testing.T) *Blockstore {
+	bs := New(context.Background(), &testRibs{RBS: openTestRibs(t)})
+
+	t.Cleanup(func() {
+		require.NoError(t, bs.Close())
+	})
+
+	return bs
+}
+
+func randBlocks(t *testing.T, n int, codec uint64) []blocks.Block {
+	out := make([]blocks.Block, n)
+	for i := range out {
+		data := make([]byte, 256)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		c, err := cid.Prefix{
+			Version:  1,
+			Codec:    codec,
+			MhType:   multihash.SHA2_256,
+			MhLength: -1,
+		}.Sum(data)
+		require.NoError(t, err)
+
+		out[i], err = blocks.NewBlockWithCid(data, c)
+		require.NoError(t, err)
+	}
+	return out
+}
+
+func TestAllKeysChan(t *testing.T) {
+	ctx := context.Background()
+	bs := openTestBlockstore(t)
+
+	defer func(n int) {
+		AllKeysPageSize = n
+	}(AllKeysPageSize)
+	AllKeysPageSize = 7
+
+	blks := append(randBlocks(t, 20, cid.Raw), randBlocks(t, 20, cid.DagCBOR)...)
+	require.NoError(t, bs.PutMany(ctx, blks))
+	require.NoError(t, bs.Flush(ctx))
+
+	expect := map[cid.Cid]struct{}{}
+	for _, blk := range blks {
+		// keys are enumerated as raw CIDs
+		expect[cid.NewCidV1(cid.Raw, blk.Cid().Hash())] = struct{}{}
+	}
+
+	ch, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+
+	got := map[cid.Cid]struct{}{}
+	for c := range ch {
+		got[c] = struct{}{}
+	}
+	require.Equal(t, expect, got)
+
+	got = map[cid.Cid]struct{}{}
+	require.NoError(t, bs.ForEachKey(func(c cid.Cid) error {
+		got[c] = struct{}{}
+		return nil
+	}))
+	require.Equal(t, expect, got)
+
+	// cancelling the context stops enumeration
+	cctx, cancel := context.WithCancel(ctx)
+	ch, err = bs.AllKeysChan(cctx)
+	require.NoError(t, err)
+	<-ch
+	cancel()
+	for range ch {
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	ctx := context.Background()
+	bs := openTestBlockstore(t)
+
+	blks := randBlocks(t, 4, cid.Raw)
+	require.NoError(t, bs.PutMany(ctx, blks))
+	require.NoError(t, bs.Flush(ctx))
+
+	has := func(blk blocks.Block) bool {
+		h, err := bs.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		return h
+	}
+
+	require.NoError(t, bs.DeleteBlock(ctx, blks[0].Cid()))
+	require.NoError(t, bs.DeleteMany(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid()}))
+
+	// put wins over a delete in the same batch
+	require.NoError(t, bs.Put(ctx, blks[2]))
+	require.NoError(t, bs.Flush(ctx))
+
+	require.False(t, has(blks[0]))
+	require.False(t, has(blks[1]))
+	require.True(t, has(blks[2]))
+	require.True(t, has(blks[3]))
+
+	_, err := bs.Get(ctx, blks[0].Cid())
+	require.True(t, ipld.IsNotFound(err))
+
+	// deleted blocks can be written again
+	require.NoError(t, bs.Put(ctx, blks[0]))
+	require.NoError(t, bs.Flush(ctx))
+	require.True(t, has(blks[0]))
+}
+
+func TestPoisonedBlockstore(t *testing.T) {
+	ctx := context.Background()
+
+	fr := &faultyRibs{testRibs: testRibs{RBS: openTestRibs(t)}}
+	bs := New(ctx, fr)
+	t.Cleanup(func() {
+		require.NoError(t, bs.Close())
+	})
+
+	blks := randBlocks(t, 3, cid.Raw)
+
+	require.NoError(t, bs.Put(ctx, blks[0]))
+	require.NoError(t, bs.Flush(ctx))
+	require.NoError(t, bs.Err())
+
+	fr.failFlush.Store(true)
+
+	// puts are acknowledged before flush, the failure surfaces in Flush
+	require.NoError(t, bs.Put(ctx, blks[1]))
+	require.ErrorIs(t, bs.Flush(ctx), errInjected)
+	require.ErrorIs(t, bs.Err(), errInjected)
+
+	// all later calls fail with the original error
+	require.ErrorIs(t, bs.Put(ctx, blks[2]), errInjected)
+	require.ErrorIs(t, bs.DeleteBlock(ctx, blks[0].Cid()), errInjected)
+	require.ErrorIs(t, bs.Flush(ctx), errInjected)
+	_, err := bs.Get(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, errInjected)
+	_, err = bs.Has(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, errInjected)
+	_, err = bs.AllKeysChan(ctx)
+	require.ErrorIs(t, err, errInjected)
+
+	// reopen after the cause is fixed
+	fr.failFlush.Store(false)
+	require.NoError(t, bs.Reopen(ctx))
+	require.NoError(t, bs.Err())
+
+	require.NoError(t, bs.Put(ctx, blks[2]))
+	require.NoError(t, bs.Flush(ctx))
+
+	has, err := bs.Has(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+func TestPoisonedAutoReopen(t *testing.T) {
+	ctx := context.Background()
+
+	fr := &faultyRibs{testRibs: testRibs{RBS: openTestRibs(t)}}
+	bs := New(ctx, fr, WithAutoReopen(20*time.Millisecond))
+	t.Cleanup(func() {
+		require.NoError(t, bs.Close())
+	})
+
+	fr.failFlush.Store(true)
+	require.NoError(t, bs.Put(ctx, randBlocks(t, 1, cid.Raw)[0]))
+	require.ErrorIs(t, bs.Flush(ctx), errInjected)
+
+	fr.failFlush.Store(false)
+	require.Eventually(t, func() bool {
+		return bs.Err() == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, bs.Put(ctx, randBlocks(t, 1, cid.Raw)[0]))
+	require.NoError(t, bs.Flush(ctx))
+}
+
+func TestDurabilityModes(t *testing.T) {
+	ctx := context.Background()
+
+	open := func(t *testing.T, opts ...Option) (*faultyRibs, *Blockstore) {
+		fr := &faultyRibs{testRibs: testRibs{RBS: openTestRibs(t)}}
+		bs := New(ctx, fr, opts...)
+		t.Cleanup(func() {
+			require.NoError(t, bs.Close())
+		})
+		return fr, bs
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		fr, bs := open(t, WithMaxUnflushedBlocks(4))
+
+		// acknowledged without flushing
+		require.NoError(t, bs.PutMany(ctx, randBlocks(t, 4, cid.Raw)))
+		require.Equal(t, int64(0), fr.flushes.Load())
+
+		require.NoError(t, bs.Flush(ctx))
+		require.Equal(t, int64(1), fr.flushes.Load())
+
+		// exceeding max unflushed blocks flushes before acknowledging
+		require.NoError(t, bs.PutMany(ctx, randBlocks(t, 5, cid.Raw)))
+		require.Equal(t, int64(2), fr.flushes.Load())
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		fr, bs := open(t, WithSyncPuts(true))
+
+		require.NoError(t, bs.Put(ctx, randBlocks(t, 1, cid.Raw)[0]))
+		require.Equal(t, int64(1), fr.flushes.Load())
+
+		blk := randBlocks(t, 1, cid.Raw)[0]
+		require.NoError(t, bs.Put(ctx, blk))
+		require.Equal(t, int64(2), fr.flushes.Load())
+
+		require.NoError(t, bs.DeleteBlock(ctx, blk.Cid()))
+		require.Equal(t, int64(3), fr.flushes.Load())
+
+		// failed flushes are reported to the writer
+		fr.failFlush.Store(true)
+		require.ErrorIs(t, bs.Put(ctx, randBlocks(t, 1, cid.Raw)[0]), errInjected)
+		require.ErrorIs(t, bs.Err(), errInjected)
+	})
+
+	t.Run("group-commit", func(t *testing.T) {
+		fr, bs := open(t, WithGroupCommit(100*time.Millisecond))
+
+		errs := make(chan error)
+		for i := 0; i < 8; i++ {
+			blk := randBlocks(t, 1, cid.Raw)[0]
+			go func() {
+				err := bs.Put(ctx, blk)
+				if err == nil && fr.flushes.Load() == 0 {
+					err = errors.New("put acknowledged before flush")
+				}
+				errs <- err
+			}()
+		}
+
+		for i := 0; i < 8; i++ {
+			require.NoError(t, <-errs)
+		}
+
+		// concurrent writes share flushes
+		require.Less(t, fr.flushes.Load(), int64(8))
+	})
+
+	t.Run("flush-interval", func(t *testing.T) {
+		fr, bs := open(t, WithFlushInterval(20*time.Millisecond))
+
+		require.NoError(t, bs.Put(ctx, randBlocks(t, 1, cid.Raw)[0]))
+		require.Eventually(t, func() bool {
+			return fr.flushes.Load() == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestView(t *testing.T) {
+	ctx := context.Background()
+	bs := openTestBlockstore(t)
+
+	blk := randBlocks(t, 1, cid.Raw)[0]
+	require.NoError(t, bs.Put(ctx, blk))
+
+	// unflushed data is served from the write cache
+	require.NoError(t, bs.View(ctx, blk.Cid(), func(data []byte) error {
+		require.Equal(t, blk.RawData(), data)
+		return nil
+	}))
+
+	require.NoError(t, bs.Flush(ctx))
+	require.NoError(t, bs.View(ctx, blk.Cid(), func(data []byte) error {
+		require.Equal(t, blk.RawData(), data)
+		return nil
+	}))
+
+	// callback errors are returned
+	errCb := errors.New("callback error")
+	require.ErrorIs(t, bs.View(ctx, blk.Cid(), func([]byte) error {
+		return errCb
+	}), errCb)
+
+	// not found
+	missing := randBlocks(t, 1, cid.Raw)[0]
+	called := false
+	err := bs.View(ctx, missing.Cid(), func([]byte) error {
+		called = true
+		return nil
+	})
+	require.True(t, ipld.IsNotFound(err))
+	require.False(t, called)
+
+	// identity cids are viewed without a lookup
+	idc, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   multihash.IDENTITY,
+		MhLength: -1,
+	}.Sum([]byte("inline"))
+	require.NoError(t, err)
+	require.NoError(t, bs.View(ctx, idc, func(data []byte) error {
+		require.Equal(t, []byte("inline"), data)
+		return nil
+	}))
+}
+
+func benchmarkRead(b *testing.B, read func(ctx context.Context, bs *Blockstore, c cid.Cid) error) {
+	ctx := context.Background()
+
+	r, err := rbstor.Open(b.TempDir())
+	require.NoError(b, err)
+	require.NoError(b, r.Start())
+	defer r.Close() // nolint
+
+	bs := New(ctx, &testRibs{RBS: r})
+	defer bs.Close() // nolint
+
+	data := make([]byte, 64<<10)
+	_, err = rand.Read(data)
+	require.NoError(b, err)
+	blk := blocks.NewBlock(data)
+
+	require.NoError(b, bs.Put(ctx, blk))
+	require.NoError(b, bs.Flush(ctx))
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := read(ctx, bs, blk.Cid()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchmarkRead(b, func(ctx context.Context, bs *Blockstore, c cid.Cid) error {
+		_, err := bs.Get(ctx, c)
+		return err
+	})
+}
+
+func BenchmarkView(b *testing.B) {
+	benchmarkRead(b, func(ctx context.Context, bs *Blockstore, c cid.Cid) error {
+		return bs.View(ctx, c, func([]byte) error {
+			return nil
+		})
+	})
+}
@@ -0,0 +1,96 @@
+package kuboribs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/pinning/pinner/dspinner"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/kubo/gc"
+	"github.com/lotus-web3/ribs"
+	ribsbstore "github.com/lotus-web3/ribs/integrations/blockstore"
+	"github.com/lotus-web3/ribs/rbstor"
+	"github.com/stretchr/testify/require"
+)
+
+// testRibs is a RIBS without deal-making, backed by a local rbstor
+type testRibs struct {
+	ribs.RBS
+}
+
+func (t *testRibs) Wallet() ribs.Wallet {
+	return nil
+}
+
+func (t *testRibs) DealDiag() ribs.RIBSDiag {
+	return nil
+}
+
+func TestKuboGC(t *testing.T) {
+	ctx := context.Background()
+
+	r, err := rbstor.Open(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, r.Start())
+
+	rbs := ribsbstore.New(ctx, &testRibs{RBS: r})
+	t.Cleanup(func() {
+		require.NoError(t, rbs.Close())
+		require.NoError(t, r.Close())
+	})
+
+	gcbs := blockstore.NewGCBlockstore(rbs, &flushingGCLocker{flusher: rbs})
+	dserv := merkledag.NewDAGService(blockservice.New(gcbs, offline.Exchange(gcbs)))
+
+	leaf := func(s string) format.Node {
+		return merkledag.NewRawNode([]byte(s))
+	}
+
+	pinned := merkledag.NodeWithData([]byte("root"))
+	pinnedLeaves := []format.Node{leaf("a"), leaf("b")}
+	for _, l := range pinnedLeaves {
+		require.NoError(t, pinned.AddNodeLink(l.Cid().String(), l))
+	}
+
+	garbage := merkledag.NodeWithData([]byte("garbage"))
+	garbageLeaf := leaf("c")
+	require.NoError(t, garbage.AddNodeLink("c", garbageLeaf))
+
+	all := append([]format.Node{pinned, garbage, garbageLeaf}, pinnedLeaves...)
+	require.NoError(t, dserv.AddMany(ctx, all))
+
+	// the adder flushes through PinLock, deletes don't override unflushed puts
+	require.NoError(t, rbs.Flush(ctx))
+
+	dstore := dssync.MutexWrap(datastore.NewMapDatastore())
+	pinner, err := dspinner.New(ctx, dstore, dserv)
+	require.NoError(t, err)
+	require.NoError(t, pinner.Pin(ctx, pinned, true, ""))
+	require.NoError(t, pinner.Flush(ctx))
+
+	var removed []cid.Cid
+	for res := range gc.GC(ctx, gcbs, dstore, pinner, nil) {
+		require.NoError(t, res.Error)
+		removed = append(removed, res.KeyRemoved)
+	}
+	require.Len(t, removed, 2)
+
+	has := func(n format.Node) bool {
+		h, err := gcbs.Has(ctx, n.Cid())
+		require.NoError(t, err)
+		return h
+	}
+
+	require.False(t, has(garbage))
+	require.False(t, has(garbageLeaf))
+	for _, n := range append([]format.Node{pinned}, pinnedLeaves...) {
+		require.True(t, has(n))
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	lotusbstore "github.com/filecoin-project/lotus/blockstore"
 	blockstore "github.com/ipfs/boxo/blockstore"
@@ -28,6 +32,7 @@ import (
 	ribsbstore "github.com/lotus-web3/ribs/integrations/blockstore"
 	"github.com/lotus-web3/ribs/integrations/web"
 	"github.com/lotus-web3/ribs/rbdeal"
+	"github.com/lotus-web3/ribs/rbstor"
 	"github.com/mitchellh/go-homedir"
 	"go.uber.org/fx"
 	"golang.org/x/xerrors"
@@ -69,7 +74,10 @@ func (p *ribsPlugin) Options(info core.FXNodeInfo) ([]fx.Option, error) {
 			gclocker = &flushingGCLocker{
 				flusher: rbs,
 			}
-			gcbs = blockstore.NewGCBlockstore(bb, gclocker)
+			gcbs = &viewingGCBlockstore{
+				GCBlockstore: blockstore.NewGCBlockstore(bb, gclocker),
+				Viewer:       rbs,
+			}
 
 			bs = gcbs
 			return
@@ -93,8 +101,28 @@ type ribsIn struct {
 }
 
 var (
-	defaultDataDir = "~/.ribsdata"
-	dataEnv        = "RIBS_DATA"
+	defaultDataDir    = "~/.ribsdata"
+	dataEnv           = "RIBS_DATA"
+	writableGroupsEnv = "RIBS_WRITABLE_GROUPS"
+
+	// verifyReadsEnv enables checking block hashes on reads, corrupted groups
+	// are repaired from Filecoin or S3 copies
+	verifyReadsEnv = "RIBS_VERIFY_READS"
+
+	// scrubIntervalEnv sets how often local groups are checked for corruption
+	// in the background, 0 disables scrubbing
+	scrubIntervalEnv = "RIBS_SCRUB_INTERVAL"
+
+	// bstoreAutoReopenEnv sets the time after which a failed blockstore
+	// accepts writes again, by default a failed blockstore requires a restart
+	bstoreAutoReopenEnv = "RIBS_BLOCKSTORE_AUTO_REOPEN"
+
+	// bstoreGroupCommitEnv makes writes return only after being committed,
+	// grouping commits within the specified window; 0 commits each write
+	bstoreGroupCommitEnv = "RIBS_BLOCKSTORE_GROUP_COMMIT"
+
+	// bstoreFlushIntervalEnv sets the interval for flushing buffered writes
+	bstoreFlushIntervalEnv = "RIBS_BLOCKSTORE_FLUSH_INTERVAL"
 )
 
 func makeRibs(ri ribsIn) (ribs.RIBS, error) {
@@ -105,6 +133,30 @@ func makeRibs(ri ribsIn) (ribs.RIBS, error) {
 		}))
 	}
 
+	if wgs := os.Getenv(writableGroupsEnv); wgs != "" {
+		wg, err := strconv.Atoi(wgs)
+		if err != nil {
+			return nil, xerrors.Errorf("parse %s: %w", writableGroupsEnv, err)
+		}
+		opts = append(opts, rbdeal.WithRBSOptions(rbstor.WithWritableGroups(wg)))
+	}
+
+	if vrs := os.Getenv(verifyReadsEnv); vrs != "" {
+		vr, err := strconv.ParseBool(vrs)
+		if err != nil {
+			return nil, xerrors.Errorf("parse %s: %w", verifyReadsEnv, err)
+		}
+		opts = append(opts, rbdeal.WithRBSOptions(rbstor.WithVerifyReads(vr)))
+	}
+
+	if sis := os.Getenv(scrubIntervalEnv); sis != "" {
+		si, err := time.ParseDuration(sis)
+		if err != nil {
+			return nil, xerrors.Errorf("parse %s: %w", scrubIntervalEnv, err)
+		}
+		opts = append(opts, rbdeal.WithRBSOptions(rbstor.WithScrubInterval(si)))
+	}
+
 	dataDir := os.Getenv(dataEnv)
 	if dataDir == "" {
 		dataDir = defaultDataDir
@@ -137,28 +189,75 @@ func makeRibs(ri ribsIn) (ribs.RIBS, error) {
 	return r, nil
 }
 
-func ribsBlockstore(r ribs.RIBS, lc fx.Lifecycle) *ribsbstore.Blockstore {
-	rbs := ribsbstore.New(context.TODO(), r)
+func ribsBlockstore(r ribs.RIBS, lc fx.Lifecycle) (*ribsbstore.Blockstore, error) {
+	var opts []ribsbstore.Option
+
+	durationEnvs := map[string]func(time.Duration) ribsbstore.Option{
+		bstoreAutoReopenEnv: ribsbstore.WithAutoReopen,
+		bstoreGroupCommitEnv: func(d time.Duration) ribsbstore.Option {
+			if d == 0 {
+				return ribsbstore.WithSyncPuts(true)
+			}
+			return ribsbstore.WithGroupCommit(d)
+		},
+		bstoreFlushIntervalEnv: ribsbstore.WithFlushInterval,
+	}
+
+	for env, opt := range durationEnvs {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, xerrors.Errorf("parse %s: %w", env, err)
+		}
+		opts = append(opts, opt(d))
+	}
+
+	rbs := ribsbstore.New(context.TODO(), r, opts...)
 
 	// assert interface
 	var _ blockstore.Blockstore = rbs
 
+	// the blockstore fails all calls after failing to commit data
+	web.RegisterHealthCheck("blockstore", rbs.Err)
+
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
 			return rbs.Close()
 		},
 	})
 
-	return rbs
+	return rbs, nil
+}
+
+// viewingGCBlockstore keeps zero-copy View of the ribs blockstore accessible
+// through the GC blockstore wrapper, so that caching and identity blockstores
+// built on top of it can use it.
+type viewingGCBlockstore struct {
+	blockstore.GCBlockstore
+	blockstore.Viewer
 }
 
+var _ blockstore.Viewer = (*viewingGCBlockstore)(nil)
+
 // Adder Durability
 
 type flushingGCLocker struct {
 	flusher lotusbstore.Flusher
+
+	// pins hold the read side, GC holds the write side
+	lk          sync.RWMutex
+	gcRequested atomic.Int32
 }
 
-func (d *flushingGCLocker) Unlock(ctx context.Context) {
+type pinUnlocker struct {
+	d *flushingGCLocker
+}
+
+func (u *pinUnlocker) Unlock(ctx context.Context) {
 	// This is a potentially disturbing hack, used to gain a lot of performance
 	// while still maintaining reasonable durability guarantees.
 	// Normally unixfs Add will call PutMany with ~4-10 blocks, and expect the
@@ -167,22 +266,43 @@ func (d *flushingGCLocker) Unlock(ctx context.Context) {
 	// Here we exploit the fact that the adder takes a GC lock once for the whole
 	// add operation, so we just flush the blockstore here, which still guarantees
 	// that the data is durable after the adder returns.
-	err := d.flusher.Flush(ctx)
+	err := u.d.flusher.Flush(ctx)
 	if err != nil {
 		log.Errorw("flushing blockstore through GCLocker", "error", err)
 	}
+
+	u.d.lk.RUnlock()
+}
+
+type gcUnlocker struct {
+	d *flushingGCLocker
+}
+
+func (u *gcUnlocker) Unlock(ctx context.Context) {
+	// apply deletes queued by the GC before allowing new writes
+	err := u.d.flusher.Flush(ctx)
+	if err != nil {
+		log.Errorw("flushing blockstore after GC", "error", err)
+	}
+
+	u.d.lk.Unlock()
 }
 
 func (d *flushingGCLocker) GCLock(ctx context.Context) blockstore.Unlocker {
-	panic("no gc")
+	d.gcRequested.Add(1)
+	d.lk.Lock()
+	d.gcRequested.Add(-1)
+
+	return &gcUnlocker{d: d}
 }
 
 func (d *flushingGCLocker) PinLock(ctx context.Context) blockstore.Unlocker {
-	return d
+	d.lk.RLock()
+	return &pinUnlocker{d: d}
 }
 
 func (d *flushingGCLocker) GCRequested(ctx context.Context) bool {
-	return false
+	return d.gcRequested.Load() > 0
 }
 
 var _ blockstore.GCLocker = (*flushingGCLocker)(nil)
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var exportCmd = &cli.Command{
+	Name:      "export",
+	Usage:     "Export a DAG or a whole group from a running ribs node into a CAR file",
+	ArgsUsage: "[root cid or group with --group] [output car file, - for stdout]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "api",
+			Usage: "ribs web api address",
+			Value: "http://127.0.0.1:9010",
+		},
+		&cli.BoolFlag{
+			Name:  "car-v2",
+			Usage: "write a CARv2 file with an index",
+		},
+		&cli.BoolFlag{
+			Name:  "group",
+			Usage: "export the deal car of the group given as the first argument",
+		},
+		&cli.StringFlag{
+			Name:  "selector",
+			Usage: "dag-json IPLD selector, by default the whole DAG is exported",
+		},
+		&cli.StringFlag{
+			Name:  "namespace",
+			Usage: "namespace to read the DAG from",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			return cli.Exit("Invalid number of arguments", 1)
+		}
+
+		q := url.Values{}
+		if c.Bool("car-v2") {
+			q.Set("car", "2")
+		}
+
+		var what, path string
+		if c.Bool("group") {
+			if c.IsSet("selector") || c.IsSet("namespace") {
+				return cli.Exit("--selector and --namespace can't be used with --group", 1)
+			}
+
+			group, err := strconv.ParseInt(c.Args().Get(0), 10, 64)
+			if err != nil {
+				return xerrors.Errorf("parse group: %w", err)
+			}
+
+			what = fmt.Sprintf("group %d", group)
+			path = fmt.Sprintf("export/group/%d", group)
+		} else {
+			root, err := cid.Parse(c.Args().Get(0))
+			if err != nil {
+				return xerrors.Errorf("parse root cid: %w", err)
+			}
+
+			if c.IsSet("selector") {
+				q.Set("selector", c.String("selector"))
+			}
+			if c.IsSet("namespace") {
+				q.Set("ns", c.String("namespace"))
+			}
+
+			what = root.String()
+			path = fmt.Sprintf("export/%s", root)
+		}
+
+		u := fmt.Sprintf("%s/%s?%s", strings.TrimSuffix(c.String("api"), "/"), path, q.Encode())
+
+		req, err := http.NewRequestWithContext(c.Context, http.MethodGet, u, nil)
+		if err != nil {
+			return xerrors.Errorf("create request: %w", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return xerrors.Errorf("export request: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+			return xerrors.Errorf("export failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+
+		var out io.Writer = os.Stdout
+		if c.Args().Get(1) != "-" {
+			f, err := os.Create(c.Args().Get(1))
+			if err != nil {
+				return xerrors.Errorf("create output file: %w", err)
+			}
+			defer f.Close()
+			out = f
+		}
+
+		n, err := io.Copy(out, resp.Body)
+		if err != nil {
+			return xerrors.Errorf("writing car (%d bytes written): %w", n, err)
+		}
+
+		if f, ok := out.(*os.File); ok && f != os.Stdout {
+			if err := f.Close(); err != nil {
+				return xerrors.Errorf("close output file: %w", err)
+			}
+		}
+
+		_, _ = fmt.Fprintf(os.Stderr, "exported %s (%d bytes)\n", what, n)
+		return nil
+	},
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/integrations/web"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var importCmd = &cli.Command{
+	Name:      "import",
+	Usage:     "Import a CAR file into a running ribs node",
+	ArgsUsage: "[car file]",
+	Description: `The CAR file is read by the node, so the path must be accessible on the
+node filesystem. Blocks which are already stored are skipped, so importing
+the same file again is cheap.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "api",
+			Usage: "ribs rpc api address",
+			Value: "ws://127.0.0.1:9010/rpc/v0",
+		},
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "verify that block data matches block CIDs",
+		},
+		&cli.Int64Flag{
+			Name:  "resume-offset",
+			Usage: "resume an interrupted import from the last reported offset",
+		},
+		&cli.StringFlag{
+			Name:  "namespace",
+			Usage: "namespace to import data into",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return cli.Exit("Invalid number of arguments", 1)
+		}
+
+		path, err := filepath.Abs(c.Args().First())
+		if err != nil {
+			return xerrors.Errorf("resolve car path: %w", err)
+		}
+
+		var api struct {
+			ImportCar func(ctx context.Context, path string, params web.ImportCarParams) (<-chan ribs.CarImportProgress, error)
+		}
+
+		closer, err := jsonrpc.NewClient(c.Context, c.String("api"), "RIBS", &api, nil)
+		if err != nil {
+			return xerrors.Errorf("connect to api: %w", err)
+		}
+		defer closer()
+
+		progress, err := api.ImportCar(c.Context, path, web.ImportCarParams{
+			Verify:       c.Bool("verify"),
+			ResumeOffset: c.Int64("resume-offset"),
+			Namespace:    c.String("namespace"),
+		})
+		if err != nil {
+			return xerrors.Errorf("import car: %w", err)
+		}
+
+		var last ribs.CarImportProgress
+		for p := range progress {
+			last = p
+			_, _ = fmt.Fprintf(os.Stderr, "offset %d: %d blocks (%d bytes) imported, %d skipped\n", p.Offset, p.Blocks, p.Bytes, p.Skipped)
+		}
+
+		switch {
+		case last.Done:
+			return nil
+		case last.Error != "":
+			return xerrors.Errorf("import failed, resume with --resume-offset=%d: %s", last.Offset, last.Error)
+		default:
+			return xerrors.Errorf("import interrupted, resume with --resume-offset=%d", last.Offset)
+		}
+	},
+}
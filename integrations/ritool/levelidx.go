@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/cheggaaa/pb"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/ipfs/go-cid"
 	"github.com/lotus-web3/ribs/carlog"
+	"github.com/lotus-web3/ribs/rbstor"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
 )
@@ -29,6 +31,44 @@ var idxLevelCmd = &cli.Command{
 	},
 }
 
+var topIndexFlag = &cli.StringFlag{
+	Name:  "top-index",
+	Usage: "path to the top-level index.pebble, used to print CIDs with their codecs",
+}
+
+// indexCids makes CIDs for multihashes with codecs from the top-level index,
+// blocks with unknown codecs are printed as raw CIDs
+func indexCids(ctx context.Context, topIndex string, mhs []multihash.Multihash) ([]cid.Cid, error) {
+	codecs := make([]uint64, len(mhs))
+
+	if topIndex != "" {
+		idx, err := rbstor.NewPebbleIndex(topIndex)
+		if err != nil {
+			return nil, xerrors.Errorf("open top-level index: %w", err)
+		}
+		defer idx.Close()
+
+		err = idx.GetCodecs(ctx, mhs, func(c []uint64) error {
+			copy(codecs, c)
+			return nil
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("get codecs: %w", err)
+		}
+	}
+
+	out := make([]cid.Cid, len(mhs))
+	for i, m := range mhs {
+		codec := codecs[i]
+		if codec == 0 {
+			codec = cid.Raw
+		}
+		out[i] = cid.NewCidV1(codec, m)
+	}
+
+	return out, nil
+}
+
 var toTruncateCmd = &cli.Command{
 	Name:      "to-truncate",
 	Usage:     "read a head file into a json file",
@@ -41,6 +81,7 @@ var toTruncateCmd = &cli.Command{
 		&cli.BoolFlag{
 			Name: "cids",
 		},
+		topIndexFlag,
 	},
 	Action: func(c *cli.Context) error {
 		if c.NArg() != 1 {
@@ -61,8 +102,13 @@ var toTruncateCmd = &cli.Command{
 			fmt.Println("blocks to truncate:", len(mhs))
 		}
 
-		for _, mh := range mhs {
-			fmt.Println(cid.NewCidV1(cid.Raw, mh).String())
+		cids, err := indexCids(c.Context, c.String(topIndexFlag.Name), mhs)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range cids {
+			fmt.Println(c.String())
 		}
 
 		return nil
@@ -105,6 +151,9 @@ var matchCarlogCids = &cli.Command{
 	Name:      "match-carlog",
 	Usage:     "match carlog cids with leveldb index",
 	ArgsUsage: "[carlog file] [leveldb file]",
+	Flags: []cli.Flag{
+		topIndexFlag,
+	},
 	Action: func(c *cli.Context) error {
 		if c.NArg() != 2 {
 			return cli.Exit("Invalid number of arguments", 1)
@@ -137,7 +186,8 @@ var matchCarlogCids = &cli.Command{
 			return xerrors.Errorf("reading car header: %w", err)
 		}
 
-		seenSet, notIndexedSet := cid.NewSet(), cid.NewSet()
+		// carlog entries are matched by multihash, the leveldb index doesn't store codecs
+		seenSet, notIndexedSet := map[string]struct{}{}, cid.NewSet()
 
 		entBuf := make([]byte, 16<<20)
 
@@ -175,11 +225,6 @@ var matchCarlogCids = &cli.Command{
 				return xerrors.Errorf("parsing cid: %w", err)
 			}
 
-			if c.Prefix().Codec != cid.Raw {
-				// todo: allow non-raw flag
-				return xerrors.Errorf("non-raw cid %s", c)
-			}
-
 			res, err := li.Get([]multihash.Multihash{c.Hash()})
 			if err != nil {
 				return xerrors.Errorf("get: %w", err)
@@ -187,18 +232,19 @@ var matchCarlogCids = &cli.Command{
 			if res[0] == -1 {
 				notIndexedSet.Add(c)
 			} else {
-				seenSet.Add(c)
+				seenSet[string(c.Hash())] = struct{}{}
 			}
 
 			// Update the progress bar
 			bar.Add(int(entLen))
 		}
 
-		notCarlogSet := cid.NewSet()
+		var notCarlog []multihash.Multihash
 
 		err = li.List(func(c multihash.Multihash, offs []int64) error {
-			if !seenSet.Has(cid.NewCidV1(cid.Raw, c)) {
-				notCarlogSet.Add(cid.NewCidV1(cid.Raw, c))
+			if _, ok := seenSet[string(c)]; !ok {
+				// iterator keys are only valid until the next entry
+				notCarlog = append(notCarlog, append(multihash.Multihash{}, c...))
 			}
 			return nil
 		})
@@ -206,7 +252,12 @@ var matchCarlogCids = &cli.Command{
 			return xerrors.Errorf("list: %w", err)
 		}
 
-		for _, c := range notCarlogSet.Keys() {
+		notCarlogCids, err := indexCids(c.Context, c.String(topIndexFlag.Name), notCarlog)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range notCarlogCids {
 			fmt.Println("indexed not in log:", c.String())
 		}
 
@@ -214,7 +265,7 @@ var matchCarlogCids = &cli.Command{
 			fmt.Println("in log not indexed:", c.String())
 		}
 
-		fmt.Printf("indexed: %d, not indexed: %d, not in log: %d\n", seenSet.Len(), notIndexedSet.Len(), notCarlogSet.Len())
+		fmt.Printf("indexed: %d, not indexed: %d, not in log: %d\n", len(seenSet), notIndexedSet.Len(), len(notCarlog))
 
 		return nil
 	},
@@ -17,6 +17,8 @@ func main() {
 			ldbcidCmd,
 			groupCmd,
 			claimsExtendCmd,
+			exportCmd,
+			importCmd,
 		},
 	}
 
@@ -0,0 +1,121 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbstor"
+)
+
+// Export streams a DAG as a CAR file.
+//
+// GET /export/{root}?car=2&selector={dag-json selector}&ns={namespace}
+func (ri *RIBSWeb) Export(w http.ResponseWriter, r *http.Request) {
+	root, err := cid.Parse(r.PathValue("root"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing root cid: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var opts []rbstor.ExportOption
+
+	switch r.URL.Query().Get("car") {
+	case "", "1":
+	case "2":
+		opts = append(opts, rbstor.WithExportCarV2(true))
+	default:
+		http.Error(w, "car version must be 1 or 2", http.StatusBadRequest)
+		return
+	}
+
+	if sel := r.URL.Query().Get("selector"); sel != "" {
+		sn, err := selectorparse.ParseJSONSelector(sel)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parsing selector: %s", err), http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, rbstor.WithExportSelector(sn))
+	}
+
+	sess := ri.ribs.Session(r.Context(), ribs.WithNamespace(r.URL.Query().Get("ns")))
+
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", root.String()+".car"))
+
+	cw := &countingWriter{w: w}
+	if err := rbstor.ExportCar(r.Context(), sess, root, cw, opts...); err != nil {
+		log.Errorw("export car", "root", root, "error", err)
+
+		if cw.n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the response is already partially sent, the best we can do is to cut
+		// it short, making the car invalid
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ExportGroup streams the deal CAR of a group. With car=2 the CAR is
+// written as a CARv2 with an embedded index, the payload stays the same CARv1
+// which is stored in deals.
+//
+// GET /export/group/{group}?car=2
+func (ri *RIBSWeb) ExportGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := strconv.ParseInt(r.PathValue("group"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing group: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	cw := &countingWriter{w: w}
+
+	var write func() error
+	switch r.URL.Query().Get("car") {
+	case "", "1":
+		write = func() error {
+			return ri.ribs.Storage().ReadCar(r.Context(), group, func(sz int64) {
+				w.Header().Set("Content-Length", strconv.FormatInt(sz, 10))
+			}, cw)
+		}
+	case "2":
+		write = func() error {
+			return ri.ribs.Storage().ReadCarV2(r.Context(), group, cw)
+		}
+	default:
+		http.Error(w, "car version must be 1 or 2", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("group-%d.car", group)))
+
+	if err := write(); err != nil {
+		log.Errorw("export group car", "group", group, "error", err)
+
+		if cw.n == 0 {
+			w.Header().Del("Content-Length")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
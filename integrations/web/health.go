@@ -0,0 +1,67 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var (
+	healthLk     sync.Mutex
+	healthChecks = map[string]func() error{}
+)
+
+// RegisterHealthCheck adds a named check to the /healthz endpoint. A check
+// returning an error makes the endpoint respond with 503.
+func RegisterHealthCheck(name string, check func() error) {
+	healthLk.Lock()
+	defer healthLk.Unlock()
+
+	healthChecks[name] = check
+}
+
+type healthStatus struct {
+	Healthy bool
+	Checks  map[string]string
+}
+
+// Health reports results of registered health checks
+//
+// GET /healthz
+func (ri *RIBSWeb) Health(w http.ResponseWriter, r *http.Request) {
+	healthLk.Lock()
+	names := make([]string, 0, len(healthChecks))
+	for name := range healthChecks {
+		names = append(names, name)
+	}
+	checks := make([]func() error, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		checks[i] = healthChecks[name]
+	}
+	healthLk.Unlock()
+
+	st := healthStatus{
+		Healthy: true,
+		Checks:  map[string]string{},
+	}
+
+	for i, check := range checks {
+		if err := check(); err != nil {
+			st.Healthy = false
+			st.Checks[names[i]] = err.Error()
+			continue
+		}
+		st.Checks[names[i]] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Errorw("writing health status", "error", err)
+	}
+}
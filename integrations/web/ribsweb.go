@@ -61,6 +61,9 @@ func Serve(ctx context.Context, listen string, ribs ribs.RIBS) error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handlers.Index)
+	mux.HandleFunc("GET /export/{root}", handlers.Export)
+	mux.HandleFunc("GET /export/group/{group}", handlers.ExportGroup)
+	mux.HandleFunc("GET /healthz", handlers.Health)
 
 	mux.Handle("/rpc/v0", rpc)
 
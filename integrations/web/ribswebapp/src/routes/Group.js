@@ -112,6 +112,7 @@ export default function Group() {
                     {dealCounts.errors > 0 && <span><span className="deal-counts-err">{dealCounts.errors} Errored</span></span>}
                 </div>
                 <div>PieceCID: {group.PieceCID} <a target="_blank" href={`https://filecoin.tools/${group.PieceCID}`}>[filecoin.tools]</a></div>
+                {group.PieceCIDv2 && <div>PieceCID v2: {group.PieceCIDv2}</div>}
                 <div>RootCID: {group.RootCID}</div>
             </div>
             <div className="group" >
@@ -2,14 +2,17 @@ package web
 
 import (
 	"context"
+	"os"
 	"runtime"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-jsonrpc"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
 
 	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbstor"
 )
 
 type RIBSRpc struct {
@@ -44,6 +47,92 @@ func (rc *RIBSRpc) GroupMeta(ctx context.Context, group ribs.GroupKey) (ribs.Gro
 	return rc.ribs.StorageDiag().GroupMeta(group)
 }
 
+func (rc *RIBSRpc) FindGroups(ctx context.Context, filter ribs.GroupFilter) ([]ribs.GroupKey, error) {
+	return rc.ribs.StorageDiag().FindGroups(ctx, filter)
+}
+
+func (rc *RIBSRpc) SetGroupLabels(ctx context.Context, group ribs.GroupKey, labels map[string]string) error {
+	return rc.ribs.Storage().SetGroupLabels(ctx, group, labels)
+}
+
+func (rc *RIBSRpc) SetNamespaceQuota(ctx context.Context, ns string, maxBytes int64) error {
+	return rc.ribs.Storage().SetNamespaceQuota(ctx, ns, maxBytes)
+}
+
+func (rc *RIBSRpc) Pin(ctx context.Context, roots []cid.Cid) error {
+	return rc.ribs.Pins().Pin(ctx, roots)
+}
+
+func (rc *RIBSRpc) Unpin(ctx context.Context, roots []cid.Cid) error {
+	return rc.ribs.Pins().Unpin(ctx, roots)
+}
+
+func (rc *RIBSRpc) Pins(ctx context.Context) ([]cid.Cid, error) {
+	return rc.ribs.Pins().List(ctx)
+}
+
+type GCParams struct {
+	// AllowEmptyPinSet unlinks all data when no roots are pinned
+	AllowEmptyPinSet bool
+}
+
+func (rc *RIBSRpc) GC(ctx context.Context, params GCParams) (ribs.GCStats, error) {
+	var opts []ribs.GCOption
+	if params.AllowEmptyPinSet {
+		opts = append(opts, ribs.WithEmptyPinSet())
+	}
+
+	return rc.ribs.Pins().GC(ctx, opts...)
+}
+
+type ImportCarParams struct {
+	// Verify checks that block data matches block CIDs
+	Verify bool
+
+	// ResumeOffset continues an interrupted import, see CarImportProgress.Offset
+	ResumeOffset int64
+
+	Namespace string
+}
+
+// ImportCar imports a CAR file from the node filesystem, streaming progress.
+// The last progress update has either Done or Error set.
+func (rc *RIBSRpc) ImportCar(ctx context.Context, path string, params ImportCarParams) (<-chan ribs.CarImportProgress, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("open car: %w", err)
+	}
+
+	out := make(chan ribs.CarImportProgress, 16)
+
+	go func() {
+		defer close(out)
+		defer f.Close()
+
+		send := func(p ribs.CarImportProgress) {
+			select {
+			case out <- p:
+			case <-ctx.Done():
+			}
+		}
+
+		sess := rc.ribs.Session(ctx, ribs.WithNamespace(params.Namespace))
+
+		p, err := rbstor.ImportCar(ctx, sess, f,
+			rbstor.WithImportVerify(params.Verify),
+			rbstor.WithImportResume(params.ResumeOffset),
+			rbstor.WithImportProgress(send))
+		if err != nil {
+			log.Errorw("import car", "path", path, "offset", p.Offset, "error", err)
+			p.Error = err.Error()
+		}
+
+		send(p)
+	}()
+
+	return out, nil
+}
+
 func (rc *RIBSRpc) GroupDeals(ctx context.Context, group ribs.GroupKey) ([]ribs.DealMeta, error) {
 	return rc.ribs.DealDiag().GroupDeals(group)
 }
@@ -88,6 +177,10 @@ func (rc *RIBSRpc) GetGroupStats(ctx context.Context) (*ribs.GroupStats, error)
 	return rc.ribs.StorageDiag().GetGroupStats()
 }
 
+func (rc *RIBSRpc) GroupEvents(ctx context.Context, since int64, filter ribs.GroupEventFilter) (<-chan ribs.GroupEvent, error) {
+	return rc.ribs.Storage().SubscribeEvents(ctx, since, filter)
+}
+
 func (rc *RIBSRpc) RuntimeStats(ctx context.Context) (runtime.MemStats, error) {
 	var out runtime.MemStats
 	runtime.ReadMemStats(&out)
@@ -0,0 +1,372 @@
+package rbdeal
+
+import (
+	"context"
+	"io"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"golang.org/x/xerrors"
+)
+
+// aggregator packs groups with pieces smaller than minPieceSize into FRC-0058
+// aggregates, makes deals for the aggregates and offloads aggregated groups
+// once the aggregate has enough deals
+func (r *ribs) aggregator(ctx context.Context) {
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(AggregateCheckInterval):
+		}
+
+		if err := r.runAggregateLoop(ctx); err != nil {
+			log.Errorw("aggregate loop failed", "error", err)
+		}
+	}
+}
+
+func (r *ribs) runAggregateLoop(ctx context.Context) error {
+	if err := r.maybeCreateAggregate(ctx); err != nil {
+		return xerrors.Errorf("creating aggregate: %w", err)
+	}
+
+	stats, err := r.db.GetAggregateDealStats()
+	if err != nil {
+		return xerrors.Errorf("getting aggregate deal stats: %w", err)
+	}
+
+	for _, as := range stats {
+		if as.TotalDeals-as.FailedDeals-as.Unretrievable < int64(targetReplicaCount) {
+			if as.LocalGroups != as.Groups {
+				// aggregate data can only be served while all groups are local
+				log.Debugw("not making aggregate deals, some groups are offloaded", "aggregate", as.AggregateID, "groups", as.Groups, "local", as.LocalGroups)
+				continue
+			}
+
+			go func(id int64) {
+				err := r.makeAggregateDeals(context.TODO(), id, r.wallet)
+				if err != nil {
+					log.Errorw("starting new aggregate deals", "aggregate", id, "error", err)
+				}
+			}(as.AggregateID)
+		} else if as.Retrievable >= int64(minimumReplicaCount) && as.LocalGroups > 0 {
+			if err := r.offloadAggregate(ctx, as.AggregateID); err != nil {
+				return xerrors.Errorf("offloading aggregate %d: %w", as.AggregateID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// maybeCreateAggregate aggregates queued groups when there are enough of them
+// to fill an aggregate, or when some waited for aggregateMaxWait
+func (r *ribs) maybeCreateAggregate(ctx context.Context) error {
+	cands, err := r.db.QueueAggregationCandidates()
+	if err != nil {
+		return xerrors.Errorf("getting aggregation candidates: %w", err)
+	}
+	if len(cands) == 0 {
+		return nil
+	}
+
+	dealSize := abi.PaddedPieceSize(minPieceSize)
+
+	l, err := layoutAggregate(cands, dealSize)
+	if err != nil {
+		return xerrors.Errorf("laying out aggregate: %w", err)
+	}
+	if l == nil {
+		return nil
+	}
+
+	capacity := datasegment.IndexStart(dealSize)
+	full := float64(l.used) >= aggregateMinFill*float64(capacity)
+	if !full && time.Since(time.Unix(l.oldest, 0)) < aggregateMaxWait {
+		return nil
+	}
+
+	id, err := r.db.CreateAggregate(l.info, l.members)
+	if err != nil {
+		return xerrors.Errorf("storing aggregate: %w", err)
+	}
+
+	log.Infow("created aggregate", "aggregate", id, "piece", l.info.PieceCid, "groups", len(l.members), "used", l.used, "capacity", capacity, "full", full)
+
+	go func() {
+		err := r.makeAggregateDeals(context.TODO(), id, r.wallet)
+		if err != nil {
+			log.Errorw("starting new aggregate deals", "aggregate", id, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// aggregateLayout is a set of queued groups packed into an aggregate
+type aggregateLayout struct {
+	info    aggregateInfo
+	members []aggregateMember
+
+	// used is the padded size taken by group pieces, oldest is the queue time
+	// of the group which waited the longest
+	used   uint64
+	oldest int64
+}
+
+// layoutAggregate packs candidates into an aggregate of dealSize, candidates
+// which don't fit are skipped. Returns nil when no candidate fits.
+func layoutAggregate(cands []aggregationCandidate, dealSize abi.PaddedPieceSize) (*aggregateLayout, error) {
+	capacity := datasegment.IndexStart(dealSize)
+	maxEntries := datasegment.MaxIndexEntries(dealSize)
+
+	// candidates are sorted by decreasing size, so picked pieces are placed
+	// without gaps
+	var picked []aggregationCandidate
+	var used uint64
+	oldest := time.Now().Unix()
+
+	for _, c := range cands {
+		if len(picked) == maxEntries {
+			break
+		}
+		if used+uint64(c.PieceSize) > capacity {
+			continue
+		}
+
+		picked = append(picked, c)
+		used += uint64(c.PieceSize)
+		if c.QueuedAt < oldest {
+			oldest = c.QueuedAt
+		}
+	}
+
+	if len(picked) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	pieces := make([]abi.PieceInfo, len(picked))
+	for i, c := range picked {
+		pieces[i].Size = abi.PaddedPieceSize(c.PieceSize)
+		pieces[i].PieceCID, err = commcid.PieceCommitmentV1ToCID(c.CommP)
+		if err != nil {
+			return nil, xerrors.Errorf("group %d piece cid: %w", c.Group, err)
+		}
+	}
+
+	agg, err := datasegment.NewAggregate(dealSize, pieces)
+	if err != nil {
+		return nil, xerrors.Errorf("new aggregate: %w", err)
+	}
+
+	pieceCid, err := agg.PieceCID()
+	if err != nil {
+		return nil, xerrors.Errorf("aggregate piece cid: %w", err)
+	}
+
+	members := make([]aggregateMember, len(picked))
+	for i, c := range picked {
+		ip, err := agg.InclusionProof(i)
+		if err != nil {
+			return nil, xerrors.Errorf("inclusion proof for group %d: %w", c.Group, err)
+		}
+		if err := ip.Verify(pieceCid, dealSize, pieces[i].PieceCID, pieces[i].Size); err != nil {
+			return nil, xerrors.Errorf("verifying inclusion proof for group %d: %w", c.Group, err)
+		}
+
+		proof, err := ip.MarshalBinary()
+		if err != nil {
+			return nil, xerrors.Errorf("marshaling inclusion proof: %w", err)
+		}
+
+		members[i] = aggregateMember{
+			Group:          c.Group,
+			Segment:        i,
+			SegOffset:      int64(agg.Index[i].Offset),
+			SegSize:        int64(agg.Index[i].Size),
+			InclusionProof: proof,
+		}
+	}
+
+	return &aggregateLayout{
+		info: aggregateInfo{
+			PieceCid:    pieceCid,
+			PieceSize:   int64(dealSize),
+			PayloadSize: int64(dealSize.Unpadded()),
+			Root:        picked[0].Root,
+		},
+		members: members,
+		used:    used,
+		oldest:  oldest,
+	}, nil
+}
+
+func (r *ribs) makeAggregateDeals(ctx context.Context, id int64, w *ributil.LocalWallet) error {
+	r.dealsLk.Lock()
+	if _, ok := r.aggregateDealsLocks[id]; ok {
+		r.dealsLk.Unlock()
+
+		// another goroutine is already making deals for this aggregate
+		return nil
+	}
+	r.aggregateDealsLocks[id] = struct{}{}
+	r.dealsLk.Unlock()
+
+	defer func() {
+		r.dealsLk.Lock()
+		delete(r.aggregateDealsLocks, id)
+		r.dealsLk.Unlock()
+	}()
+
+	ai, err := r.db.GetAggregate(id)
+	if err != nil {
+		return xerrors.Errorf("get aggregate: %w", err)
+	}
+
+	groups, err := r.db.AggregateGroups(id)
+	if err != nil {
+		return xerrors.Errorf("get aggregate groups: %w", err)
+	}
+	if len(groups) == 0 {
+		return xerrors.Errorf("aggregate %d has no groups", id)
+	}
+
+	notFailed, err := r.db.GetNonFailedAggregateDealCount(id)
+	if err != nil {
+		return xerrors.Errorf("getting non-failed aggregate deal count: %w", err)
+	}
+
+	if notFailed >= targetReplicaCount {
+		return nil
+	}
+
+	return r.makeDeals(ctx, aggregateDealTarget(ai, groups), notFailed, w)
+}
+
+// aggregateDealTarget is the deal target of an aggregate, groups are in segment
+// order
+func aggregateDealTarget(ai aggregateInfo, groups []aggregateGroup) dealTarget {
+	return dealTarget{
+		aggregate: ai.ID,
+		lead:      groups[0].Group,
+		pieceCid:  ai.PieceCid,
+		pieceSize: ai.PieceSize,
+		root:      ai.Root,
+		carSize:   ai.PayloadSize,
+	}
+}
+
+// offloadAggregate offloads local groups of an aggregate, unless the aggregate
+// is being uploaded to providers
+func (r *ribs) offloadAggregate(ctx context.Context, id int64) error {
+	groups, err := r.db.AggregateGroups(id)
+	if err != nil {
+		return xerrors.Errorf("get aggregate groups: %w", err)
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	// aggregate uploads are tracked on the first group
+	upStat := r.CarUploadStats().ByGroup
+	if upStat[groups[0].Group] != nil {
+		log.Infow("NOT OFFLOADING AGGREGATE yet", "aggregate", id, "uploads", upStat[groups[0].Group].ActiveRequests)
+		return nil
+	}
+
+	for _, g := range groups {
+		if g.State != iface.GroupStateLocalReadyForDeals {
+			continue
+		}
+
+		log.Infow("OFFLOAD GROUP", "group", g.Group, "aggregate", id)
+
+		if err := r.Storage().Offload(ctx, g.Group); err != nil {
+			return xerrors.Errorf("offloading group %d: %w", g.Group, err)
+		}
+	}
+
+	return nil
+}
+
+// openedAggregate is an aggregate with its segment index, used to serve the
+// aggregate payload
+type openedAggregate struct {
+	r *ribs
+
+	info   aggregateInfo
+	groups []aggregateGroup
+	agg    *datasegment.Aggregate
+}
+
+func (r *ribs) openAggregate(id int64) (*openedAggregate, error) {
+	ai, err := r.db.GetAggregate(id)
+	if err != nil {
+		return nil, xerrors.Errorf("get aggregate: %w", err)
+	}
+
+	groups, err := r.db.AggregateGroups(id)
+	if err != nil {
+		return nil, xerrors.Errorf("get aggregate groups: %w", err)
+	}
+
+	pieces := make([]abi.PieceInfo, len(groups))
+	for i, g := range groups {
+		if g.Segment != i {
+			return nil, xerrors.Errorf("aggregate %d missing segment %d", id, i)
+		}
+
+		pieces[i].Size = abi.PaddedPieceSize(g.PieceSize)
+		pieces[i].PieceCID, err = commcid.PieceCommitmentV1ToCID(g.CommP)
+		if err != nil {
+			return nil, xerrors.Errorf("group %d piece cid: %w", g.Group, err)
+		}
+	}
+
+	agg, err := datasegment.NewAggregate(abi.PaddedPieceSize(ai.PieceSize), pieces)
+	if err != nil {
+		return nil, xerrors.Errorf("new aggregate: %w", err)
+	}
+
+	pieceCid, err := agg.PieceCID()
+	if err != nil {
+		return nil, xerrors.Errorf("aggregate piece cid: %w", err)
+	}
+	if pieceCid != ai.PieceCid {
+		return nil, xerrors.Errorf("aggregate %d piece cid mismatch, stored %s, computed %s", id, ai.PieceCid, pieceCid)
+	}
+
+	return &openedAggregate{
+		r:      r,
+		info:   ai,
+		groups: groups,
+		agg:    agg,
+	}, nil
+}
+
+// readRange writes size bytes of the aggregate payload starting at off
+func (a *openedAggregate) readRange(ctx context.Context, off, size int64, out io.Writer) error {
+	_, err := a.agg.WritePayloadRange(out, off, size, func(w io.Writer, seg int, off, size int64) (int64, error) {
+		g := a.groups[seg]
+
+		// group pieces are zero-padded after the car
+		if off >= g.CarSize {
+			return 0, nil
+		}
+		if off+size > g.CarSize {
+			size = g.CarSize - off
+		}
+
+		if err := a.r.Storage().ReadCarRange(ctx, g.Group, off, size, w); err != nil {
+			return 0, xerrors.Errorf("reading group %d car: %w", g.Group, err)
+		}
+		return size, nil
+	})
+	return err
+}
@@ -0,0 +1,244 @@
+package rbdeal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeStorage struct {
+	iface.Storage
+
+	cars map[iface.GroupKey][]byte
+
+	hashes    map[iface.GroupKey][]multihash.Multihash
+	points    map[iface.GroupKey]*piecesample.Points
+	pointsErr error
+}
+
+func (s *fakeStorage) ReadCarRange(ctx context.Context, group iface.GroupKey, off, size int64, out io.Writer) error {
+	car, ok := s.cars[group]
+	if !ok {
+		return fmt.Errorf("group %d not found", group)
+	}
+	if off < 0 || size < 0 || off+size > int64(len(car)) {
+		return fmt.Errorf("range %d+%d out of group %d car of %d bytes", off, size, group, len(car))
+	}
+
+	_, err := out.Write(car[off : off+size])
+	return err
+}
+
+func (s *fakeStorage) HashSample(ctx context.Context, group iface.GroupKey) ([]multihash.Multihash, error) {
+	return s.hashes[group], nil
+}
+
+func (s *fakeStorage) BlockSample(ctx context.Context, group iface.GroupKey, seed [32]byte, n int) ([]piecesample.Entry, error) {
+	if s.pointsErr != nil {
+		return nil, s.pointsErr
+	}
+	p, ok := s.points[group]
+	if !ok {
+		return nil, fmt.Errorf("group %d sample points: %w", group, os.ErrNotExist)
+	}
+	return p.Sample(seed, n), nil
+}
+
+type fakeSession struct {
+	iface.Session
+}
+
+// GetCids returns undefined cids, as for blocks stored without a codec
+func (fakeSession) GetCids(ctx context.Context, mh []multihash.Multihash, cb func([]cid.Cid) error) error {
+	return cb(make([]cid.Cid, len(mh)))
+}
+
+type fakeRBS struct {
+	iface.RBS
+
+	storage *fakeStorage
+}
+
+func (f *fakeRBS) Storage() iface.Storage {
+	return f.storage
+}
+
+func (f *fakeRBS) Session(ctx context.Context, opts ...iface.SessionOption) iface.Session {
+	return fakeSession{}
+}
+
+func commPOf(t *testing.T, data []byte) ([]byte, abi.PaddedPieceSize) {
+	var cp commp.Calc
+	_, err := cp.Write(data)
+	require.NoError(t, err)
+
+	raw, size, err := cp.Digest()
+	require.NoError(t, err)
+
+	return raw, abi.PaddedPieceSize(size)
+}
+
+func TestLayoutAggregate(t *testing.T) {
+	const dealSize = abi.PaddedPieceSize(64 << 10)
+
+	capacity := datasegment.IndexStart(dealSize)
+	root := blocks.NewBlock([]byte("root")).Cid()
+
+	cand := func(group iface.GroupKey, size uint64, queued int64) aggregationCandidate {
+		return aggregationCandidate{
+			Group:     group,
+			QueuedAt:  queued,
+			CommP:     bytes.Repeat([]byte{byte(group)}, 32),
+			PieceSize: int64(size),
+			Root:      root,
+		}
+	}
+
+	l, err := layoutAggregate(nil, dealSize)
+	require.NoError(t, err)
+	require.Nil(t, l)
+
+	l, err = layoutAggregate([]aggregationCandidate{cand(1, uint64(dealSize), 10)}, dealSize)
+	require.NoError(t, err)
+	require.Nil(t, l)
+
+	// sorted by decreasing size, the third group doesn't fit after the first two
+	cands := []aggregationCandidate{
+		cand(1, uint64(dealSize/2), 30),
+		cand(2, uint64(dealSize/4), 20),
+		cand(3, uint64(dealSize/2), 5),
+		cand(4, uint64(dealSize/8), 40),
+	}
+
+	l, err = layoutAggregate(cands, dealSize)
+	require.NoError(t, err)
+	require.NotNil(t, l)
+
+	require.Equal(t, int64(dealSize), l.info.PieceSize)
+	require.Equal(t, int64(dealSize.Unpadded()), l.info.PayloadSize)
+	require.Equal(t, root, l.info.Root)
+	require.Equal(t, uint64(dealSize/2+dealSize/4+dealSize/8), l.used)
+	require.LessOrEqual(t, l.used, capacity)
+	require.Equal(t, int64(20), l.oldest)
+
+	require.Len(t, l.members, 3)
+	var off int64
+	for i, g := range []iface.GroupKey{1, 2, 4} {
+		m := l.members[i]
+		require.Equal(t, g, m.Group)
+		require.Equal(t, i, m.Segment)
+		require.Equal(t, off, m.SegOffset)
+		require.Equal(t, cands[g-1].PieceSize, m.SegSize)
+		require.NotEmpty(t, m.InclusionProof)
+
+		off += m.SegSize
+	}
+}
+
+func TestAggregateReadRange(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+
+	const dealSize = abi.PaddedPieceSize(64 << 10)
+
+	db := openTestDB(t, t.TempDir())
+	storage := &fakeStorage{cars: map[iface.GroupKey][]byte{}}
+	r := &ribs{
+		RBS: &fakeRBS{storage: storage},
+		db:  db,
+	}
+
+	root := blocks.NewBlock([]byte("root")).Cid()
+
+	// groups by decreasing piece size, cars don't fill the pieces
+	var cands []aggregationCandidate
+	for i, carSize := range []int{9000, 3000, 1500, 700} {
+		group := iface.GroupKey(101 + i)
+
+		car := make([]byte, carSize)
+		rng.Read(car)
+		storage.cars[group] = car
+
+		cp, pieceSize := commPOf(t, car)
+
+		_, err := db.db.Exec(`insert into groups (id, blocks, bytes, g_state, jb_recorded_head, piece_size, commp, car_size, root) values (?, 1, ?, ?, 0, ?, ?, ?, ?)`,
+			group, carSize, iface.GroupStateLocalReadyForDeals, pieceSize, cp, carSize, root.Bytes())
+		require.NoError(t, err)
+
+		cands = append(cands, aggregationCandidate{
+			Group:     group,
+			CommP:     cp,
+			PieceSize: int64(pieceSize),
+			Root:      root,
+		})
+	}
+
+	l, err := layoutAggregate(cands, dealSize)
+	require.NoError(t, err)
+	require.Len(t, l.members, len(cands))
+
+	id, err := db.CreateAggregate(l.info, l.members)
+	require.NoError(t, err)
+
+	agg, err := r.openAggregate(id)
+	require.NoError(t, err)
+
+	// the full payload is committed to by the aggregate piece cid
+	var payload bytes.Buffer
+	require.NoError(t, agg.readRange(ctx, 0, int64(dealSize.Unpadded()), &payload))
+	require.Equal(t, int(dealSize.Unpadded()), payload.Len())
+
+	cp, pieceSize := commPOf(t, payload.Bytes())
+	require.Equal(t, dealSize, pieceSize)
+	pieceCid, err := commcid.PieceCommitmentV1ToCID(cp)
+	require.NoError(t, err)
+	require.Equal(t, l.info.PieceCid, pieceCid)
+
+	// group cars are at their segment offsets, followed by zeros
+	for i, g := range agg.groups {
+		car := storage.cars[g.Group]
+		at := agg.agg.UnpaddedOffset(i)
+
+		seg := payload.Bytes()[at : at+int64(abi.PaddedPieceSize(g.SegSize).Unpadded())]
+		require.Equal(t, car, seg[:len(car)])
+		require.Equal(t, make([]byte, len(seg)-len(car)), seg[len(car):])
+	}
+
+	// ranges match the full payload
+	for _, rg := range [][2]int64{{0, 100}, {8000, 2000}, {agg.agg.UnpaddedOffset(1) - 10, 20}, {int64(dealSize.Unpadded()) - 500, 500}} {
+		var buf bytes.Buffer
+		require.NoError(t, agg.readRange(ctx, rg[0], rg[1], &buf))
+		require.Equal(t, payload.Bytes()[rg[0]:rg[0]+rg[1]], buf.Bytes(), "range %d+%d", rg[0], rg[1])
+	}
+
+	// deals are made for the aggregate, tracked on the first group
+	dt := aggregateDealTarget(agg.info, agg.groups)
+	require.Equal(t, iface.GroupKey(0), dt.group)
+	require.Equal(t, id, dt.aggregate)
+	require.Equal(t, iface.GroupKey(101), dt.lead)
+	require.Equal(t, l.info.PieceCid, dt.pieceCid)
+	require.Equal(t, int64(dealSize), dt.pieceSize)
+	require.Equal(t, int64(dealSize.Unpadded()), dt.carSize)
+	require.Equal(t, fmt.Sprintf("aggregate %d", id), dt.String())
+
+	// aggregates which don't match the stored piece are not served
+	_, err = db.db.Exec(`update groups set commp = ? where id = 102`, bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	_, err = r.openAggregate(id)
+	require.ErrorContains(t, err, "piece cid mismatch")
+}
@@ -3,7 +3,6 @@ package rbdeal
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
@@ -11,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,12 +19,14 @@ import (
 
 	"github.com/gbrlsnchs/jwt/v3"
 	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
 	gostream "github.com/libp2p/go-libp2p-gostream"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/ributil"
 	types "github.com/lotus-web3/ribs/ributil/boosttypes"
+	"github.com/lotus-web3/ribs/ributil/piececid"
 	"golang.org/x/xerrors"
 )
 
@@ -128,30 +130,17 @@ func (r *ribs) CarUploadStats() iface.UploadStats {
 
 type carStatWriter struct {
 	groupCtr *int64
-	wrote    int64
 
-	w         io.Writer
-	toDiscard int64
+	// wrote is the car offset reached, including the skipped range start
+	wrote int64
+
+	w io.Writer
 }
 
 func (c *carStatWriter) Write(p []byte) (n int, err error) {
-	defer func() {
-		c.wrote += int64(n)
-	}()
-
-	var discarded int64
-	if c.toDiscard > 0 {
-		if int64(len(p)) <= c.toDiscard {
-			c.toDiscard -= int64(len(p))
-			return len(p), nil
-		}
-		p = p[c.toDiscard:]
-		discarded = c.toDiscard
-		c.toDiscard = 0
-	}
 	n, err = c.w.Write(p)
+	c.wrote += int64(n)
 	atomic.AddInt64(c.groupCtr, int64(n))
-	n += int(discarded)
 	return
 }
 
@@ -164,6 +153,10 @@ type carRequestToken struct {
 	Timeout int64
 	CarSize int64
 
+	// Aggregate is set for aggregate transfers, Group is the first group of
+	// the aggregate then
+	Aggregate int64 `json:",omitempty"`
+
 	DealUUID uuid.UUID
 }
 
@@ -180,19 +173,20 @@ func (r *ribs) verify(ctx context.Context, token string) (carRequestToken, error
 	return payload, nil
 }
 
-func (r *ribs) makeCarRequestToken(group int64, timeout time.Duration, carSize int64, deal uuid.UUID) ([]byte, error) {
+func (r *ribs) makeCarRequestToken(group int64, aggregate int64, timeout time.Duration, carSize int64, deal uuid.UUID) ([]byte, error) {
 	p := carRequestToken{
-		Group:    group,
-		Timeout:  time.Now().Add(timeout).Unix(),
-		CarSize:  carSize,
-		DealUUID: deal,
+		Group:     group,
+		Timeout:   time.Now().Add(timeout).Unix(),
+		CarSize:   carSize,
+		Aggregate: aggregate,
+		DealUUID:  deal,
 	}
 
 	return jwt.Sign(&p, jwtKey)
 }
 
-func (r *ribs) makeCarRequest(group int64, timeout time.Duration, carSize int64, deal uuid.UUID) (types.Transfer, error) {
-	reqToken, err := r.makeCarRequestToken(group, timeout, carSize, deal)
+func (r *ribs) makeCarRequest(group int64, aggregate int64, timeout time.Duration, carSize int64, deal uuid.UUID) (types.Transfer, error) {
+	reqToken, err := r.makeCarRequestToken(group, aggregate, timeout, carSize, deal)
 	if err != nil {
 		return types.Transfer{}, xerrors.Errorf("make car request token: %w", err)
 	}
@@ -356,6 +350,28 @@ func getPreferredAddrs(h host.Host) []ma.Multiaddr {
 	return sortedAddrs
 }
 
+// carRequestPiece returns the v1 piece CID of car requests for
+// /piece/{piece cid} paths, which can have a v1 or a v2 piece CID. Requests for
+// other paths are served based on the token alone, cid.Undef is returned then.
+func carRequestPiece(p string) (cid.Cid, error) {
+	dir, file := path.Split(strings.TrimSuffix(p, "/"))
+	if path.Base(dir) != "piece" {
+		return cid.Undef, nil
+	}
+
+	c, err := cid.Parse(file)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("parsing piece cid: %w", err)
+	}
+
+	v1, err := piececid.Normalize(c)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("normalizing piece cid: %w", err)
+	}
+
+	return v1, nil
+}
+
 func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	if req.Header.Get("Authorization") == "" {
 		log.Errorw("car request auth: no auth header", "url", req.URL)
@@ -380,6 +396,13 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 
 	log := log.With("peer", pid, "deal", reqToken.DealUUID)
 
+	reqPiece, err := carRequestPiece(req.URL.Path)
+	if err != nil {
+		log.Errorw("car request: invalid piece cid", "error", err, "url", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Protect the libp2p connection for the lifetime of the transfer
 	tag := uuid.New().String()
 	r.host.ConnManager().Protect(pid, tag)
@@ -425,25 +448,79 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	gm, err := r.RBS.StorageDiag().GroupMeta(reqToken.Group)
-	if err != nil {
-		log.Errorw("car request: group meta", "error", err, "url", req.URL)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var carSize int64
+	var readRange func(ctx context.Context, off, size int64, out io.Writer) error
+
+	if reqToken.Aggregate != 0 {
+		agg, err := r.openAggregate(reqToken.Aggregate)
+		if err != nil {
+			log.Errorw("car request: open aggregate", "error", err, "url", req.URL, "aggregate", reqToken.Aggregate)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if reqPiece.Defined() && reqPiece != agg.info.PieceCid {
+			log.Errorw("car request: piece cid mismatch", "url", req.URL, "aggregate", reqToken.Aggregate, "piece", agg.info.PieceCid)
+			http.Error(w, "piece not found", http.StatusNotFound)
+			return
+		}
+
+		carSize = agg.info.PayloadSize
+		readRange = agg.readRange
+	} else {
+		if reqPiece.Defined() {
+			gd, err := r.RBS.Storage().DescibeGroup(req.Context(), reqToken.Group)
+			if err != nil {
+				log.Errorw("car request: describe group", "error", err, "url", req.URL)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if reqPiece != gd.PieceCid {
+				log.Errorw("car request: piece cid mismatch", "url", req.URL, "group", reqToken.Group, "piece", gd.PieceCid)
+				http.Error(w, "piece not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		gm, err := r.RBS.StorageDiag().GroupMeta(reqToken.Group)
+		if err != nil {
+			log.Errorw("car request: group meta", "error", err, "url", req.URL)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if gm.DealCarSize == nil {
+			log.Errorw("car request: no deal car size", "url", req.URL)
+			http.Error(w, "no deal car size", http.StatusInternalServerError)
+			return
+		}
+
+		carSize = *gm.DealCarSize
+		readRange = func(ctx context.Context, off, size int64, out io.Writer) error {
+			return r.RBS.Storage().ReadCarRange(ctx, reqToken.Group, off, size, out)
+		}
 	}
-	if gm.DealCarSize == nil {
-		log.Errorw("car request: no deal car size", "url", req.URL)
-		http.Error(w, "no deal car size", http.StatusInternalServerError)
+
+	if toDiscard >= carSize || (toLimit != -1 && toLimit < toDiscard) {
+		log.Errorw("car request: range not satisfiable", "range", req.Header.Get("Range"), "carSize", carSize)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", carSize))
+		http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
+	if toLimit >= carSize {
+		toLimit = carSize - 1
+	}
 
 	// todo run more checks here?
 
-	s3u, err := r.maybeGetS3URL(reqToken.Group)
-	if err != nil {
-		log.Errorw("car request: s3 url", "error", err, "url", req.URL)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var s3u string
+	if reqToken.Aggregate == 0 {
+		// aggregates are assembled from local groups
+		s3u, err = r.maybeGetS3URL(reqToken.Group)
+		if err != nil {
+			log.Errorw("car request: s3 url", "error", err, "url", req.URL)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	if s3u != "" {
@@ -474,9 +551,9 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	r.uploadStats[reqToken.Group].ActiveRequests++
 
 	sw := &carStatWriter{
-		groupCtr:  &r.uploadStats[reqToken.Group].UploadBytes,
-		w:         w,
-		toDiscard: toDiscard,
+		groupCtr: &r.uploadStats[reqToken.Group].UploadBytes,
+		wrote:    toDiscard,
+		w:        w,
 	}
 
 	r.uploadStatsLk.Unlock()
@@ -539,7 +616,7 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	rateWriter := ributil.NewRateEnforcingWriter(sw, rc, transferIdleTimeout)
 	defer rateWriter.Done()
 
-	respLen := *gm.DealCarSize - toDiscard
+	respLen := carSize - toDiscard
 	if toLimit != -1 {
 		respLen = toLimit - toDiscard + 1
 	}
@@ -547,19 +624,7 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Length", strconv.FormatInt(respLen, 10))
 	w.Header().Set("Content-Type", "application/vnd.ipld.car")
 
-	// limit writer in case we have a range request
-	var errLimitReached = errors.New("byte limit reached")
-	var writerToUse io.Writer = rateWriter
-
-	if toLimit != -1 {
-		writerToUse = &LimitWriter{
-			W:   rateWriter,
-			N:   toLimit - toDiscard + 1,
-			Err: errLimitReached,
-		}
-	}
-
-	err = r.RBS.Storage().ReadCar(req.Context(), reqToken.Group, func(int64) {}, writerToUse)
+	err = readRange(req.Context(), toDiscard, respLen, rateWriter)
 
 	defer func() {
 		if err := r.db.UpdateTransferStats(reqToken.DealUUID, sw.wrote, rateWriter.WriteError()); err != nil {
@@ -569,36 +634,8 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	}()
 
 	if err != nil {
-		log.Errorw("car request: write car", "error", err, "url", req.URL, "group", reqToken.Group, "deal", reqToken.DealUUID, "remote", req.RemoteAddr)
+		log.Errorw("car request: write car", "error", err, "url", req.URL, "group", reqToken.Group, "aggregate", reqToken.Aggregate, "deal", reqToken.DealUUID, "remote", req.RemoteAddr)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
-
-type LimitWriter struct {
-	W       io.Writer
-	N       int64
-	Err     error
-	Reached bool // flag to indicate whether the limit has been reached
-}
-
-func (lw *LimitWriter) Write(p []byte) (n int, err error) {
-	if lw.Reached {
-		return 0, lw.Err
-	}
-	if lw.N <= 0 {
-		lw.Reached = true
-		return 0, lw.Err
-	}
-	if int64(len(p)) > lw.N {
-		p = p[0:lw.N]
-		lw.Reached = true
-	}
-	n, err = lw.W.Write(p)
-	lw.N -= int64(n)
-	if lw.N <= 0 {
-		lw.Reached = true
-		lw.Err = err
-	}
-	return
-}
@@ -0,0 +1,33 @@
+package rbdeal
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarRequestPiece(t *testing.T) {
+	v1, v2 := testPieceCids(t)
+
+	for p, expect := range map[string]cid.Cid{
+		"":                            cid.Undef,
+		"/":                           cid.Undef,
+		"/data":                       cid.Undef,
+		"/piece/" + v1.String():       v1,
+		"/piece/" + v2.String():       v1,
+		"/peer/piece/" + v2.String():  v1,
+		"/piece/" + v2.String() + "/": v1,
+	} {
+		c, err := carRequestPiece(p)
+		require.NoError(t, err, p)
+		require.Equal(t, expect, c, p)
+	}
+
+	_, err := carRequestPiece("/piece/notacid")
+	require.Error(t, err)
+
+	// not a piece cid
+	_, err = carRequestPiece("/piece/bafkqaaa")
+	require.Error(t, err)
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/ipfs/go-cid"
 	iface "github.com/lotus-web3/ribs"
 	types "github.com/lotus-web3/ribs/ributil/boosttypes"
+	"github.com/lotus-web3/ribs/ributil/piececid"
 	"golang.org/x/xerrors"
 )
 
@@ -52,7 +53,7 @@ create table if not exists deals (
     client_addr text not null,
     provider_addr integer not null,
 
-    group_id integer not null,
+    group_id integer, /* null for aggregate deals */
     price_afil_gib_epoch integer not null,
     verified integer not null,
     keep_unsealed integer not null,
@@ -263,6 +264,10 @@ type schema struct {
 	VersionNumber int
 	Description   string
 	Schema        string
+
+	// Migrate, if set, runs after Schema in the same transaction, for data
+	// updates which can't be expressed in SQL
+	Migrate func(tx *sql.Tx) error
 }
 
 var schemas = []schema{
@@ -270,8 +275,201 @@ var schemas = []schema{
 		VersionNumber: 2,
 		Description:   "Add sector_number to deals table",
 		Schema:        `ALTER TABLE deals ADD COLUMN sector_number INTEGER;`,
+	},
+	{
+		VersionNumber: 3,
+		Description:   "Add group aggregates",
+		Schema: `
+CREATE TABLE aggregates (
+    id INTEGER NOT NULL CONSTRAINT aggregates_pk PRIMARY KEY AUTOINCREMENT,
+    piece_cid TEXT NOT NULL,
+    piece_size INTEGER NOT NULL,
+    payload_size INTEGER NOT NULL, /* unpadded piece size, transferred to providers */
+    root BLOB NOT NULL, /* deal data root, root of the first group */
+    created_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
+);
+
+CREATE TABLE aggregate_groups (
+    group_id INTEGER NOT NULL CONSTRAINT aggregate_groups_pk PRIMARY KEY,
+    aggregate_id INTEGER NOT NULL,
+    segment INTEGER NOT NULL, /* entry in the segment index */
+    seg_offset INTEGER NOT NULL, /* padded offset in the aggregate */
+    seg_size INTEGER NOT NULL,
+    inclusion_proof BLOB NOT NULL
+);
+
+CREATE INDEX idx_aggregate_groups_aggregate ON aggregate_groups(aggregate_id, segment);
+
+/* small groups waiting for an aggregate */
+CREATE TABLE aggregate_queue (
+    group_id INTEGER NOT NULL CONSTRAINT aggregate_queue_pk PRIMARY KEY,
+    queued_at INTEGER DEFAULT (strftime('%s','now')) NOT NULL
+);
+
+/* deals for aggregates have group_id 0, null since version 4 */
+ALTER TABLE deals ADD COLUMN aggregate_id INTEGER;
+CREATE INDEX idx_deals_aggregate ON deals(aggregate_id);
+`,
+	},
+	{
+		VersionNumber: 4,
+		Description:   "Key aggregate deals by aggregate_id only",
+		Schema: `
+/* rebuild deals with a nullable group_id, aggregate deals used group_id 0
+   which was counted as a group by per-group queries. legacy_alter_table keeps
+   the rename from checking views on the dropped table. */
+PRAGMA legacy_alter_table = ON;
+
+CREATE TABLE deals_new (
+    uuid text not null constraint deals_pk primary key,
+    start_time integer default (strftime('%s','now')) not null,
+
+    client_addr text not null,
+    provider_addr integer not null,
+
+    group_id integer, /* null for aggregate deals */
+    price_afil_gib_epoch integer not null,
+    verified integer not null,
+    keep_unsealed integer not null,
+
+    start_epoch integer not null,
+    end_epoch integer not null,
+
+    signed_proposal_bytes blob not null,
+
+    deal_id integer,
+    deal_pub_ts text,
+    sector_start_epoch integer,
+
+    /* deal state */
+    proposed integer not null default 0, /* 1 when the deal is successfully proposed */
+    published integer not null default 0, /* publish cid is set, and we have validated the message is landed on chain with some finality */
+    sealed integer not null default 0, /* deal state SectorStartEpoch set */
+
+    failed integer not null default 0, /* 1 when the deal is unsuccessful for ANY reason */
+    rejected integer not null default 0,
+
+    failed_expired integer not null default 0, /* 1 when the deal is failed AND the proposal start has passed TODO */
+
+    error_msg text,
+
+    /* status queries */
+    last_state_query integer default 0 not null,
+    last_state_query_error text,
+
+    /* data transfer */
+    car_transfer_start_time integer,
+    car_transfer_attempts integer not null default 0,
+
+    car_transfer_last_end_time integer,
+    car_transfer_last_bytes integer,
+
+    /* sp deal state */
+    sp_status text, /* boost checkpoint name */
+    sp_sealing_status text,
+    sp_sig_proposal text,
+    sp_pub_msg_cid text,
+
+    sp_recv_bytes integer,
+    sp_txsize integer, /* todo swap for car_size in group? */
+
+    /* market deal state checks */
+    last_deal_state_check integer not null default 0,
+
+    /* retrieval checks */
+    last_retrieval_check integer not null default 0,
+    last_retrieval_check_success integer not null default 0,
+    retrieval_probes_success integer not null default 0,
+    retrieval_probes_fail integer not null default 0,
+
+    retrieval_probe_prev_error text,
+
+    retrieval_probe_prev_ms integer,
+    retrieval_probe_prev_ttfb_ms integer,
+
+    sector_number INTEGER,
+    aggregate_id INTEGER
+);
+
+INSERT INTO deals_new SELECT * FROM deals;
+DROP TABLE deals;
+ALTER TABLE deals_new RENAME TO deals;
+
+UPDATE deals SET group_id = NULL WHERE aggregate_id IS NOT NULL;
+
+CREATE INDEX idx_deals_provider ON deals(provider_addr, group_id, rejected, start_time);
+CREATE INDEX idx_deals_group ON deals(group_id, rejected, start_time);
+CREATE INDEX idx_deals_retrieval ON deals(last_retrieval_check, last_retrieval_check_success);
+CREATE INDEX idx_deals_start_time_rejected_failed ON deals (rejected, failed, start_time);
+CREATE INDEX idx_deals_aggregate ON deals(aggregate_id);
+
+PRAGMA legacy_alter_table = OFF;
+`,
+	},
+	{
+		VersionNumber: 5,
+		Description:   "Add v2 piece cid to deals table",
+		Schema: `
+ALTER TABLE deals ADD COLUMN piece_cid_v2 TEXT;
+
+/* group pieces have the v2 cid in the groups table, aggregates are filled in by the migration */
+UPDATE deals SET piece_cid_v2 = (SELECT g.piece_cid_v2 FROM groups g WHERE g.id = deals.group_id) WHERE group_id IS NOT NULL;
+`,
+		Migrate: backfillAggregateDealPieceCidV2,
 	}}
 
+// backfillAggregateDealPieceCidV2 sets v2 piece CIDs of aggregate deals made
+// before v2 piece CIDs were stored with deals
+func backfillAggregateDealPieceCidV2(tx *sql.Tx) error {
+	res, err := tx.Query(`SELECT id, piece_cid, piece_size, payload_size FROM aggregates`)
+	if err != nil {
+		return xerrors.Errorf("query aggregates: %w", err)
+	}
+
+	type aggregatePiece struct {
+		id      int64
+		pieceV2 string
+	}
+	var pieces []aggregatePiece
+
+	for res.Next() {
+		var id, pieceSize, payloadSize int64
+		var pieceCid string
+		if err := res.Scan(&id, &pieceCid, &pieceSize, &payloadSize); err != nil {
+			_ = res.Close()
+			return xerrors.Errorf("scanning aggregate: %w", err)
+		}
+
+		v1, err := cid.Decode(pieceCid)
+		if err != nil {
+			_ = res.Close()
+			return xerrors.Errorf("aggregate %d piece cid: %w", id, err)
+		}
+
+		c, err := piececid.FromV1(v1, abi.PaddedPieceSize(pieceSize), uint64(payloadSize))
+		if err != nil {
+			_ = res.Close()
+			return xerrors.Errorf("aggregate %d v2 piece cid: %w", id, err)
+		}
+
+		pieces = append(pieces, aggregatePiece{id: id, pieceV2: c.String()})
+	}
+	if err := res.Err(); err != nil {
+		return xerrors.Errorf("iterating aggregates: %w", err)
+	}
+	if err := res.Close(); err != nil {
+		return xerrors.Errorf("closing aggregate iterator: %w", err)
+	}
+
+	for _, p := range pieces {
+		if _, err := tx.Exec(`UPDATE deals SET piece_cid_v2 = ? WHERE aggregate_id = ?`, p.pieceV2, p.id); err != nil {
+			return xerrors.Errorf("update aggregate %d deals: %w", p.id, err)
+		}
+	}
+
+	return nil
+}
+
 func openRibsDB(root string) (*ribsDB, error) {
 	rdb, err := sql.Open("sqlite3", filepath.Join(root, "store.db"))
 	if err != nil {
@@ -296,6 +494,34 @@ func openRibsDB(root string) (*ribsDB, error) {
 	return rd, nil
 }
 
+// applySchema applies a schema update and records its version in one
+// transaction, so that interrupted updates are retried on the next start
+func (r *ribsDB) applySchema(s schema) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin: %w", err)
+	}
+
+	if _, err := tx.Exec(s.Schema); err != nil {
+		_ = tx.Rollback()
+		return xerrors.Errorf("exec schema: %w", err)
+	}
+
+	if s.Migrate != nil {
+		if err := s.Migrate(tx); err != nil {
+			_ = tx.Rollback()
+			return xerrors.Errorf("migrate data: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec("INSERT INTO schema_version (version_number, description) VALUES (?, ?)", s.VersionNumber, s.Description); err != nil {
+		_ = tx.Rollback()
+		return xerrors.Errorf("insert schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
+
 var analyzeInterval = 6 * time.Hour
 
 func (r *ribsDB) startDB() error {
@@ -304,19 +530,22 @@ func (r *ribsDB) startDB() error {
 		return xerrors.Errorf("exec schema: %w", err)
 	}
 
+	// Refuse databases written by newer versions
+	var dbVersion int
+	if err := r.db.QueryRow("SELECT coalesce(max(version_number), 0) FROM schema_version").Scan(&dbVersion); err != nil {
+		return xerrors.Errorf("query schema version: %w", err)
+	}
+	if latest := schemas[len(schemas)-1].VersionNumber; dbVersion > latest {
+		return xerrors.Errorf("store.db deal schema version %d is newer than supported version %d", dbVersion, latest)
+	}
+
 	// Apply any pending schema updates
 	for i, s := range schemas {
 		var version int
 		err := r.db.QueryRow("SELECT version_number FROM schema_version WHERE version_number = ?", s.VersionNumber).Scan(&version)
 		if err == sql.ErrNoRows {
-			_, err = r.db.Exec(s.Schema)
-			if err != nil {
-				return xerrors.Errorf("exec schema update %d: %w", i, err)
-			}
-
-			_, err = r.db.Exec("INSERT INTO schema_version (version_number, description) VALUES (?, ?)", s.VersionNumber, s.Description)
-			if err != nil {
-				return xerrors.Errorf("insert schema version %d: %w", i, err)
+			if err := r.applySchema(s); err != nil {
+				return xerrors.Errorf("apply schema update %d: %w", i, err)
 			}
 		} else if err != nil {
 			return xerrors.Errorf("query schema version %d: %w", i, err)
@@ -477,7 +706,9 @@ type dealProvider struct {
 	ask_verif_price float64
 }
 
-func (r *ribsDB) SelectDealProviders(group iface.GroupKey, pieceSize int64, verified bool, maxPrice float64) ([]dealProvider, error) {
+// SelectDealProviders selects providers for a group, or for an aggregate when
+// group is 0
+func (r *ribsDB) SelectDealProviders(group iface.GroupKey, aggregate int64, pieceSize int64, verified bool, maxPrice float64) ([]dealProvider, error) {
 	// only reachable, with boost_deals, only ones that don't have deals for this group
 	// 6 at random
 	// 2 of them with booster_http
@@ -489,11 +720,11 @@ func (r *ribsDB) SelectDealProviders(group iface.GroupKey, pieceSize int64, veri
 
 	res, err := r.db.Query(`select id, ask_price, ask_verif_price from good_providers
 									WHERE id NOT IN (
-										SELECT provider_addr FROM deals	WHERE group_id = ?
+										SELECT provider_addr FROM deals	WHERE group_id = ? OR aggregate_id = ?
 										  AND (rejected = 0 OR (rejected = 1 AND start_time >= strftime('%s', 'now', '-24 hours')))
 										  AND (failed = 0 OR (rejected = 0 AND failed = 1 AND  start_time >= strftime('%s', 'now', '-100 hours')))
 									) and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 15`,
-		group, pieceSize, pieceSize)
+		group, aggregate, pieceSize, pieceSize)
 	if err != nil {
 		return nil, xerrors.Errorf("querying providers: %w", err)
 	}
@@ -525,10 +756,10 @@ func (r *ribsDB) SelectDealProviders(group iface.GroupKey, pieceSize int64, veri
 
 	res, err = r.db.Query(`select id, ask_price, ask_verif_price from good_providers
 									WHERE id NOT IN (
-										SELECT provider_addr FROM deals	WHERE group_id = ?
+										SELECT provider_addr FROM deals	WHERE group_id = ? OR aggregate_id = ?
 										  AND (rejected = 0 OR (rejected = 1 AND start_time >= strftime('%s', 'now', '-24 hours')))
 										  AND (failed = 0 OR (rejected = 0 AND failed = 1 AND  start_time >= strftime('%s', 'now', '-100 hours')))
-									) and booster_http = 1 and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 7`, group, pieceSize, pieceSize)
+									) and booster_http = 1 and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 7`, group, aggregate, pieceSize, pieceSize)
 	if err != nil {
 		return nil, xerrors.Errorf("querying providers: %w", err)
 	}
@@ -553,10 +784,10 @@ func (r *ribsDB) SelectDealProviders(group iface.GroupKey, pieceSize int64, veri
 
 	res, err = r.db.Query(`select id, ask_price, ask_verif_price from good_providers
 									WHERE id NOT IN (
-										SELECT provider_addr FROM deals	WHERE group_id = ?
+										SELECT provider_addr FROM deals	WHERE group_id = ? OR aggregate_id = ?
 										  AND (rejected = 0 OR (rejected = 1 AND start_time >= strftime('%s', 'now', '-24 hours')))
 										  AND (failed = 0 OR (rejected = 0 AND failed = 1 AND  start_time >= strftime('%s', 'now', '-100 hours')))
-									) and booster_bitswap = 1 and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 7`, group, pieceSize, pieceSize)
+									) and booster_bitswap = 1 and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 7`, group, aggregate, pieceSize, pieceSize)
 	if err != nil {
 		return nil, xerrors.Errorf("querying providers: %w", err)
 	}
@@ -757,6 +988,13 @@ type dbDealInfo struct {
 	DealUUID string
 	GroupID  iface.GroupKey
 
+	// AggregateID is set for deals made for aggregates, GroupID is 0 then and
+	// the deal is stored without a group
+	AggregateID int64
+
+	// PieceCidV2 is the FRC-0069 piece CID of the deal piece
+	PieceCidV2 cid.Cid
+
 	ClientAddr   string
 	ProviderAddr int64
 
@@ -771,8 +1009,21 @@ type dbDealInfo struct {
 }
 
 func (r *ribsDB) StoreDealProposal(d dbDealInfo) error {
-	_, err := r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes) values
-                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, d.GroupID, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.StartEpoch, d.EndEpoch, d.SignedProposalBytes)
+	groupID, aggregateID := &d.GroupID, &d.AggregateID
+	if d.AggregateID != 0 {
+		groupID = nil
+	} else {
+		aggregateID = nil
+	}
+
+	var pieceV2 *string
+	if d.PieceCidV2.Defined() {
+		ps := d.PieceCidV2.String()
+		pieceV2 = &ps
+	}
+
+	_, err := r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, aggregate_id, piece_cid_v2, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes) values
+                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, groupID, aggregateID, pieceV2, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.StartEpoch, d.EndEpoch, d.SignedProposalBytes)
 	if err != nil {
 		return xerrors.Errorf("inserting deal: %w", err)
 	}
@@ -1295,7 +1546,7 @@ func (r *ribsDB) GroupDeals(gk iface.GroupKey) ([]iface.DealMeta, error) {
 										sp_status, sp_sealing_status, error_msg, sp_recv_bytes, sp_txsize, sp_pub_msg_cid, start_epoch, end_epoch,
 										retrieval_probes_success, retrieval_probes_fail, retrieval_probe_prev_ttfb_ms,
 										last_retrieval_check > 0 AND last_retrieval_check > (last_retrieval_check_success + 3600*24) as no_recent_retr
-										from deals where group_id = ?`, gk)
+										from deals where group_id = ? or aggregate_id = (select aggregate_id from aggregate_groups where group_id = ?)`, gk, gk)
 	if err != nil {
 		return nil, xerrors.Errorf("getting group meta: %w", err)
 	}
@@ -1506,6 +1757,13 @@ type RetrCheckCandidate struct {
 	Group    int64
 	Verified bool
 	FastRetr bool
+
+	// AggregatePiece is the deal piece of aggregate deals, Group is the first
+	// group of the aggregate then
+	AggregatePiece cid.Cid
+
+	// PieceCidV2 is the v2 piece CID of the deal piece, undefined if unknown
+	PieceCidV2 cid.Cid
 }
 
 func (r *ribsDB) GetRetrievalCheckCandidates() ([]RetrCheckCandidate, error) {
@@ -1513,10 +1771,12 @@ func (r *ribsDB) GetRetrievalCheckCandidates() ([]RetrCheckCandidate, error) {
 	now := time.Now().Unix()
 
 	rows, err := r.db.Query(`
-		SELECT uuid, provider_addr, group_id, verified, keep_unsealed FROM deals 
-		WHERE sealed = 1 
-		AND failed = 0 
-		AND last_retrieval_check <= ?`,
+		SELECT d.uuid, d.provider_addr, coalesce(ag.group_id, d.group_id), d.verified, d.keep_unsealed, a.piece_cid, d.piece_cid_v2 FROM deals d
+		LEFT JOIN aggregates a ON a.id = d.aggregate_id
+		LEFT JOIN aggregate_groups ag ON ag.aggregate_id = d.aggregate_id AND ag.segment = 0
+		WHERE d.sealed = 1 
+		AND d.failed = 0 
+		AND d.last_retrieval_check <= ?`,
 		now-secondsIn6Hours)
 	if err != nil {
 		return nil, xerrors.Errorf("getting retrieval check candidates: %w", err)
@@ -1526,11 +1786,24 @@ func (r *ribsDB) GetRetrievalCheckCandidates() ([]RetrCheckCandidate, error) {
 	var deals []RetrCheckCandidate
 	for rows.Next() {
 		var deal RetrCheckCandidate
+		var aggPiece, pieceV2 *string
 		// Assuming Deal is a struct that can scan all columns from the deals table
-		err := rows.Scan(&deal.DealID, &deal.Provider, &deal.Group, &deal.Verified, &deal.FastRetr)
+		err := rows.Scan(&deal.DealID, &deal.Provider, &deal.Group, &deal.Verified, &deal.FastRetr, &aggPiece, &pieceV2)
 		if err != nil {
 			return nil, xerrors.Errorf("scanning deal: %w", err)
 		}
+		if aggPiece != nil {
+			deal.AggregatePiece, err = cid.Decode(*aggPiece)
+			if err != nil {
+				return nil, xerrors.Errorf("parsing aggregate piece cid: %w", err)
+			}
+		}
+		if pieceV2 != nil {
+			deal.PieceCidV2, err = cid.Decode(*pieceV2)
+			if err != nil {
+				return nil, xerrors.Errorf("parsing v2 piece cid: %w", err)
+			}
+		}
 		deals = append(deals, deal)
 	}
 
@@ -1596,8 +1869,8 @@ type RetrCandidate struct {
 func (r *ribsDB) GetRetrievalCandidates(group iface.GroupKey) ([]RetrCandidate, error) {
 	rows, err := r.db.Query(`
 		SELECT uuid, provider_addr, verified, keep_unsealed, last_retrieval_check_success FROM deals 
-		WHERE group_id = ? AND sealed = 1 AND failed = 0 order by retrieval_probe_prev_ttfb_ms asc, last_retrieval_check_success desc, keep_unsealed desc`,
-		group)
+		WHERE (group_id = ? OR aggregate_id = (SELECT aggregate_id FROM aggregate_groups WHERE group_id = ?)) AND sealed = 1 AND failed = 0 order by retrieval_probe_prev_ttfb_ms asc, last_retrieval_check_success desc, keep_unsealed desc`,
+		group, group)
 	if err != nil {
 		return nil, xerrors.Errorf("getting retrieval candidates: %w", err)
 	}
@@ -1927,6 +2200,29 @@ func (r *ribsDB) GetAssignedRepairWorkByWorkerID(workerID int) ([]iface.GroupKey
 	return groupIDs, nil
 }
 
+// GetRetrievableDealCount counts non-failed deals which passed a retrieval
+// check in the last day
+func (r *ribsDB) GetRetrievableDealCount(group iface.GroupKey) (int, error) {
+	var count int
+	err := r.db.QueryRow(`select count(*) from deals where group_id = ? and failed = 0 and last_retrieval_check_success > 0 and last_retrieval_check < (last_retrieval_check_success + 3600*24)`, group).Scan(&count)
+	if err != nil {
+		return 0, xerrors.Errorf("querying retrievable deal count: %w", err)
+	}
+
+	return count, nil
+}
+
+// AddRepair queues a group for repair, if it's not queued already
+func (r *ribsDB) AddRepair(groupID iface.GroupKey, retrievableDeals int) error {
+	query := `
+		INSERT INTO repairs (group_id, retrievable_deals)
+		VALUES (?, ?)
+		ON CONFLICT (group_id) DO NOTHING;
+	`
+	_, err := r.db.Exec(query, groupID, retrievableDeals)
+	return err
+}
+
 func (r *ribsDB) DelRepair(groupID iface.GroupKey) error {
 	query := `
 		DELETE FROM repairs
@@ -1952,3 +2248,268 @@ func (r *ribsDB) UpdateRepairOnStepNotDone(workerID int) error {
 
 	return nil
 }
+
+type aggregationCandidate struct {
+	Group    iface.GroupKey
+	QueuedAt int64
+
+	CommP     []byte
+	PieceSize int64
+	Root      cid.Cid
+}
+
+// QueueAggregationCandidates queues groups ready for deals with pieces smaller
+// than minPieceSize which don't have live deals, and returns all queued groups,
+// largest first
+func (r *ribsDB) QueueAggregationCandidates() ([]aggregationCandidate, error) {
+	_, err := r.db.Exec(`INSERT OR IGNORE INTO aggregate_queue (group_id)
+		SELECT g.id FROM groups g
+		WHERE g.g_state = ? AND g.piece_size < ?
+		  AND g.id NOT IN (SELECT group_id FROM aggregate_groups)
+		  AND NOT EXISTS (SELECT 1 FROM deals d WHERE d.group_id = g.id AND d.failed = 0)`,
+		iface.GroupStateLocalReadyForDeals, minPieceSize)
+	if err != nil {
+		return nil, xerrors.Errorf("queueing aggregation candidates: %w", err)
+	}
+
+	rows, err := r.db.Query(`SELECT q.group_id, q.queued_at, g.commp, g.piece_size, g.root FROM aggregate_queue q
+		JOIN groups g ON g.id = q.group_id
+		WHERE g.g_state = ?
+		ORDER BY g.piece_size DESC, q.queued_at ASC, q.group_id ASC`, iface.GroupStateLocalReadyForDeals)
+	if err != nil {
+		return nil, xerrors.Errorf("querying aggregation candidates: %w", err)
+	}
+	defer rows.Close()
+
+	var out []aggregationCandidate
+	for rows.Next() {
+		var c aggregationCandidate
+		var root []byte
+		if err := rows.Scan(&c.Group, &c.QueuedAt, &c.CommP, &c.PieceSize, &root); err != nil {
+			return nil, xerrors.Errorf("scanning aggregation candidate: %w", err)
+		}
+		if _, c.Root, err = cid.CidFromBytes(root); err != nil {
+			return nil, xerrors.Errorf("parsing group root: %w", err)
+		}
+		out = append(out, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating aggregation candidates: %w", err)
+	}
+
+	return out, nil
+}
+
+type aggregateInfo struct {
+	ID int64
+
+	PieceCid    cid.Cid
+	PieceSize   int64
+	PayloadSize int64
+	Root        cid.Cid
+}
+
+type aggregateMember struct {
+	Group   iface.GroupKey
+	Segment int
+
+	SegOffset int64
+	SegSize   int64
+
+	InclusionProof []byte
+}
+
+// CreateAggregate stores an aggregate with its member groups, and removes the
+// groups from the aggregation queue
+func (r *ribsDB) CreateAggregate(ai aggregateInfo, members []aggregateMember) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, xerrors.Errorf("begin: %w", err)
+	}
+
+	var id int64
+	err = tx.QueryRow(`INSERT INTO aggregates (piece_cid, piece_size, payload_size, root) VALUES (?, ?, ?, ?) RETURNING id`,
+		ai.PieceCid.String(), ai.PieceSize, ai.PayloadSize, ai.Root.Bytes()).Scan(&id)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, xerrors.Errorf("inserting aggregate: %w", err)
+	}
+
+	for _, m := range members {
+		_, err := tx.Exec(`INSERT INTO aggregate_groups (group_id, aggregate_id, segment, seg_offset, seg_size, inclusion_proof) VALUES (?, ?, ?, ?, ?, ?)`,
+			m.Group, id, m.Segment, m.SegOffset, m.SegSize, m.InclusionProof)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, xerrors.Errorf("inserting aggregate group %d: %w", m.Group, err)
+		}
+
+		if _, err := tx.Exec(`DELETE FROM aggregate_queue WHERE group_id = ?`, m.Group); err != nil {
+			_ = tx.Rollback()
+			return 0, xerrors.Errorf("removing group %d from the aggregation queue: %w", m.Group, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, xerrors.Errorf("commit: %w", err)
+	}
+
+	return id, nil
+}
+
+func scanAggregateInfo(row interface{ Scan(...any) error }) (aggregateInfo, error) {
+	var ai aggregateInfo
+	var pieceCid string
+	var root []byte
+
+	if err := row.Scan(&ai.ID, &pieceCid, &ai.PieceSize, &ai.PayloadSize, &root); err != nil {
+		return aggregateInfo{}, err
+	}
+
+	var err error
+	ai.PieceCid, err = cid.Decode(pieceCid)
+	if err != nil {
+		return aggregateInfo{}, xerrors.Errorf("parsing aggregate piece cid: %w", err)
+	}
+	_, ai.Root, err = cid.CidFromBytes(root)
+	if err != nil {
+		return aggregateInfo{}, xerrors.Errorf("parsing aggregate root: %w", err)
+	}
+
+	return ai, nil
+}
+
+func (r *ribsDB) GetAggregate(id int64) (aggregateInfo, error) {
+	ai, err := scanAggregateInfo(r.db.QueryRow(`SELECT id, piece_cid, piece_size, payload_size, root FROM aggregates WHERE id = ?`, id))
+	if err != nil {
+		return aggregateInfo{}, xerrors.Errorf("getting aggregate %d: %w", id, err)
+	}
+	return ai, nil
+}
+
+// GroupAggregate returns the aggregate the group is a part of, found is false
+// for groups which aren't aggregated
+func (r *ribsDB) GroupAggregate(group iface.GroupKey) (ai aggregateInfo, m aggregateMember, found bool, err error) {
+	row := r.db.QueryRow(`SELECT a.id, a.piece_cid, a.piece_size, a.payload_size, a.root, ag.segment, ag.seg_offset, ag.seg_size, ag.inclusion_proof
+		FROM aggregate_groups ag JOIN aggregates a ON a.id = ag.aggregate_id
+		WHERE ag.group_id = ?`, group)
+
+	var pieceCid string
+	var root []byte
+	err = row.Scan(&ai.ID, &pieceCid, &ai.PieceSize, &ai.PayloadSize, &root, &m.Segment, &m.SegOffset, &m.SegSize, &m.InclusionProof)
+	if err == sql.ErrNoRows {
+		return aggregateInfo{}, aggregateMember{}, false, nil
+	}
+	if err != nil {
+		return aggregateInfo{}, aggregateMember{}, false, xerrors.Errorf("getting group aggregate: %w", err)
+	}
+
+	ai.PieceCid, err = cid.Decode(pieceCid)
+	if err != nil {
+		return aggregateInfo{}, aggregateMember{}, false, xerrors.Errorf("parsing aggregate piece cid: %w", err)
+	}
+	_, ai.Root, err = cid.CidFromBytes(root)
+	if err != nil {
+		return aggregateInfo{}, aggregateMember{}, false, xerrors.Errorf("parsing aggregate root: %w", err)
+	}
+	m.Group = group
+
+	return ai, m, true, nil
+}
+
+type aggregateGroup struct {
+	aggregateMember
+
+	State     iface.GroupState
+	CommP     []byte
+	PieceSize int64
+	CarSize   int64
+}
+
+// AggregateGroups returns groups of an aggregate in segment index order
+func (r *ribsDB) AggregateGroups(id int64) ([]aggregateGroup, error) {
+	rows, err := r.db.Query(`SELECT ag.group_id, ag.segment, ag.seg_offset, ag.seg_size, ag.inclusion_proof, g.g_state, g.commp, g.piece_size, g.car_size
+		FROM aggregate_groups ag JOIN groups g ON g.id = ag.group_id
+		WHERE ag.aggregate_id = ? ORDER BY ag.segment`, id)
+	if err != nil {
+		return nil, xerrors.Errorf("querying aggregate groups: %w", err)
+	}
+	defer rows.Close()
+
+	var out []aggregateGroup
+	for rows.Next() {
+		var g aggregateGroup
+		if err := rows.Scan(&g.Group, &g.Segment, &g.SegOffset, &g.SegSize, &g.InclusionProof, &g.State, &g.CommP, &g.PieceSize, &g.CarSize); err != nil {
+			return nil, xerrors.Errorf("scanning aggregate group: %w", err)
+		}
+		out = append(out, g)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating aggregate groups: %w", err)
+	}
+
+	return out, nil
+}
+
+type AggregateDealStats struct {
+	AggregateID int64
+
+	TotalDeals    int64
+	FailedDeals   int64
+	SealedDeals   int64
+	Retrievable   int64
+	Unretrievable int64
+
+	// Groups is the number of groups in the aggregate, LocalGroups is the
+	// number of groups which aren't offloaded yet
+	Groups      int64
+	LocalGroups int64
+}
+
+func (r *ribsDB) GetAggregateDealStats() ([]AggregateDealStats, error) {
+	rows, err := r.db.Query(`SELECT
+    a.id,
+    COUNT(d.uuid),
+    COUNT(CASE WHEN d.failed = 1 THEN 1 ELSE NULL END),
+    COUNT(CASE WHEN d.sealed = 1 THEN 1 ELSE NULL END),
+    COUNT(CASE WHEN d.failed = 0 AND d.last_retrieval_check > 0 AND d.last_retrieval_check < (d.last_retrieval_check_success + 3600*24) THEN 1 ELSE NULL END),
+    COUNT(CASE WHEN d.failed = 0 AND d.last_retrieval_check > 0 AND d.last_retrieval_check > (d.last_retrieval_check_success + 3600*24) THEN 1 ELSE NULL END),
+    (SELECT COUNT(*) FROM aggregate_groups ag WHERE ag.aggregate_id = a.id),
+    (SELECT COUNT(*) FROM aggregate_groups ag JOIN groups g ON g.id = ag.group_id WHERE ag.aggregate_id = a.id AND g.g_state = ?)
+FROM
+    aggregates a
+        LEFT JOIN
+    deals d ON d.aggregate_id = a.id
+GROUP BY
+    a.id`, iface.GroupStateLocalReadyForDeals)
+	if err != nil {
+		return nil, xerrors.Errorf("fetch aggregate deal stats: %w", err)
+	}
+	defer rows.Close()
+
+	var out []AggregateDealStats
+	for rows.Next() {
+		var s AggregateDealStats
+		if err := rows.Scan(&s.AggregateID, &s.TotalDeals, &s.FailedDeals, &s.SealedDeals, &s.Retrievable, &s.Unretrievable, &s.Groups, &s.LocalGroups); err != nil {
+			return nil, xerrors.Errorf("scan aggregate deal stats: %w", err)
+		}
+		out = append(out, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterate aggregate deal stats: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *ribsDB) GetNonFailedAggregateDealCount(id int64) (int, error) {
+	var count int
+	err := r.db.QueryRow(`select count(*) from deals where aggregate_id = ? and failed = 0 and case when last_retrieval_check > 0 then last_retrieval_check < (last_retrieval_check_success + 3600*24) else 1 end = 1`, id).Scan(&count)
+	if err != nil {
+		return 0, xerrors.Errorf("querying aggregate deal count: %w", err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,136 @@
+package rbdeal
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/rbstor"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestDB opens the deal db next to the rbstor db, which creates the
+// groups table
+func openTestDB(t *testing.T, root string) *ribsDB {
+	db, err := openRibsDB(root)
+	require.NoError(t, err)
+
+	rbs, err := rbstor.Open(root, rbstor.WithDB(db.db))
+	require.NoError(t, err)
+	require.NoError(t, rbs.Start())
+	t.Cleanup(func() {
+		require.NoError(t, rbs.Close())
+	})
+
+	require.NoError(t, db.startDB())
+	return db
+}
+
+func testDeal(uuid string, group, aggregate int64) dbDealInfo {
+	return dbDealInfo{
+		DealUUID:            uuid,
+		GroupID:             group,
+		AggregateID:         aggregate,
+		ClientAddr:          "f1client",
+		ProviderAddr:        1000,
+		SignedProposalBytes: []byte{1},
+	}
+}
+
+func TestDealDBAggregateDealsHaveNoGroup(t *testing.T) {
+	root := t.TempDir()
+
+	// a database from before aggregate deals had no group
+	allSchemas := schemas
+	schemas = schemas[:2]
+	old := openTestDB(t, root)
+	schemas = allSchemas
+
+	_, err := old.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, aggregate_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes)
+		values ('old-agg', 'f1client', 1000, 0, 1, 0, 0, 0, 0, 0, x'01')`)
+	require.NoError(t, err)
+
+	db, err := openRibsDB(root)
+	require.NoError(t, err)
+	require.NoError(t, db.startDB())
+
+	var group sql.NullInt64
+	require.NoError(t, db.db.QueryRow(`select group_id from deals where uuid = 'old-agg'`).Scan(&group))
+	require.False(t, group.Valid)
+
+	require.NoError(t, db.StoreDealProposal(testDeal("group", 1, 0)))
+	require.NoError(t, db.StoreDealProposal(testDeal("agg", 0, 1)))
+
+	require.NoError(t, db.db.QueryRow(`select group_id from deals where uuid = 'agg'`).Scan(&group))
+	require.False(t, group.Valid)
+
+	var aggregate sql.NullInt64
+	require.NoError(t, db.db.QueryRow(`select aggregate_id from deals where uuid = 'group'`).Scan(&aggregate))
+	require.False(t, aggregate.Valid)
+
+	// aggregate deals aren't counted for any group
+	var groups int
+	require.NoError(t, db.db.QueryRow(`select count(distinct group_id) from deals`).Scan(&groups))
+	require.Equal(t, 1, groups)
+
+	n, err := db.GetNonFailedDealCount(0)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = db.GetNonFailedDealCount(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = db.GetNonFailedAggregateDealCount(1)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+}
+
+func TestDealDBPieceCidV2(t *testing.T) {
+	root := t.TempDir()
+	v1, v2 := testPieceCids(t)
+
+	// deals made before v2 piece cids were stored with deals
+	allSchemas := schemas
+	schemas = schemas[:3]
+	old := openTestDB(t, root)
+	schemas = allSchemas
+
+	_, err := old.db.Exec(`insert into groups (id, blocks, bytes, g_state, jb_recorded_head, piece_size, car_size, piece_cid_v2) values (101, 1, 1000, 4, 0, 2048, 1000, ?)`, v2.String())
+	require.NoError(t, err)
+	_, err = old.db.Exec(`insert into aggregates (id, piece_cid, piece_size, payload_size, root) values (1, ?, 2048, 1000, x'01')`, v1.String())
+	require.NoError(t, err)
+	_, err = old.db.Exec(`insert into aggregate_groups (group_id, aggregate_id, segment, seg_offset, seg_size, inclusion_proof) values (104, 1, 0, 0, 1024, x'01')`)
+	require.NoError(t, err)
+
+	_, err = old.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, aggregate_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes)
+		values ('old-group', 'f1client', 1000, 101, null, 0, 0, 0, 0, 0, x'01'), ('old-agg', 'f1client', 1000, null, 1, 0, 0, 0, 0, 0, x'01')`)
+	require.NoError(t, err)
+
+	db, err := openRibsDB(root)
+	require.NoError(t, err)
+	require.NoError(t, db.startDB())
+
+	d := testDeal("new", 102, 0)
+	d.PieceCidV2 = v2
+	require.NoError(t, db.StoreDealProposal(d))
+	require.NoError(t, db.StoreDealProposal(testDeal("none", 103, 0)))
+
+	_, err = db.db.Exec(`update deals set sealed = 1`)
+	require.NoError(t, err)
+
+	cands, err := db.GetRetrievalCheckCandidates()
+	require.NoError(t, err)
+	require.Len(t, cands, 4)
+
+	got := map[string]cid.Cid{}
+	for _, c := range cands {
+		got[c.DealID] = c.PieceCidV2
+	}
+	require.Equal(t, map[string]cid.Cid{
+		"old-group": v2,
+		"old-agg":   v2,
+		"new":       v2,
+		"none":      cid.Undef,
+	}, got)
+}
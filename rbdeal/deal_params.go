@@ -26,6 +26,17 @@ var (
 	dealDownloadTimeout = time.Hour * 24 * 4
 )
 
+// aggregation of groups with pieces smaller than minPieceSize into deals of
+// minPieceSize
+var (
+	// aggregates are made once they are this full, or when a group waited in
+	// the aggregation queue for aggregateMaxWait
+	aggregateMinFill = 0.9
+	aggregateMaxWait = 24 * time.Hour
+)
+
+var AggregateCheckInterval = time.Minute
+
 // deal checker
 const clientReadDeadline = 10 * time.Second
 const clientWriteDeadline = 10 * time.Second
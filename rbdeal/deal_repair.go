@@ -6,12 +6,12 @@ import (
 	"github.com/ipfs/go-cid"
 	ribs2 "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/ributil"
+	"github.com/lotus-web3/ribs/ributil/piececid"
 	"github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
 	"io"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
 	"time"
 )
@@ -125,6 +125,58 @@ func (r *ribs) repairStep(ctx context.Context, workerID int) error {
 	return nil
 }
 
+func (r *ribs) subGroupCorruption() error {
+	return r.subscribeEvents("group-corruption", ribs2.GroupEventFilter{
+		Types: []ribs2.GroupEventType{ribs2.GroupEventCorrupted},
+	}, func(ev ribs2.GroupEvent) {
+		if err := r.onGroupCorrupted(context.TODO(), ev.Group); err != nil {
+			log.Errorw("handling corrupted group", "group", ev.Group, "error", err)
+		}
+	})
+}
+
+// onGroupCorrupted replaces local data of a corrupted group with a copy from
+// Filecoin or S3. Local data is dropped with Offload, and the group is queued
+// for repair, which reloads the data with LoadFilCar.
+func (r *ribs) onGroupCorrupted(ctx context.Context, group ribs2.GroupKey) error {
+	gm, err := r.RBS.StorageDiag().GroupMeta(group)
+	if err != nil {
+		return xerrors.Errorf("getting group meta: %w", err)
+	}
+
+	if gm.State != ribs2.GroupStateLocalReadyForDeals {
+		// groups before deal-making have no copies to repair from, offloaded
+		// groups are already served from copies
+		return xerrors.Errorf("can't repair group in state %d", gm.State)
+	}
+
+	retrievable, err := r.db.GetRetrievableDealCount(group)
+	if err != nil {
+		return err
+	}
+
+	s3, err := r.db.HasS3Offload(group)
+	if err != nil {
+		return xerrors.Errorf("checking s3 offload: %w", err)
+	}
+
+	if retrievable == 0 && !s3 {
+		return xerrors.Errorf("no retrievable copies to repair from")
+	}
+
+	log.Warnw("repairing corrupted group", "group", group, "retrievableDeals", retrievable, "s3", s3)
+
+	if err := r.Storage().Offload(ctx, group); err != nil {
+		return xerrors.Errorf("offloading corrupted data: %w", err)
+	}
+
+	if err := r.db.AddRepair(group, retrievable); err != nil {
+		return xerrors.Errorf("queueing repair: %w", err)
+	}
+
+	return nil
+}
+
 func (r *ribs) fetchGroup(ctx context.Context, workerID int, group ribs2.GroupKey) (string, error) {
 	rstat := ribs2.RepairJob{
 		GroupKey:      group,
@@ -184,6 +236,17 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 	type retrievalSource struct {
 		provider string
 		reqUrl   url.URL
+
+		// piece is set for provider sources, reqUrl is the provider endpoint
+		// then, and the piece URL is resolved before fetching
+		piece bool
+	}
+
+	// providers are asked for the v2 piece cid only when they don't know the
+	// v1 one
+	piece := gm.PieceCid
+	if gm.PieceCidV2.Defined() {
+		piece = gm.PieceCidV2
 	}
 
 	var sources []retrievalSource
@@ -205,6 +268,20 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 		}
 	}
 
+	if s3Url, err := r.maybeGetS3URL(group); err != nil {
+		log.Warnw("failed to get s3 url", "group", group, "err", err)
+	} else if s3Url != "" {
+		u, err := url.Parse(s3Url)
+		if err != nil {
+			return xerrors.Errorf("failed to parse s3 url: %w", err)
+		}
+
+		sources = append(sources, retrievalSource{
+			provider: "s3",
+			reqUrl:   *u,
+		})
+	}
+
 	for _, candidate := range candidates {
 		// booster-http providers
 		addrInfo, err := r.retrProv.getAddrInfoCached(candidate.Provider)
@@ -223,13 +300,10 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 			continue
 		}
 
-		// start fetch into the file
-		reqUrl := *u
-		reqUrl.Path = path.Join(reqUrl.Path, "piece", gm.PieceCid.String())
-
 		sources = append(sources, retrievalSource{
 			provider: fmt.Sprint(candidate.Provider),
-			reqUrl:   reqUrl,
+			reqUrl:   *u,
+			piece:    true,
 		})
 	}
 
@@ -239,6 +313,13 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 		})
 
 		reqUrl := candidate.reqUrl
+		if candidate.piece {
+			reqUrl, err = resolvePieceURL(ctx, reqUrl, piece)
+			if err != nil {
+				log.Warnw("failed to resolve piece url", "err", err, "group", group, "provider", candidate.provider)
+				continue
+			}
+		}
 
 		log.Infow("attempting http repair retrieval", "url", reqUrl.String(), "group", group, "provider", candidate.provider)
 
@@ -371,10 +452,9 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 			return xerrors.Errorf("sum car: %w", err)
 		}
 
-		if dc.PieceCID != gm.PieceCid {
-			//return xerrors.Errorf("piece cid mismatch: %s != %s", dc.PieceCID, gm.PieceCid)
+		if err := verifyRepairPiece(gm, dc); err != nil {
 			// todo record
-			log.Errorw("piece cid mismatch", "cid", dc.PieceCID, "expected", gm.PieceCid, "provider", candidate.provider, "group", group, "file", groupFile)
+			log.Errorw("piece cid mismatch", "error", err, "provider", candidate.provider, "group", group, "file", groupFile)
 
 			// remove the file
 			_ = os.Remove(groupFile)
@@ -481,10 +561,10 @@ func (r *ribs) fetchGroupLassie(ctx context.Context, workerID int, group ribs2.G
 		return xerrors.Errorf("sum car: %w", err)
 	}
 
-	if dc.PieceCID != gm.PieceCid {
+	if err := verifyRepairPiece(gm, dc); err != nil {
 		_ = os.Remove(groupFile)
-		log.Errorw("piece cid mismatch in lassie fetch", "cid", dc.PieceCID, "expected", gm.PieceCid, "group", group, "file", groupFile)
-		return xerrors.Errorf("piece cid mismatch: %s != %s", dc.PieceCID, gm.PieceCid)
+		log.Errorw("piece cid mismatch in lassie fetch", "error", err, "group", group, "file", groupFile)
+		return err
 	}
 
 	r.updateRepairStats(workerID, func(r *ribs2.RepairJob) {
@@ -494,3 +574,26 @@ func (r *ribs) fetchGroupLassie(ctx context.Context, workerID int, group ribs2.G
 
 	return nil
 }
+
+// verifyRepairPiece checks that fetched group data matches the group piece.
+// When the v2 piece CID is known, the fetched payload size is checked too, so
+// that data with extra trailing zeros is rejected.
+func verifyRepairPiece(gd ribs2.GroupDesc, dc ributil.DataCIDSize) error {
+	if dc.PieceCID != gd.PieceCid {
+		return xerrors.Errorf("piece cid mismatch: %s != %s", dc.PieceCID, gd.PieceCid)
+	}
+
+	if !gd.PieceCidV2.Defined() {
+		return nil
+	}
+
+	v2, err := piececid.FromV1(dc.PieceCID, dc.PieceSize, uint64(dc.PayloadSize))
+	if err != nil {
+		return xerrors.Errorf("computing v2 piece cid: %w", err)
+	}
+	if v2 != gd.PieceCidV2 {
+		return xerrors.Errorf("v2 piece cid mismatch: %s != %s", v2, gd.PieceCidV2)
+	}
+
+	return nil
+}
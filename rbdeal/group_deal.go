@@ -19,6 +19,7 @@ import (
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/ributil"
 	types "github.com/lotus-web3/ribs/ributil/boosttypes"
+	"github.com/lotus-web3/ribs/ributil/piececid"
 	"golang.org/x/xerrors"
 	gobig "math/big"
 )
@@ -33,6 +34,33 @@ func (e ErrRejected) Error() string {
 	return fmt.Sprintf("deal proposal rejected: %s", e.Reason)
 }
 
+// dealTarget is a piece deals are made for, either a single group, or an
+// aggregate of small groups
+type dealTarget struct {
+	group     iface.GroupKey // 0 for aggregates
+	aggregate int64          // 0 for group deals
+
+	// lead is the group used for upload stats, the first group of aggregates
+	lead iface.GroupKey
+
+	pieceCid  cid.Cid
+	pieceSize int64
+	root      cid.Cid
+	carSize   int64
+}
+
+// pieceCidV2 returns the FRC-0069 piece CID of the target piece
+func (t dealTarget) pieceCidV2() (cid.Cid, error) {
+	return piececid.FromV1(t.pieceCid, abi.PaddedPieceSize(t.pieceSize), uint64(t.carSize))
+}
+
+func (t dealTarget) String() string {
+	if t.aggregate != 0 {
+		return fmt.Sprintf("aggregate %d", t.aggregate)
+	}
+	return fmt.Sprintf("group %d", t.group)
+}
+
 func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.LocalWallet) error {
 	r.dealsLk.Lock()
 	if _, ok := r.moreDealsLocks[id]; ok {
@@ -50,10 +78,6 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 		r.dealsLk.Unlock()
 	}()
 
-	if err := r.maybeEnsureS3Offload(id); err != nil {
-		return xerrors.Errorf("attempting s3 offload: %w", err)
-	}
-
 	dealInfo, err := r.db.GetDealParams(ctx, id)
 	if err != nil {
 		return xerrors.Errorf("get deal params: %w", err)
@@ -65,11 +89,38 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 		return xerrors.Errorf("getting non-failed deal count: %w", err)
 	}
 
+	if dealInfo.PieceSize < int64(minPieceSize) && notFailed == 0 {
+		// small groups are dealt as a part of an aggregate, see aggregator.go
+		return nil
+	}
+
+	if err := r.maybeEnsureS3Offload(id); err != nil {
+		return xerrors.Errorf("attempting s3 offload: %w", err)
+	}
+
 	if notFailed >= targetReplicaCount {
 		// occasionally in some racy cases we can end up here
 		return nil
 	}
 
+	pieceCid, err := commcid.PieceCommitmentV1ToCID(dealInfo.CommP)
+	if err != nil {
+		return fmt.Errorf("failed to convert commP to cid: %w", err)
+	}
+
+	return r.makeDeals(ctx, dealTarget{
+		group:     id,
+		lead:      id,
+		pieceCid:  pieceCid,
+		pieceSize: dealInfo.PieceSize,
+		root:      dealInfo.Root,
+		carSize:   dealInfo.CarSize,
+	}, notFailed, w)
+}
+
+// makeDeals makes deals for the target until there are targetReplicaCount
+// non-failed deals
+func (r *ribs) makeDeals(ctx context.Context, t dealTarget, notFailed int, w *ributil.LocalWallet) error {
 	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
 	if err != nil {
 		return xerrors.Errorf("creating gateway rpc client: %w", err)
@@ -98,14 +149,14 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 		verified = true
 	}
 
-	provs, err := r.db.SelectDealProviders(id, dealInfo.PieceSize, verified, maxToPay)
+	pieceV2, err := t.pieceCidV2()
 	if err != nil {
-		return xerrors.Errorf("select deal providers: %w", err)
+		return xerrors.Errorf("v2 piece cid: %w", err)
 	}
 
-	pieceCid, err := commcid.PieceCommitmentV1ToCID(dealInfo.CommP)
+	provs, err := r.db.SelectDealProviders(t.group, t.aggregate, t.pieceSize, verified, maxToPay)
 	if err != nil {
-		return fmt.Errorf("failed to convert commP to cid: %w", err)
+		return xerrors.Errorf("select deal providers: %w", err)
 	}
 
 	makeDealWith := func(prov dealProvider) error {
@@ -122,7 +173,7 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 
 		var providerCollateral abi.TokenAmount
 
-		bounds, err := gw.StateDealProviderCollateralBounds(ctx, abi.PaddedPieceSize(dealInfo.PieceSize), verified, ctypes.EmptyTSK)
+		bounds, err := gw.StateDealProviderCollateralBounds(ctx, abi.PaddedPieceSize(t.pieceSize), verified, ctypes.EmptyTSK)
 		if err != nil {
 			return fmt.Errorf("node error getting collateral bounds: %w", err)
 		}
@@ -148,7 +199,7 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 		price := big.Zero()
 		pricef.Int(price.Int)
 
-		dealProposal, err := dealProposal(ctx, w, walletAddr, dealInfo.Root, abi.PaddedPieceSize(dealInfo.PieceSize), pieceCid, maddr, startEpoch, duration, verified, providerCollateral, price)
+		dealProposal, err := dealProposal(ctx, w, walletAddr, t.root, abi.PaddedPieceSize(t.pieceSize), t.pieceCid, maddr, startEpoch, duration, verified, providerCollateral, price)
 		if err != nil {
 			return fmt.Errorf("failed to create a deal proposal: %w", err)
 		}
@@ -159,7 +210,7 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 		}
 
 		// generate transfer token
-		transfer, err := r.makeCarRequest(id, dealDownloadTimeout, dealInfo.CarSize, dealUuid)
+		transfer, err := r.makeCarRequest(t.lead, t.aggregate, dealDownloadTimeout, t.carSize, dealUuid)
 		if err != nil {
 			return xerrors.Errorf("make car request token: %w", err)
 		}
@@ -167,14 +218,16 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 		dealParams := types.DealParams{
 			DealUUID:           dealUuid,
 			ClientDealProposal: *dealProposal,
-			DealDataRoot:       dealInfo.Root,
+			DealDataRoot:       t.root,
 			IsOffline:          false,
 			Transfer:           transfer,
 		}
 
 		di := dbDealInfo{
 			DealUUID:            dealUuid.String(),
-			GroupID:             id,
+			GroupID:             t.group,
+			AggregateID:         t.aggregate,
+			PieceCidV2:          pieceV2,
 			ClientAddr:          walletAddr.String(),
 			ProviderAddr:        prov.id,
 			PricePerEpoch:       price.Int64(),
@@ -265,7 +318,7 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, w *ributil.
 			return xerrors.Errorf("marking deal as successfully proposed: %w", err)
 		}
 
-		log.Warnf("Deal %s with %s accepted for group %d!!!", dealUuid, maddr, id)
+		log.Warnf("Deal %s with %s accepted for %s!!!", dealUuid, maddr, t)
 
 		return nil
 	}
@@ -2,6 +2,8 @@ package rbdeal
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	lru "github.com/hashicorp/golang-lru/v2"
 	trustlessutils "github.com/ipld/go-trustless-utils"
@@ -9,7 +11,6 @@ import (
 	"github.com/lotus-web3/ribs/carlog"
 	"github.com/multiformats/go-multiaddr"
 	"io"
-	"math/rand"
 	"net/http"
 	"os"
 	"sync"
@@ -18,12 +19,14 @@ import (
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/api/client"
 	"github.com/filecoin-project/lotus/blockstore"
+	ctypes "github.com/filecoin-project/lotus/chain/types"
 	"github.com/filecoin-project/lotus/lib/must"
 	"github.com/ipfs/go-unixfsnode"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipni/go-libipni/metadata"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/ributil"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
@@ -39,6 +42,10 @@ var maxConsecutiveTimeouts = 5
 var consecutiveTimoutsForgivePeriod = 10 * time.Minute
 var parallelChecks = 30
 
+// retrievalSampleSize is the number of piece sample points picked per group
+// in each retrieval check round
+var retrievalSampleSize = 16
+
 type ProbingRetrievalFinder struct {
 	lk      sync.Mutex
 	lookups map[cid.Cid][]types.RetrievalCandidate
@@ -108,10 +115,19 @@ func (r *ribs) doRetrievalCheck(ctx context.Context, gw api.Gateway, prf *Probin
 	r.rckSuccess.Store(0)
 	r.rckFail.Store(0)
 
+	// blocks to check are picked with a seed from the group piece and the
+	// chain head, so that anyone can check which blocks should be checked.
+	// Without a chain head, blocks are picked from hash samples.
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		log.Warnw("failed to get chain head, checking blocks from hash samples", "err", err)
+		head = nil
+	}
+
 	// last retr check candidates
 
 	groups := map[iface.GroupKey]iface.GroupDesc{}
-	samples := map[iface.GroupKey][]multihash.Multihash{}
+	samples := map[iface.GroupKey][]cid.Cid{}
 	for _, candidate := range candidates {
 		if _, ok := groups[candidate.Group]; ok {
 			continue
@@ -124,13 +140,14 @@ func (r *ribs) doRetrievalCheck(ctx context.Context, gw api.Gateway, prf *Probin
 
 		groups[candidate.Group] = gm
 
-		sample, err := r.Storage().HashSample(ctx, candidate.Group)
+		sample, err := r.retrievalSample(ctx, candidate.Group, gm, head)
 		if err != nil {
 			return xerrors.Errorf("failed to load sample for group %d: %w", candidate.Group, err)
 		}
 
 		samples[candidate.Group] = sample
 	}
+	sampleIdx := map[iface.GroupKey]int{}
 
 	timeoutCache := must.One(lru.New[int64, *timeoutEntry](1000))
 
@@ -175,9 +192,16 @@ func (r *ribs) doRetrievalCheck(ctx context.Context, gw api.Gateway, prf *Probin
 
 		timeoutLk.Unlock()
 
+		if len(samples[candidate.Group]) == 0 {
+			log.Warnw("no sample for group", "group", candidate.Group)
+			r.rckFail.Add(1)
+			r.rckFailAll.Add(1)
+			continue
+		}
+
 	retryGetSample:
-		hashToGet := samples[candidate.Group][rand.Intn(len(samples[candidate.Group]))]
-		cidToGet := cid.NewCidV1(cid.Raw, hashToGet)
+		cidToGet := samples[candidate.Group][sampleIdx[candidate.Group]%len(samples[candidate.Group])]
+		sampleIdx[candidate.Group]++
 
 		prf.lk.Lock()
 		_, ok = prf.lookups[cidToGet]
@@ -188,6 +212,10 @@ func (r *ribs) doRetrievalCheck(ctx context.Context, gw api.Gateway, prf *Probin
 		}
 
 		group := groups[candidate.Group]
+		if candidate.AggregatePiece.Defined() {
+			// blocks of aggregated groups are retrieved from the aggregate piece
+			group.PieceCid = candidate.AggregatePiece
+		}
 
 		addrInfo, err := r.db.GetProviderAddrs(candidate.Provider)
 		if err != nil {
@@ -288,6 +316,51 @@ func (r *ribs) doRetrievalCheck(ctx context.Context, gw api.Gateway, prf *Probin
 	return nil
 }
 
+// retrievalSample returns hashes of blocks at group piece sample points
+// picked with a seed from the chain head. Groups without usable sample
+// points, and checks without a chain head, use the hash sample saved at
+// finalize.
+func (r *ribs) retrievalSample(ctx context.Context, group iface.GroupKey, gd iface.GroupDesc, head *ctypes.TipSet) ([]cid.Cid, error) {
+	var seed [32]byte
+	if head != nil {
+		var err error
+		seed, err = piecesample.Seed(gd.PieceCid, int64(head.Height()), head.MinTicket().VRFProof)
+		if err != nil {
+			return nil, xerrors.Errorf("sample seed: %w", err)
+		}
+
+		ents, err := r.Storage().BlockSample(ctx, group, seed, retrievalSampleSize)
+		if err == nil {
+			out := make([]cid.Cid, len(ents))
+			for i, e := range ents {
+				out[i] = e.Cid
+			}
+
+			log.Debugw("retrieval check sample", "group", group, "piece", gd.PieceCid, "epoch", head.Height(), "points", len(ents))
+			return out, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnw("failed to get block sample, using the hash sample", "group", group, "err", err)
+		}
+	} else {
+		// the sample can't be derived from the chain, pick it at random
+		_, _ = rand.Read(seed[:])
+	}
+
+	hashes, err := r.Storage().HashSample(ctx, group)
+	if err != nil {
+		return nil, xerrors.Errorf("getting hash sample: %w", err)
+	}
+
+	idx := piecesample.Pick(seed, len(hashes), retrievalSampleSize)
+	picked := make([]multihash.Multihash, len(idx))
+	for i, ix := range idx {
+		picked[i] = hashes[ix]
+	}
+
+	return r.blockCids(ctx, picked)
+}
+
 func (r *ribs) retrievalCheckCandidate(ctx context.Context, candidate RetrCheckCandidate, addrInfo ProviderAddrInfo, cidToGet cid.Cid, group iface.GroupDesc, fixedPeer []peer.AddrInfo,
 	prf *ProbingRetrievalFinder, lsi *lassie.Lassie, timeoutCache *lru.Cache[int64, *timeoutEntry], cs []types.RetrievalCandidate) error {
 	//// http path, maybe
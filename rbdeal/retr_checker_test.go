@@ -0,0 +1,110 @@
+package rbdeal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	ctypes "github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func testTipSet(t *testing.T, height abi.ChainEpoch) *ctypes.TipSet {
+	miner, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	c := blocks.NewBlock([]byte("state")).Cid()
+	ts, err := ctypes.NewTipSet([]*ctypes.BlockHeader{{
+		Miner:                 miner,
+		Ticket:                &ctypes.Ticket{VRFProof: []byte("ticket")},
+		ElectionProof:         &ctypes.ElectionProof{VRFProof: []byte("election")},
+		ParentStateRoot:       c,
+		ParentMessageReceipts: c,
+		Messages:              c,
+		Height:                height,
+		BLSAggregate:          &crypto.Signature{Type: crypto.SigTypeBLS},
+		BlockSig:              &crypto.Signature{Type: crypto.SigTypeBLS},
+	}})
+	require.NoError(t, err)
+	return ts
+}
+
+func TestRetrievalSample(t *testing.T) {
+	ctx := context.Background()
+
+	defer func(n int) { retrievalSampleSize = n }(retrievalSampleSize)
+	retrievalSampleSize = 4
+
+	hashes := make([]multihash.Multihash, 32)
+	points := &piecesample.Points{PayloadSize: 1 << 20}
+	for i := range hashes {
+		c := blocks.NewBlock([]byte(fmt.Sprint(i))).Cid()
+		hashes[i] = c.Hash()
+		points.Entries = append(points.Entries, piecesample.Entry{
+			Point:  int64(i+1) * piecesample.MinStride,
+			Offset: int64(i) * piecesample.MinStride,
+			Size:   piecesample.MinStride,
+			Cid:    cid.NewCidV1(cid.DagCBOR, c.Hash()),
+		})
+	}
+
+	storage := &fakeStorage{
+		hashes: map[iface.GroupKey][]multihash.Multihash{1: hashes, 2: hashes},
+		points: map[iface.GroupKey]*piecesample.Points{1: points},
+	}
+	r := &ribs{RBS: &fakeRBS{storage: storage}}
+
+	v1, _ := testPieceCids(t)
+	gd := iface.GroupDesc{PieceCid: v1}
+
+	head := testTipSet(t, 100)
+	seed, err := piecesample.Seed(v1, int64(head.Height()), head.MinTicket().VRFProof)
+	require.NoError(t, err)
+
+	// blocks at sample points picked with the chain head
+	sample, err := r.retrievalSample(ctx, 1, gd, head)
+	require.NoError(t, err)
+
+	var expect []cid.Cid
+	for _, e := range points.Sample(seed, retrievalSampleSize) {
+		expect = append(expect, e.Cid)
+	}
+	require.Equal(t, expect, sample)
+
+	// groups without sample points, or with damaged ones, use the hash sample
+	// picked with the same seed
+	expect = nil
+	for _, ix := range piecesample.Pick(seed, len(hashes), retrievalSampleSize) {
+		expect = append(expect, cid.NewCidV1(cid.Raw, hashes[ix]))
+	}
+
+	sample, err = r.retrievalSample(ctx, 2, gd, head)
+	require.NoError(t, err)
+	require.Equal(t, expect, sample)
+
+	storage.pointsErr = xerrors.Errorf("decoding sample points: reading entry 3: unexpected EOF")
+	sample, err = r.retrievalSample(ctx, 1, gd, head)
+	require.NoError(t, err)
+	require.Equal(t, expect, sample)
+
+	// without a chain head blocks are picked from the hash sample
+	sample, err = r.retrievalSample(ctx, 1, gd, nil)
+	require.NoError(t, err)
+	require.Len(t, sample, retrievalSampleSize)
+
+	seen := map[cid.Cid]struct{}{}
+	for _, c := range sample {
+		require.Contains(t, hashes, c.Hash())
+		seen[c] = struct{}{}
+	}
+	require.Len(t, seen, retrievalSampleSize)
+}
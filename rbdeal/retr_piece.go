@@ -0,0 +1,74 @@
+package rbdeal
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"golang.org/x/xerrors"
+)
+
+// pieceRequest requests a piece from the provider HTTP endpoint at base, and
+// returns the response with the piece URL which was requested.
+//
+// piece may be a v1 or a v2 piece CID. The piece is requested by its v1 CID
+// first, and only after a 404 by the v2 CID, for providers which index pieces
+// by v2 CIDs. The v2 CID is only tried when piece is a v2 CID.
+func pieceRequest(ctx context.Context, method string, base url.URL, piece cid.Cid, header http.Header) (*http.Response, url.URL, error) {
+	v1, err := piececid.Normalize(piece)
+	if err != nil {
+		return nil, url.URL{}, xerrors.Errorf("normalizing piece cid: %w", err)
+	}
+
+	pieces := []cid.Cid{v1}
+	if piececid.IsV2(piece) {
+		pieces = append(pieces, piece)
+	}
+
+	var resp *http.Response
+	var u url.URL
+	for _, pc := range pieces {
+		if resp != nil {
+			// the provider doesn't know the previous piece cid
+			_ = resp.Body.Close()
+		}
+
+		u = base
+		u.Path = path.Join(u.Path, "piece", pc.String())
+
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+		if err != nil {
+			return nil, url.URL{}, xerrors.Errorf("failed to create request: %w", err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("User-Agent", "ribs/0.0.0")
+
+		resp, err = http.DefaultClient.Do(req) // todo use a tuned client
+		if err != nil {
+			return nil, u, xerrors.Errorf("failed to do request: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusNotFound {
+			break
+		}
+	}
+
+	return resp, u, nil
+}
+
+// resolvePieceURL returns the URL at which the provider at base serves the
+// piece, see pieceRequest
+func resolvePieceURL(ctx context.Context, base url.URL, piece cid.Cid) (url.URL, error) {
+	resp, u, err := pieceRequest(ctx, http.MethodHead, base, piece, nil)
+	if err != nil {
+		return url.URL{}, err
+	}
+	_ = resp.Body.Close()
+
+	return u, nil
+}
@@ -0,0 +1,95 @@
+package rbdeal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"github.com/stretchr/testify/require"
+)
+
+func testPieceCids(t *testing.T) (v1, v2 cid.Cid) {
+	v1, err := commcid.PieceCommitmentV1ToCID(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+
+	v2, err = piececid.FromV1(v1, 2048, 1000)
+	require.NoError(t, err)
+
+	return v1, v2
+}
+
+func TestPieceRequest(t *testing.T) {
+	ctx := context.Background()
+	v1, v2 := testPieceCids(t)
+
+	var lk sync.Mutex
+	var known cid.Cid
+	var reqs []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lk.Lock()
+		reqs = append(reqs, req.Method+" "+req.URL.Path+" "+req.Header.Get("Range"))
+		k := known
+		lk.Unlock()
+
+		if req.URL.Path != "/sp/piece/"+k.String() {
+			http.NotFound(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer srv.Close()
+
+	base, err := url.Parse(srv.URL + "/sp")
+	require.NoError(t, err)
+
+	try := func(knows, piece cid.Cid) (int, string, []string) {
+		lk.Lock()
+		known, reqs = knows, nil
+		lk.Unlock()
+
+		resp, u, err := pieceRequest(ctx, http.MethodGet, *base, piece, http.Header{"Range": []string{"bytes=1-2"}})
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		lk.Lock()
+		defer lk.Unlock()
+		return resp.StatusCode, u.Path, reqs
+	}
+
+	// pieces are requested by the v1 cid first
+	status, p, r := try(v1, v2)
+	require.Equal(t, http.StatusPartialContent, status)
+	require.Equal(t, "/sp/piece/"+v1.String(), p)
+	require.Equal(t, []string{"GET /sp/piece/" + v1.String() + " bytes=1-2"}, r)
+
+	// the v2 cid is only used after a 404
+	status, p, r = try(v2, v2)
+	require.Equal(t, http.StatusPartialContent, status)
+	require.Equal(t, "/sp/piece/"+v2.String(), p)
+	require.Equal(t, []string{
+		"GET /sp/piece/" + v1.String() + " bytes=1-2",
+		"GET /sp/piece/" + v2.String() + " bytes=1-2",
+	}, r)
+
+	// without the v2 cid there is nothing to fall back to
+	status, p, r = try(v2, v1)
+	require.Equal(t, http.StatusNotFound, status)
+	require.Equal(t, "/sp/piece/"+v1.String(), p)
+	require.Len(t, r, 1)
+
+	lk.Lock()
+	known = v2
+	lk.Unlock()
+
+	u, err := resolvePieceURL(ctx, *base, v2)
+	require.NoError(t, err)
+	require.Equal(t, "/sp/piece/"+v2.String(), u.Path)
+}
@@ -1,7 +1,10 @@
 package rbdeal
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
 	"github.com/filecoin-project/lassie/pkg/storage"
 	"github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/storage/deferred"
@@ -15,6 +18,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lassie/pkg/lassie"
 	"github.com/filecoin-project/lassie/pkg/net/host"
 	"github.com/filecoin-project/lassie/pkg/types"
@@ -31,6 +35,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/ributil"
+	"github.com/lotus-web3/ribs/ributil/piececid"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
@@ -298,7 +303,33 @@ func newRetrievalProvider(ctx context.Context, r *ribs) (*retrievalProvider, err
 	return rp, nil
 }
 
+// blockCids gets CIDs of blocks with codecs recorded in the top-level index,
+// blocks with unknown codecs are requested as raw blocks
+func (r *ribs) blockCids(ctx context.Context, mh []multihash.Multihash) ([]cid.Cid, error) {
+	out := make([]cid.Cid, len(mh))
+	err := r.Session(ctx).GetCids(ctx, mh, func(cids []cid.Cid) error {
+		copy(out, cids)
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting block cids: %w", err)
+	}
+
+	for i, c := range out {
+		if !c.Defined() && mh[i] != nil {
+			out[i] = cid.NewCidV1(cid.Raw, mh[i])
+		}
+	}
+
+	return out, nil
+}
+
 func (r *retrievalProvider) FetchBlocks(ctx context.Context, group iface.GroupKey, mh []multihash.Multihash, cb func(cidx int, data []byte)) error {
+	cids, err := r.r.blockCids(ctx, mh)
+	if err != nil {
+		return err
+	}
+
 	// try cache
 	var cacheHits int
 	var bytesServed int64
@@ -358,12 +389,14 @@ func (r *retrievalProvider) FetchBlocks(ctx context.Context, group iface.GroupKe
 		if hasHttpCandidates {
 			r.r.retrHttpTries.Add(1)
 
+			pieceCid, locs := r.pieceLocations(ctx, group, mh)
+
 			for i, hashToGet := range mh {
 				if hashToGet == nil {
 					continue
 				}
 
-				cidToGet := cid.NewCidV1(cid.Raw, hashToGet)
+				cidToGet := cids[i]
 
 				promise, err := r.retrievalPromise(ctx, cidToGet, i, cb)
 				if err != nil {
@@ -408,7 +441,7 @@ func (r *retrievalProvider) FetchBlocks(ctx context.Context, group iface.GroupKe
 					go func() {
 						defer wg.Done()
 
-						err = r.doHttpRetrieval(ctx, group, candidate.Provider, u, cidToGet, func(data []byte) {
+						onData := func(data []byte) {
 							successOnce.Do(func() {
 								r.ongoingRequestsLk.Lock()
 								delete(r.ongoingRequests, cidToGet)
@@ -422,7 +455,16 @@ func (r *retrievalProvider) FetchBlocks(ctx context.Context, group iface.GroupKe
 								anySuccess = true
 								done <- struct{}{}
 							})
-						})
+						}
+
+						if locs != nil && locs[i].Offset >= 0 {
+							// SPs serve pieces even if they don't index block CIDs
+							if err := r.doPieceRangeRetrieval(ctx, group, candidate.Provider, u, pieceCid, hashToGet, locs[i], onData); err == nil {
+								return
+							}
+						}
+
+						err = r.doHttpRetrieval(ctx, group, candidate.Provider, u, cidToGet, onData)
 						_ = err // already logged in doHttpRetrieval
 					}()
 				}
@@ -504,7 +546,7 @@ func (r *retrievalProvider) FetchBlocks(ctx context.Context, group iface.GroupKe
 
 		var err error
 		for j := 0; j < 16; j++ {
-			err = r.fetchOne(ctx, hashToGet, i, linkSystem, wstor, cb, &bytesServed)
+			err = r.fetchOne(ctx, hashToGet, cids[i], i, linkSystem, wstor, cb, &bytesServed)
 			if err == nil {
 				break
 			}
@@ -579,6 +621,132 @@ func (r *retrievalProvider) doHttpRetrieval(ctx context.Context, group iface.Gro
 	return nil
 }
 
+// pieceLocations returns the group piece CID, v2 when it's known, and
+// locations of blocks in the piece. Locations are nil if they aren't known.
+func (r *retrievalProvider) pieceLocations(ctx context.Context, group iface.GroupKey, mh []multihash.Multihash) (cid.Cid, []iface.BlockLocation) {
+	gd, err := r.r.Storage().DescibeGroup(ctx, group)
+	if err != nil {
+		log.Warnw("failed to get group description", "group", group, "err", err)
+		return cid.Undef, nil
+	}
+	if !gd.PieceCid.Defined() {
+		return cid.Undef, nil
+	}
+
+	// blocks of aggregated groups are in the aggregate piece, after the
+	// payload of groups before them
+	pieceCid := gd.PieceCid
+	if gd.PieceCidV2.Defined() {
+		pieceCid = gd.PieceCidV2
+	}
+	var base int64
+
+	ai, am, aggregated, err := r.r.db.GroupAggregate(group)
+	if err != nil {
+		log.Warnw("failed to get group aggregate", "group", group, "err", err)
+		return cid.Undef, nil
+	}
+	if aggregated {
+		pieceCid, err = piececid.FromV1(ai.PieceCid, abi.PaddedPieceSize(ai.PieceSize), uint64(ai.PayloadSize))
+		if err != nil {
+			log.Warnw("failed to get aggregate v2 piece cid", "group", group, "aggregate", ai.ID, "err", err)
+			return cid.Undef, nil
+		}
+		base = int64(abi.PaddedPieceSize(am.SegOffset).Unpadded())
+	}
+
+	// skip blocks already served from cache
+	toLocate := make([]multihash.Multihash, 0, len(mh))
+	for _, m := range mh {
+		if m != nil {
+			toLocate = append(toLocate, m)
+		}
+	}
+
+	found, err := r.r.Storage().CarLocations(ctx, group, toLocate)
+	if err != nil {
+		log.Warnw("failed to get block locations in piece", "group", group, "err", err)
+		return cid.Undef, nil
+	}
+
+	locs := make([]iface.BlockLocation, len(mh))
+	for i, m := range mh {
+		if m == nil {
+			locs[i] = iface.BlockLocation{Offset: -1}
+			continue
+		}
+		locs[i], found = found[0], found[1:]
+		if locs[i].Offset >= 0 {
+			locs[i].Offset += base
+		}
+	}
+
+	return pieceCid, locs
+}
+
+func (r *retrievalProvider) doPieceRangeRetrieval(ctx context.Context, group iface.GroupKey, prov int64, u *url.URL, pieceCid cid.Cid, hashToGet multihash.Multihash, loc iface.BlockLocation, cb func([]byte)) error {
+	// fetch the block entry from the piece
+	// like curl -H "Range: bytes={off}-{end}" http://{SP's http retrieval URL}/piece/{pieceCID}
+
+	if loc.Size > carlog.MaxEntryLen+binary.MaxVarintLen64 {
+		return xerrors.Errorf("block entry too large (%d bytes)", loc.Size)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second) // todo make tunable, use mostly for ttfb
+	defer cancel()
+
+	resp, pu, err := pieceRequest(ctx, http.MethodGet, *u, pieceCid, http.Header{
+		"Range": []string{fmt.Sprintf("bytes=%d-%d", loc.Offset, loc.Offset+loc.Size-1)},
+	})
+	reqUrl := pu.String()
+	if err != nil {
+		log.Warnw("piece range retrieval failed", "error", err, "url", reqUrl, "group", group, "provider", prov)
+		return err
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode != http.StatusPartialContent {
+		log.Warnw("piece range retrieval failed (non-206 response)", "status", resp.StatusCode, "url", reqUrl, "group", group, "provider", prov)
+		return xerrors.Errorf("non-206 response: %d", resp.StatusCode)
+	}
+
+	ent := make([]byte, loc.Size)
+	if _, err := io.ReadFull(resp.Body, ent); err != nil {
+		log.Warnw("piece range retrieval failed (failed to read response)", "error", err, "url", reqUrl, "group", group, "provider", prov)
+		return xerrors.Errorf("failed to read response: %w", err)
+	}
+
+	entLen, n := binary.Uvarint(ent)
+	if n <= 0 || entLen != uint64(len(ent)-n) {
+		log.Warnw("piece range retrieval failed (invalid entry length)", "url", reqUrl, "group", group, "provider", prov)
+		return xerrors.Errorf("invalid entry length")
+	}
+
+	cn, c, err := cid.CidFromBytes(ent[n:])
+	if err != nil {
+		log.Warnw("piece range retrieval failed (invalid entry cid)", "error", err, "url", reqUrl, "group", group, "provider", prov)
+		return xerrors.Errorf("parsing entry cid: %w", err)
+	}
+	data := ent[n+cn:]
+
+	if !bytes.Equal(c.Hash(), hashToGet) {
+		log.Warnw("piece range retrieval failed (unexpected block)", "url", reqUrl, "group", group, "provider", prov, "expected", hashToGet, "actual", c)
+		return xerrors.Errorf("unexpected block %s", c)
+	}
+
+	checkCid, err := c.Prefix().Sum(data)
+	if err != nil {
+		return xerrors.Errorf("failed to hash response: %w", err)
+	}
+	if !checkCid.Equals(c) {
+		log.Warnw("piece range retrieval failed (response hash mismatch!!!)", "url", reqUrl, "group", group, "provider", prov, "expected", c, "actual", checkCid)
+		return xerrors.Errorf("response hash mismatch")
+	}
+
+	cb(data)
+	return nil
+}
+
 func (r *retrievalProvider) retrievalPromise(ctx context.Context, cidToGet cid.Cid, i int, cb func(cidx int, data []byte)) (*requestPromise, error) {
 	r.ongoingRequestsLk.Lock()
 
@@ -615,9 +783,7 @@ func (r *retrievalProvider) retrievalPromise(ctx context.Context, cidToGet cid.C
 	return promise, nil
 }
 
-func (r *retrievalProvider) fetchOne(ctx context.Context, hashToGet multihash.Multihash, i int, linkSystem linking.LinkSystem, wstor *ributil.IpldStoreWrapper, cb func(cidx int, data []byte), bytesServed *int64) error {
-	cidToGet := cid.NewCidV1(cid.Raw, hashToGet)
-
+func (r *retrievalProvider) fetchOne(ctx context.Context, hashToGet multihash.Multihash, cidToGet cid.Cid, i int, linkSystem linking.LinkSystem, wstor *ributil.IpldStoreWrapper, cb func(cidx int, data []byte), bytesServed *int64) error {
 	promise, err := r.retrievalPromise(ctx, cidToGet, i, cb)
 	if err != nil || promise == nil {
 		return err
@@ -30,6 +30,8 @@ type openOptions struct {
 	localWalletOpener   func(path string) (*ributil.LocalWallet, error)
 	localWalletPath     string
 	fileCoinAPIEndpoint string
+
+	rbsOpts []rbstor.OpenOption
 }
 
 type OpenOption func(*openOptions)
@@ -70,6 +72,13 @@ func WithFileCoinApiEndpoint(wp string) OpenOption {
 	}
 }
 
+// WithRBSOptions sets options passed to the underlying block storage.
+func WithRBSOptions(opts ...rbstor.OpenOption) OpenOption {
+	return func(o *openOptions) {
+		o.rbsOpts = append(o.rbsOpts, opts...)
+	}
+}
+
 type ribs struct {
 	iface.RBS
 	db *ribsDB
@@ -124,8 +133,9 @@ type ribs struct {
 	s3UploadBytes, s3UploadStarted, s3UploadDone, s3UploadErr, s3Redirects, s3ReadReqs, s3ReadBytes atomic.Int64
 
 	/* dealmaking */
-	dealsLk        sync.Mutex
-	moreDealsLocks map[iface.GroupKey]struct{}
+	dealsLk             sync.Mutex
+	moreDealsLocks      map[iface.GroupKey]struct{}
+	aggregateDealsLocks map[int64]struct{}
 
 	/* retrieval */
 	retrHost host.Host
@@ -173,7 +183,7 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 		return nil, xerrors.Errorf("open db: %w", err)
 	}
 
-	rbs, err := rbstor.Open(root, rbstor.WithDB(db.db))
+	rbs, err := rbstor.Open(root, append([]rbstor.OpenOption{rbstor.WithDB(db.db)}, opt.rbsOpts...)...)
 	if err != nil {
 		return nil, xerrors.Errorf("open RBS: %w", err)
 	}
@@ -203,7 +213,8 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 		spCrawlClosed:     make(chan struct{}),
 		marketWatchClosed: make(chan struct{}),
 
-		moreDealsLocks: map[iface.GroupKey]struct{}{},
+		moreDealsLocks:      map[iface.GroupKey]struct{}{},
+		aggregateDealsLocks: map[int64]struct{}{},
 
 		repairFetchCounters: ributil.NewRateCounters[iface.GroupKey](ributil.MinAvgGlobalLogPeerRate(float64(minTransferMbps), float64(linkSpeedMbps/4))),
 	}
@@ -278,12 +289,21 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 
 	r.RBS.ExternalStorage().InstallProvider(rp)
 
+	// subscribe before starting storage so that events from resumed groups are seen
+	if err := r.subGroupChanges(r.onSub); err != nil {
+		return nil, xerrors.Errorf("subscribe to group events: %w", err)
+	}
+	if err := r.subGroupCorruption(); err != nil {
+		return nil, xerrors.Errorf("subscribe to group corruption events: %w", err)
+	}
+
 	if err := r.RBS.Start(); err != nil {
 		return nil, xerrors.Errorf("start storage: %w", err)
 	}
 
 	go r.spCrawler()
 	go r.dealTracker(context.TODO())
+	go r.aggregator(context.TODO())
 	go r.watchMarket(context.TODO())
 	go r.retrievalChecker(context.TODO())
 	if err := r.setupCarServer(context.TODO(), r.host); err != nil {
@@ -302,16 +322,52 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 	/*go r.repairWorker(context.TODO(), 9)
 	go r.repairWorker(context.TODO(), 10)*/
 
-	r.subGroupChanges()
-
 	go r.claimChecker()
 
 	return r, nil
 }
 
-func (r *ribs) subGroupChanges() {
-	r.Storage().Subscribe(func(group iface.GroupKey, from, to iface.GroupState) {
-		go r.onSub(group, from, to)
+// subscribeEvents delivers group events to handle, starting after the last
+// event handled by the named subscriber, so that events sent while the node
+// was down are not missed. The cursor is saved after handle returns, handle
+// must finish processing the event before returning.
+func (r *ribs) subscribeEvents(name string, filter iface.GroupEventFilter, handle func(ev iface.GroupEvent)) error {
+	since, err := r.Storage().EventCursor(context.TODO(), name)
+	if err != nil {
+		return err
+	}
+
+	evs, err := r.Storage().SubscribeEvents(context.TODO(), since, filter)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for ev := range evs {
+			handle(ev)
+
+			if err := r.Storage().SetEventCursor(context.TODO(), name, ev.Seq); err != nil {
+				log.Errorw("saving event cursor", "subscriber", name, "seq", ev.Seq, "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// subGroupChanges calls onChange for group state changes, and for groups
+// opened in their current state, so that work on groups is resumed after a
+// restart
+func (r *ribs) subGroupChanges(onChange func(group iface.GroupKey, from, to iface.GroupState)) error {
+	return r.subscribeEvents("group-changes", iface.GroupEventFilter{
+		Types: []iface.GroupEventType{iface.GroupEventStateChange, iface.GroupEventOpened},
+	}, func(ev iface.GroupEvent) {
+		from := ev.From
+		if ev.Type == iface.GroupEventOpened {
+			from = ev.To
+		}
+
+		onChange(ev.Group, from, ev.To)
 	})
 }
 
@@ -327,12 +383,10 @@ func (r *ribs) onSub(group iface.GroupKey, from, to iface.GroupState) {
 			return
 		}
 
-		go func() {
-			err = r.makeMoreDeals(context.TODO(), group, r.wallet)
-			if err != nil {
-				log.Errorf("starting new deals: %s", err)
-			}
-		}()
+		err = r.makeMoreDeals(context.TODO(), group, r.wallet)
+		if err != nil {
+			log.Errorf("starting new deals: %s", err)
+		}
 	}
 }
 
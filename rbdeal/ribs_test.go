@@ -0,0 +1,147 @@
+package rbdeal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+// eventStorage delivers events sent to evs to subscribers
+type eventStorage struct {
+	iface.Storage
+
+	evs chan iface.GroupEvent
+
+	lk      sync.Mutex
+	cursors map[string]int64
+}
+
+func (s *eventStorage) SubscribeEvents(ctx context.Context, since int64, filter iface.GroupEventFilter) (<-chan iface.GroupEvent, error) {
+	out := make(chan iface.GroupEvent)
+	go func() {
+		defer close(out)
+		for ev := range s.evs {
+			if ev.Seq <= since || !filter.Match(ev) {
+				continue
+			}
+			out <- ev
+		}
+	}()
+	return out, nil
+}
+
+func (s *eventStorage) EventCursor(ctx context.Context, name string) (int64, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	seq, ok := s.cursors[name]
+	if !ok {
+		return iface.GroupEventSeqLatest, nil
+	}
+	return seq, nil
+}
+
+func (s *eventStorage) SetEventCursor(ctx context.Context, name string, seq int64) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.cursors[name] = seq
+	return nil
+}
+
+type eventRBS struct {
+	iface.RBS
+
+	storage *eventStorage
+}
+
+func (f *eventRBS) Storage() iface.Storage {
+	return f.storage
+}
+
+type groupChange struct {
+	group    iface.GroupKey
+	from, to iface.GroupState
+}
+
+func TestSubGroupChangesOpened(t *testing.T) {
+	st := &eventStorage{
+		evs:     make(chan iface.GroupEvent),
+		cursors: map[string]int64{},
+	}
+	defer close(st.evs)
+
+	r := &ribs{RBS: &eventRBS{storage: st}}
+
+	var lk sync.Mutex
+	var changes []groupChange
+
+	require.NoError(t, r.subGroupChanges(func(group iface.GroupKey, from, to iface.GroupState) {
+		lk.Lock()
+		defer lk.Unlock()
+		changes = append(changes, groupChange{group, from, to})
+	}))
+
+	// a group ready for deals before a restart is only reported as opened
+	st.evs <- iface.GroupEvent{Seq: 1, Group: 1, Type: iface.GroupEventOpened, To: iface.GroupStateLocalReadyForDeals}
+	st.evs <- iface.GroupEvent{Seq: 2, Group: 2, Type: iface.GroupEventFinalized}
+	st.evs <- iface.GroupEvent{Seq: 3, Group: 2, Type: iface.GroupEventStateChange, From: iface.GroupStateWritable, To: iface.GroupStateFull}
+
+	require.Eventually(t, func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(changes) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Equal(t, []groupChange{
+		{1, iface.GroupStateLocalReadyForDeals, iface.GroupStateLocalReadyForDeals},
+		{2, iface.GroupStateWritable, iface.GroupStateFull},
+	}, changes)
+
+	// the cursor is saved after the handler returns
+	require.Eventually(t, func() bool {
+		since, err := st.EventCursor(context.Background(), "group-changes")
+		require.NoError(t, err)
+		return since == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSubscribeEventsCursorAfterHandler(t *testing.T) {
+	st := &eventStorage{
+		evs:     make(chan iface.GroupEvent),
+		cursors: map[string]int64{},
+	}
+	defer close(st.evs)
+
+	r := &ribs{RBS: &eventRBS{storage: st}}
+
+	handling := make(chan struct{})
+	release := make(chan struct{})
+
+	require.NoError(t, r.subscribeEvents("test", iface.GroupEventFilter{}, func(ev iface.GroupEvent) {
+		close(handling)
+		<-release
+	}))
+
+	st.evs <- iface.GroupEvent{Seq: 1, Group: 1, Type: iface.GroupEventFinalized}
+	<-handling
+
+	// events being handled aren't marked as processed
+	time.Sleep(20 * time.Millisecond)
+	since, err := st.EventCursor(context.Background(), "test")
+	require.NoError(t, err)
+	require.Equal(t, iface.GroupEventSeqLatest, since)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		since, err := st.EventCursor(context.Background(), "test")
+		require.NoError(t, err)
+		return since == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
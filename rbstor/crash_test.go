@@ -0,0 +1,118 @@
+package rbstor
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/lotus-web3/ribs/ributil/vfs/faultfs"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashConsistency(t *testing.T) {
+	for seed := int64(0); seed < 16; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			testCrashConsistency(t, seed)
+		})
+	}
+}
+
+func testCrashConsistency(t *testing.T, seed int64) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(seed))
+	fs := faultfs.New(seed)
+	root := t.TempDir()
+
+	ri, err := Open(root, WithFS(fs))
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+
+	// let the group get created before injecting faults
+	sess := ri.Session(ctx)
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, randBlocks(t, 1, 64)))
+	require.NoError(t, bt.Flush(ctx))
+
+	fs.CrashAfter(rng.Int63n(48))
+	if seed%4 == 0 {
+		fs.FailSyncs(0.2)
+	}
+
+	// blocks from flushed batches must survive the crash, other written blocks
+	// may be lost, but must have correct data if read
+	committed := map[string][]byte{}
+	written := map[string][]byte{}
+	var unflushed []blocks.Block
+
+	for i := 0; i < 24; i++ {
+		b := make([]blocks.Block, 1+rng.Intn(8))
+		for i := range b {
+			data := make([]byte, 1+rng.Intn(4<<10))
+			rng.Read(data)
+			b[i] = blocks.NewBlock(data)
+			written[string(b[i].Cid().Hash())] = data
+		}
+		unflushed = append(unflushed, b...)
+
+		if err := bt.Put(ctx, b); err != nil {
+			break
+		}
+		if rng.Intn(2) == 0 {
+			if err := bt.Flush(ctx); err != nil {
+				break
+			}
+
+			for _, blk := range unflushed {
+				committed[string(blk.Cid().Hash())] = blk.RawData()
+			}
+			unflushed = nil
+		}
+	}
+
+	_ = ri.Close()
+	require.NoError(t, fs.Crash())
+	fs.FailSyncs(0)
+
+	ri, err = Open(root, WithFS(fs), WithVerifyReads(true))
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+	defer func() {
+		require.NoError(t, ri.Close())
+	}()
+
+	sess = ri.Session(ctx)
+
+	check := func() {
+		var hashes []mh.Multihash
+		for h := range written {
+			hashes = append(hashes, mh.Multihash(h))
+		}
+
+		err := sess.View(ctx, hashes, func(i int, data []byte) {
+			exp, ok := committed[string(hashes[i])]
+			if !ok {
+				exp = written[string(hashes[i])]
+			}
+			require.Equal(t, exp, data)
+			delete(committed, string(hashes[i]))
+		})
+		require.NoError(t, err)
+		require.Empty(t, committed, "committed blocks lost")
+	}
+	check()
+
+	// the store accepts writes after recovery
+	b := randBlocks(t, 4, 1024)
+	bt = sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, b))
+	require.NoError(t, bt.Flush(ctx))
+
+	for _, blk := range b {
+		written[string(blk.Cid().Hash())] = blk.RawData()
+		committed[string(blk.Cid().Hash())] = blk.RawData()
+	}
+	check()
+}
@@ -5,10 +5,14 @@ import (
 	"database/sql"
 	"github.com/lotus-web3/ribs/ributil"
 	"path/filepath"
+	"strings"
+	"time"
 
 	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/ipfs/go-cid"
 	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil/piececid"
 	"golang.org/x/xerrors"
 )
 
@@ -82,8 +86,180 @@ create table if not exists offloads
 
 create index if not exists offloads_group_id_index
 	on offloads (group_id);
+
+/* group labels */
+
+create table if not exists group_labels
+(
+    group_id integer not null
+        constraint group_labels_groups_id_fk
+            references groups
+                on update cascade on delete cascade,
+    key      text    not null,
+    value    text    not null,
+    constraint group_labels_pk
+        primary key (group_id, key)
+);
+
+create index if not exists group_labels_key_value_index
+    on group_labels (key, value);
+
+/* namespaces */
+
+create table if not exists namespaces
+(
+    namespace   text    not null
+        constraint namespaces_pk
+            primary key,
+    quota_bytes integer not null default 0
+);
+
+/* pins */
+
+create table if not exists pins
+(
+    root       blob    not null
+        constraint pins_pk
+            primary key,
+    created_at integer not null
+);
+
+/* group events */
+
+create table if not exists group_events
+(
+    seq        integer not null
+        constraint group_events_pk
+            primary key autoincrement,
+    at         integer not null,
+    group_id   integer not null,
+    event_type integer not null,
+    from_state integer,
+    to_state   integer,
+    piece_cid  text,
+    error      text
+);
+
+/* last group event handled by each named subscriber */
+
+create table if not exists group_event_cursors
+(
+    name text not null
+        constraint group_event_cursors_pk
+            primary key,
+    seq  integer not null
+);
+
+create table if not exists rbs_schema_version
+(
+    version_number integer primary key,
+    description    text,
+    applied_on     datetime default current_timestamp
+);
 `
 
+type schema struct {
+	VersionNumber int
+	Description   string
+	Schema        string
+
+	// Migrate, if set, runs after Schema in the same transaction, for data
+	// updates which can't be expressed in SQL
+	Migrate func(tx *sql.Tx) error
+}
+
+// schemas are applied in order after dbSchema, each exactly once
+var schemas = []schema{
+	{
+		VersionNumber: 1,
+		Description:   "Add namespace to groups table",
+		Schema: `ALTER TABLE groups ADD COLUMN namespace TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS groups_namespace_g_state_index ON groups (namespace, g_state);`,
+	},
+	{
+		VersionNumber: 2,
+		Description:   "Add unlinked data counters to groups table",
+		Schema: `ALTER TABLE groups ADD COLUMN unlinked_blocks INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE groups ADD COLUMN unlinked_bytes INTEGER NOT NULL DEFAULT 0;`,
+	},
+	{
+		VersionNumber: 3,
+		Description:   "Add group scrub results table",
+		Schema: `CREATE TABLE IF NOT EXISTS group_scrubs
+(
+    group_id    INTEGER NOT NULL
+        CONSTRAINT group_scrubs_pk
+            PRIMARY KEY
+        CONSTRAINT group_scrubs_groups_id_fk
+            REFERENCES groups
+                ON UPDATE CASCADE ON DELETE CASCADE,
+    scrubbed_at INTEGER NOT NULL,
+    blocks      INTEGER NOT NULL,
+    bytes       INTEGER NOT NULL,
+    error       TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS group_scrubs_scrubbed_at_index ON group_scrubs (scrubbed_at);`,
+	},
+	{
+		VersionNumber: 4,
+		Description:   "Add v2 piece cid to groups table",
+		Schema:        `ALTER TABLE groups ADD COLUMN piece_cid_v2 TEXT;`,
+		Migrate:       backfillPieceCidV2,
+	},
+	{
+		VersionNumber: 5,
+		Description:   "Add released bytes to namespaces table",
+		Schema:        `ALTER TABLE namespaces ADD COLUMN released_bytes INTEGER NOT NULL DEFAULT 0;`,
+	},
+}
+
+// backfillPieceCidV2 computes v2 piece CIDs of groups which had commP
+// computed before v2 piece CIDs were stored
+func backfillPieceCidV2(tx *sql.Tx) error {
+	res, err := tx.Query(`SELECT id, commp, piece_size, car_size FROM groups WHERE commp IS NOT NULL AND piece_size IS NOT NULL AND car_size IS NOT NULL`)
+	if err != nil {
+		return xerrors.Errorf("query groups: %w", err)
+	}
+
+	type groupPiece struct {
+		id      iface.GroupKey
+		pieceV2 string
+	}
+	var pieces []groupPiece
+
+	for res.Next() {
+		var id iface.GroupKey
+		var commp []byte
+		var pieceSize, carSize int64
+		if err := res.Scan(&id, &commp, &pieceSize, &carSize); err != nil {
+			_ = res.Close()
+			return xerrors.Errorf("scanning group: %w", err)
+		}
+
+		c, err := piececid.FromCommP(commp, abi.PaddedPieceSize(pieceSize), uint64(carSize))
+		if err != nil {
+			_ = res.Close()
+			return xerrors.Errorf("group %d v2 piece cid: %w", id, err)
+		}
+
+		pieces = append(pieces, groupPiece{id: id, pieceV2: c.String()})
+	}
+	if err := res.Err(); err != nil {
+		return xerrors.Errorf("iterating groups: %w", err)
+	}
+	if err := res.Close(); err != nil {
+		return xerrors.Errorf("closing group iterator: %w", err)
+	}
+
+	for _, p := range pieces {
+		if _, err := tx.Exec(`UPDATE groups SET piece_cid_v2 = ? WHERE id = ?`, p.pieceV2, p.id); err != nil {
+			return xerrors.Errorf("update group %d: %w", p.id, err)
+		}
+	}
+
+	return nil
+}
+
 type rbsDB struct {
 	db *ributil.RetryDB
 }
@@ -111,11 +287,61 @@ func openRibsDB(root string, opt *ributil.RetryDB) (*rbsDB, error) {
 		return nil, xerrors.Errorf("exec schema: %w", err)
 	}
 
+	// Refuse databases written by newer versions
+	var dbVersion int
+	if err := db.QueryRow("SELECT coalesce(max(version_number), 0) FROM rbs_schema_version").Scan(&dbVersion); err != nil {
+		return nil, xerrors.Errorf("query schema version: %w", err)
+	}
+	if latest := schemas[len(schemas)-1].VersionNumber; dbVersion > latest {
+		return nil, xerrors.Errorf("store.db schema version %d is newer than supported version %d", dbVersion, latest)
+	}
+
+	// Apply any pending schema updates
+	for i, s := range schemas {
+		var version int
+		err := db.QueryRow("SELECT version_number FROM rbs_schema_version WHERE version_number = ?", s.VersionNumber).Scan(&version)
+		if err == sql.ErrNoRows {
+			if err := applySchema(db, s); err != nil {
+				return nil, xerrors.Errorf("apply schema update %d: %w", i, err)
+			}
+		} else if err != nil {
+			return nil, xerrors.Errorf("query schema version %d: %w", i, err)
+		}
+	}
+
 	return &rbsDB{
 		db: db,
 	}, nil
 }
 
+// applySchema applies a schema update and records its version in one
+// transaction, so that interrupted updates are retried on the next start
+func applySchema(db *ributil.RetryDB, s schema) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin: %w", err)
+	}
+
+	if _, err := tx.Exec(s.Schema); err != nil {
+		_ = tx.Rollback()
+		return xerrors.Errorf("exec schema: %w", err)
+	}
+
+	if s.Migrate != nil {
+		if err := s.Migrate(tx); err != nil {
+			_ = tx.Rollback()
+			return xerrors.Errorf("migrate data: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec("INSERT INTO rbs_schema_version (version_number, description) VALUES (?, ?)", s.VersionNumber, s.Description); err != nil {
+		_ = tx.Rollback()
+		return xerrors.Errorf("insert schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
+
 func (r *rbsDB) GetGroupStats() (*iface.GroupStats, error) {
 	var gs iface.GroupStats
 	err := r.db.QueryRow(`SELECT group_count, total_data_size, non_offloaded_data_size, offloaded_data_size FROM group_stats_view`).Scan(&gs.GroupCount, &gs.TotalDataSize, &gs.NonOffloadedDataSize, &gs.OffloadedDataSize)
@@ -125,8 +351,25 @@ func (r *rbsDB) GetGroupStats() (*iface.GroupStats, error) {
 	return &gs, nil
 }
 
-func (r *rbsDB) GetWritableGroup() (selected iface.GroupKey, blocks, bytes, jbhead int64, state iface.GroupState, err error) {
-	res, err := r.db.Query("select id, blocks, bytes, jb_recorded_head, g_state from groups where g_state = 0")
+// GetWritableGroup returns the first writable group in the namespace accepted by the filter
+// GetWritableGroup finds a writable group in the namespace with exactly the given labels
+func (r *rbsDB) GetWritableGroup(ns string, labels map[string]string, filter func(iface.GroupKey) bool) (selected iface.GroupKey, blocks, bytes, jbhead int64, state iface.GroupState, err error) {
+	query := `select id, blocks, bytes, jb_recorded_head, g_state from groups where g_state = 0 and namespace = ?`
+	args := []interface{}{ns}
+
+	var nlabels int
+	for k, v := range labels {
+		if v == "" {
+			continue
+		}
+		query += ` and id in (select group_id from group_labels where key = ? and value = ?)`
+		args = append(args, k, v)
+		nlabels++
+	}
+	query += ` and (select count(*) from group_labels where group_id = groups.id) = ?`
+	args = append(args, nlabels)
+
+	res, err := r.db.Query(query, args...)
 	if err != nil {
 		return 0, 0, 0, 0, 0, xerrors.Errorf("finding writable groups: %w", err)
 	}
@@ -134,11 +377,21 @@ func (r *rbsDB) GetWritableGroup() (selected iface.GroupKey, blocks, bytes, jbhe
 
 	selectedGroup := iface.UndefGroupKey
 
-	if res.Next() {
-		err := res.Scan(&selectedGroup, &blocks, &bytes, &jbhead, &state)
+	for res.Next() {
+		var id iface.GroupKey
+		err := res.Scan(&id, &blocks, &bytes, &jbhead, &state)
 		if err != nil {
 			return 0, 0, 0, 0, 0, xerrors.Errorf("scanning group: %w", err)
 		}
+
+		if filter(id) {
+			selectedGroup = id
+			break
+		}
+	}
+
+	if selectedGroup == iface.UndefGroupKey {
+		blocks, bytes, jbhead, state = 0, 0, 0, 0
 	}
 
 	if err := res.Err(); err != nil {
@@ -151,8 +404,8 @@ func (r *rbsDB) GetWritableGroup() (selected iface.GroupKey, blocks, bytes, jbhe
 	return selectedGroup, blocks, bytes, jbhead, state, nil
 }
 
-func (r *rbsDB) CreateGroup() (out iface.GroupKey, err error) {
-	err = r.db.QueryRow("insert into groups (blocks, bytes, g_state, jb_recorded_head) values (0, 0, 0, 0) returning id").Scan(&out)
+func (r *rbsDB) CreateGroup(ns string) (out iface.GroupKey, err error) {
+	err = r.db.QueryRow("insert into groups (blocks, bytes, g_state, jb_recorded_head, namespace) values (0, 0, 0, 0, ?) returning id", ns).Scan(&out)
 	if err != nil {
 		return iface.UndefGroupKey, xerrors.Errorf("creating group entry: %w", err)
 	}
@@ -160,35 +413,101 @@ func (r *rbsDB) CreateGroup() (out iface.GroupKey, err error) {
 	return
 }
 
-func (r *rbsDB) OpenGroup(gid iface.GroupKey) (blocks, bytes, jbhead int64, state iface.GroupState, err error) {
-	res, err := r.db.Query("select blocks, bytes, jb_recorded_head, g_state from groups where id = ?", gid)
+func (r *rbsDB) OpenGroup(gid iface.GroupKey) (blocks, bytes, jbhead int64, state iface.GroupState, ns string, err error) {
+	res, err := r.db.Query("select blocks, bytes, jb_recorded_head, g_state, namespace from groups where id = ?", gid)
 	if err != nil {
-		return 0, 0, 0, 0, xerrors.Errorf("finding writable groups: %w", err)
+		return 0, 0, 0, 0, "", xerrors.Errorf("finding writable groups: %w", err)
 	}
 	defer res.Close()
 
 	var found bool
 
 	if res.Next() {
-		err := res.Scan(&blocks, &bytes, &jbhead, &state)
+		err := res.Scan(&blocks, &bytes, &jbhead, &state, &ns)
 		if err != nil {
-			return 0, 0, 0, 0, xerrors.Errorf("scanning group: %w", err)
+			return 0, 0, 0, 0, "", xerrors.Errorf("scanning group: %w", err)
 		}
 
 		found = true
 	}
 
 	if err := res.Err(); err != nil {
-		return 0, 0, 0, 0, xerrors.Errorf("iterating groups: %w", err)
+		return 0, 0, 0, 0, "", xerrors.Errorf("iterating groups: %w", err)
 	}
 	if err := res.Close(); err != nil {
-		return 0, 0, 0, 0, xerrors.Errorf("closing group iterator: %w", err)
+		return 0, 0, 0, 0, "", xerrors.Errorf("closing group iterator: %w", err)
 	}
 	if !found {
-		return 0, 0, 0, 0, xerrors.Errorf("group %d not found", gid)
+		return 0, 0, 0, 0, "", xerrors.Errorf("group %d not found", gid)
+	}
+
+	return blocks, bytes, jbhead, state, ns, nil
+}
+
+func (r *rbsDB) GroupNamespace(gid iface.GroupKey) (ns string, err error) {
+	err = r.db.QueryRow("select namespace from groups where id = ?", gid).Scan(&ns)
+	if err != nil {
+		return "", xerrors.Errorf("getting group namespace: %w", err)
+	}
+
+	return ns, nil
+}
+
+func (r *rbsDB) SetNamespaceQuota(ctx context.Context, ns string, quota int64) error {
+	_, err := r.db.ExecContext(ctx, `insert into namespaces (namespace, quota_bytes) values (?, ?) on conflict (namespace) do update set quota_bytes = excluded.quota_bytes`, ns, quota)
+	if err != nil {
+		return xerrors.Errorf("set namespace quota: %w", err)
+	}
+
+	return nil
+}
+
+// AddNamespaceReleased records data unlinked from a namespace, which doesn't
+// count towards the namespace quota. Negative values charge data which was
+// linked again.
+func (r *rbsDB) AddNamespaceReleased(ctx context.Context, ns string, bytes int64) error {
+	_, err := r.db.ExecContext(ctx, `insert into namespaces (namespace, released_bytes) values (?, ?) on conflict (namespace) do update set released_bytes = released_bytes + excluded.released_bytes`, ns, bytes)
+	if err != nil {
+		return xerrors.Errorf("add namespace released bytes: %w", err)
+	}
+
+	return nil
+}
+
+// NamespaceUsage returns the namespace quota and the amount of data stored in
+// namespace groups which wasn't unlinked from the namespace
+func (r *rbsDB) NamespaceUsage(ns string) (quota, bytes int64, err error) {
+	err = r.db.QueryRow(`select coalesce((select quota_bytes from namespaces where namespace = ?), 0), coalesce(sum(bytes), 0) - coalesce((select released_bytes from namespaces where namespace = ?), 0) from groups where namespace = ?`, ns, ns, ns).Scan(&quota, &bytes)
+	if err != nil {
+		return 0, 0, xerrors.Errorf("getting namespace usage: %w", err)
+	}
+
+	return quota, bytes, nil
+}
+
+func (r *rbsDB) NamespaceStats() (map[string]iface.NamespaceStats, error) {
+	res, err := r.db.Query(`select g.namespace, count(*), sum(g.blocks), sum(g.bytes), coalesce(n.quota_bytes, 0) from groups g left join namespaces n on g.namespace = n.namespace group by g.namespace`)
+	if err != nil {
+		return nil, xerrors.Errorf("getting namespace stats: %w", err)
+	}
+	defer res.Close()
+
+	out := map[string]iface.NamespaceStats{}
+	for res.Next() {
+		var ns string
+		var st iface.NamespaceStats
+		if err := res.Scan(&ns, &st.Groups, &st.Blocks, &st.Bytes, &st.QuotaBytes); err != nil {
+			return nil, xerrors.Errorf("scanning namespace stats: %w", err)
+		}
+
+		out[ns] = st
 	}
 
-	return blocks, bytes, jbhead, state, nil
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating namespace stats: %w", err)
+	}
+
+	return out, nil
 }
 
 func (r *rbsDB) GroupStates() (gs map[iface.GroupKey]iface.GroupState, err error) {
@@ -239,9 +558,9 @@ func (r *rbsDB) SetGroupState(ctx context.Context, id iface.GroupKey, state ifac
 	return nil
 }
 
-func (r *rbsDB) SetCommP(ctx context.Context, id iface.GroupKey, state iface.GroupState, commp []byte, paddedPieceSize int64, root cid.Cid, carSize int64) error {
-	_, err := r.db.ExecContext(ctx, `update groups set commp = ?, piece_size = ?, root = ?, car_size = ?, g_state = ? where id = ?;`,
-		commp[:], paddedPieceSize, root.Bytes(), carSize, state, id)
+func (r *rbsDB) SetCommP(ctx context.Context, id iface.GroupKey, state iface.GroupState, commp []byte, paddedPieceSize int64, pieceV2, root cid.Cid, carSize int64) error {
+	_, err := r.db.ExecContext(ctx, `update groups set commp = ?, piece_size = ?, piece_cid_v2 = ?, root = ?, car_size = ?, g_state = ? where id = ?;`,
+		commp[:], paddedPieceSize, pieceV2.String(), root.Bytes(), carSize, state, id)
 	if err != nil {
 		return xerrors.Errorf("update group commp: %w", err)
 	}
@@ -249,6 +568,186 @@ func (r *rbsDB) SetCommP(ctx context.Context, id iface.GroupKey, state iface.Gro
 	return nil
 }
 
+func (r *rbsDB) SetGroupLabels(ctx context.Context, id iface.GroupKey, labels map[string]string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin transaction: %w", err)
+	}
+
+	for k, v := range labels {
+		if v == "" {
+			_, err = tx.ExecContext(ctx, `delete from group_labels where group_id = ? and key = ?`, id, k)
+		} else {
+			_, err = tx.ExecContext(ctx, `insert into group_labels (group_id, key, value) values (?, ?, ?) on conflict (group_id, key) do update set value = excluded.value`, id, k, v)
+		}
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				log.Errorw("rollback SetGroupLabels", "error", err)
+			}
+			return xerrors.Errorf("set group label: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *rbsDB) GroupLabels(ctx context.Context, id iface.GroupKey) (map[string]string, error) {
+	res, err := r.db.QueryContext(ctx, `select key, value from group_labels where group_id = ?`, id)
+	if err != nil {
+		return nil, xerrors.Errorf("getting group labels: %w", err)
+	}
+	defer res.Close()
+
+	out := map[string]string{}
+	for res.Next() {
+		var k, v string
+		if err := res.Scan(&k, &v); err != nil {
+			return nil, xerrors.Errorf("scanning group label: %w", err)
+		}
+
+		out[k] = v
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating group labels: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *rbsDB) FindGroups(ctx context.Context, filter iface.GroupFilter) ([]iface.GroupKey, error) {
+	query := `select id from groups where 1 = 1`
+	var args []interface{}
+
+	for k, v := range filter.Labels {
+		query += ` and id in (select group_id from group_labels where key = ? and value = ?)`
+		args = append(args, k, v)
+	}
+
+	if len(filter.States) > 0 {
+		query += ` and g_state in (?` + strings.Repeat(`, ?`, len(filter.States)-1) + `)`
+		for _, st := range filter.States {
+			args = append(args, st)
+		}
+	}
+
+	query += ` order by id desc`
+
+	res, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, xerrors.Errorf("finding groups: %w", err)
+	}
+	defer res.Close()
+
+	var groups []iface.GroupKey
+	for res.Next() {
+		var id iface.GroupKey
+		if err := res.Scan(&id); err != nil {
+			return nil, xerrors.Errorf("scanning group: %w", err)
+		}
+
+		groups = append(groups, id)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating groups: %w", err)
+	}
+
+	return groups, nil
+}
+
+// AddUnlinked records data unlinked from the index, which is still stored in the group
+func (r *rbsDB) AddUnlinked(ctx context.Context, id iface.GroupKey, blocks, bytes int64) error {
+	_, err := r.db.ExecContext(ctx, `update groups set unlinked_blocks = unlinked_blocks + ?, unlinked_bytes = unlinked_bytes + ? where id = ?`, blocks, bytes, id)
+	if err != nil {
+		return xerrors.Errorf("update unlinked counters: %w", err)
+	}
+
+	return nil
+}
+
+/* PINS */
+
+func (r *rbsDB) AddPins(ctx context.Context, roots []cid.Cid) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin transaction: %w", err)
+	}
+
+	now := time.Now().Unix()
+	for _, c := range roots {
+		_, err := tx.ExecContext(ctx, `insert into pins (root, created_at) values (?, ?) on conflict (root) do nothing`, c.Bytes(), now)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				log.Errorw("rollback AddPins", "error", err)
+			}
+			return xerrors.Errorf("insert pin: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *rbsDB) RemovePins(ctx context.Context, roots []cid.Cid) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin transaction: %w", err)
+	}
+
+	for _, c := range roots {
+		_, err := tx.ExecContext(ctx, `delete from pins where root = ?`, c.Bytes())
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				log.Errorw("rollback RemovePins", "error", err)
+			}
+			return xerrors.Errorf("delete pin: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *rbsDB) Pins(ctx context.Context) ([]cid.Cid, error) {
+	res, err := r.db.QueryContext(ctx, `select root from pins order by created_at, root`)
+	if err != nil {
+		return nil, xerrors.Errorf("listing pins: %w", err)
+	}
+	defer res.Close()
+
+	var out []cid.Cid
+	for res.Next() {
+		var root []byte
+		if err := res.Scan(&root); err != nil {
+			return nil, xerrors.Errorf("scanning pin: %w", err)
+		}
+
+		c, err := cid.Cast(root)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing pin cid: %w", err)
+		}
+
+		out = append(out, c)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating pins: %w", err)
+	}
+
+	return out, nil
+}
+
 /* DIAGNOSTICS */
 
 func (r *rbsDB) Groups() ([]iface.GroupKey, error) {
@@ -281,7 +780,8 @@ func (r *rbsDB) Groups() ([]iface.GroupKey, error) {
 }
 
 func (r *rbsDB) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
-	res, err := r.db.Query("select blocks, bytes, g_state, car_size, commp, root from groups where id = ?", gk)
+	res, err := r.db.Query(`select g.blocks, g.bytes, g.g_state, g.car_size, g.commp, coalesce(g.piece_cid_v2, ''), g.root, g.unlinked_blocks, g.unlinked_bytes, coalesce(s.scrubbed_at, 0), coalesce(s.error, '')
+		from groups g left join group_scrubs s on s.group_id = g.id where g.id = ?`, gk)
 	if err != nil {
 		return iface.GroupMeta{}, xerrors.Errorf("getting group meta: %w", err)
 	}
@@ -293,9 +793,13 @@ func (r *rbsDB) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 	var found bool
 	var carSize *int64
 	var commp, root []byte
+	var pcidV2 string
+	var unlinkedBlocks, unlinkedBytes int64
+	var lastScrub int64
+	var scrubError string
 
 	if res.Next() {
-		err := res.Scan(&blocks, &bytes, &state, &carSize, &commp, &root)
+		err := res.Scan(&blocks, &bytes, &state, &carSize, &commp, &pcidV2, &root, &unlinkedBlocks, &unlinkedBytes, &lastScrub, &scrubError)
 		if err != nil {
 			return iface.GroupMeta{}, xerrors.Errorf("scanning group: %w", err)
 		}
@@ -342,17 +846,24 @@ func (r *rbsDB) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 		Blocks: blocks,
 		Bytes:  bytes,
 
+		UnlinkedBlocks: unlinkedBlocks,
+		UnlinkedBytes:  unlinkedBytes,
+
 		DealCarSize: carSize,
 
-		PieceCID: pcid,
-		RootCID:  rcid,
+		PieceCID:   pcid,
+		PieceCIDv2: pcidV2,
+		RootCID:    rcid,
+
+		LastScrub:  lastScrub,
+		ScrubError: scrubError,
 	}, nil
 }
 
 func (r *rbsDB) DescibeGroup(ctx context.Context, group iface.GroupKey) (iface.GroupDesc, error) {
 	var out iface.GroupDesc
 
-	res, err := r.db.QueryContext(ctx, "SELECT root, commp, car_size FROM groups WHERE id = ?", group)
+	res, err := r.db.QueryContext(ctx, "SELECT root, commp, coalesce(piece_cid_v2, ''), car_size FROM groups WHERE id = ?", group)
 	if err != nil {
 		return iface.GroupDesc{}, xerrors.Errorf("finding group: %w", err)
 	}
@@ -362,7 +873,8 @@ func (r *rbsDB) DescibeGroup(ctx context.Context, group iface.GroupKey) (iface.G
 
 	if res.Next() {
 		var root, commp []byte
-		err := res.Scan(&root, &commp, &out.CarSize)
+		var pieceV2 string
+		err := res.Scan(&root, &commp, &pieceV2, &out.CarSize)
 		if err != nil {
 			return iface.GroupDesc{}, xerrors.Errorf("scanning group: %w", err)
 		}
@@ -377,6 +889,13 @@ func (r *rbsDB) DescibeGroup(ctx context.Context, group iface.GroupKey) (iface.G
 			return iface.GroupDesc{}, xerrors.Errorf("converting commp to cid: %w", err)
 		}
 
+		if pieceV2 != "" {
+			out.PieceCidV2, err = cid.Decode(pieceV2)
+			if err != nil {
+				return iface.GroupDesc{}, xerrors.Errorf("decoding v2 piece cid: %w", err)
+			}
+		}
+
 		found = true
 	}
 
@@ -419,6 +938,37 @@ func (r *rbsDB) GetOffloadCandidate() (id iface.GroupKey, err error) {
 	return
 }
 
+// GetScrubCandidate returns the local writable or finalized group which was
+// scrubbed least recently, if it wasn't scrubbed since `before` (unix time)
+func (r *rbsDB) GetScrubCandidate(before int64) (id iface.GroupKey, err error) {
+	err = r.db.QueryRow(`
+		SELECT g.id
+		FROM groups g
+		LEFT JOIN offloads o ON g.id = o.group_id
+		LEFT JOIN group_scrubs s ON g.id = s.group_id
+		WHERE o.group_id IS NULL AND g.g_state IN (?, ?) AND COALESCE(s.scrubbed_at, 0) < ?
+		ORDER BY COALESCE(s.scrubbed_at, 0), g.id
+		LIMIT 1
+	`, iface.GroupStateWritable, iface.GroupStateLocalReadyForDeals, before).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return iface.UndefGroupKey, nil
+		}
+		return 0, xerrors.Errorf("getting scrub candidate: %w", err)
+	}
+	return
+}
+
+func (r *rbsDB) RecordScrub(ctx context.Context, gid iface.GroupKey, at time.Time, blocks, bytes int64, scrubErr string) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO group_scrubs (group_id, scrubbed_at, blocks, bytes, error) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (group_id) DO UPDATE SET scrubbed_at = excluded.scrubbed_at, blocks = excluded.blocks, bytes = excluded.bytes, error = excluded.error`,
+		gid, at.Unix(), blocks, bytes, scrubErr)
+	if err != nil {
+		return xerrors.Errorf("recording scrub result: %w", err)
+	}
+	return nil
+}
+
 func (r *rbsDB) WriteOffloadEntry(gid iface.GroupKey) (err error) {
 	_, err = r.db.Exec("INSERT OR IGNORE INTO offloads (group_id) VALUES (?)", gid)
 	if err != nil {
@@ -426,3 +976,99 @@ func (r *rbsDB) WriteOffloadEntry(gid iface.GroupKey) (err error) {
 	}
 	return nil
 }
+
+/* EVENTS */
+
+// AppendGroupEvents appends events to the event log in one transaction, and
+// returns the sequence number of the last event
+func (r *rbsDB) AppendGroupEvents(ctx context.Context, evs []iface.GroupEvent) (seq int64, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, xerrors.Errorf("begin transaction: %w", err)
+	}
+
+	for _, ev := range evs {
+		err = tx.QueryRowContext(ctx, `insert into group_events (at, group_id, event_type, from_state, to_state, piece_cid, error) values (?, ?, ?, ?, ?, ?, ?) returning seq`,
+			ev.At, ev.Group, ev.Type, ev.From, ev.To, ev.PieceCID, ev.Error).Scan(&seq)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				log.Errorw("rollback AppendGroupEvents", "error", err)
+			}
+			return 0, xerrors.Errorf("inserting group event: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, xerrors.Errorf("commit transaction: %w", err)
+	}
+
+	return seq, nil
+}
+
+func (r *rbsDB) GroupEvents(ctx context.Context, after int64, limit int) ([]iface.GroupEvent, error) {
+	res, err := r.db.QueryContext(ctx, `select seq, at, group_id, event_type, from_state, to_state, piece_cid, error from group_events where seq > ? order by seq limit ?`, after, limit)
+	if err != nil {
+		return nil, xerrors.Errorf("listing group events: %w", err)
+	}
+	defer res.Close()
+
+	var out []iface.GroupEvent
+	for res.Next() {
+		var ev iface.GroupEvent
+		if err := res.Scan(&ev.Seq, &ev.At, &ev.Group, &ev.Type, &ev.From, &ev.To, &ev.PieceCID, &ev.Error); err != nil {
+			return nil, xerrors.Errorf("scanning group event: %w", err)
+		}
+
+		out = append(out, ev)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating group events: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *rbsDB) LatestGroupEventSeq(ctx context.Context) (seq int64, err error) {
+	err = r.db.QueryRow(`select coalesce(max(seq), 0) from group_events`).Scan(&seq)
+	if err != nil {
+		return 0, xerrors.Errorf("getting latest group event: %w", err)
+	}
+
+	return seq, nil
+}
+
+// GroupEventCursor returns the sequence number of the last event handled by a
+// named subscriber, or GroupEventSeqLatest if the subscriber didn't handle
+// any events
+func (r *rbsDB) GroupEventCursor(ctx context.Context, name string) (int64, error) {
+	var seq int64
+	err := r.db.QueryRow(`select seq from group_event_cursors where name = ?`, name).Scan(&seq)
+	switch {
+	case err == sql.ErrNoRows:
+		return iface.GroupEventSeqLatest, nil
+	case err != nil:
+		return 0, xerrors.Errorf("querying group event cursor: %w", err)
+	}
+
+	return seq, nil
+}
+
+func (r *rbsDB) SetGroupEventCursor(ctx context.Context, name string, seq int64) error {
+	_, err := r.db.ExecContext(ctx, `insert into group_event_cursors (name, seq) values (?, ?) on conflict (name) do update set seq = excluded.seq`, name, seq)
+	if err != nil {
+		return xerrors.Errorf("setting group event cursor: %w", err)
+	}
+
+	return nil
+}
+
+// PruneGroupEvents removes events with sequence numbers lower than `before`
+func (r *rbsDB) PruneGroupEvents(ctx context.Context, before int64) error {
+	_, err := r.db.ExecContext(ctx, `delete from group_events where seq < ?`, before)
+	if err != nil {
+		return xerrors.Errorf("pruning group events: %w", err)
+	}
+
+	return nil
+}
@@ -22,6 +22,11 @@ func (r *rbs) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 		return iface.GroupMeta{}, xerrors.Errorf("get group meta: %w", err)
 	}
 
+	m.Labels, err = r.db.GroupLabels(context.TODO(), gk)
+	if err != nil {
+		return iface.GroupMeta{}, xerrors.Errorf("get group labels: %w", err)
+	}
+
 	r.lk.Lock()
 	g, ok := r.openGroups[gk]
 	r.lk.Unlock()
@@ -36,12 +41,21 @@ func (r *rbs) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 	return m, nil
 }
 
+func (r *rbs) FindGroups(ctx context.Context, filter iface.GroupFilter) ([]iface.GroupKey, error) {
+	return r.db.FindGroups(ctx, filter)
+}
+
 func (r *rbs) GetGroupStats() (*iface.GroupStats, error) {
 	gs, err := r.db.GetGroupStats()
 	if err != nil {
 		return nil, err
 	}
 
+	gs.Namespaces, err = r.db.NamespaceStats()
+	if err != nil {
+		return nil, err
+	}
+
 	r.lk.Lock()
 	gs.OpenGroups = len(r.openGroups)
 	gs.OpenWritable = len(r.writableGroups)
@@ -0,0 +1,326 @@
+package rbstor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// eventSubBuffer is the size of per-subscriber event channels
+	eventSubBuffer = 128
+
+	// eventPageSize is the number of events read from the event log at once
+	eventPageSize = 256
+
+	// eventLogRetention is the number of most recent events kept in the event log
+	eventLogRetention int64 = 1_000_000
+
+	// eventRetryMin and eventRetryMax bound the backoff between attempts to
+	// write events which failed to be recorded
+	eventRetryMin = 100 * time.Millisecond
+	eventRetryMax = 30 * time.Second
+)
+
+type eventSub struct {
+	// notify is poked (non-blocking) when new events are appended to the log
+	notify chan struct{}
+}
+
+// eventQueue holds events waiting to be written to the durable event log, so
+// that sending events never waits for disk writes
+type eventQueue struct {
+	lk   sync.Mutex
+	cond *sync.Cond
+
+	queue []iface.GroupEvent
+
+	// queued and written count all events, flushes wait for written to catch up
+	queued, written int64
+	closed          bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.lk)
+	return q
+}
+
+// sendEvent queues the event for the durable event log, subscribers are
+// notified once it is written
+func (r *rbs) sendEvent(ev iface.GroupEvent) {
+	ev.At = time.Now().UnixMilli()
+
+	q := r.events
+	q.lk.Lock()
+	q.queue = append(q.queue, ev)
+	q.queued++
+	q.lk.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flushEvents waits until all events queued before the call are written
+func (r *rbs) flushEvents() {
+	q := r.events
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	target := q.queued
+	for q.written < target && !q.closed {
+		q.cond.Wait()
+	}
+}
+
+// eventWriter writes queued events to the event log, until the queue is
+// stopped and drained. Events which fail to be written stay queued and are
+// retried with backoff, written only counts recorded events.
+func (r *rbs) eventWriter() {
+	q := r.events
+	defer close(q.done)
+
+	var retry time.Duration
+
+	for {
+		q.lk.Lock()
+		evs := q.queue
+		q.queue = nil
+		q.lk.Unlock()
+
+		if len(evs) > 0 {
+			if err := r.writeEvents(evs); err != nil {
+				q.lk.Lock()
+				q.queue = append(evs, q.queue...)
+				q.lk.Unlock()
+
+				retry *= 2
+				if retry < eventRetryMin {
+					retry = eventRetryMin
+				}
+				if retry > eventRetryMax {
+					retry = eventRetryMax
+				}
+
+				log.Errorw("recording group events", "events", len(evs), "retryIn", retry, "error", err)
+
+				select {
+				case <-time.After(retry):
+					continue
+				case <-q.stop:
+					q.lk.Lock()
+					log.Errorw("dropping group events which failed to be recorded", "events", len(q.queue))
+					q.queue = nil
+					q.closed = true
+					q.cond.Broadcast()
+					q.lk.Unlock()
+					return
+				}
+			}
+			retry = 0
+
+			q.lk.Lock()
+			q.written += int64(len(evs))
+			q.cond.Broadcast()
+			q.lk.Unlock()
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-q.stop:
+			q.lk.Lock()
+			if len(q.queue) > 0 {
+				q.lk.Unlock()
+				continue
+			}
+			q.closed = true
+			q.cond.Broadcast()
+			q.lk.Unlock()
+			return
+		}
+	}
+}
+
+func (r *rbs) writeEvents(evs []iface.GroupEvent) error {
+	seq, err := r.db.AppendGroupEvents(context.TODO(), evs)
+	if err != nil {
+		return xerrors.Errorf("appending group events: %w", err)
+	}
+
+	first := seq - int64(len(evs)) + 1
+	if seq > eventLogRetention && first/1024 != seq/1024 {
+		if err := r.db.PruneGroupEvents(context.TODO(), seq-eventLogRetention); err != nil {
+			log.Errorw("pruning group event log", "error", err)
+		}
+	}
+
+	r.subLk.Lock()
+	defer r.subLk.Unlock()
+
+	for _, sub := range r.subs {
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// sendStateChange sends a state change event, transitions which don't change
+// the state aren't recorded
+func (r *rbs) sendStateChange(group iface.GroupKey, from, to iface.GroupState) {
+	if from == to {
+		return
+	}
+
+	r.sendEvent(iface.GroupEvent{
+		Group: group,
+		Type:  iface.GroupEventStateChange,
+		From:  from,
+		To:    to,
+	})
+}
+
+func (r *rbs) sendFailure(group iface.GroupKey, err error) {
+	r.sendEvent(iface.GroupEvent{
+		Group: group,
+		Type:  iface.GroupEventFailed,
+		Error: err.Error(),
+	})
+}
+
+// reportCorruption sends GroupEventCorrupted, once per group until the group
+// data is reloaded
+func (r *rbs) reportCorruption(group iface.GroupKey, err error) {
+	r.corruptedLk.Lock()
+	_, reported := r.corrupted[group]
+	r.corrupted[group] = struct{}{}
+	r.corruptedLk.Unlock()
+
+	log.Errorw("group data corrupted", "group", group, "error", err)
+
+	if reported {
+		return
+	}
+
+	r.sendEvent(iface.GroupEvent{
+		Group: group,
+		Type:  iface.GroupEventCorrupted,
+		Error: err.Error(),
+	})
+}
+
+func (r *rbs) clearCorruption(group iface.GroupKey) {
+	r.corruptedLk.Lock()
+	defer r.corruptedLk.Unlock()
+
+	delete(r.corrupted, group)
+}
+
+func (r *rbs) SubscribeEvents(ctx context.Context, since int64, filter iface.GroupEventFilter) (<-chan iface.GroupEvent, error) {
+	if since == iface.GroupEventSeqLatest {
+		// events sent before subscribing aren't new
+		r.flushEvents()
+
+		var err error
+		since, err = r.db.LatestGroupEventSeq(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("getting latest event: %w", err)
+		}
+	}
+
+	sub := &eventSub{
+		notify: make(chan struct{}, 1),
+	}
+
+	r.subLk.Lock()
+	r.subs = append(r.subs, sub)
+	r.subLk.Unlock()
+
+	out := make(chan iface.GroupEvent, eventSubBuffer)
+
+	go func() {
+		defer close(out)
+		defer r.unsubscribe(sub)
+
+		for {
+			evs, err := r.db.GroupEvents(ctx, since, eventPageSize)
+			if err != nil {
+				log.Errorw("reading group event log", "error", err)
+			}
+
+			for _, ev := range evs {
+				since = ev.Seq
+
+				if !filter.Match(ev) {
+					continue
+				}
+
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				case <-r.close:
+					return
+				}
+			}
+
+			if len(evs) == eventPageSize {
+				// more events may be in the log
+				continue
+			}
+
+			var retry <-chan time.Time
+			if err != nil {
+				retry = time.After(time.Second)
+			}
+
+			select {
+			case <-sub.notify:
+			case <-retry:
+			case <-ctx.Done():
+				return
+			case <-r.close:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (r *rbs) EventCursor(ctx context.Context, name string) (int64, error) {
+	return r.db.GroupEventCursor(ctx, name)
+}
+
+func (r *rbs) SetEventCursor(ctx context.Context, name string, seq int64) error {
+	return r.db.SetGroupEventCursor(ctx, name, seq)
+}
+
+func (r *rbs) unsubscribe(sub *eventSub) {
+	r.subLk.Lock()
+	defer r.subLk.Unlock()
+
+	for i, s := range r.subs {
+		if s == sub {
+			r.subs = append(r.subs[:i], r.subs[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package rbstor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func recvEvent(t *testing.T, evs <-chan iface.GroupEvent) iface.GroupEvent {
+	select {
+	case ev, ok := <-evs:
+		require.True(t, ok, "event channel closed")
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	panic("unreachable")
+}
+
+func TestGroupEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	td := t.TempDir()
+
+	ri, err := Open(td)
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+	r := ri.(*rbs)
+
+	r.sendStateChange(1, iface.GroupStateFull, iface.GroupStateVRCARDone)
+
+	// subscribers only see new events with GroupEventSeqLatest
+	live, err := r.SubscribeEvents(ctx, iface.GroupEventSeqLatest, iface.GroupEventFilter{
+		Types: []iface.GroupEventType{iface.GroupEventCommP},
+	})
+	require.NoError(t, err)
+
+	r.sendEvent(iface.GroupEvent{Group: 2, Type: iface.GroupEventFinalized})
+	r.sendEvent(iface.GroupEvent{Group: 1, Type: iface.GroupEventCommP, PieceCID: "baga"})
+
+	ev := recvEvent(t, live)
+	require.Equal(t, iface.GroupKey(1), ev.Group)
+	require.Equal(t, "baga", ev.PieceCID)
+
+	// replay from the start of the log
+	replay, err := r.SubscribeEvents(ctx, 0, iface.GroupEventFilter{
+		Groups: []iface.GroupKey{1},
+	})
+	require.NoError(t, err)
+
+	first := recvEvent(t, replay)
+	require.Equal(t, iface.GroupEventStateChange, first.Type)
+	require.Equal(t, iface.GroupStateFull, first.From)
+	require.Equal(t, iface.GroupStateVRCARDone, first.To)
+
+	require.Equal(t, iface.GroupEventCommP, recvEvent(t, replay).Type)
+
+	// transitions which don't change the state aren't recorded
+	before, err := r.db.LatestGroupEventSeq(ctx)
+	require.NoError(t, err)
+	r.sendStateChange(3, iface.GroupStateWritable, iface.GroupStateWritable)
+	r.flushEvents()
+	after, err := r.db.LatestGroupEventSeq(ctx)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	// events queued before close are written
+	r.sendEvent(iface.GroupEvent{Group: 3, Type: iface.GroupEventReloaded})
+
+	require.NoError(t, ri.Close())
+
+	// subscriptions end when storage is closed
+	require.Eventually(t, func() bool {
+		_, ok := <-live
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// resume after restart from the saved subscriber cursor
+	ri, err = Open(td)
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+	t.Cleanup(func() {
+		require.NoError(t, ri.Close())
+	})
+
+	since, err := ri.Storage().EventCursor(ctx, "test")
+	require.NoError(t, err)
+	require.Equal(t, iface.GroupEventSeqLatest, since)
+
+	require.NoError(t, ri.Storage().SetEventCursor(ctx, "test", first.Seq))
+	since, err = ri.Storage().EventCursor(ctx, "test")
+	require.NoError(t, err)
+	require.Equal(t, first.Seq, since)
+
+	resumed, err := ri.Storage().SubscribeEvents(ctx, since, iface.GroupEventFilter{})
+	require.NoError(t, err)
+
+	ev = recvEvent(t, resumed)
+	require.Equal(t, iface.GroupKey(2), ev.Group)
+	require.Equal(t, iface.GroupEventFinalized, ev.Type)
+	require.Greater(t, ev.Seq, first.Seq)
+
+	require.Equal(t, iface.GroupEventCommP, recvEvent(t, resumed).Type)
+	require.Equal(t, iface.GroupEventReloaded, recvEvent(t, resumed).Type)
+}
+
+func TestGroupOpenedEvent(t *testing.T) {
+	defer func(n int64) { maxGroupBlocks = n }(maxGroupBlocks)
+	maxGroupBlocks = 64
+
+	ctx := context.Background()
+	td := t.TempDir()
+
+	ri, err := Open(td)
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+	r := ri.(*rbs)
+
+	bt := r.Session(ctx).Batch(ctx)
+	require.NoError(t, bt.Put(ctx, randBlocks(t, 80, 1024)))
+	require.NoError(t, bt.Flush(ctx))
+
+	require.Eventually(t, func() bool {
+		gm, err := r.GroupMeta(1)
+		require.NoError(t, err)
+		return gm.State == iface.GroupStateLocalReadyForDeals
+	}, 10*time.Second, 20*time.Millisecond)
+
+	r.flushEvents()
+	since, err := r.db.LatestGroupEventSeq(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, ri.Close())
+
+	// groups which don't change state after a restart are still reported
+	ri, err = Open(td)
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+	t.Cleanup(func() {
+		require.NoError(t, ri.Close())
+	})
+
+	evs, err := ri.Storage().SubscribeEvents(ctx, since, iface.GroupEventFilter{
+		Groups: []iface.GroupKey{1},
+	})
+	require.NoError(t, err)
+
+	ev := recvEvent(t, evs)
+	require.Equal(t, iface.GroupEventOpened, ev.Type)
+	require.Equal(t, iface.GroupStateLocalReadyForDeals, ev.To)
+}
+
+func TestGroupEventsRetry(t *testing.T) {
+	defer func(d time.Duration) { eventRetryMin = d }(eventRetryMin)
+	eventRetryMin = 10 * time.Millisecond
+
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	// make writes to the event log fail
+	_, err := r.db.db.Exec(`ALTER TABLE group_events RENAME TO group_events_moved`)
+	require.NoError(t, err)
+
+	r.sendEvent(iface.GroupEvent{Group: 1, Type: iface.GroupEventFinalized})
+
+	time.Sleep(50 * time.Millisecond)
+
+	r.events.lk.Lock()
+	written := r.events.written
+	r.events.lk.Unlock()
+	require.Equal(t, int64(0), written)
+
+	_, err = r.db.db.Exec(`ALTER TABLE group_events_moved RENAME TO group_events`)
+	require.NoError(t, err)
+
+	// failed events are written once the log is writable again
+	r.flushEvents()
+
+	evs, err := r.db.GroupEvents(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, evs, 1)
+	require.Equal(t, iface.GroupEventFinalized, evs[0].Type)
+}
@@ -0,0 +1,270 @@
+package rbstor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	_ "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// ExportPrefetchWindow is the default max number of blocks prefetched ahead of
+// the DAG traversal
+var ExportPrefetchWindow = 256
+
+type exportOptions struct {
+	selector ipld.Node
+	carV2    bool
+	prefetch int
+}
+
+type ExportOption func(*exportOptions)
+
+// WithExportSelector limits the export to blocks matched by an IPLD selector.
+// By default the whole DAG is exported.
+func WithExportSelector(sel ipld.Node) ExportOption {
+	return func(o *exportOptions) {
+		o.selector = sel
+	}
+}
+
+// WithExportCarV2 makes the export write a CARv2 with an index. Writing CARv2
+// to a stream requires knowing the data size upfront, so the DAG is traversed
+// twice.
+func WithExportCarV2(v2 bool) ExportOption {
+	return func(o *exportOptions) {
+		o.carV2 = v2
+	}
+}
+
+// WithExportPrefetch sets the max number of blocks fetched ahead of the
+// traversal, 0 disables prefetching
+func WithExportPrefetch(blocks int) ExportOption {
+	return func(o *exportOptions) {
+		o.prefetch = blocks
+	}
+}
+
+// ExportCar traverses the DAG under root through the session and writes it
+// as a CAR to out. Blocks are read with Session.View, so data in offloaded
+// groups is exported too.
+func ExportCar(ctx context.Context, sess iface.Session, root cid.Cid, out io.Writer, opts ...ExportOption) error {
+	o := exportOptions{
+		selector: selectorparse.CommonSelector_ExploreAllRecursively,
+		prefetch: ExportPrefetchWindow,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	pf := newPrefetcher(sess, o.prefetch)
+
+	ls := cidlink.DefaultLinkSystem()
+	ls.StorageReadOpener = func(lctx linking.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		c := lnk.(cidlink.Link).Cid
+
+		data, err := pf.get(lctx.Ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.NewReader(data), nil
+	}
+
+	if !o.carV2 {
+		if _, err := carv2.TraverseV1(ctx, &ls, root, o.selector, out); err != nil {
+			return xerrors.Errorf("writing carv1: %w", err)
+		}
+		return nil
+	}
+
+	w, err := carv2.NewSelectiveWriter(ctx, &ls, root, o.selector)
+	if err != nil {
+		return xerrors.Errorf("preparing carv2: %w", err)
+	}
+
+	// the first pass only counted data size, start prefetching from scratch
+	pf = newPrefetcher(sess, o.prefetch)
+
+	if _, err := w.WriteTo(out); err != nil {
+		return xerrors.Errorf("writing carv2: %w", err)
+	}
+
+	return nil
+}
+
+// prefetcher reads blocks linked from loaded blocks in the background, so that
+// reads from multiple groups (possibly offloaded) happen in parallel with the
+// sequential traversal
+type prefetcher struct {
+	sess iface.Session
+
+	lk      sync.Mutex
+	pending map[string]*prefetchEntry
+	loaded  map[string]struct{}
+
+	// order of prefetched blocks, oldest first, can contain blocks which were
+	// already consumed
+	order []string
+
+	// window limits the number of prefetched blocks held in memory
+	window int
+}
+
+type prefetchEntry struct {
+	done chan struct{}
+	data []byte
+}
+
+func newPrefetcher(sess iface.Session, window int) *prefetcher {
+	return &prefetcher{
+		sess:    sess,
+		pending: map[string]*prefetchEntry{},
+		loaded:  map[string]struct{}{},
+		window:  window,
+	}
+}
+
+func (p *prefetcher) get(ctx context.Context, c cid.Cid) ([]byte, error) {
+	if data, ok := ributil.InlineData(c); ok {
+		return data, nil
+	}
+
+	p.lk.Lock()
+	e, ok := p.pending[string(c.Hash())]
+	if ok {
+		delete(p.pending, string(c.Hash()))
+	}
+	p.loaded[string(c.Hash())] = struct{}{}
+	p.lk.Unlock()
+
+	var data []byte
+
+	if ok {
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		data = e.data
+	}
+
+	if data == nil {
+		// not prefetched, or prefetch failed
+		err := p.sess.View(ctx, []mh.Multihash{c.Hash()}, func(cidx int, d []byte) {
+			data = make([]byte, len(d))
+			copy(data, d)
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("reading block %s: %w", c, err)
+		}
+		if data == nil {
+			return nil, xerrors.Errorf("block %s not found", c)
+		}
+	}
+
+	p.prefetchLinks(ctx, c, data)
+
+	return data, nil
+}
+
+// evictOldest drops the oldest prefetched block which wasn't consumed, blocks
+// not matched by the selector are never consumed. Must be called with p.lk held.
+func (p *prefetcher) evictOldest() bool {
+	for len(p.order) > 0 {
+		k := p.order[0]
+		p.order = p.order[1:]
+
+		if _, ok := p.pending[k]; ok {
+			delete(p.pending, k)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *prefetcher) prefetchLinks(ctx context.Context, c cid.Cid, data []byte) {
+	if p.window == 0 {
+		return
+	}
+
+	var toFetch []mh.Multihash
+	var entries []*prefetchEntry
+
+	p.lk.Lock()
+	_ = ributil.BlockLinks(c, data, func(l cid.Cid) {
+		if _, ok := ributil.InlineData(l); ok {
+			return
+		}
+		if _, ok := p.pending[string(l.Hash())]; ok {
+			return
+		}
+		if _, ok := p.loaded[string(l.Hash())]; ok {
+			// the traversal visits blocks only once
+			return
+		}
+
+		if len(entries) >= p.window {
+			// links of this block fill the window
+			return
+		}
+		if len(p.pending) >= p.window && !p.evictOldest() {
+			return
+		}
+
+		e := &prefetchEntry{done: make(chan struct{})}
+		p.pending[string(l.Hash())] = e
+		p.order = append(p.order, string(l.Hash()))
+
+		toFetch = append(toFetch, l.Hash())
+		entries = append(entries, e)
+	})
+
+	// drop consumed blocks from the order
+	if len(p.order) > 2*p.window {
+		order := make([]string, 0, len(p.pending))
+		for _, k := range p.order {
+			if _, ok := p.pending[k]; ok {
+				order = append(order, k)
+			}
+		}
+		p.order = order
+	}
+	p.lk.Unlock()
+
+	if len(toFetch) == 0 {
+		return
+	}
+
+	go func() {
+		defer func() {
+			for _, e := range entries {
+				close(e.done)
+			}
+		}()
+
+		err := p.sess.View(ctx, toFetch, func(cidx int, d []byte) {
+			data := make([]byte, len(d))
+			copy(data, d)
+			entries[cidx].data = data
+		})
+		if err != nil {
+			log.Debugw("export prefetch failed", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,143 @@
+package rbstor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportCar(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+	sess := r.Session(ctx)
+
+	leaves := randBlocks(t, 4, 1024)
+
+	nd := merkledag.NodeWithData(nil)
+	for i, leaf := range leaves[:2] {
+		require.NoError(t, nd.AddRawLink(string(rune('a'+i)), &format.Link{Cid: leaf.Cid()}))
+	}
+	root := cborLinks(t, nd.Cid(), leaves[2].Cid(), leaves[3].Cid())
+
+	dag := append([]blocks.Block{root, nd}, leaves...)
+
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, append(dag, randBlocks(t, 2, 1024)...)))
+	require.NoError(t, bt.Flush(ctx))
+
+	readCar := func(data []byte) []cid.Cid {
+		br, err := carv2.NewBlockReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, []cid.Cid{root.Cid()}, br.Roots)
+
+		var out []cid.Cid
+		for {
+			blk, err := br.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			out = append(out, blk.Cid())
+		}
+		return out
+	}
+
+	var expect []cid.Cid
+	for _, blk := range []blocks.Block{root, nd, leaves[0], leaves[1], leaves[2], leaves[3]} {
+		expect = append(expect, blk.Cid())
+	}
+
+	for _, prefetch := range []int{0, 2, ExportPrefetchWindow} {
+		var buf bytes.Buffer
+		require.NoError(t, ExportCar(ctx, sess, root.Cid(), &buf, WithExportPrefetch(prefetch)))
+		require.Equal(t, expect, readCar(buf.Bytes()))
+	}
+
+	t.Run("carv2", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, ExportCar(ctx, sess, root.Cid(), &buf, WithExportCarV2(true)))
+
+		cr, err := carv2.NewReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), cr.Version)
+
+		st, err := cr.Inspect(true)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(dag)), st.BlockCount)
+
+		require.Equal(t, expect, readCar(buf.Bytes()))
+	})
+
+	t.Run("selector", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, ExportCar(ctx, sess, root.Cid(), &buf, WithExportSelector(selectorparse.CommonSelector_MatchPoint)))
+		require.Equal(t, []cid.Cid{root.Cid()}, readCar(buf.Bytes()))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		var buf bytes.Buffer
+		missing := cborLinks(t, randBlocks(t, 1, 1024)[0].Cid())
+		require.Error(t, ExportCar(ctx, sess, missing.Cid(), &buf))
+	})
+}
+
+func TestExportPrefetchPartialSelector(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+	sess := r.Session(ctx)
+
+	leaves := randBlocks(t, 3, 1024)
+	skipped := randBlocks(t, 2, 1024)
+
+	wanted := cborLinks(t, leaves[0].Cid(), leaves[1].Cid(), leaves[2].Cid())
+	root := cborLinks(t, skipped[0].Cid(), skipped[1].Cid(), wanted.Cid())
+
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, append(append([]blocks.Block{root, wanted}, leaves...), skipped...)))
+	require.NoError(t, bt.Flush(ctx))
+
+	// only the last link of the root is explored
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	sel := ssb.ExploreIndex(2, ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))).Node()
+
+	var buf bytes.Buffer
+	require.NoError(t, ExportCar(ctx, sess, root.Cid(), &buf, WithExportSelector(sel), WithExportPrefetch(2)))
+
+	br, err := carv2.NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	var got []cid.Cid
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, blk.Cid())
+	}
+	require.Equal(t, []cid.Cid{root.Cid(), wanted.Cid(), leaves[0].Cid(), leaves[1].Cid(), leaves[2].Cid()}, got)
+
+	// blocks skipped by the selector don't hold the window
+	pf := newPrefetcher(sess, 2)
+	_, err = pf.get(ctx, root.Cid())
+	require.NoError(t, err)
+	_, err = pf.get(ctx, wanted.Cid())
+	require.NoError(t, err)
+
+	pf.lk.Lock()
+	defer pf.lk.Unlock()
+	require.Len(t, pf.pending, 2)
+	require.Contains(t, pf.pending, string(leaves[0].Cid().Hash()))
+	require.Contains(t, pf.pending, string(leaves[1].Cid().Hash()))
+}
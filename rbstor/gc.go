@@ -0,0 +1,494 @@
+package rbstor
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// gcViewBatch is the number of blocks read at once in the GC mark phase
+	gcViewBatch = 256
+
+	// gcUnlinkBatch is the number of blocks unlinked at once in the GC sweep phase
+	gcUnlinkBatch = 4096
+)
+
+type gcState struct {
+	lk sync.Mutex
+
+	// running is set while GC runs, only one GC can run at a time
+	running bool
+
+	// written tracks blocks written while GC is running, those are never swept
+	written map[string]struct{}
+}
+
+func (r *rbs) Pins() iface.RBSPins {
+	return r
+}
+
+func (r *rbs) Pin(ctx context.Context, roots []cid.Cid) error {
+	return r.db.AddPins(ctx, roots)
+}
+
+func (r *rbs) Unpin(ctx context.Context, roots []cid.Cid) error {
+	return r.db.RemovePins(ctx, roots)
+}
+
+func (r *rbs) List(ctx context.Context) ([]cid.Cid, error) {
+	return r.db.Pins(ctx)
+}
+
+// gcNoteWrite protects blocks written while GC is running from being swept
+func (r *rbs) gcNoteWrite(c []mh.Multihash) {
+	r.gc.lk.Lock()
+	defer r.gc.lk.Unlock()
+
+	if r.gc.written == nil {
+		return
+	}
+
+	for _, m := range c {
+		r.gc.written[string(m)] = struct{}{}
+	}
+}
+
+// ErrNoPins is returned by GC when no roots are pinned, and
+// iface.WithEmptyPinSet wasn't set
+var ErrNoPins = xerrors.New("no pinned roots")
+
+func (r *rbs) GC(ctx context.Context, opts ...iface.GCOption) (iface.GCStats, error) {
+	var o iface.GCOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	r.gc.lk.Lock()
+	if r.gc.running {
+		r.gc.lk.Unlock()
+		return iface.GCStats{}, xerrors.Errorf("gc already running")
+	}
+	r.gc.running = true
+	r.gc.written = map[string]struct{}{}
+	r.gc.lk.Unlock()
+
+	defer func() {
+		r.gc.lk.Lock()
+		r.gc.running = false
+		r.gc.written = nil
+		r.gc.lk.Unlock()
+	}()
+
+	var stats iface.GCStats
+
+	roots, err := r.db.Pins(ctx)
+	if err != nil {
+		return stats, xerrors.Errorf("listing pins: %w", err)
+	}
+
+	// an empty pin set usually means that pins were never set up, sweeping
+	// would unlink everything
+	if len(roots) == 0 && !o.AllowEmptyPinSet {
+		return stats, xerrors.Errorf("gc: %w", ErrNoPins)
+	}
+
+	marked, err := r.gcMark(ctx, roots)
+	if err != nil {
+		return stats, xerrors.Errorf("gc mark: %w", err)
+	}
+	stats.Marked = int64(len(marked))
+
+	log.Infow("gc mark done", "marked", stats.Marked)
+
+	if err := r.gcSweep(ctx, marked, &stats); err != nil {
+		return stats, xerrors.Errorf("gc sweep: %w", err)
+	}
+
+	log.Infow("gc sweep done", "unlinked", stats.Unlinked, "unlinkedBytes", stats.UnlinkedBytes)
+
+	return stats, nil
+}
+
+// gcMark walks pinned DAGs, and returns the set of reachable multihashes
+func (r *rbs) gcMark(ctx context.Context, roots []cid.Cid) (map[string]struct{}, error) {
+	sess := r.Session(ctx)
+	marked := map[string]struct{}{}
+
+	queue := roots
+	for len(queue) > 0 {
+		var next, toRead []cid.Cid
+
+		for _, c := range queue {
+			if data, ok := ributil.InlineData(c); ok {
+				// inline blocks aren't stored, but can link to stored blocks
+				err := ributil.BlockLinks(c, data, func(l cid.Cid) {
+					next = append(next, l)
+				})
+				if err != nil {
+					return nil, xerrors.Errorf("reading inline links: %w", err)
+				}
+				continue
+			}
+
+			if _, ok := marked[string(c.Hash())]; ok {
+				continue
+			}
+			marked[string(c.Hash())] = struct{}{}
+
+			toRead = append(toRead, c)
+		}
+
+		for len(toRead) > 0 {
+			n := gcViewBatch
+			if n > len(toRead) {
+				n = len(toRead)
+			}
+			batch := toRead[:n]
+			toRead = toRead[n:]
+
+			hashes := make([]mh.Multihash, len(batch))
+			for i, c := range batch {
+				hashes[i] = c.Hash()
+			}
+
+			var lk sync.Mutex
+			var linkErr error
+
+			err := sess.View(ctx, hashes, func(cidx int, data []byte) {
+				lk.Lock()
+				defer lk.Unlock()
+
+				err := ributil.BlockLinks(batch[cidx], data, func(l cid.Cid) {
+					next = append(next, l)
+				})
+				if err != nil && linkErr == nil {
+					linkErr = err
+				}
+			})
+			if err != nil {
+				return nil, xerrors.Errorf("reading blocks: %w", err)
+			}
+			if linkErr != nil {
+				return nil, xerrors.Errorf("reading links: %w", linkErr)
+			}
+		}
+
+		queue = next
+	}
+
+	return marked, nil
+}
+
+func (r *rbs) gcSweep(ctx context.Context, marked map[string]struct{}, stats *iface.GCStats) error {
+	var toUnlink []mh.Multihash
+
+	flush := func() error {
+		if len(toUnlink) == 0 {
+			return nil
+		}
+
+		// filter out blocks written since GC started
+		r.gc.lk.Lock()
+		n := 0
+		for _, m := range toUnlink {
+			if _, ok := r.gc.written[string(m)]; !ok {
+				toUnlink[n] = m
+				n++
+			}
+		}
+		toUnlink = toUnlink[:n]
+
+		// hold gc lock while unlinking so that writes can't race with the unlink
+		defer r.gc.lk.Unlock()
+
+		blocks, bytes, err := r.gcUnlink(ctx, toUnlink)
+		if err != nil {
+			return err
+		}
+
+		stats.Unlinked += blocks
+		stats.UnlinkedBytes += bytes
+		toUnlink = toUnlink[:0]
+		return nil
+	}
+
+	err := r.index.Hashes(ctx, func(m mh.Multihash, size int32, codec uint64) error {
+		if _, ok := marked[string(m)]; ok {
+			return nil
+		}
+
+		toUnlink = append(toUnlink, m)
+		if len(toUnlink) >= gcUnlinkBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("iterating index: %w", err)
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return r.index.Sync(ctx)
+}
+
+// gcUnlink unlinks unreachable blocks from all namespaces referencing them,
+// or storing them in namespace groups, so that namespace quota is released.
+// Blocks left in the default namespace are unlinked last.
+func (r *rbs) gcUnlink(ctx context.Context, c []mh.Multihash) (blocks, bytes int64, err error) {
+	byNs := map[string]map[string]mh.Multihash{}
+	add := func(ns string, m mh.Multihash) {
+		if byNs[ns] == nil {
+			byNs[ns] = map[string]mh.Multihash{}
+		}
+		byNs[ns][string(m)] = m
+	}
+
+	err = r.index.Refs(ctx, c, func(cidx int, ns string, count int64) error {
+		if count > 0 {
+			add(ns, c[cidx])
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("getting namespace refs: %w", err)
+	}
+
+	// blocks written before refs were recorded only have a group
+	err = r.index.GetGroups(ctx, c, func(cidx int, group iface.GroupKey) (bool, error) {
+		if group == iface.UndefGroupKey {
+			return true, nil
+		}
+
+		gns, err := r.groupNamespace(group)
+		if err != nil {
+			return false, err
+		}
+		if gns != "" {
+			add(gns, c[cidx])
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("getting groups: %w", err)
+	}
+
+	namespaces := make([]string, 0, len(byNs))
+	for ns := range byNs {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	for _, ns := range namespaces {
+		nsBlocks := make([]mh.Multihash, 0, len(byNs[ns]))
+		for _, m := range byNs[ns] {
+			nsBlocks = append(nsBlocks, m)
+		}
+
+		b, n, err := r.unlinkNamespace(ctx, ns, nsBlocks)
+		if err != nil {
+			return 0, 0, xerrors.Errorf("unlinking from namespace %q: %w", ns, err)
+		}
+		blocks += b
+		bytes += n
+	}
+
+	b, n, err := r.unlinkNamespace(ctx, "", c)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return blocks + b, bytes + n, nil
+}
+
+// unlinkNamespace drops namespace references to blocks, blocks are unlinked
+// when no references are left. Quota used by blocks stored in namespace
+// groups is released with their last reference. The default namespace
+// unlinks blocks directly.
+func (r *rbs) unlinkNamespace(ctx context.Context, ns string, c []mh.Multihash) (blocks, bytes int64, err error) {
+	if ns == "" {
+		return r.unlink(ctx, c)
+	}
+
+	var released []mh.Multihash
+	err = r.index.RemoveRefs(ctx, ns, c, func(cidx int) error {
+		released = append(released, c[cidx])
+		return nil
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("removing namespace refs: %w", err)
+	}
+
+	// sizes are gone from the index once blocks are unlinked
+	size, err := r.storedSize(ctx, ns, released)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	held, err := r.heldOutside(ctx, ns, released)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(held) > 0 {
+		n := make([]mh.Multihash, 0, len(released)-len(held))
+		for i, m := range released {
+			if _, ok := held[i]; !ok {
+				n = append(n, m)
+			}
+		}
+		released = n
+	}
+
+	blocks, bytes, err = r.unlink(ctx, released)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := r.releaseUsage(ctx, ns, size); err != nil {
+		return 0, 0, xerrors.Errorf("releasing namespace usage: %w", err)
+	}
+
+	return blocks, bytes, nil
+}
+
+// heldOutside finds blocks stored in groups of the default namespace, or
+// of namespaces which didn't unlink them
+func (r *rbs) heldOutside(ctx context.Context, ns string, c []mh.Multihash) (map[int]struct{}, error) {
+	refs := map[int]map[string]int64{}
+	err := r.index.Refs(ctx, c, func(cidx int, rns string, count int64) error {
+		if refs[cidx] == nil {
+			refs[cidx] = map[string]int64{}
+		}
+		refs[cidx][rns] = count
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting namespace refs: %w", err)
+	}
+
+	held := map[int]struct{}{}
+	err = r.index.GetGroups(ctx, c, func(cidx int, group iface.GroupKey) (bool, error) {
+		if group == iface.UndefGroupKey {
+			return true, nil
+		}
+
+		gns, err := r.groupNamespace(group)
+		if err != nil {
+			return false, err
+		}
+		if gns == ns {
+			return true, nil
+		}
+
+		if count, ok := refs[cidx][gns]; gns == "" || !ok || count > 0 {
+			// group namespace doesn't track refs, or still references the block
+			held[cidx] = struct{}{}
+			return false, nil
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("getting groups: %w", err)
+	}
+
+	return held, nil
+}
+
+// unlink removes blocks which aren't referenced by any namespace from the
+// index, and records unlinked data per group
+func (r *rbs) unlink(ctx context.Context, c []mh.Multihash) (blocks, bytes int64, err error) {
+	referenced := map[int]struct{}{}
+	err = r.index.Refs(ctx, c, func(cidx int, ns string, count int64) error {
+		if count > 0 {
+			referenced[cidx] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("getting namespace refs: %w", err)
+	}
+
+	if len(referenced) > 0 {
+		n := make([]mh.Multihash, 0, len(c)-len(referenced))
+		for i, m := range c {
+			if _, ok := referenced[i]; !ok {
+				n = append(n, m)
+			}
+		}
+		c = n
+	}
+
+	if len(c) == 0 {
+		return 0, 0, nil
+	}
+
+	sizes := make([]int32, len(c))
+	err = r.index.GetSizes(ctx, c, func(s []int32) error {
+		copy(sizes, s)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("getting sizes: %w", err)
+	}
+
+	type unlinked struct {
+		blocks, bytes int64
+	}
+	byGroup := map[iface.GroupKey]*unlinked{}
+	seen := map[int]map[iface.GroupKey]struct{}{}
+
+	err = r.index.GetGroups(ctx, c, func(cidx int, group iface.GroupKey) (bool, error) {
+		if group == iface.UndefGroupKey {
+			return true, nil
+		}
+
+		if seen[cidx] == nil {
+			seen[cidx] = map[iface.GroupKey]struct{}{}
+		}
+		if _, ok := seen[cidx][group]; ok {
+			return true, nil
+		}
+		seen[cidx][group] = struct{}{}
+
+		if byGroup[group] == nil {
+			byGroup[group] = &unlinked{}
+		}
+		byGroup[group].blocks++
+		byGroup[group].bytes += int64(sizes[cidx])
+
+		return true, nil
+	})
+	if err != nil {
+		return 0, 0, xerrors.Errorf("getting groups: %w", err)
+	}
+
+	if err := r.index.Remove(ctx, c); err != nil {
+		return 0, 0, xerrors.Errorf("removing from index: %w", err)
+	}
+
+	for g, u := range byGroup {
+		if err := r.db.AddUnlinked(ctx, g, u.blocks, u.bytes); err != nil {
+			return 0, 0, xerrors.Errorf("recording unlinked data: %w", err)
+		}
+	}
+
+	for i := range c {
+		if sizes[i] >= 0 {
+			blocks++
+			bytes += int64(sizes[i])
+		}
+	}
+
+	return blocks, bytes, nil
+}
@@ -0,0 +1,198 @@
+package rbstor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	iface "github.com/lotus-web3/ribs"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	leaves := randBlocks(t, 4, 1024)
+	garbage := randBlocks(t, 3, 1024)
+
+	nd := merkledag.NodeWithData(nil)
+	for i, leaf := range leaves[:2] {
+		require.NoError(t, nd.AddRawLink(string(rune('a'+i)), &format.Link{Cid: leaf.Cid()}))
+	}
+
+	// dag-cbor node linking to the dag-pb node and remaining leaves
+	cborRoot := cborLinks(t, append([]cid.Cid{nd.Cid()}, leaves[2].Cid(), leaves[3].Cid())...)
+
+	all := append(append([]blocks.Block{nd, cborRoot}, leaves...), garbage...)
+
+	bt := r.Session(ctx).Batch(ctx)
+	require.NoError(t, bt.Put(ctx, all))
+	require.NoError(t, bt.Flush(ctx))
+
+	require.NoError(t, r.Pins().Pin(ctx, []cid.Cid{cborRoot.Cid()}))
+	pins, err := r.Pins().List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{cborRoot.Cid()}, pins)
+
+	st, err := r.Pins().GC(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), st.Marked)
+	require.Equal(t, int64(3), st.Unlinked)
+	require.Equal(t, int64(3*1024), st.UnlinkedBytes)
+
+	has := func(blk blocks.Block) bool {
+		var found bool
+		err := r.Session(ctx).GetSize(ctx, []mh.Multihash{blk.Cid().Hash()}, func(sizes []int32) error {
+			found = sizes[0] != -1
+			return nil
+		})
+		require.NoError(t, err)
+		return found
+	}
+
+	for _, blk := range all[:6] {
+		require.True(t, has(blk))
+	}
+	for _, blk := range garbage {
+		require.False(t, has(blk))
+	}
+
+	gm, err := r.GroupMeta(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), gm.UnlinkedBlocks)
+	require.Equal(t, int64(3*1024), gm.UnlinkedBytes)
+
+	// after unpinning everything is collected
+	require.NoError(t, r.Pins().Unpin(ctx, []cid.Cid{cborRoot.Cid()}))
+	st, err = r.Pins().GC(ctx, iface.WithEmptyPinSet())
+	require.NoError(t, err)
+	require.Equal(t, int64(6), st.Unlinked)
+}
+
+func TestGCNoPins(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	blks := randBlocks(t, 3, 1024)
+
+	bt := r.Session(ctx).Batch(ctx)
+	require.NoError(t, bt.Put(ctx, blks))
+	require.NoError(t, bt.Flush(ctx))
+
+	_, err := r.Pins().GC(ctx)
+	require.ErrorIs(t, err, ErrNoPins)
+
+	err = r.Session(ctx).GetSize(ctx, []mh.Multihash{blks[0].Cid().Hash(), blks[1].Cid().Hash(), blks[2].Cid().Hash()}, func(sizes []int32) error {
+		require.Equal(t, []int32{1024, 1024, 1024}, sizes)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestGCNamespace(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	require.NoError(t, r.SetNamespaceQuota(ctx, "a", 3*1024))
+
+	sessA := r.Session(ctx, iface.WithNamespace("a"))
+	sessB := r.Session(ctx, iface.WithNamespace("b"))
+
+	blks := randBlocks(t, 3, 1024)
+	pinned, shared := blks[0], blks[1]
+
+	bt := sessA.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, blks))
+	require.NoError(t, bt.Flush(ctx))
+
+	bt = sessB.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, []blocks.Block{shared}))
+	require.NoError(t, bt.Flush(ctx))
+
+	require.NoError(t, r.Pins().Pin(ctx, []cid.Cid{pinned.Cid()}))
+
+	st, err := r.Pins().GC(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), st.Unlinked)
+
+	has := func(sess iface.Session, blk blocks.Block) bool {
+		var found bool
+		err := sess.GetSize(ctx, []mh.Multihash{blk.Cid().Hash()}, func(sizes []int32) error {
+			found = sizes[0] != -1
+			return nil
+		})
+		require.NoError(t, err)
+		return found
+	}
+
+	require.True(t, has(sessA, pinned))
+	for _, blk := range blks[1:] {
+		require.False(t, has(sessA, blk))
+		require.False(t, has(sessB, blk))
+	}
+
+	// quota of swept blocks is released
+	bt = sessA.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, randBlocks(t, 2, 1024)))
+	require.NoError(t, bt.Flush(ctx))
+}
+
+func TestBatchUnlink(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+	sess := r.Session(ctx)
+
+	blks := randBlocks(t, 2, 1024)
+
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, blks))
+	require.NoError(t, bt.Flush(ctx))
+
+	// put is preferred over unlink in the same batch
+	bt = sess.Batch(ctx)
+	require.NoError(t, bt.Unlink(ctx, []mh.Multihash{blks[0].Cid().Hash(), blks[1].Cid().Hash()}))
+	require.NoError(t, bt.Put(ctx, blks[1:]))
+	require.NoError(t, bt.Flush(ctx))
+
+	var sizes []int32
+	err := sess.GetSize(ctx, []mh.Multihash{blks[0].Cid().Hash(), blks[1].Cid().Hash()}, func(s []int32) error {
+		sizes = s
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int32{-1, 1024}, sizes)
+
+	found, err := r.FindHashes(ctx, blks[0].Cid().Hash())
+	require.NoError(t, err)
+	require.Empty(t, found)
+}
+
+// cborLinks creates a dag-cbor block containing a list of links
+func cborLinks(t *testing.T, links ...cid.Cid) blocks.Block {
+	// array header
+	data := []byte{0x80 | byte(len(links))}
+	for _, l := range links {
+		lb := append([]byte{0}, l.Bytes()...)
+
+		data = append(data, 0xd8, 42) // tag 42
+		data = append(data, 0x58, byte(len(lb)))
+		data = append(data, lb...)
+	}
+
+	c, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   mh.SHA2_256,
+		MhLength: -1,
+	}.Sum(data)
+	require.NoError(t, err)
+
+	blk, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+	return blk
+}
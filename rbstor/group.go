@@ -13,7 +13,10 @@ import (
 	"github.com/ipfs/go-cid"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/carlog"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
 	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/multierr"
 	"golang.org/x/sync/errgroup"
 
 	"os"
@@ -39,6 +42,13 @@ type Group struct {
 	path string
 	id   int64
 
+	// namespace the group belongs to, set when the group is opened
+	namespace string
+
+	// labels of sessions writing to the group, see labelsKey, set when a
+	// writable group is opened
+	labels string
+
 	// access with dataLk
 	state iface.GroupState
 
@@ -78,7 +88,7 @@ type Group struct {
 
 func OpenGroup(ctx context.Context, db *rbsDB, index iface.Index, staging *atomic.Pointer[iface.StagingStorageProvider],
 	id, committedBlocks, committedSize, recordedHead int64,
-	path string, state iface.GroupState, create bool) (*Group, error) {
+	path string, state iface.GroupState, create bool, jbOpts ...carlog.Option) (*Group, error) {
 	groupPath := filepath.Join(path, "grp", strconv.FormatInt(id, 32))
 
 	if err := os.MkdirAll(groupPath, 0755); err != nil {
@@ -107,7 +117,7 @@ func OpenGroup(ctx context.Context, db *rbsDB, index iface.Index, staging *atomi
 		}
 
 		return index.DropGroup(ctx, h, id)
-	})
+	}, jbOpts...)
 	if err != nil {
 		return nil, xerrors.Errorf("open jbob (grp: %s): %w", groupPath, err)
 	}
@@ -180,9 +190,11 @@ func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
 
 	c := make([]mh.Multihash, len(b))
 	sz := make([]int32, len(b))
+	codecs := make([]uint64, len(b))
 	for i, blk := range b {
 		c[i] = blk.Cid().Hash()
 		sz[i] = int32(len(blk.RawData()))
+		codecs[i] = blk.Cid().Prefix().Codec
 	}
 
 	// parallel data(log) / index write; In case of unclean shutdown we may get
@@ -208,9 +220,9 @@ func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
 	eg.Go(func() error {
 		// 3. write top-level index (before we update group head so replay is possible, before jbob commit so that it's faster)
 		//    missed, uncommitted jbob writes should be ignored.
-		// ^ TODO: Test this commit edge case
+		// ^ exercised by TestCrashConsistency
 		// TODO: Async index queue
-		err := m.index.AddGroup(ctx, c[:writeBlocks], sz[:writeBlocks], m.id)
+		err := m.index.AddGroup(ctx, c[:writeBlocks], sz[:writeBlocks], codecs[:writeBlocks], m.id)
 		if err != nil {
 			// todo handle properly (abort, close, check disk space / resources, repopen)
 			return xerrors.Errorf("writing index: %w", err)
@@ -241,6 +253,14 @@ func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
 	return writeBlocks, nil
 }
 
+// writable returns whether the group still accepts writes
+func (m *Group) writable() bool {
+	m.dataLk.RLock()
+	defer m.dataLk.RUnlock()
+
+	return m.state == iface.GroupStateWritable
+}
+
 func (m *Group) Sync(ctx context.Context) error {
 	m.dataLk.Lock()
 	defer m.dataLk.Unlock()
@@ -313,21 +333,32 @@ func (m *Group) View(ctx context.Context, c []mh.Multihash, cb func(cidx int, fo
 	})
 }
 
-func (m *Group) Close() error {
-	if err := m.Sync(context.Background()); err != nil {
-		return err
+func (m *Group) scrub(ctx context.Context, throttle func(ctx context.Context, n int64) error) (carlog.ScrubStats, error) {
+	m.readers.Add(1)
+	defer m.readers.Done()
+
+	if m.offloaded.Load() != 0 {
+		return carlog.ScrubStats{}, ErrOffloaded
 	}
 
+	return m.jb.Scrub(ctx, throttle)
+}
+
+func (m *Group) Close() error {
+	// close the carlog even if the final sync fails, so that the group can be
+	// reopened and recovered
+	serr := m.Sync(context.Background())
+
 	m.dataLk.Lock()
 	defer m.dataLk.Unlock()
 
 	err := m.jb.Close()
 	// todo mark as closed
-	return err
+	return multierr.Combine(serr, err)
 }
 
 // returns car size and root cid
-func (m *Group) writeCar(w io.Writer) (int64, cid.Cid, error) {
+func (m *Group) writeCar(w io.Writer, opts ...carlog.WriteCarOption) (int64, cid.Cid, error) {
 	m.readers.Add(1)
 	defer m.readers.Done()
 
@@ -336,7 +367,27 @@ func (m *Group) writeCar(w io.Writer) (int64, cid.Cid, error) {
 	}
 
 	// writeCar is thread safe
-	return m.jb.WriteCar(w)
+	return m.jb.WriteCar(w, opts...)
+}
+
+func (m *Group) writeCarRange(w io.Writer, off, size int64) (int64, error) {
+	m.readers.Add(1)
+	defer m.readers.Done()
+
+	if m.offloaded.Load() != 0 {
+		return 0, ErrOffloaded
+	}
+
+	// WriteCarRange is thread safe
+	return m.jb.WriteCarRange(w, off, size)
+}
+
+func (m *Group) carLocations(c []mh.Multihash) ([]carlog.BlockLocation, error) {
+	m.readers.Add(1)
+	defer m.readers.Done()
+
+	// CarLocations is thread safe, and works on offloaded carlogs
+	return m.jb.CarLocations(c)
 }
 
 func (m *Group) hashSample() ([]mh.Multihash, error) {
@@ -344,6 +395,16 @@ func (m *Group) hashSample() ([]mh.Multihash, error) {
 	return m.jb.HashSample()
 }
 
+func (m *Group) samplePoints() (*piecesample.Points, error) {
+	// samplePoints is thread safe
+	return m.jb.SamplePoints()
+}
+
+func (m *Group) pieceTree() (*datasegment.PieceTree, error) {
+	// pieceTree is thread safe
+	return m.jb.PieceTree()
+}
+
 type carStorageWrapper struct {
 	storage iface.StagingStorageProvider
 	group   iface.GroupKey
@@ -7,15 +7,23 @@ import (
 	"time"
 
 	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/ipfs/go-cid"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/carlog"
 	"github.com/lotus-web3/ribs/ributil"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
 	"golang.org/x/xerrors"
 )
 
 var globalCommpBytes atomic.Int64
 
+// maxPieceSize bounds the piece tree built while computing commP, before the
+// piece size is known. It is the largest sector size.
+const maxPieceSize = abi.PaddedPieceSize(64 << 30)
+
 func (m *Group) Finalize(ctx context.Context) error {
 	m.dataLk.Lock()
 	defer m.dataLk.Unlock()
@@ -48,27 +56,65 @@ func (m *Group) GenCommP() error {
 
 	start := time.Now()
 
+	// record blocks at piece sample points while computing commP
+	rec := piecesample.NewRecorder()
+
+	// keep the upper piece tree, so that sample proofs don't need the whole car
+	tb, err := datasegment.NewPieceTreeBuilder(maxPieceSize)
+	if err != nil {
+		return xerrors.Errorf("new piece tree builder: %w", err)
+	}
+
 	commStatWr := &rateStatWriter{
-		w:  cc,
+		w:  io.MultiWriter(cc, rec, tb),
 		st: &globalCommpBytes,
 	}
 	defer commStatWr.done()
 
-	carSize, root, err := m.writeCar(commStatWr)
+	// the canonical car index is built from the same pass
+	carSize, root, err := m.writeCar(commStatWr, carlog.WithCarIndex(true))
 	if err != nil {
 		return xerrors.Errorf("write car: %w", err)
 	}
 
+	points, err := rec.Points()
+	if err != nil {
+		return xerrors.Errorf("recording sample points: %w", err)
+	}
+	if err := m.jb.SaveSamplePoints(points); err != nil {
+		return xerrors.Errorf("saving sample points: %w", err)
+	}
+
 	sum, err := cc.Sum()
 	if err != nil {
 		return xerrors.Errorf("sum car (size: %d): %w", carSize, err)
 	}
 
+	tree, err := tb.TreeOf(sum.PieceSize)
+	if err != nil {
+		return xerrors.Errorf("piece tree: %w", err)
+	}
+	treeCid, err := tree.PieceCID()
+	if err != nil {
+		return xerrors.Errorf("piece tree cid: %w", err)
+	}
+	if treeCid != sum.PieceCID {
+		return xerrors.Errorf("piece tree cid %s doesn't match commP %s", treeCid, sum.PieceCID)
+	}
+	if err := m.jb.SavePieceTree(tree); err != nil {
+		return xerrors.Errorf("saving piece tree: %w", err)
+	}
+
 	log.Infow("generated commP", "duration", time.Since(start), "commP", sum.PieceCID, "pps", sum.PieceSize, "mbps", float64(carSize)/time.Since(start).Seconds()/1024/1024)
 
 	p, _ := commcid.CIDToDataCommitmentV1(sum.PieceCID)
 
-	if err := m.setCommP(context.Background(), iface.GroupStateLocalReadyForDeals, p, int64(sum.PieceSize), root, carSize); err != nil {
+	pieceV2, err := piececid.FromCommP(p, sum.PieceSize, uint64(carSize))
+	if err != nil {
+		return xerrors.Errorf("v2 piece cid: %w", err)
+	}
+
+	if err := m.setCommP(context.Background(), iface.GroupStateLocalReadyForDeals, p, int64(sum.PieceSize), pieceV2, root, carSize); err != nil {
 		return xerrors.Errorf("set commP: %w", err)
 	}
 
@@ -130,14 +176,14 @@ func (m *Group) advanceState(ctx context.Context, st iface.GroupState) error {
 	return m.db.SetGroupState(ctx, m.id, st)
 }
 
-func (m *Group) setCommP(ctx context.Context, state iface.GroupState, commp []byte, paddedPieceSize int64, root cid.Cid, carSize int64) error {
+func (m *Group) setCommP(ctx context.Context, state iface.GroupState, commp []byte, paddedPieceSize int64, pieceV2, root cid.Cid, carSize int64) error {
 	m.dblk.Lock()
 	defer m.dblk.Unlock()
 
 	m.state = state
 
 	// todo enter failed state on error
-	return m.db.SetCommP(ctx, m.id, state, commp, paddedPieceSize, root, carSize)
+	return m.db.SetCommP(ctx, m.id, state, commp, paddedPieceSize, pieceV2, root, carSize)
 }
 
 // offload completely removes local data
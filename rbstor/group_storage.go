@@ -2,25 +2,34 @@ package rbstor
 
 import (
 	"context"
+	"errors"
+	"sort"
 	"time"
 
 	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/carlog"
 	"golang.org/x/xerrors"
 )
 
 const MaxLocalGroupCount = 64 // todo user config
 
-func (r *rbs) createGroup(ctx context.Context) (iface.GroupKey, *Group, error) {
+func (r *rbs) createGroup(ctx context.Context, ns string, labels map[string]string) (iface.GroupKey, *Group, error) {
 	if err := r.ensureSpaceForGroup(ctx); err != nil {
 		return 0, nil, xerrors.Errorf("ensure space for group: %w", err)
 	}
 
-	selectedGroup, err := r.db.CreateGroup()
+	selectedGroup, err := r.db.CreateGroup(ns)
 	if err != nil {
 		return iface.UndefGroupKey, nil, xerrors.Errorf("creating group: %w", err)
 	}
 
-	g, err := r.openGroup(ctx, selectedGroup, 0, 0, 0, iface.GroupStateWritable, true)
+	if len(labels) > 0 {
+		if err := r.db.SetGroupLabels(ctx, selectedGroup, labels); err != nil {
+			return iface.UndefGroupKey, nil, xerrors.Errorf("setting group labels: %w", err)
+		}
+	}
+
+	g, err := r.openGroup(ctx, selectedGroup, ns, 0, 0, 0, iface.GroupStateWritable, true)
 	if err != nil {
 		return iface.UndefGroupKey, nil, xerrors.Errorf("opening group: %w", err)
 	}
@@ -28,13 +37,20 @@ func (r *rbs) createGroup(ctx context.Context) (iface.GroupKey, *Group, error) {
 	return selectedGroup, g, nil
 }
 
-func (r *rbs) openGroup(ctx context.Context, group iface.GroupKey, blocks, bytes, jbhead int64, state iface.GroupState, create bool) (*Group, error) {
-	g, err := OpenGroup(ctx, r.db, r.index, &r.staging, group, blocks, bytes, jbhead, r.root, state, create)
+func (r *rbs) openGroup(ctx context.Context, group iface.GroupKey, ns string, blocks, bytes, jbhead int64, state iface.GroupState, create bool) (*Group, error) {
+	g, err := OpenGroup(ctx, r.db, r.index, &r.staging, group, blocks, bytes, jbhead, r.root, state, create, carlog.WithVerifyReads(r.verifyReads), carlog.WithFS(r.fs))
 	if err != nil {
 		return nil, xerrors.Errorf("opening group: %w", err)
 	}
+	g.namespace = ns
 
 	if state == iface.GroupStateWritable {
+		labels, err := r.db.GroupLabels(ctx, group)
+		if err != nil {
+			return nil, xerrors.Errorf("getting group labels: %w", err)
+		}
+		g.labels = labelsKey(labels)
+
 		r.writableGroups[group] = g
 	}
 	r.openGroups[group] = g
@@ -42,66 +58,104 @@ func (r *rbs) openGroup(ctx context.Context, group iface.GroupKey, blocks, bytes
 	return g, nil
 }
 
-func (r *rbs) withWritableGroup(ctx context.Context, prefer iface.GroupKey, cb func(group *Group) error) (selectedGroup iface.GroupKey, err error) {
+func (r *rbs) withWritableGroup(ctx context.Context, ns string, labels map[string]string, prefer iface.GroupKey, cb func(group *Group) error) (selectedGroup iface.GroupKey, err error) {
 	r.lk.Lock()
-	defer r.lk.Unlock()
+	g, err := r.selectWritableGroup(ctx, ns, labels, prefer)
+	r.lk.Unlock()
+	if err != nil {
+		return iface.UndefGroupKey, err
+	}
 
-	r.writeLk.Lock()
-	defer r.writeLk.Unlock()
+	// writes to different groups can happen in parallel, writes to a single
+	// group are serialized by the group
+	err = cb(g)
 
-	defer func() {
-		if err != nil || selectedGroup == iface.UndefGroupKey {
-			return
-		}
-		// if the group was filled, drop it from writableGroups and start finalize
-		if r.writableGroups[selectedGroup].state != iface.GroupStateWritable {
-			delete(r.writableGroups, selectedGroup)
+	// if the group was filled, drop it from writableGroups and start finalize
+	if !g.writable() {
+		r.lk.Lock()
+		if r.writableGroups[g.id] == g {
+			delete(r.writableGroups, g.id)
+
+			r.sendStateChange(g.id, iface.GroupStateWritable, iface.GroupStateFull)
 
 			r.tasks <- task{
 				tt:    taskTypeFinalize,
-				group: selectedGroup,
+				group: g.id,
 			}
 		}
-	}()
+		r.lk.Unlock()
+	}
 
-	// todo prefer
-	for g, grp := range r.writableGroups {
-		return g, cb(grp)
+	if err != nil {
+		return iface.UndefGroupKey, err
 	}
 
-	// no writable groups, try to open one
+	return g.id, nil
+}
 
-	selectedGroup = iface.UndefGroupKey
-	{
-		var blocks, bytes, jbhead int64
-		var state iface.GroupState
+// selectWritableGroup picks a group in the namespace to write to, must be called with r.lk held.
+// Only groups with the exact same labels are picked, so that sessions with
+// different labels don't share groups.
+func (r *rbs) selectWritableGroup(ctx context.Context, ns string, labels map[string]string, prefer iface.GroupKey) (*Group, error) {
+	lk := labelsKey(labels)
 
-		selectedGroup, blocks, bytes, jbhead, state, err = r.db.GetWritableGroup()
-		if err != nil {
-			return iface.UndefGroupKey, xerrors.Errorf("finding writable groups: %w", err)
+	if g, ok := r.writableGroups[prefer]; ok && g.namespace == ns && g.labels == lk {
+		return g, nil
+	}
+
+	keys := make([]iface.GroupKey, 0, len(r.writableGroups))
+	for k, g := range r.writableGroups {
+		if g.namespace == ns && g.labels == lk {
+			keys = append(keys, k)
 		}
+	}
 
-		if selectedGroup != iface.UndefGroupKey {
-			g, err := r.openGroup(ctx, selectedGroup, blocks, bytes, jbhead, state, false)
-			if err != nil {
-				return iface.UndefGroupKey, xerrors.Errorf("opening group: %w", err)
-			}
+	if len(keys) >= r.maxWritableGroups {
+		// enough writable groups are open, spread new writers across them
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i] < keys[j]
+		})
+
+		r.writableRR++
+		return r.writableGroups[keys[r.writableRR%len(keys)]], nil
+	}
+
+	// not enough writable groups, try to open one
+
+	selectedGroup, blocks, bytes, jbhead, state, err := r.db.GetWritableGroup(ns, labels, func(gk iface.GroupKey) bool {
+		_, open := r.writableGroups[gk]
+		return !open
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("finding writable groups: %w", err)
+	}
 
-			return selectedGroup, cb(g)
+	if selectedGroup != iface.UndefGroupKey {
+		g, err := r.openGroup(ctx, selectedGroup, ns, blocks, bytes, jbhead, state, false)
+		if err != nil {
+			return nil, xerrors.Errorf("opening group: %w", err)
 		}
+
+		return g, nil
 	}
 
 	// no writable groups, create one
 
-	selectedGroup, g, err := r.createGroup(ctx)
+	_, g, err := r.createGroup(ctx, ns, labels)
 	if err != nil {
-		return iface.UndefGroupKey, xerrors.Errorf("creating group: %w", err)
+		return nil, xerrors.Errorf("creating group: %w", err)
 	}
 
-	return selectedGroup, cb(g)
+	return g, nil
 }
 
 func (r *rbs) withReadableGroup(ctx context.Context, group iface.GroupKey, cb func(group *Group) error) (err error) {
+	defer func() {
+		if errors.Is(err, carlog.ErrCorrupted) {
+			r.reportCorruption(group, err)
+		}
+	}()
+
 	r.lk.Lock()
 
 	// todo prefer
@@ -112,13 +166,13 @@ func (r *rbs) withReadableGroup(ctx context.Context, group iface.GroupKey, cb fu
 
 	// not open, open it
 
-	blocks, bytes, jbhead, state, err := r.db.OpenGroup(group)
+	blocks, bytes, jbhead, state, ns, err := r.db.OpenGroup(group)
 	if err != nil {
 		r.lk.Unlock()
 		return xerrors.Errorf("getting group metadata: %w", err)
 	}
 
-	g, err := r.openGroup(ctx, group, blocks, bytes, jbhead, state, false)
+	g, err := r.openGroup(ctx, group, ns, blocks, bytes, jbhead, state, false)
 	if err != nil {
 		r.lk.Unlock()
 		return xerrors.Errorf("opening group: %w", err)
@@ -173,7 +227,12 @@ func (r *rbs) ensureSpaceForGroup(ctx context.Context) error {
 	defer r.lk.Lock()
 
 	return r.withReadableGroup(ctx, offloadCandidate, func(g *Group) error {
-		err := g.offloadStaging()
-		return err
+		if err := g.offloadStaging(); err != nil {
+			r.sendFailure(g.id, xerrors.Errorf("offload to staging: %w", err))
+			return err
+		}
+
+		r.sendEvent(iface.GroupEvent{Group: g.id, Type: iface.GroupEventStagingOffloaded})
+		return nil
 	})
 }
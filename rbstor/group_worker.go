@@ -4,6 +4,7 @@ import (
 	"context"
 
 	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
 )
 
 func (r *rbs) groupWorker(i int) {
@@ -39,10 +40,12 @@ func (r *rbs) workerExecTask(toExec task) {
 		err := g.Finalize(context.TODO())
 		if err != nil {
 			log.Errorw("finalizing group", "error", err, "group", toExec.group)
+			r.sendFailure(toExec.group, xerrors.Errorf("finalize: %w", err))
+		} else {
+			r.sendEvent(iface.GroupEvent{Group: toExec.group, Type: iface.GroupEventFinalized})
+			r.sendStateChange(toExec.group, iface.GroupStateFull, iface.GroupStateVRCARDone)
 		}
 
-		r.sendSub(toExec.group, iface.GroupStateFull, iface.GroupStateVRCARDone)
-
 		log.Debugw("finalize fallthrough to genCommP", "group", toExec.group)
 		fallthrough
 
@@ -61,9 +64,17 @@ func (r *rbs) workerExecTask(toExec task) {
 		err := g.GenCommP() // todo do in finalize...
 		if err != nil {
 			log.Errorw("generating commP", "group", toExec.group, "err", err)
+			r.sendFailure(toExec.group, xerrors.Errorf("generate commP: %w", err))
+			return
 		}
 
-		r.sendSub(toExec.group, iface.GroupStateVRCARDone, iface.GroupStateLocalReadyForDeals)
+		gm, err := r.db.GroupMeta(toExec.group)
+		if err != nil {
+			log.Errorw("getting group meta", "group", toExec.group, "err", err)
+		}
+
+		r.sendEvent(iface.GroupEvent{Group: toExec.group, Type: iface.GroupEventCommP, PieceCID: gm.PieceCID})
+		r.sendStateChange(toExec.group, iface.GroupStateVRCARDone, iface.GroupStateLocalReadyForDeals)
 	case taskTypeFinDataReload:
 		r.workersFinDataReload.Add(1)
 		defer r.workersFinDataReload.Add(-1)
@@ -79,19 +90,15 @@ func (r *rbs) workerExecTask(toExec task) {
 		err := g.FinDataReload(context.TODO())
 		if err != nil {
 			log.Errorw("finishing data reload", "group", toExec.group, "err", err)
+			r.sendFailure(toExec.group, xerrors.Errorf("finish data reload: %w", err))
+			return
 		}
 
-		r.sendSub(toExec.group, iface.GroupStateReload, iface.GroupStateLocalReadyForDeals)
+		r.sendEvent(iface.GroupEvent{Group: toExec.group, Type: iface.GroupEventReloaded})
+		r.sendStateChange(toExec.group, iface.GroupStateReload, iface.GroupStateLocalReadyForDeals)
 	}
 }
 
-func (r *rbs) Subscribe(sub iface.GroupSub) {
-	r.subLk.Lock()
-	defer r.subLk.Unlock()
-
-	r.subs = append(r.subs, sub)
-}
-
 func (r *rbs) resumeGroups(ctx context.Context) {
 	gs, err := r.db.GroupStates()
 	if err != nil {
@@ -121,9 +128,12 @@ func (r *rbs) resumeGroup(group iface.GroupKey) {
 		}()
 	}
 
-	r.sendSub(group, r.openGroups[group].state, r.openGroups[group].state)
+	state := r.openGroups[group].state
 
-	switch r.openGroups[group].state {
+	// state didn't change, but subscribers may have work to resume
+	r.sendEvent(iface.GroupEvent{Group: group, Type: iface.GroupEventOpened, To: state})
+
+	switch state {
 	case iface.GroupStateWritable: // nothing to do
 	case iface.GroupStateFull:
 		sendTask(taskTypeFinalize)
@@ -135,12 +145,3 @@ func (r *rbs) resumeGroup(group iface.GroupKey) {
 		sendTask(taskTypeFinDataReload)
 	}
 }
-
-func (r *rbs) sendSub(group iface.GroupKey, old, new iface.GroupState) {
-	r.subLk.Lock()
-	defer r.subLk.Unlock()
-
-	for _, sub := range r.subs {
-		sub(group, old, new)
-	}
-}
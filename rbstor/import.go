@@ -0,0 +1,264 @@
+package rbstor
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	carv2 "github.com/ipld/go-car/v2"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// ImportBatchBytes is the amount of block data committed to the blockstore at
+// once during CAR import. Progress is reported after each commit.
+var ImportBatchBytes int64 = 32 << 20
+
+type importOptions struct {
+	verify   bool
+	resume   int64
+	progress func(iface.CarImportProgress)
+}
+
+type ImportOption func(*importOptions)
+
+// WithImportVerify makes the import check that block data matches block CIDs
+func WithImportVerify(verify bool) ImportOption {
+	return func(o *importOptions) {
+		o.verify = verify
+	}
+}
+
+// WithImportResume continues an interrupted import from a CAR offset reported
+// in CarImportProgress.Offset. The CAR header is still read from the start of
+// the input; if the input is an io.Seeker, data before the offset is skipped
+// with a seek.
+func WithImportResume(offset int64) ImportOption {
+	return func(o *importOptions) {
+		o.resume = offset
+	}
+}
+
+// WithImportProgress sets a callback called after each committed batch
+func WithImportProgress(cb func(iface.CarImportProgress)) ImportOption {
+	return func(o *importOptions) {
+		o.progress = cb
+	}
+}
+
+// ImportCar streams blocks from a CARv1 or CARv2 file into the blockstore
+// through the session. Blocks which are already stored are skipped.
+func ImportCar(ctx context.Context, sess iface.Session, in io.Reader, opts ...ImportOption) (iface.CarImportProgress, error) {
+	o := importOptions{
+		progress: func(iface.CarImportProgress) {},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cr := &carImportReader{r: in}
+	cr.br = bufio.NewReaderSize(cr, 1<<20)
+
+	var p iface.CarImportProgress
+
+	hdr, err := car.ReadHeader(cr.br)
+	if err != nil {
+		return p, xerrors.Errorf("reading car header: %w", err)
+	}
+
+	dataEnd := int64(-1) // -1 = until EOF
+
+	switch hdr.Version {
+	case 1:
+	case 2:
+		var v2h carv2.Header
+		if _, err := v2h.ReadFrom(cr.br); err != nil {
+			return p, xerrors.Errorf("reading carv2 header: %w", err)
+		}
+
+		if err := cr.skipTo(int64(v2h.DataOffset)); err != nil {
+			return p, xerrors.Errorf("skipping to carv2 data: %w", err)
+		}
+		dataEnd = int64(v2h.DataOffset + v2h.DataSize)
+
+		hdr, err = car.ReadHeader(cr.br)
+		if err != nil {
+			return p, xerrors.Errorf("reading carv2 inner header: %w", err)
+		}
+		if hdr.Version != 1 {
+			return p, xerrors.Errorf("unexpected carv2 inner car version %d", hdr.Version)
+		}
+	default:
+		return p, xerrors.Errorf("unsupported car version %d", hdr.Version)
+	}
+
+	if o.resume > cr.offset() {
+		if dataEnd >= 0 && o.resume > dataEnd {
+			return p, xerrors.Errorf("resume offset %d is past car data end %d", o.resume, dataEnd)
+		}
+		if err := cr.skipTo(o.resume); err != nil {
+			return p, xerrors.Errorf("skipping to resume offset %d: %w", o.resume, err)
+		}
+	}
+	p.Offset = cr.offset()
+
+	bt := sess.Batch(ctx)
+
+	var batch []blocks.Block
+	var batchBytes int64
+
+	commit := func(offset int64) error {
+		if len(batch) > 0 {
+			toPut, err := importFilterExisting(ctx, sess, batch)
+			if err != nil {
+				return xerrors.Errorf("checking existing blocks: %w", err)
+			}
+
+			if err := bt.Put(ctx, toPut); err != nil {
+				return xerrors.Errorf("put blocks: %w", err)
+			}
+			if err := bt.Flush(ctx); err != nil {
+				return xerrors.Errorf("flush blocks: %w", err)
+			}
+
+			p.Blocks += int64(len(toPut))
+			p.Bytes += blocksSize(toPut)
+			p.Skipped += int64(len(batch) - len(toPut))
+		}
+
+		p.Offset = offset
+		o.progress(p)
+
+		batch = batch[:0]
+		batchBytes = 0
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+
+		off := cr.offset()
+		if dataEnd >= 0 && off >= dataEnd {
+			break
+		}
+
+		c, data, err := carutil.ReadNode(cr.br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p, xerrors.Errorf("reading block at offset %d: %w", off, err)
+		}
+
+		if o.verify {
+			vc, err := c.Prefix().Sum(data)
+			if err != nil {
+				return p, xerrors.Errorf("hashing block %s at offset %d: %w", c, off, err)
+			}
+			if !vc.Equals(c) {
+				return p, xerrors.Errorf("block at offset %d doesn't match cid %s (got %s)", off, c, vc)
+			}
+		}
+
+		if _, ok := ributil.InlineData(c); ok {
+			// inline blocks aren't stored
+			continue
+		}
+
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return p, xerrors.Errorf("creating block: %w", err)
+		}
+
+		batch = append(batch, blk)
+		batchBytes += int64(len(data))
+
+		if batchBytes >= ImportBatchBytes {
+			if err := commit(cr.offset()); err != nil {
+				return p, err
+			}
+		}
+	}
+
+	if err := commit(cr.offset()); err != nil {
+		return p, err
+	}
+
+	p.Done = true
+	return p, nil
+}
+
+// importFilterExisting returns blocks which aren't stored yet
+func importFilterExisting(ctx context.Context, sess iface.Session, b []blocks.Block) ([]blocks.Block, error) {
+	hashes := make([]mh.Multihash, len(b))
+	for i, blk := range b {
+		hashes[i] = blk.Cid().Hash()
+	}
+
+	out := make([]blocks.Block, 0, len(b))
+	seen := map[string]struct{}{}
+
+	err := sess.GetSize(ctx, hashes, func(sizes []int32) error {
+		for i, size := range sizes {
+			if size != -1 {
+				continue
+			}
+
+			// cars can contain duplicate blocks
+			if _, ok := seen[string(hashes[i])]; ok {
+				continue
+			}
+			seen[string(hashes[i])] = struct{}{}
+
+			out = append(out, b[i])
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+// carImportReader tracks the offset in the CAR file
+type carImportReader struct {
+	r  io.Reader
+	br *bufio.Reader
+
+	read int64
+}
+
+func (c *carImportReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+// offset returns the offset of the next byte read from br
+func (c *carImportReader) offset() int64 {
+	return c.read - int64(c.br.Buffered())
+}
+
+func (c *carImportReader) skipTo(off int64) error {
+	cur := c.offset()
+	if off < cur {
+		return xerrors.Errorf("can't skip back from offset %d to %d", cur, off)
+	}
+
+	if s, ok := c.r.(io.Seeker); ok && off-cur > int64(c.br.Buffered()) {
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return xerrors.Errorf("seek: %w", err)
+		}
+		c.read = off
+		c.br.Reset(c)
+		return nil
+	}
+
+	_, err := c.br.Discard(int(off - cur))
+	return err
+}
@@ -0,0 +1,110 @@
+package rbstor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportCar(t *testing.T) {
+	ctx := context.Background()
+
+	leaves := randBlocks(t, 16, 1024)
+	var links []cid.Cid
+	for _, leaf := range leaves {
+		links = append(links, leaf.Cid())
+	}
+	root := cborLinks(t, links...)
+	dag := append([]blocks.Block{root}, leaves...)
+
+	// build test cars by exporting from a source blockstore
+	src := openTestRbs(t)
+	bt := src.Session(ctx).Batch(ctx)
+	require.NoError(t, bt.Put(ctx, dag))
+	require.NoError(t, bt.Flush(ctx))
+
+	var carV1, carV2 bytes.Buffer
+	require.NoError(t, ExportCar(ctx, src.Session(ctx), root.Cid(), &carV1))
+	require.NoError(t, ExportCar(ctx, src.Session(ctx), root.Cid(), &carV2, WithExportCarV2(true)))
+
+	hasAll := func(r iface.RBS) bool {
+		hashes := make([]mh.Multihash, len(dag))
+		for i, blk := range dag {
+			hashes[i] = blk.Cid().Hash()
+		}
+
+		var all bool
+		err := r.Session(ctx).GetSize(ctx, hashes, func(sizes []int32) error {
+			all = true
+			for _, s := range sizes {
+				all = all && s != -1
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return all
+	}
+
+	for name, data := range map[string][]byte{"v1": carV1.Bytes(), "v2": carV2.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			r := openTestRbs(t)
+
+			p, err := ImportCar(ctx, r.Session(ctx), bytes.NewReader(data), WithImportVerify(true))
+			require.NoError(t, err)
+			require.True(t, p.Done)
+			require.Equal(t, int64(len(dag)), p.Blocks)
+			require.True(t, hasAll(r))
+
+			// re-import doesn't write anything
+			p, err = ImportCar(ctx, r.Session(ctx), bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, int64(0), p.Blocks)
+			require.Equal(t, int64(len(dag)), p.Skipped)
+		})
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		r := openTestRbs(t)
+
+		defer func(b int64) {
+			ImportBatchBytes = b
+		}(ImportBatchBytes)
+		ImportBatchBytes = 4 << 10
+
+		// interrupt the import after the first committed batch
+		cctx, cancel := context.WithCancel(ctx)
+		var last iface.CarImportProgress
+		_, err := ImportCar(cctx, r.Session(ctx), bytes.NewReader(carV1.Bytes()), WithImportProgress(func(p iface.CarImportProgress) {
+			last = p
+			cancel()
+		}))
+		require.ErrorIs(t, err, context.Canceled)
+		require.Less(t, last.Blocks, int64(len(dag)))
+		require.False(t, hasAll(r))
+
+		// resume from a non-seekable stream
+		p, err := ImportCar(ctx, r.Session(ctx), io.MultiReader(bytes.NewReader(carV1.Bytes())), WithImportResume(last.Offset))
+		require.NoError(t, err)
+		require.Equal(t, int64(len(dag))-last.Blocks, p.Blocks)
+		require.Equal(t, int64(0), p.Skipped)
+		require.Equal(t, int64(carV1.Len()), p.Offset)
+		require.True(t, hasAll(r))
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		r := openTestRbs(t)
+
+		data := bytes.Clone(carV1.Bytes())
+		data[len(data)-1] ^= 0xff
+
+		_, err := ImportCar(ctx, r.Session(ctx), bytes.NewReader(data), WithImportVerify(true))
+		require.ErrorContains(t, err, "doesn't match cid")
+	})
+}
@@ -32,9 +32,49 @@ func (m *MeteredIndex) GetSizes(ctx context.Context, mh []multihash.Multihash, c
 	return m.sub.GetSizes(ctx, mh, cb)
 }
 
-func (m *MeteredIndex) AddGroup(ctx context.Context, mh []multihash.Multihash, sizes []int32, group iface.GroupKey) error {
+func (m *MeteredIndex) AddGroup(ctx context.Context, mh []multihash.Multihash, sizes []int32, codecs []uint64, group iface.GroupKey) error {
 	atomic.AddInt64(&m.writes, int64(len(mh)))
-	return m.sub.AddGroup(ctx, mh, sizes, group)
+	return m.sub.AddGroup(ctx, mh, sizes, codecs, group)
+}
+
+func (m *MeteredIndex) GetCodecs(ctx context.Context, mh []multihash.Multihash, cb func([]uint64) error) error {
+	atomic.AddInt64(&m.reads, int64(len(mh)))
+	return m.sub.GetCodecs(ctx, mh, cb)
+}
+
+func (m *MeteredIndex) AddRefs(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int) error) error {
+	atomic.AddInt64(&m.writes, int64(len(mh)))
+	return m.sub.AddRefs(ctx, ns, mh, cb)
+}
+
+func (m *MeteredIndex) RemoveRefs(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int) error) error {
+	atomic.AddInt64(&m.writes, int64(len(mh)))
+	return m.sub.RemoveRefs(ctx, ns, mh, cb)
+}
+
+func (m *MeteredIndex) RefCounts(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int, count int64, has bool) error) error {
+	atomic.AddInt64(&m.reads, int64(len(mh)))
+	return m.sub.RefCounts(ctx, ns, mh, cb)
+}
+
+func (m *MeteredIndex) Refs(ctx context.Context, mh []multihash.Multihash, cb func(cidx int, ns string, count int64) error) error {
+	atomic.AddInt64(&m.reads, int64(len(mh)))
+	return m.sub.Refs(ctx, mh, cb)
+}
+
+func (m *MeteredIndex) Remove(ctx context.Context, mh []multihash.Multihash) error {
+	atomic.AddInt64(&m.writes, int64(len(mh)))
+	return m.sub.Remove(ctx, mh)
+}
+
+func (m *MeteredIndex) Hashes(ctx context.Context, cb func(mh multihash.Multihash, size int32, codec uint64) error) error {
+	return m.sub.Hashes(ctx, cb)
+}
+
+func (m *MeteredIndex) ListEntries(ctx context.Context, after multihash.Multihash, limit int) ([]iface.IndexEntry, error) {
+	ents, err := m.sub.ListEntries(ctx, after, limit)
+	atomic.AddInt64(&m.reads, int64(len(ents)))
+	return ents, err
 }
 
 func (m *MeteredIndex) Sync(ctx context.Context) error {
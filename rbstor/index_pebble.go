@@ -1,6 +1,7 @@
 package rbstor
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"sync"
@@ -18,8 +19,12 @@ type PebbleIndex struct {
 	/*
 
 		Keys:
-		- 's:[mh bytes]' -> [i32BE size]{[i64BE best groupIdx]}
+		- 's:[mh bytes]' -> [i32BE size]{[i64BE best groupIdx]{[uvarint codec]}}
+		  (groupIdx is -1 when the group was dropped, but the codec is known)
 		- 'i:[mh bytes][i64BE groupIdx]' -> {}
+		- 'r:[mh bytes][namespace]' -> {[u64BE refcount]}
+		  (empty value is a count of 1, zero count marks data unlinked from the namespace)
+		- 'v:' -> [i64BE index version]
 
 	*/
 
@@ -30,6 +35,9 @@ type PebbleIndex struct {
 
 	// todo sharded lock
 	dropLk sync.Mutex
+
+	// refLk guards refcount read-modify-write
+	refLk sync.Mutex
 }
 
 // NewPebbleIndex creates a new Pebble-backed Index.
@@ -40,6 +48,11 @@ func NewPebbleIndex(path string) (*PebbleIndex, error) {
 		return nil, err
 	}
 
+	if err := migratePebbleIndex(db); err != nil {
+		_ = db.Close()
+		return nil, xerrors.Errorf("migrating index: %w", err)
+	}
+
 	return &PebbleIndex{
 		db: db,
 		iterPool: sync.Pool{
@@ -50,6 +63,103 @@ func NewPebbleIndex(path string) (*PebbleIndex, error) {
 	}, nil
 }
 
+// PebbleIndexVersion is the version of the index key layout written by this
+// code. Older indexes are migrated on open, newer indexes are refused.
+const PebbleIndexVersion = 1
+
+var pebbleVersionKey = []byte("v:")
+
+type pebbleMigration struct {
+	Description string
+
+	// Migrate adds changes upgrading the index by one version to the batch,
+	// the batch is committed together with the new version
+	Migrate func(db *pebble.DB, b *pebble.Batch) error
+}
+
+// pebbleMigrations[i] migrates the index from version i to i+1
+var pebbleMigrations = []pebbleMigration{
+	{
+		Description: "Set version on indexes created before index versioning",
+		Migrate: func(db *pebble.DB, b *pebble.Batch) error {
+			// layout of unversioned indexes is the same as version 1
+			return nil
+		},
+	},
+}
+
+func migratePebbleIndex(db *pebble.DB) error {
+	version, err := pebbleIndexVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version > PebbleIndexVersion {
+		return xerrors.Errorf("index version %d is newer than supported version %d", version, PebbleIndexVersion)
+	}
+
+	for ; version < PebbleIndexVersion; version++ {
+		m := pebbleMigrations[version]
+
+		log.Infow("migrating index", "from", version, "to", version+1, "migration", m.Description)
+
+		b := db.NewBatch()
+		if err := m.Migrate(db, b); err != nil {
+			_ = b.Close()
+			return xerrors.Errorf("migrating index from version %d (%s): %w", version, m.Description, err)
+		}
+
+		if err := b.Set(pebbleVersionKey, pebbleVersionVal(version+1), nil); err != nil {
+			_ = b.Close()
+			return xerrors.Errorf("setting index version: %w", err)
+		}
+
+		if err := b.Commit(pebble.Sync); err != nil {
+			return xerrors.Errorf("committing index migration: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// pebbleIndexVersion returns the stored index version. Empty indexes are at
+// the current version, indexes with data but without a version are version 0.
+func pebbleIndexVersion(db *pebble.DB) (int64, error) {
+	val, closer, err := db.Get(pebbleVersionKey)
+	switch {
+	case err == pebble.ErrNotFound:
+		iter := db.NewIter(nil)
+		empty := !iter.First()
+		if err := iter.Close(); err != nil {
+			return 0, xerrors.Errorf("checking for empty index: %w", err)
+		}
+
+		if empty {
+			return PebbleIndexVersion, setPebbleIndexVersion(db, PebbleIndexVersion)
+		}
+		return 0, nil
+	case err != nil:
+		return 0, xerrors.Errorf("get index version: %w", err)
+	}
+
+	defer closer.Close()
+
+	if len(val) != 8 {
+		return 0, xerrors.Errorf("invalid index version value length %d", len(val))
+	}
+	return int64(binary.BigEndian.Uint64(val)), nil
+}
+
+func setPebbleIndexVersion(db *pebble.DB, version int64) error {
+	return db.Set(pebbleVersionKey, pebbleVersionVal(version), pebble.Sync)
+}
+
+func pebbleVersionVal(version int64) []byte {
+	vb := make([]byte, 8)
+	binary.BigEndian.PutUint64(vb, uint64(version))
+	return vb
+}
+
 func (i *PebbleIndex) Sync(ctx context.Context) error {
 	return i.db.Flush()
 }
@@ -66,15 +176,13 @@ func (i *PebbleIndex) GetGroups(ctx context.Context, mh []multihash.Multihash, c
 			return xerrors.Errorf("get(s:) get: %w", err)
 		}
 
-		if len(val) > 4 {
-			//size := binary.BigEndian.Uint32(val[:4])
-			groupIdx := binary.BigEndian.Uint64(val[4:])
-			groupKey := iface.GroupKey(groupIdx)
+		_, groupKey, _ := parseSizeVal(val)
 
-			if err := closer.Close(); err != nil {
-				return xerrors.Errorf("get(s:) close: %w", err)
-			}
+		if err := closer.Close(); err != nil {
+			return xerrors.Errorf("get(s:) close: %w", err)
+		}
 
+		if groupKey != iface.UndefGroupKey {
 			more, err := cb(idx, groupKey)
 			if err != nil {
 				return err
@@ -84,10 +192,6 @@ func (i *PebbleIndex) GetGroups(ctx context.Context, mh []multihash.Multihash, c
 			}
 		}
 
-		if err := closer.Close(); err != nil {
-			return xerrors.Errorf("getsizes close: %w", err)
-		}
-
 		// try to get from iterable list
 
 		keyPrefix := append([]byte("i:"), m...)
@@ -149,13 +253,67 @@ func (i *PebbleIndex) GetSizes(ctx context.Context, mh []multihash.Multihash, cb
 	return cb(sizes)
 }
 
-func (i *PebbleIndex) AddGroup(ctx context.Context, mh []multihash.Multihash, sizes []int32, group iface.GroupKey) error {
+func (i *PebbleIndex) GetCodecs(ctx context.Context, mh []multihash.Multihash, cb func([]uint64) error) error {
+	codecs := make([]uint64, len(mh))
+
+	for id, m := range mh {
+		sizeKey := append([]byte("s:"), m...)
+		val, closer, err := i.db.Get(sizeKey)
+		if err == pebble.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return xerrors.Errorf("getcodecs get: %w", err)
+		}
+
+		_, _, codecs[id] = parseSizeVal(val)
+
+		if err := closer.Close(); err != nil {
+			return xerrors.Errorf("getcodecs close: %w", err)
+		}
+	}
+
+	return cb(codecs)
+}
+
+// sizeVal encodes a 's:' key value
+func sizeVal(size int32, group iface.GroupKey, codec uint64) []byte {
+	if group == iface.UndefGroupKey && codec == 0 {
+		out := make([]byte, 4)
+		binary.BigEndian.PutUint32(out, uint32(size))
+		return out
+	}
+
+	out := make([]byte, 12, 12+binary.MaxVarintLen64)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	binary.BigEndian.PutUint64(out[4:], uint64(group))
+
+	if codec != 0 {
+		out = binary.AppendUvarint(out, codec)
+	}
+	return out
+}
+
+// parseSizeVal decodes a 's:' key value. Group is UndefGroupKey and codec is
+// 0 if the value doesn't contain them.
+func parseSizeVal(val []byte) (size int32, group iface.GroupKey, codec uint64) {
+	size = int32(binary.BigEndian.Uint32(val))
+	group = iface.UndefGroupKey
+
+	if len(val) >= 12 {
+		group = iface.GroupKey(binary.BigEndian.Uint64(val[4:]))
+	}
+	if len(val) > 12 {
+		codec, _ = binary.Uvarint(val[12:])
+	}
+
+	return size, group, codec
+}
+
+func (i *PebbleIndex) AddGroup(ctx context.Context, mh []multihash.Multihash, sizes []int32, codecs []uint64, group iface.GroupKey) error {
 	groupBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(groupBytes, uint64(group))
 
-	sizeBytes := make([]byte, 4+len(groupBytes))
-	copy(sizeBytes[4:], groupBytes)
-
 	batch := i.db.NewBatch()
 	defer batch.Close()
 
@@ -169,10 +327,13 @@ func (i *PebbleIndex) AddGroup(ctx context.Context, mh []multihash.Multihash, si
 		}
 		{
 			// size key
-			binary.BigEndian.PutUint32(sizeBytes, uint32(sizes[i]))
+			var codec uint64
+			if codecs != nil {
+				codec = codecs[i]
+			}
 
 			key := append([]byte("s:"), m...)
-			if err := batch.Set(key, sizeBytes, pebble.NoSync); err != nil {
+			if err := batch.Set(key, sizeVal(sizes[i], group, codec), pebble.NoSync); err != nil {
 				return xerrors.Errorf("addgroup set (sk): %w", err)
 			}
 		}
@@ -185,6 +346,149 @@ func (i *PebbleIndex) AddGroup(ctx context.Context, mh []multihash.Multihash, si
 	return nil
 }
 
+func refKey(ns string, m multihash.Multihash) []byte {
+	return append(append([]byte("r:"), m...), ns...)
+}
+
+func parseRefVal(val []byte) int64 {
+	if len(val) < 8 {
+		// refs written before refcounting
+		return 1
+	}
+	return int64(binary.BigEndian.Uint64(val))
+}
+
+func refVal(count int64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, uint64(count))
+	return out
+}
+
+// getRef returns the refcount of a ref key, has is false when the key doesn't exist
+func (i *PebbleIndex) getRef(key []byte) (count int64, has bool, err error) {
+	val, closer, err := i.db.Get(key)
+	switch err {
+	case nil:
+	case pebble.ErrNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, xerrors.Errorf("get(r:) get: %w", err)
+	}
+
+	count = parseRefVal(val)
+	if err := closer.Close(); err != nil {
+		return 0, false, xerrors.Errorf("get(r:) close: %w", err)
+	}
+	return count, true, nil
+}
+
+// setRefs sets namespace refs to held or dropped. cb is called once for each
+// multihash whose ref changed, refs missing when dropped count as held, as
+// they belong to data written before refs were recorded.
+func (i *PebbleIndex) setRefs(ns string, mh []multihash.Multihash, held bool, cb func(cidx int) error) error {
+	i.refLk.Lock()
+	defer i.refLk.Unlock()
+
+	batch := i.db.NewBatch()
+	defer batch.Close()
+
+	var count int64
+	if held {
+		count = 1
+	}
+
+	seen := map[string]struct{}{}
+	for idx, m := range mh {
+		key := refKey(ns, m)
+		if _, ok := seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+
+		prev, has, err := i.getRef(key)
+		if err != nil {
+			return err
+		}
+
+		changed := (prev > 0) != held
+		if !has {
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+
+		if err := batch.Set(key, refVal(count), pebble.NoSync); err != nil {
+			return xerrors.Errorf("setrefs set: %w", err)
+		}
+
+		if cb != nil {
+			if err := cb(idx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return xerrors.Errorf("setrefs commit: %w", err)
+	}
+
+	return nil
+}
+
+func (i *PebbleIndex) AddRefs(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int) error) error {
+	return i.setRefs(ns, mh, true, cb)
+}
+
+func (i *PebbleIndex) RemoveRefs(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int) error) error {
+	return i.setRefs(ns, mh, false, cb)
+}
+
+func (i *PebbleIndex) RefCounts(ctx context.Context, ns string, mh []multihash.Multihash, cb func(cidx int, count int64, has bool) error) error {
+	for idx, m := range mh {
+		count, has, err := i.getRef(refKey(ns, m))
+		if err != nil {
+			return err
+		}
+
+		if err := cb(idx, count, has); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *PebbleIndex) Refs(ctx context.Context, mh []multihash.Multihash, cb func(cidx int, ns string, count int64) error) error {
+	for idx, m := range mh {
+		prefix := append([]byte("r:"), m...)
+
+		iter := i.db.NewIter(&pebble.IterOptions{
+			LowerBound: prefix,
+			UpperBound: prefixEnd(prefix),
+		})
+
+		for iter.First(); iter.Valid(); iter.Next() {
+			ns := string(iter.Key()[len(prefix):])
+			if err := cb(idx, ns, parseRefVal(iter.Value())); err != nil {
+				_ = iter.Close()
+				return err
+			}
+		}
+
+		if err := iter.Error(); err != nil {
+			_ = iter.Close()
+			return xerrors.Errorf("iter error: %w", err)
+		}
+
+		if err := iter.Close(); err != nil {
+			return xerrors.Errorf("closing iterator: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (i *PebbleIndex) DropGroup(ctx context.Context, mh []multihash.Multihash, group iface.GroupKey) error {
 	i.dropLk.Lock()
 	defer i.dropLk.Unlock()
@@ -218,18 +522,10 @@ func (i *PebbleIndex) DropGroup(ctx context.Context, mh []multihash.Multihash, g
 			return xerrors.Errorf("get(s:) get: %w", err)
 		}
 
-		if len(val) > 4 {
-			//size := binary.BigEndian.Uint32(val[:4])
-			groupIdx := binary.BigEndian.Uint64(val[4:])
-			groupKey := iface.GroupKey(groupIdx)
-
-			if groupKey == group {
-				newSizeVal := make([]byte, 4)
-				copy(newSizeVal, val[:4])
-
-				if err := batch.Set(sizeKey, newSizeVal, pebble.NoSync); err != nil {
-					return xerrors.Errorf("dropgroup set (sk): %w", err)
-				}
+		size, groupKey, codec := parseSizeVal(val)
+		if groupKey == group {
+			if err := batch.Set(sizeKey, sizeVal(size, iface.UndefGroupKey, codec), pebble.NoSync); err != nil {
+				return xerrors.Errorf("dropgroup set (sk): %w", err)
 			}
 		}
 
@@ -247,6 +543,118 @@ func (i *PebbleIndex) DropGroup(ctx context.Context, mh []multihash.Multihash, g
 	return nil
 }
 
+// prefixEnd returns the smallest key greater than all keys with the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (i *PebbleIndex) Remove(ctx context.Context, mh []multihash.Multihash) error {
+	i.dropLk.Lock()
+	defer i.dropLk.Unlock()
+
+	batch := i.db.NewBatch()
+	defer batch.Close()
+
+	for _, m := range mh {
+		if err := batch.Delete(append([]byte("s:"), m...), pebble.NoSync); err != nil {
+			return xerrors.Errorf("remove delete (sk): %w", err)
+		}
+
+		for _, prefix := range [][]byte{append([]byte("i:"), m...), append([]byte("r:"), m...)} {
+			if err := batch.DeleteRange(prefix, prefixEnd(prefix), pebble.NoSync); err != nil {
+				return xerrors.Errorf("remove delete range: %w", err)
+			}
+		}
+	}
+
+	if err := batch.Commit(pebble.NoSync); err != nil {
+		return xerrors.Errorf("remove commit: %w", err)
+	}
+
+	return nil
+}
+
+func (i *PebbleIndex) Hashes(ctx context.Context, cb func(mh multihash.Multihash, size int32, codec uint64) error) error {
+	prefix := []byte("s:")
+
+	iter := i.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			_ = iter.Close()
+			return err
+		}
+
+		key := iter.Key()
+		m := make(multihash.Multihash, len(key)-len(prefix))
+		copy(m, key[len(prefix):])
+
+		size, _, codec := parseSizeVal(iter.Value())
+		if err := cb(m, size, codec); err != nil {
+			_ = iter.Close()
+			return err
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		_ = iter.Close()
+		return xerrors.Errorf("iter error: %w", err)
+	}
+
+	return iter.Close()
+}
+
+func (i *PebbleIndex) ListEntries(ctx context.Context, after multihash.Multihash, limit int) ([]iface.IndexEntry, error) {
+	prefix := []byte("s:")
+
+	iter := i.db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+
+	start := append(append([]byte{}, prefix...), after...)
+
+	var out []iface.IndexEntry
+	for iter.SeekGE(start); iter.Valid() && len(out) < limit; iter.Next() {
+		if err := ctx.Err(); err != nil {
+			_ = iter.Close()
+			return nil, err
+		}
+
+		key := iter.Key()
+		if len(after) > 0 && bytes.Equal(key, start) {
+			continue
+		}
+
+		m := make(multihash.Multihash, len(key)-len(prefix))
+		copy(m, key[len(prefix):])
+
+		size, _, codec := parseSizeVal(iter.Value())
+		out = append(out, iface.IndexEntry{
+			Hash:  m,
+			Size:  size,
+			Codec: codec,
+		})
+	}
+
+	if err := iter.Error(); err != nil {
+		_ = iter.Close()
+		return nil, xerrors.Errorf("iter error: %w", err)
+	}
+
+	return out, iter.Close()
+}
+
 const averageEntrySize = 35 + 8 // multihash is ~35 bytes, groupkey is 8 bytes
 
 func (i *PebbleIndex) EstimateSize(ctx context.Context) (int64, error) {
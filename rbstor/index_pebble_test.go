@@ -7,6 +7,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/cockroachdb/pebble"
+	"github.com/ipfs/go-cid"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
@@ -22,7 +24,7 @@ func TestPebbleIndex(t *testing.T) {
 	mhs, sizes := genMhashList(t, 10)
 	testGroup := iface.GroupKey(2)
 
-	err = idx.AddGroup(context.Background(), mhs, sizes, testGroup)
+	err = idx.AddGroup(context.Background(), mhs, sizes, nil, testGroup)
 	require.NoError(t, err)
 
 	result := map[int][]iface.GroupKey{}
@@ -49,6 +51,58 @@ func TestPebbleIndex(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestPebbleIndexCodecs(t *testing.T) {
+	ctx := context.Background()
+
+	idx, err := NewPebbleIndex(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, idx.Close())
+	})
+
+	mhs, sizes := genMhashList(t, 4)
+	codecs := []uint64{cid.Raw, cid.DagCBOR, 0, 0xf104}
+	group := iface.GroupKey(2)
+
+	require.NoError(t, idx.AddGroup(ctx, mhs, sizes, codecs, group))
+
+	getCodecs := func() []uint64 {
+		var out []uint64
+		require.NoError(t, idx.GetCodecs(ctx, mhs, func(c []uint64) error {
+			out = c
+			return nil
+		}))
+		return out
+	}
+
+	require.Equal(t, codecs, getCodecs())
+
+	hashCodecs := map[string]uint64{}
+	require.NoError(t, idx.Hashes(ctx, func(mh multihash.Multihash, size int32, codec uint64) error {
+		hashCodecs[string(mh)] = codec
+		return nil
+	}))
+	for i, mh := range mhs {
+		require.Equal(t, codecs[i], hashCodecs[string(mh)])
+	}
+
+	// codecs are kept when the group is dropped
+	require.NoError(t, idx.DropGroup(ctx, mhs, group))
+	require.Equal(t, codecs, getCodecs())
+
+	require.NoError(t, idx.GetGroups(ctx, mhs, func(cidx int, gk iface.GroupKey) (bool, error) {
+		t.Fatalf("unexpected group %d for %d", gk, cidx)
+		return true, nil
+	}))
+
+	var gotSizes []int32
+	require.NoError(t, idx.GetSizes(ctx, mhs, func(s []int32) error {
+		gotSizes = s
+		return nil
+	}))
+	require.Equal(t, sizes, gotSizes)
+}
+
 func TestMultipleGroupsPerHash(t *testing.T) {
 	idx, err := NewPebbleIndex(t.TempDir())
 	require.NoError(t, err)
@@ -60,10 +114,10 @@ func TestMultipleGroupsPerHash(t *testing.T) {
 	group1 := iface.GroupKey(2)
 	group2 := iface.GroupKey(3)
 
-	err = idx.AddGroup(context.Background(), mhs, sizes, group1)
+	err = idx.AddGroup(context.Background(), mhs, sizes, nil, group1)
 	require.NoError(t, err)
 
-	err = idx.AddGroup(context.Background(), mhs, sizes, group2)
+	err = idx.AddGroup(context.Background(), mhs, sizes, nil, group2)
 	require.NoError(t, err)
 
 	result := map[int][]iface.GroupKey{}
@@ -132,7 +186,7 @@ func BenchmarkAddGet16k(b *testing.B) {
 		group := iface.GroupKey(n)
 		b.StartTimer()
 
-		err = idx.AddGroup(context.Background(), mhs, sizes, group)
+		err = idx.AddGroup(context.Background(), mhs, sizes, nil, group)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -172,7 +226,7 @@ func BenchmarkGetSingleHash100k(b *testing.B) {
 	mhs, sizes := genMhashList(b, 1_000_000)
 	for i, mh := range mhs {
 		group := iface.GroupKey(i)
-		err = idx.AddGroup(context.Background(), []multihash.Multihash{mh}, []int32{sizes[i]}, group)
+		err = idx.AddGroup(context.Background(), []multihash.Multihash{mh}, []int32{sizes[i]}, nil, group)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -217,9 +271,173 @@ func BenchmarkAddSingleHash100k(b *testing.B) {
 		group := iface.GroupKey(100_000 + n) // Use new groups for each AddGroup call
 		b.StartTimer()
 
-		err = idx.AddGroup(context.Background(), []multihash.Multihash{mhs[hashIndex]}, []int32{sizes[hashIndex]}, group)
+		err = idx.AddGroup(context.Background(), []multihash.Multihash{mhs[hashIndex]}, []int32{sizes[hashIndex]}, nil, group)
 		if err != nil {
 			b.Fatal(err)
 		}
 	}
 }
+
+func TestPebbleIndexListEntries(t *testing.T) {
+	ctx := context.Background()
+
+	idx, err := NewPebbleIndex(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, idx.Close())
+	})
+
+	mhs, sizes := genMhashList(t, 25)
+	require.NoError(t, idx.AddGroup(ctx, mhs, sizes, nil, 1))
+
+	seen := map[string]int32{}
+	var after multihash.Multihash
+	for {
+		ents, err := idx.ListEntries(ctx, after, 10)
+		require.NoError(t, err)
+
+		for _, ent := range ents {
+			_, dup := seen[string(ent.Hash)]
+			require.False(t, dup)
+			seen[string(ent.Hash)] = ent.Size
+		}
+
+		if len(ents) < 10 {
+			break
+		}
+		after = ents[len(ents)-1].Hash
+	}
+
+	require.Len(t, seen, len(mhs))
+	for i, mh := range mhs {
+		require.Equal(t, sizes[i], seen[string(mh)])
+	}
+}
+
+func TestPebbleIndexVersion(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	version := func() int64 {
+		db, err := pebble.Open(dir, &pebble.Options{})
+		require.NoError(t, err)
+		defer db.Close()
+
+		v, err := pebbleIndexVersion(db)
+		require.NoError(t, err)
+		return v
+	}
+
+	idx, err := NewPebbleIndex(dir)
+	require.NoError(t, err)
+
+	mhs, sizes := genMhashList(t, 10)
+	require.NoError(t, idx.AddGroup(ctx, mhs, sizes, nil, 1))
+	require.NoError(t, idx.Close())
+	require.Equal(t, int64(PebbleIndexVersion), version())
+
+	// indexes created before versioning are migrated
+	db, err := pebble.Open(dir, &pebble.Options{})
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(pebbleVersionKey, pebble.Sync))
+	require.NoError(t, db.Close())
+	require.Equal(t, int64(0), version())
+
+	idx, err = NewPebbleIndex(dir)
+	require.NoError(t, err)
+	require.NoError(t, idx.GetSizes(ctx, mhs, func(s []int32) error {
+		require.Equal(t, sizes, s)
+		return nil
+	}))
+	require.NoError(t, idx.Close())
+	require.Equal(t, int64(PebbleIndexVersion), version())
+
+	// newer indexes are refused
+	db, err = pebble.Open(dir, &pebble.Options{})
+	require.NoError(t, err)
+	require.NoError(t, setPebbleIndexVersion(db, PebbleIndexVersion+1))
+	require.NoError(t, db.Close())
+
+	_, err = NewPebbleIndex(dir)
+	require.ErrorContains(t, err, "newer than supported")
+}
+
+func TestPebbleIndexRefs(t *testing.T) {
+	ctx := context.Background()
+
+	idx, err := NewPebbleIndex(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, idx.Close())
+	})
+
+	mhs, _ := genMhashList(t, 2)
+
+	// legacy refs without a count are a single reference
+	require.NoError(t, idx.db.Set(refKey("b", mhs[0]), nil, pebble.Sync))
+
+	// refs record membership, adding a held ref again is a no-op
+	var added []int
+	addRefs := func(m ...multihash.Multihash) {
+		added = nil
+		require.NoError(t, idx.AddRefs(ctx, "a", m, func(cidx int) error {
+			added = append(added, cidx)
+			return nil
+		}))
+	}
+
+	addRefs(mhs[0], mhs[0], mhs[1])
+	require.Equal(t, []int{0, 2}, added)
+	addRefs(mhs[0])
+	require.Empty(t, added)
+
+	counts := func(ns string) ([]int64, []bool) {
+		c, h := make([]int64, len(mhs)), make([]bool, len(mhs))
+		err := idx.RefCounts(ctx, ns, mhs, func(cidx int, count int64, has bool) error {
+			c[cidx], h[cidx] = count, has
+			return nil
+		})
+		require.NoError(t, err)
+		return c, h
+	}
+
+	c, h := counts("a")
+	require.Equal(t, []int64{1, 1}, c)
+	require.Equal(t, []bool{true, true}, h)
+
+	var dropped []int
+	err = idx.RemoveRefs(ctx, "a", []multihash.Multihash{mhs[1], mhs[1]}, func(cidx int) error {
+		dropped = append(dropped, cidx)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, dropped)
+
+	// dropped refs are kept with a zero count
+	c, h = counts("a")
+	require.Equal(t, []int64{1, 0}, c)
+	require.Equal(t, []bool{true, true}, h)
+
+	// missing refs belong to data written before refs were recorded
+	dropped = nil
+	err = idx.RemoveRefs(ctx, "c", mhs[:1], func(cidx int) error {
+		dropped = append(dropped, cidx)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, dropped)
+
+	addRefs(mhs[1])
+	require.Equal(t, []int{0}, added)
+
+	refs := map[string]int64{}
+	require.NoError(t, idx.Refs(ctx, mhs[:1], func(cidx int, ns string, count int64) error {
+		refs[ns] = count
+		return nil
+	}))
+	require.Equal(t, map[string]int64{"a": 1, "b": 1, "c": 0}, refs)
+
+	require.NoError(t, idx.Remove(ctx, mhs))
+	_, h = counts("a")
+	require.Equal(t, []bool{false, false}, h)
+}
@@ -0,0 +1,229 @@
+package rbstor
+
+import (
+	"context"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	iface "github.com/lotus-web3/ribs"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+var ErrQuotaExceeded = fmt.Errorf("namespace quota exceeded")
+
+type nsUsage struct {
+	quota int64 // 0 = no limit
+
+	// used includes data written to groups but not yet flushed
+	used int64
+}
+
+// groupNamespace returns the namespace of a group, thread safe
+func (r *rbs) groupNamespace(group iface.GroupKey) (string, error) {
+	r.nsLk.Lock()
+	defer r.nsLk.Unlock()
+
+	if ns, ok := r.groupNs[group]; ok {
+		return ns, nil
+	}
+
+	ns, err := r.db.GroupNamespace(group)
+	if err != nil {
+		return "", err
+	}
+
+	// group namespace never changes
+	r.groupNs[group] = ns
+	return ns, nil
+}
+
+// usage must be called with nsLk held
+func (r *rbs) usage(ns string) (*nsUsage, error) {
+	if u, ok := r.nsUsage[ns]; ok {
+		return u, nil
+	}
+
+	quota, used, err := r.db.NamespaceUsage(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &nsUsage{
+		quota: quota,
+		used:  used,
+	}
+	r.nsUsage[ns] = u
+	return u, nil
+}
+
+func (r *rbs) reserveQuota(ns string, size int64) error {
+	r.nsLk.Lock()
+	defer r.nsLk.Unlock()
+
+	u, err := r.usage(ns)
+	if err != nil {
+		return xerrors.Errorf("getting namespace usage: %w", err)
+	}
+
+	if u.quota > 0 && u.used+size > u.quota {
+		return xerrors.Errorf("namespace %q: writing %d bytes, %d of %d used: %w", ns, size, u.used, u.quota, ErrQuotaExceeded)
+	}
+
+	u.used += size
+	return nil
+}
+
+func (r *rbs) releaseQuota(ns string, size int64) {
+	if size == 0 {
+		return
+	}
+
+	r.nsLk.Lock()
+	defer r.nsLk.Unlock()
+
+	if u, ok := r.nsUsage[ns]; ok {
+		u.used -= size
+	}
+}
+
+// releaseUsage gives back quota used by data unlinked from the namespace
+func (r *rbs) releaseUsage(ctx context.Context, ns string, size int64) error {
+	if size == 0 {
+		return nil
+	}
+
+	r.nsLk.Lock()
+	defer r.nsLk.Unlock()
+
+	if err := r.db.AddNamespaceReleased(ctx, ns, size); err != nil {
+		return err
+	}
+
+	if u, ok := r.nsUsage[ns]; ok {
+		u.used -= size
+	}
+	return nil
+}
+
+// storedSize returns the size of blocks stored in groups of the namespace
+func (r *rbs) storedSize(ctx context.Context, ns string, c []mh.Multihash) (int64, error) {
+	if len(c) == 0 {
+		return 0, nil
+	}
+
+	stored := make([]bool, len(c))
+	err := r.index.GetGroups(ctx, c, func(cidx int, group iface.GroupKey) (bool, error) {
+		if group == iface.UndefGroupKey {
+			return true, nil
+		}
+
+		gns, err := r.groupNamespace(group)
+		if err != nil {
+			return false, err
+		}
+		if gns == ns {
+			stored[cidx] = true
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, xerrors.Errorf("getting groups: %w", err)
+	}
+
+	var size int64
+	err = r.index.GetSizes(ctx, c, func(sizes []int32) error {
+		for i, s := range sizes {
+			if stored[i] && s > 0 {
+				size += int64(s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, xerrors.Errorf("getting sizes: %w", err)
+	}
+
+	return size, nil
+}
+
+func (r *rbs) SetNamespaceQuota(ctx context.Context, ns string, maxBytes int64) error {
+	r.nsLk.Lock()
+	defer r.nsLk.Unlock()
+
+	if err := r.db.SetNamespaceQuota(ctx, ns, maxBytes); err != nil {
+		return err
+	}
+
+	if u, ok := r.nsUsage[ns]; ok {
+		u.quota = maxBytes
+	}
+
+	return nil
+}
+
+// dedup filters out blocks which are already stored in any namespace, those
+// only need a namespace reference
+func (r *ribSession) dedup(ctx context.Context, b []blocks.Block) ([]blocks.Block, error) {
+	hashes := make([]mh.Multihash, len(b))
+	for i, blk := range b {
+		hashes[i] = blk.Cid().Hash()
+	}
+
+	found := make([]bool, len(b))
+
+	err := r.r.index.GetGroups(ctx, hashes, func(cidx int, group iface.GroupKey) (bool, error) {
+		if group == iface.UndefGroupKey {
+			return true, nil
+		}
+
+		found[cidx] = true
+		return false, nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("finding existing blocks: %w", err)
+	}
+
+	toWrite := make([]blocks.Block, 0, len(b))
+	for i, blk := range b {
+		if !found[i] {
+			toWrite = append(toWrite, blk)
+		}
+	}
+
+	return toWrite, nil
+}
+
+// relinkedSize returns the size of blocks unlinked from the session namespace
+// which are still stored in its groups
+func (r *ribSession) relinkedSize(ctx context.Context, c []mh.Multihash) (int64, error) {
+	ns := r.opts.Namespace
+
+	var unlinked []mh.Multihash
+	seen := map[string]struct{}{}
+	err := r.r.index.RefCounts(ctx, ns, c, func(cidx int, count int64, has bool) error {
+		if _, ok := seen[string(c[cidx])]; ok {
+			return nil
+		}
+		seen[string(c[cidx])] = struct{}{}
+
+		if has && count == 0 {
+			unlinked = append(unlinked, c[cidx])
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, xerrors.Errorf("getting namespace refs: %w", err)
+	}
+
+	return r.r.storedSize(ctx, ns, unlinked)
+}
+
+func blocksSize(b []blocks.Block) int64 {
+	var size int64
+	for _, blk := range b {
+		size += int64(len(blk.RawData()))
+	}
+	return size
+}
@@ -0,0 +1,226 @@
+package rbstor
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	iface "github.com/lotus-web3/ribs"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	sessA := r.Session(ctx, iface.WithNamespace("a"))
+	sessB := r.Session(ctx, iface.WithNamespace("b"))
+	sessDefault := r.Session(ctx)
+
+	put := func(sess iface.Session, blks []blocks.Block) {
+		bt := sess.Batch(ctx)
+		require.NoError(t, bt.Put(ctx, blks))
+		require.NoError(t, bt.Flush(ctx))
+	}
+
+	visible := func(sess iface.Session, blk blocks.Block) bool {
+		var seen bool
+		err := sess.View(ctx, []mh.Multihash{blk.Cid().Hash()}, func(cidx int, data []byte) {
+			require.Equal(t, blk.RawData(), data)
+			seen = true
+		})
+		require.NoError(t, err)
+
+		var size int32
+		err = sess.GetSize(ctx, []mh.Multihash{blk.Cid().Hash()}, func(sizes []int32) error {
+			size = sizes[0]
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, seen, size != -1)
+
+		return seen
+	}
+
+	shared := randBlocks(t, 1, 1024)[0]
+	onlyB := randBlocks(t, 1, 1024)[0]
+
+	put(sessA, []blocks.Block{shared})
+
+	require.True(t, visible(sessA, shared))
+	require.False(t, visible(sessB, shared))
+	require.True(t, visible(sessDefault, shared))
+
+	// shared data is only referenced by the second namespace
+	put(sessB, []blocks.Block{shared, onlyB})
+
+	require.True(t, visible(sessB, shared))
+	require.True(t, visible(sessB, onlyB))
+	require.False(t, visible(sessA, onlyB))
+
+	groupsA, err := r.FindHashes(ctx, shared.Cid().Hash())
+	require.NoError(t, err)
+	groupsB, err := r.FindHashes(ctx, onlyB.Cid().Hash())
+	require.NoError(t, err)
+	require.NotEqual(t, groupsA[0], groupsB[0])
+
+	gs, err := r.GetGroupStats()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), gs.Namespaces["a"].Blocks)
+	require.Equal(t, int64(1), gs.Namespaces["b"].Blocks)
+	require.Equal(t, int64(1024), gs.Namespaces["b"].Bytes)
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	require.NoError(t, r.SetNamespaceQuota(ctx, "q", 1500))
+
+	bt := r.Session(ctx, iface.WithNamespace("q")).Batch(ctx)
+	require.NoError(t, bt.Put(ctx, randBlocks(t, 1, 1024)))
+	require.NoError(t, bt.Flush(ctx))
+
+	err := bt.Put(ctx, randBlocks(t, 1, 1024))
+	require.True(t, xerrors.Is(err, ErrQuotaExceeded), "unexpected error: %v", err)
+
+	// other namespaces are not affected
+	bt = r.Session(ctx, iface.WithNamespace("other")).Batch(ctx)
+	require.NoError(t, bt.Put(ctx, randBlocks(t, 2, 1024)))
+
+	// raising the quota allows more writes
+	require.NoError(t, r.SetNamespaceQuota(ctx, "q", 4096))
+	bt = r.Session(ctx, iface.WithNamespace("q")).Batch(ctx)
+	require.NoError(t, bt.Put(ctx, randBlocks(t, 1, 1024)))
+	require.NoError(t, bt.Flush(ctx))
+
+	gs, err := r.GetGroupStats()
+	require.NoError(t, err)
+	require.Equal(t, int64(2048), gs.Namespaces["q"].Bytes)
+	require.Equal(t, int64(4096), gs.Namespaces["q"].QuotaBytes)
+}
+
+func TestNamespaceRefs(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	require.NoError(t, r.SetNamespaceQuota(ctx, "a", 2048))
+
+	sessA := r.Session(ctx, iface.WithNamespace("a"))
+	sessB := r.Session(ctx, iface.WithNamespace("b"))
+	blk := randBlocks(t, 1, 1024)[0]
+
+	visible := func(sess iface.Session) bool {
+		var seen bool
+		err := sess.View(ctx, []mh.Multihash{blk.Cid().Hash()}, func(cidx int, data []byte) {
+			seen = true
+		})
+		require.NoError(t, err)
+		return seen
+	}
+
+	put := func(sess iface.Session, blks ...blocks.Block) error {
+		bt := sess.Batch(ctx)
+		if err := bt.Put(ctx, blks); err != nil {
+			return err
+		}
+		return bt.Flush(ctx)
+	}
+
+	unlink := func(sess iface.Session) {
+		bt := sess.Batch(ctx)
+		require.NoError(t, bt.Unlink(ctx, []mh.Multihash{blk.Cid().Hash()}))
+		require.NoError(t, bt.Flush(ctx))
+	}
+
+	// putting a block twice references it once
+	require.NoError(t, put(sessA, blk))
+	require.NoError(t, put(sessA, blk))
+
+	unlink(sessA)
+	require.False(t, visible(sessA))
+
+	groups, err := r.FindHashes(ctx, blk.Cid().Hash())
+	require.NoError(t, err)
+	require.Empty(t, groups)
+
+	// unlinked data doesn't count towards the quota
+	require.NoError(t, put(sessA, randBlocks(t, 2, 1024)...))
+	require.ErrorIs(t, put(sessA, randBlocks(t, 1, 1024)...), ErrQuotaExceeded)
+
+	// quota is released when the last namespace ref is dropped, even if
+	// other namespaces keep the block
+	require.NoError(t, r.SetNamespaceQuota(ctx, "a", 4096))
+	require.NoError(t, put(sessA, blk))
+	require.NoError(t, put(sessB, blk))
+
+	unlink(sessA)
+	require.False(t, visible(sessA))
+	require.True(t, visible(sessB))
+
+	require.NoError(t, put(sessA, randBlocks(t, 1, 1024)...))
+	require.ErrorIs(t, put(sessA, randBlocks(t, 2, 1024)...), ErrQuotaExceeded)
+
+	// linking it again is charged again
+	require.NoError(t, put(sessA, blk))
+	require.True(t, visible(sessA))
+	require.ErrorIs(t, put(sessA, randBlocks(t, 1, 1024)...), ErrQuotaExceeded)
+}
+
+func TestNamespaceUnlinkShared(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	sessA := r.Session(ctx, iface.WithNamespace("a"))
+	sessB := r.Session(ctx, iface.WithNamespace("b"))
+	sessDefault := r.Session(ctx)
+
+	put := func(sess iface.Session, blk blocks.Block) {
+		bt := sess.Batch(ctx)
+		require.NoError(t, bt.Put(ctx, []blocks.Block{blk}))
+		require.NoError(t, bt.Flush(ctx))
+	}
+
+	unlink := func(sess iface.Session, blk blocks.Block) {
+		bt := sess.Batch(ctx)
+		require.NoError(t, bt.Unlink(ctx, []mh.Multihash{blk.Cid().Hash()}))
+		require.NoError(t, bt.Flush(ctx))
+	}
+
+	readable := func(sess iface.Session, blk blocks.Block) bool {
+		var seen bool
+		err := sess.View(ctx, []mh.Multihash{blk.Cid().Hash()}, func(cidx int, data []byte) {
+			require.Equal(t, blk.RawData(), data)
+			seen = true
+		})
+		require.NoError(t, err)
+		return seen
+	}
+
+	blks := randBlocks(t, 2, 1024)
+	shared, inDefault := blks[0], blks[1]
+
+	// stored in a group of namespace a, referenced by b
+	put(sessA, shared)
+	put(sessB, shared)
+
+	unlink(sessA, shared)
+	require.False(t, readable(sessA, shared))
+	require.True(t, readable(sessB, shared))
+	require.True(t, readable(sessDefault, shared))
+
+	// the last namespace reference unlinks the block
+	unlink(sessB, shared)
+	require.False(t, readable(sessB, shared))
+	require.False(t, readable(sessDefault, shared))
+
+	// blocks stored in the default namespace are kept
+	put(sessDefault, inDefault)
+	put(sessA, inDefault)
+
+	unlink(sessA, inDefault)
+	require.False(t, readable(sessA, inDefault))
+	require.True(t, readable(sessDefault, inDefault))
+}
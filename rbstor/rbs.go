@@ -4,20 +4,27 @@ import (
 	"context"
 	"github.com/filecoin-project/lotus/lib/must"
 	"github.com/lotus-web3/ribs/ributil"
+	"github.com/lotus-web3/ribs/ributil/vfs"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/carlog"
 	_ "github.com/mattn/go-sqlite3"
 	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/multierr"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 )
 
@@ -25,6 +32,15 @@ var log = logging.Logger("rbs")
 
 type openOptions struct {
 	db *ributil.RetryDB
+
+	writableGroups int
+
+	verifyReads bool
+
+	scrubInterval time.Duration
+	scrubRate     int64
+
+	fs vfs.FS
 }
 
 type OpenOption func(*openOptions)
@@ -35,6 +51,31 @@ func WithDB(db *ributil.RetryDB) OpenOption {
 	}
 }
 
+// WithWritableGroups sets the number of groups which can be written to
+// concurrently. Each session sticks to a single group, new sessions are spread
+// across writable groups.
+// Defaults to 1.
+func WithWritableGroups(n int) OpenOption {
+	return func(o *openOptions) {
+		o.writableGroups = n
+	}
+}
+
+// WithVerifyReads makes group reads check block data against block hashes.
+// Corrupted data is reported with GroupEventCorrupted.
+func WithVerifyReads(verify bool) OpenOption {
+	return func(o *openOptions) {
+		o.verifyReads = verify
+	}
+}
+
+// WithFS sets the filesystem used for group head and data files
+func WithFS(fs vfs.FS) OpenOption {
+	return func(o *openOptions) {
+		o.fs = fs
+	}
+}
+
 var workerCount = func() int {
 	var wc int
 	if wcs := os.Getenv("RBS_WORKERS"); wcs != "" {
@@ -51,6 +92,9 @@ var workerCount = func() int {
 	return wc
 }()
 
+// flushParallel limits the number of groups synced concurrently by Batch.Flush
+var flushParallel = 8
+
 // todo root as option, separate data / data index / index (/ staging?) paths
 func Open(root string, opts ...OpenOption) (iface.RBS, error) {
 	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
@@ -62,12 +106,21 @@ func Open(root string, opts ...OpenOption) (iface.RBS, error) {
 		return nil, xerrors.Errorf("open top index: %w", err)
 	}
 
-	opt := &openOptions{}
+	opt := &openOptions{
+		writableGroups: 1,
+		scrubInterval:  DefaultScrubInterval,
+		scrubRate:      DefaultScrubRate,
+		fs:             vfs.OS,
+	}
 
 	for _, o := range opts {
 		o(opt)
 	}
 
+	if opt.writableGroups < 1 {
+		return nil, xerrors.Errorf("writable group count must be at least 1, got %d", opt.writableGroups)
+	}
+
 	db, err := openRibsDB(root, opt.db)
 	if err != nil {
 		return nil, xerrors.Errorf("open db: %w", err)
@@ -78,16 +131,32 @@ func Open(root string, opts ...OpenOption) (iface.RBS, error) {
 		db:    db,
 		index: NewMeteredIndex(idx),
 
-		writableGroups: make(map[iface.GroupKey]*Group),
+		writableGroups:    make(map[iface.GroupKey]*Group),
+		maxWritableGroups: opt.writableGroups,
+
+		verifyReads: opt.verifyReads,
+		corrupted:   map[iface.GroupKey]struct{}{},
+
+		fs: opt.fs,
+
+		scrubInterval: opt.scrubInterval,
+		scrubRate:     opt.scrubRate,
 
 		// all open groups (including all writable)
 		openGroups: make(map[iface.GroupKey]*Group),
 
+		groupNs: map[iface.GroupKey]string{},
+		nsUsage: map[string]*nsUsage{},
+
 		tasks: make(chan task, 1024),
 
+		events: newEventQueue(),
+
 		close: make(chan struct{}),
 	}
 
+	go r.eventWriter()
+
 	for i := 0; i < workerCount; i++ {
 		r.workerClosed = append(r.workerClosed, make(chan struct{}))
 	}
@@ -101,6 +170,17 @@ func (r *rbs) Start() error {
 	}
 	go r.resumeGroups(context.TODO())
 
+	if r.scrubInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-r.close
+			cancel()
+		}()
+
+		r.bgWg.Add(1)
+		go r.scrubber(ctx)
+	}
+
 	return nil
 }
 
@@ -124,12 +204,13 @@ type rbs struct {
 	db    *rbsDB
 	index *MeteredIndex
 
-	lk      sync.Mutex
-	writeLk sync.Mutex
+	lk sync.Mutex
+
+	/* events */
+	events *eventQueue
 
-	/* subs */
 	subLk sync.Mutex
-	subs  []iface.GroupSub
+	subs  []*eventSub
 
 	/* storage */
 
@@ -141,6 +222,39 @@ type rbs struct {
 	openGroups     map[int64]*Group
 	writableGroups map[int64]*Group
 
+	// maxWritableGroups is the target number of concurrently writable groups,
+	// writableRR spreads new writers across them
+	maxWritableGroups int
+	writableRR        int
+
+	/* integrity */
+	verifyReads bool
+
+	// groups with reported corruption, until reloaded
+	corruptedLk sync.Mutex
+	corrupted   map[iface.GroupKey]struct{}
+
+	scrubInterval time.Duration
+	scrubRate     int64
+
+	// fs is used for group head and data files
+	fs vfs.FS
+
+	// lastRead is the time of the last foreground read in unix nanoseconds,
+	// the scrubber yields to reads
+	lastRead atomic.Int64
+
+	// background goroutines which must exit before groups are closed
+	bgWg sync.WaitGroup
+
+	/* gc */
+	gc gcState
+
+	/* namespaces */
+	nsLk    sync.Mutex
+	groupNs map[iface.GroupKey]string
+	nsUsage map[string]*nsUsage
+
 	external atomic.Pointer[iface.ExternalStorageProvider]
 	staging  atomic.Pointer[iface.StagingStorageProvider]
 
@@ -163,18 +277,29 @@ func (r *rbs) Close() error {
 	for i := 0; i < workerCount; i++ {
 		<-r.workerClosed[i]
 	}
+	r.bgWg.Wait()
+
+	// write out remaining events
+	close(r.events.stop)
+	<-r.events.done
 
 	r.lk.Lock()
 	defer r.lk.Unlock()
 
+	// close everything, also after failures, so that the store can be reopened
+	var errs []error
 	for _, g := range r.openGroups {
 		if err := g.Close(); err != nil {
-			return xerrors.Errorf("closing group %d: %w", g.id, err)
+			errs = append(errs, xerrors.Errorf("closing group %d: %w", g.id, err))
 		}
 	}
 
 	if err := r.index.Close(); err != nil {
-		return xerrors.Errorf("closing index: %w", err)
+		errs = append(errs, xerrors.Errorf("closing index: %w", err))
+	}
+
+	if err := multierr.Combine(errs...); err != nil {
+		return err
 	}
 
 	log.Errorf("TODO mark closed")
@@ -184,41 +309,43 @@ func (r *rbs) Close() error {
 
 type ribSession struct {
 	r *rbs
+
+	opts iface.SessionOptions
+
+	// writeTarget is the group this session writes to, all batches in the
+	// session prefer it, so that data written in a session stays in one group
+	writeTarget atomic.Int64
 }
 
 type ribBatch struct {
-	r *rbs
+	r    *rbs
+	sess *ribSession
 
-	currentWriteTarget iface.GroupKey
-	toFlush            map[iface.GroupKey]struct{}
+	toFlush map[iface.GroupKey]struct{}
+
+	// unlinks are applied on flush, unless the same block was put in the batch
+	toUnlink []mh.Multihash
+	put      map[string]struct{}
 
 	// todo: use lru
 }
 
-func (r *rbs) Session(ctx context.Context) iface.Session {
-	return &ribSession{
+func (r *rbs) Session(ctx context.Context, opts ...iface.SessionOption) iface.Session {
+	s := &ribSession{
 		r: r,
 	}
+	for _, o := range opts {
+		o(&s.opts)
+	}
+	s.writeTarget.Store(iface.UndefGroupKey)
+
+	return s
 }
 
 func (r *ribSession) View(ctx context.Context, c []mh.Multihash, cb func(cidx int, data []byte)) error {
-	done := map[int]struct{}{}
-	byGroup := map[iface.GroupKey][]int{}
-
-	err := r.r.index.GetGroups(ctx, c, func(cidx int, group iface.GroupKey) (bool, error) {
-		if _, ok := done[cidx]; ok {
-			return false, nil
-		}
-		done[cidx] = struct{}{}
-
-		if group == iface.UndefGroupKey {
-			return true, nil
-		}
-
-		byGroup[group] = append(byGroup[group], cidx)
+	r.r.noteForegroundRead()
 
-		return false, nil
-	})
+	byGroup, err := r.findGroups(ctx, c)
 	if err != nil {
 		return err
 	}
@@ -247,9 +374,12 @@ func (r *ribSession) View(ctx context.Context, c []mh.Multihash, cb func(cidx in
 			}
 
 			ext := *extp
-			return ext.FetchBlocks(ctx, g, toGet, func(cidx int, data []byte) {
+			err := ext.FetchBlocks(ctx, g, toGet, func(cidx int, data []byte) {
 				cb(cidxs[cidx], data)
 			})
+			if err != nil {
+				return xerrors.Errorf("fetching blocks from offloaded group %d: %w", g, err)
+			}
 		} else if err != nil {
 			return xerrors.Errorf("with readable group(%d)/view: %w", g, err)
 		}
@@ -258,23 +388,235 @@ func (r *ribSession) View(ctx context.Context, c []mh.Multihash, cb func(cidx in
 	return nil
 }
 
+// findGroups finds groups containing data visible to the session
+func (r *ribSession) findGroups(ctx context.Context, c []mh.Multihash) (map[iface.GroupKey][]int, error) {
+	ns := r.opts.Namespace
+
+	const (
+		refNone = iota
+		refHeld
+		refUnlinked
+	)
+
+	var refs []int
+	if ns != "" {
+		// blocks referenced by the namespace are visible in any group
+		refs = make([]int, len(c))
+		err := r.r.index.RefCounts(ctx, ns, c, func(cidx int, count int64, has bool) error {
+			switch {
+			case count > 0:
+				refs[cidx] = refHeld
+			case has:
+				refs[cidx] = refUnlinked
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, xerrors.Errorf("checking namespace refs: %w", err)
+		}
+	}
+
+	done := map[int]struct{}{}
+	byGroup := map[iface.GroupKey][]int{}
+
+	for cidx := range refs {
+		if refs[cidx] == refUnlinked {
+			// unlinked from the namespace, even if stored in its groups
+			done[cidx] = struct{}{}
+		}
+	}
+
+	err := r.r.index.GetGroups(ctx, c, func(cidx int, group iface.GroupKey) (bool, error) {
+		if _, ok := done[cidx]; ok {
+			return false, nil
+		}
+
+		if group == iface.UndefGroupKey {
+			return true, nil
+		}
+
+		if ns != "" && refs[cidx] == refNone {
+			// data written before refcounting is visible in namespace groups
+			gns, err := r.r.groupNamespace(group)
+			if err != nil {
+				return false, err
+			}
+			if gns != ns {
+				return true, nil
+			}
+		}
+
+		done[cidx] = struct{}{}
+		byGroup[group] = append(byGroup[group], cidx)
+
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return byGroup, nil
+}
+
 func (r *ribSession) GetSize(ctx context.Context, c []mh.Multihash, cb func(i []int32) error) error {
-	return r.r.index.GetSizes(ctx, c, cb)
+	if r.opts.Namespace == "" {
+		return r.r.index.GetSizes(ctx, c, cb)
+	}
+
+	byGroup, err := r.findGroups(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	visible := make([]bool, len(c))
+	for _, cidxs := range byGroup {
+		for _, cidx := range cidxs {
+			visible[cidx] = true
+		}
+	}
+
+	return r.r.index.GetSizes(ctx, c, func(sizes []int32) error {
+		for i := range sizes {
+			if !visible[i] {
+				sizes[i] = -1
+			}
+		}
+		return cb(sizes)
+	})
+}
+
+func (r *ribSession) GetCids(ctx context.Context, c []mh.Multihash, cb func([]cid.Cid) error) error {
+	found := make([]bool, len(c))
+	err := r.GetSize(ctx, c, func(sizes []int32) error {
+		for i, size := range sizes {
+			found[i] = size != -1
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("get sizes: %w", err)
+	}
+
+	return r.r.index.GetCodecs(ctx, c, func(codecs []uint64) error {
+		out := make([]cid.Cid, len(c))
+		for i, codec := range codecs {
+			if !found[i] {
+				continue
+			}
+			out[i] = indexCid(c[i], codec)
+		}
+		return cb(out)
+	})
+}
+
+func (r *ribSession) ListCids(ctx context.Context, after mh.Multihash, limit int) ([]cid.Cid, mh.Multihash, error) {
+	ents, err := r.r.index.ListEntries(ctx, after, limit)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("listing index entries: %w", err)
+	}
+	if len(ents) == 0 {
+		return nil, nil, nil
+	}
+
+	var next mh.Multihash
+	if len(ents) == limit {
+		next = ents[len(ents)-1].Hash
+	}
+
+	visible := make([]bool, len(ents))
+	for i := range visible {
+		visible[i] = true
+	}
+
+	if r.opts.Namespace != "" {
+		hashes := make([]mh.Multihash, len(ents))
+		for i, ent := range ents {
+			hashes[i] = ent.Hash
+		}
+
+		err := r.GetSize(ctx, hashes, func(sizes []int32) error {
+			for i, size := range sizes {
+				visible[i] = size != -1
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, xerrors.Errorf("filtering namespace keys: %w", err)
+		}
+	}
+
+	out := make([]cid.Cid, 0, len(ents))
+	for i, ent := range ents {
+		if !visible[i] {
+			continue
+		}
+
+		out = append(out, indexCid(ent.Hash, ent.Codec))
+	}
+
+	return out, next, nil
+}
+
+// indexCid creates a CID from index data, blocks with unknown codecs are
+// assumed to be raw
+func indexCid(h mh.Multihash, codec uint64) cid.Cid {
+	if codec == 0 {
+		codec = cid.Raw
+	}
+	return cid.NewCidV1(codec, h)
 }
 
 func (r *ribSession) Batch(ctx context.Context) iface.Batch {
 	return &ribBatch{
-		r:                  r.r,
-		currentWriteTarget: iface.UndefGroupKey,
-		toFlush:            map[iface.GroupKey]struct{}{},
+		r:       r.r,
+		sess:    r,
+		toFlush: map[iface.GroupKey]struct{}{},
+		put:     map[string]struct{}{},
 	}
 }
 
 func (r *ribBatch) Put(ctx context.Context, b []blocks.Block) error {
-	// todo filter blocks that already exist
+	ns := r.sess.opts.Namespace
+
+	hashes := make([]mh.Multihash, len(b))
+	for i, blk := range b {
+		hashes[i] = blk.Cid().Hash()
+		r.put[string(hashes[i])] = struct{}{}
+	}
+	r.r.gcNoteWrite(hashes)
+
 	var done int
+
+	var relinked int64
+	if ns != "" {
+		// data already stored is only referenced
+		var err error
+
+		b, err = r.sess.dedup(ctx, b)
+		if err != nil {
+			return xerrors.Errorf("dedup: %w", err)
+		}
+
+		// data unlinked from the namespace, but still stored in its groups,
+		// counts towards the quota again
+		relinked, err = r.sess.relinkedSize(ctx, hashes)
+		if err != nil {
+			return xerrors.Errorf("getting relinked data size: %w", err)
+		}
+
+		if err := r.r.reserveQuota(ns, blocksSize(b)+relinked); err != nil {
+			return err
+		}
+
+		// give back quota reserved for blocks which didn't get written
+		defer func() {
+			r.r.releaseQuota(ns, blocksSize(b[done:]))
+		}()
+	}
+
+	// todo filter blocks that already exist
 	for done < len(b) {
-		gk, err := r.r.withWritableGroup(ctx, r.currentWriteTarget, func(g *Group) error {
+		gk, err := r.r.withWritableGroup(ctx, ns, r.sess.opts.Labels, r.sess.writeTarget.Load(), func(g *Group) error {
 			wrote, err := g.Put(ctx, b[done:])
 			if err != nil {
 				return err
@@ -287,31 +629,84 @@ func (r *ribBatch) Put(ctx context.Context, b []blocks.Block) error {
 		}
 
 		r.toFlush[gk] = struct{}{}
-		r.currentWriteTarget = gk
+		r.sess.writeTarget.Store(gk)
+	}
+
+	if ns != "" {
+		if err := r.r.index.AddRefs(ctx, ns, hashes, nil); err != nil {
+			r.r.releaseQuota(ns, relinked)
+			return xerrors.Errorf("add namespace refs: %w", err)
+		}
+
+		if relinked > 0 {
+			if err := r.r.db.AddNamespaceReleased(ctx, ns, -relinked); err != nil {
+				return xerrors.Errorf("recording relinked data: %w", err)
+			}
+		}
 	}
 
 	return nil
 }
 
 func (r *ribBatch) Unlink(ctx context.Context, c []mh.Multihash) error {
-	//TODO implement me
-	panic("implement me")
+	r.toUnlink = append(r.toUnlink, c...)
+	return nil
 }
 
 func (r *ribBatch) Flush(ctx context.Context) error {
+	toSync := make([]iface.GroupKey, 0, len(r.toFlush))
+	for key := range r.toFlush {
+		toSync = append(toSync, key)
+	}
+	sort.Slice(toSync, func(i, j int) bool {
+		return toSync[i] < toSync[j]
+	})
+
 	r.r.lk.Lock()
-	defer r.r.lk.Unlock()
+	groups := make([]*Group, len(toSync))
+	for i, key := range toSync {
+		// nil if already flushed
+		groups[i] = r.r.writableGroups[key]
+	}
+	r.r.lk.Unlock()
+
+	// sync all touched groups in parallel; errors are collected per group so that
+	// the returned error doesn't depend on goroutine scheduling
+	errs := make([]error, len(groups))
 
-	for key := range r.toFlush { // todo run in parallel
-		g, found := r.r.writableGroups[key]
-		if !found {
-			continue // already flushed
+	eg := new(errgroup.Group)
+	eg.SetLimit(flushParallel)
+
+	for i, g := range groups {
+		if g == nil {
+			continue
 		}
-		r.r.lk.Unlock()
-		err := g.Sync(ctx)
-		r.r.lk.Lock()
-		if err != nil {
-			return xerrors.Errorf("sync group %d: %w", key, err)
+
+		i, g := i, g
+		eg.Go(func() error {
+			if err := g.Sync(ctx); err != nil {
+				errs[i] = xerrors.Errorf("sync group %d: %w", toSync[i], err)
+			}
+			return nil
+		})
+	}
+	_ = eg.Wait()
+
+	if err := multierr.Combine(errs...); err != nil {
+		return err
+	}
+
+	if len(r.toUnlink) > 0 {
+		// Put is preferred over Unlink for blocks which were put in this batch
+		toUnlink := make([]mh.Multihash, 0, len(r.toUnlink))
+		for _, m := range r.toUnlink {
+			if _, ok := r.put[string(m)]; !ok {
+				toUnlink = append(toUnlink, m)
+			}
+		}
+
+		if _, _, err := r.r.unlinkNamespace(ctx, r.sess.opts.Namespace, toUnlink); err != nil {
+			return xerrors.Errorf("unlink: %w", err)
 		}
 	}
 
@@ -320,14 +715,22 @@ func (r *ribBatch) Flush(ctx context.Context) error {
 	}
 
 	r.toFlush = map[iface.GroupKey]struct{}{}
+	r.toUnlink = nil
+	r.put = map[string]struct{}{}
 
 	return nil
 }
 
 func (r *rbs) Offload(ctx context.Context, group iface.GroupKey) error {
 	return r.withReadableGroup(ctx, group, func(g *Group) error {
-		err := g.offload()
-		return err
+		if err := g.offload(); err != nil {
+			r.sendFailure(group, xerrors.Errorf("offload: %w", err))
+			return err
+		}
+
+		r.sendEvent(iface.GroupEvent{Group: group, Type: iface.GroupEventOffloaded})
+		r.sendStateChange(group, iface.GroupStateLocalReadyForDeals, iface.GroupStateOffloaded)
+		return nil
 	})
 }
 
@@ -351,6 +754,50 @@ func (r *rbs) FindHashes(ctx context.Context, hash mh.Multihash) ([]iface.GroupK
 	return out, nil
 }
 
+func (r *rbs) SetGroupLabels(ctx context.Context, group iface.GroupKey, labels map[string]string) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if err := r.db.SetGroupLabels(ctx, group, labels); err != nil {
+		return err
+	}
+
+	// writable groups only get writes from sessions with matching labels
+	if g, ok := r.writableGroups[group]; ok {
+		labels, err := r.db.GroupLabels(ctx, group)
+		if err != nil {
+			return xerrors.Errorf("getting group labels: %w", err)
+		}
+		g.labels = labelsKey(labels)
+	}
+
+	return nil
+}
+
+// labelsKey encodes a label set, so that label sets can be compared. Labels
+// with empty values aren't stored, and are skipped.
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(strconv.Quote(k))
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
 func (r *rbs) DescibeGroup(ctx context.Context, group iface.GroupKey) (iface.GroupDesc, error) {
 	return r.db.DescibeGroup(ctx, group)
 }
@@ -372,6 +819,38 @@ func (r *rbs) ReadCar(ctx context.Context, group iface.GroupKey, sz func(int64),
 	})
 }
 
+func (r *rbs) ReadCarRange(ctx context.Context, group iface.GroupKey, off, size int64, out io.Writer) error {
+	return r.withReadableGroup(ctx, group, func(g *Group) error {
+		_, err := g.writeCarRange(out, off, size)
+		return err
+	})
+}
+
+func (r *rbs) CarLocations(ctx context.Context, group iface.GroupKey, c []mh.Multihash) ([]iface.BlockLocation, error) {
+	var out []iface.BlockLocation
+	err := r.withReadableGroup(ctx, group, func(g *Group) error {
+		locs, err := g.carLocations(c)
+		if err != nil {
+			return err
+		}
+
+		out = make([]iface.BlockLocation, len(locs))
+		for i, l := range locs {
+			out[i] = iface.BlockLocation{Offset: l.Offset, Size: l.Size}
+		}
+		return nil
+	})
+
+	return out, err
+}
+
+func (r *rbs) ReadCarV2(ctx context.Context, group iface.GroupKey, out io.Writer) error {
+	return r.withReadableGroup(ctx, group, func(g *Group) error {
+		_, _, err := g.writeCar(out, carlog.WithCarV2(true))
+		return err
+	})
+}
+
 func (r *rbs) HashSample(ctx context.Context, group iface.GroupKey) ([]mh.Multihash, error) {
 	var out []mh.Multihash
 	err := r.withReadableGroup(ctx, group, func(g *Group) error {
@@ -386,9 +865,13 @@ func (r *rbs) HashSample(ctx context.Context, group iface.GroupKey) ([]mh.Multih
 func (r *rbs) LoadFilCar(ctx context.Context, group iface.GroupKey, f io.Reader, sz int64) error {
 	err := r.withReadableGroup(ctx, group, func(g *Group) error {
 		if err := g.LoadFilCar(ctx, f, sz); err != nil {
+			r.sendFailure(group, xerrors.Errorf("load fil car: %w", err))
 			return xerrors.Errorf("load data into group: %w", err)
 		}
 
+		r.sendStateChange(group, iface.GroupStateOffloaded, iface.GroupStateReload)
+		r.clearCorruption(group)
+
 		r.tasks <- task{
 			tt:    taskTypeFinDataReload,
 			group: group,
@@ -0,0 +1,408 @@
+package rbstor
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestRbs(t testing.TB, opts ...OpenOption) *rbs {
+	ri, err := Open(t.TempDir(), opts...)
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, ri.Close())
+	})
+
+	return ri.(*rbs)
+}
+
+// openWritableGroups creates n writable groups, bypassing group selection
+func openWritableGroups(t testing.TB, r *rbs, n int) []*Group {
+	ctx := context.Background()
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	out := make([]*Group, n)
+	for i := range out {
+		_, g, err := r.createGroup(ctx, "", nil)
+		require.NoError(t, err)
+		out[i] = g
+	}
+
+	return out
+}
+
+func randBlocks(t testing.TB, n, size int) []blocks.Block {
+	out := make([]blocks.Block, n)
+	for i := range out {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		h, err := mh.Sum(data, mh.SHA2_256, -1)
+		require.NoError(t, err)
+
+		out[i], err = blocks.NewBlockWithCid(data, cid.NewCidV1(cid.Raw, h))
+		require.NoError(t, err)
+	}
+	return out
+}
+
+func TestFlushMultipleGroups(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	groups := openWritableGroups(t, r, 4)
+
+	bt := r.Session(ctx).Batch(ctx).(*ribBatch)
+
+	written := map[int64][]blocks.Block{}
+	for _, g := range groups {
+		blks := randBlocks(t, 16, 1024)
+		n, err := g.Put(ctx, blks)
+		require.NoError(t, err)
+		require.Equal(t, len(blks), n)
+
+		bt.toFlush[g.id] = struct{}{}
+		written[g.id] = blks
+	}
+
+	require.NoError(t, bt.Flush(ctx))
+	require.Empty(t, bt.toFlush)
+
+	for _, g := range groups {
+		nblocks, _, _, _, _, err := r.db.OpenGroup(g.id)
+		require.NoError(t, err)
+		require.Equal(t, int64(16), nblocks)
+	}
+
+	for gk, blks := range written {
+		for _, b := range blks {
+			found, err := r.FindHashes(ctx, b.Cid().Hash())
+			require.NoError(t, err)
+			require.Contains(t, found, gk)
+		}
+	}
+}
+
+func BenchmarkFlushGroups(b *testing.B) {
+	const groupCount = 8
+
+	for _, parallel := range []int{1, groupCount} {
+		b.Run(fmt.Sprintf("groups-%d/parallel-%d", groupCount, parallel), func(b *testing.B) {
+			defer func(prev int) {
+				flushParallel = prev
+			}(flushParallel)
+			flushParallel = parallel
+
+			ctx := context.Background()
+			r := openTestRbs(b)
+			groups := openWritableGroups(b, r, groupCount)
+			bt := r.Session(ctx).Batch(ctx).(*ribBatch)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for _, g := range groups {
+					_, err := g.Put(ctx, randBlocks(b, 64, 16<<10))
+					require.NoError(b, err)
+					bt.toFlush[g.id] = struct{}{}
+				}
+				b.StartTimer()
+
+				require.NoError(b, bt.Flush(ctx))
+			}
+		})
+	}
+}
+
+func TestSessionWriteAffinity(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t, WithWritableGroups(3))
+
+	putGroup := func(sess iface.Session) iface.GroupKey {
+		bt := sess.Batch(ctx)
+		blks := randBlocks(t, 4, 1024)
+		require.NoError(t, bt.Put(ctx, blks))
+		require.NoError(t, bt.Flush(ctx))
+
+		found, err := r.FindHashes(ctx, blks[0].Cid().Hash())
+		require.NoError(t, err)
+		require.NotEmpty(t, found)
+		return found[0]
+	}
+
+	sessGroups := map[iface.GroupKey]struct{}{}
+	for i := 0; i < 3; i++ {
+		sess := r.Session(ctx)
+
+		gk := putGroup(sess)
+		sessGroups[gk] = struct{}{}
+
+		// subsequent batches in the same session stay in the same group
+		require.Equal(t, gk, putGroup(sess))
+	}
+	require.Len(t, sessGroups, 3)
+
+	// more sessions than writable groups reuse open groups
+	gk := putGroup(r.Session(ctx))
+	require.Contains(t, sessGroups, gk)
+
+	gs, err := r.GetGroupStats()
+	require.NoError(t, err)
+	require.Equal(t, 3, gs.OpenWritable)
+}
+
+func BenchmarkParallelWriters(b *testing.B) {
+	const writers = 4
+	const blocksPerPut = 32
+	const blockSize = 16 << 10
+
+	for _, writable := range []int{1, writers} {
+		b.Run(fmt.Sprintf("writers-%d/writable-%d", writers, writable), func(b *testing.B) {
+			ctx := context.Background()
+			r := openTestRbs(b, WithWritableGroups(writable))
+
+			sessions := make([]iface.Session, writers)
+			for i := range sessions {
+				sessions[i] = r.Session(ctx)
+			}
+
+			b.SetBytes(writers * blocksPerPut * blockSize)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				toPut := make([][]blocks.Block, writers)
+				for w := range toPut {
+					toPut[w] = randBlocks(b, blocksPerPut, blockSize)
+				}
+				b.StartTimer()
+
+				var wg sync.WaitGroup
+				for w, sess := range sessions {
+					wg.Add(1)
+					go func(sess iface.Session, blks []blocks.Block) {
+						defer wg.Done()
+
+						bt := sess.Batch(ctx)
+						require.NoError(b, bt.Put(ctx, blks))
+						require.NoError(b, bt.Flush(ctx))
+					}(sess, toPut[w])
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestGroupLabels(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+
+	put := func(sess iface.Session) iface.GroupKey {
+		bt := sess.Batch(ctx)
+		blks := randBlocks(t, 4, 1024)
+		require.NoError(t, bt.Put(ctx, blks))
+		require.NoError(t, bt.Flush(ctx))
+
+		found, err := r.FindHashes(ctx, blks[0].Cid().Hash())
+		require.NoError(t, err)
+		require.NotEmpty(t, found)
+		return found[0]
+	}
+
+	g1 := put(r.Session(ctx, iface.WithSessionLabels(map[string]string{"tenant": "a", "job": "1"})))
+	g2 := put(r.Session(ctx, iface.WithSessionLabels(map[string]string{"tenant": "b"})))
+	require.NotEqual(t, g1, g2)
+
+	gm, err := r.GroupMeta(g1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"tenant": "a", "job": "1"}, gm.Labels)
+
+	found, err := r.FindGroups(ctx, iface.GroupFilter{Labels: map[string]string{"tenant": "a"}})
+	require.NoError(t, err)
+	require.Equal(t, []iface.GroupKey{g1}, found)
+
+	found, err = r.FindGroups(ctx, iface.GroupFilter{States: []iface.GroupState{iface.GroupStateWritable}})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []iface.GroupKey{g1, g2}, found)
+
+	// labels can be changed after write, empty values remove labels
+	require.NoError(t, r.SetGroupLabels(ctx, g2, map[string]string{"tenant": "a", "dataset": "x"}))
+	require.NoError(t, r.SetGroupLabels(ctx, g1, map[string]string{"job": ""}))
+
+	found, err = r.FindGroups(ctx, iface.GroupFilter{Labels: map[string]string{"tenant": "a"}})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []iface.GroupKey{g1, g2}, found)
+
+	found, err = r.FindGroups(ctx, iface.GroupFilter{Labels: map[string]string{"tenant": "a", "dataset": "x"}})
+	require.NoError(t, err)
+	require.Equal(t, []iface.GroupKey{g2}, found)
+
+	gm, err = r.GroupMeta(g1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"tenant": "a"}, gm.Labels)
+}
+
+func TestGroupLabelsSeparateGroups(t *testing.T) {
+	ctx := context.Background()
+	td := t.TempDir()
+
+	ri, err := Open(td)
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+	r := ri.(*rbs)
+
+	put := func(r *rbs, labels map[string]string) iface.GroupKey {
+		sess := r.Session(ctx, iface.WithSessionLabels(labels))
+		bt := sess.Batch(ctx)
+		blks := randBlocks(t, 4, 1024)
+		require.NoError(t, bt.Put(ctx, blks))
+		require.NoError(t, bt.Flush(ctx))
+
+		found, err := r.FindHashes(ctx, blks[0].Cid().Hash())
+		require.NoError(t, err)
+		require.NotEmpty(t, found)
+		return found[0]
+	}
+
+	tenantA := map[string]string{"tenant": "a"}
+	tenantB := map[string]string{"tenant": "b"}
+
+	// sessions with different labels never share a writable group
+	ga := put(r, tenantA)
+	gb := put(r, tenantB)
+	require.NotEqual(t, ga, gb)
+	require.Equal(t, ga, put(r, tenantA))
+
+	gu := put(r, nil)
+	require.NotEqual(t, ga, gu)
+	require.NotEqual(t, gb, gu)
+
+	gm, err := r.GroupMeta(ga)
+	require.NoError(t, err)
+	require.Equal(t, tenantA, gm.Labels)
+
+	gm, err = r.GroupMeta(gb)
+	require.NoError(t, err)
+	require.Equal(t, tenantB, gm.Labels)
+
+	gm, err = r.GroupMeta(gu)
+	require.NoError(t, err)
+	require.Empty(t, gm.Labels)
+
+	require.NoError(t, ri.Close())
+
+	// writable groups are matched by labels after a restart
+	ri, err = Open(td)
+	require.NoError(t, err)
+	require.NoError(t, ri.Start())
+	t.Cleanup(func() {
+		require.NoError(t, ri.Close())
+	})
+	r = ri.(*rbs)
+
+	require.Equal(t, gb, put(r, tenantB))
+	require.Equal(t, ga, put(r, tenantA))
+}
+
+func TestSessionGetCids(t *testing.T) {
+	ctx := context.Background()
+	r := openTestRbs(t)
+	sess := r.Session(ctx)
+
+	raw := randBlocks(t, 1, 1024)[0]
+	cbor := cborLinks(t, raw.Cid())
+	missing := randBlocks(t, 1, 1024)[0]
+
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, []blocks.Block{raw, cbor}))
+	require.NoError(t, bt.Flush(ctx))
+
+	var cids []cid.Cid
+	err := sess.GetCids(ctx, []mh.Multihash{raw.Cid().Hash(), cbor.Cid().Hash(), missing.Cid().Hash()}, func(c []cid.Cid) error {
+		cids = c
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{raw.Cid(), cbor.Cid(), cid.Undef}, cids)
+}
+
+func TestSchemaVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := openRibsDB(dir, nil)
+	require.NoError(t, err)
+
+	latest := schemas[len(schemas)-1].VersionNumber
+	var version int
+	require.NoError(t, db.db.QueryRow("SELECT max(version_number) FROM rbs_schema_version").Scan(&version))
+	require.Equal(t, latest, version)
+
+	// reopening doesn't re-apply schema updates
+	db, err = openRibsDB(dir, nil)
+	require.NoError(t, err)
+
+	// databases written by newer versions are refused
+	_, err = db.db.Exec("INSERT INTO rbs_schema_version (version_number, description) VALUES (?, ?)", latest+1, "future")
+	require.NoError(t, err)
+
+	_, err = openRibsDB(dir, nil)
+	require.ErrorContains(t, err, "newer than supported")
+}
+
+func TestPieceCidV2Backfill(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := openRibsDB(dir, nil)
+	require.NoError(t, err)
+
+	commp := make([]byte, 32)
+	commp[0] = 1
+
+	const pieceSize, carSize = 2048, 1500
+
+	// a group which got commP before v2 piece cids were stored
+	_, err = db.db.Exec(`INSERT INTO groups (id, blocks, bytes, g_state, jb_recorded_head, piece_size, commp, car_size, root) VALUES (1, 1, 1, ?, 0, ?, ?, ?, ?)`,
+		iface.GroupStateLocalReadyForDeals, pieceSize, commp, carSize, blocks.NewBlock([]byte("root")).Cid().Bytes())
+	require.NoError(t, err)
+	_, err = db.db.Exec(`UPDATE groups SET piece_cid_v2 = NULL`)
+	require.NoError(t, err)
+	_, err = db.db.Exec(`DELETE FROM rbs_schema_version WHERE version_number = 4`)
+	require.NoError(t, err)
+	_, err = db.db.Exec(`ALTER TABLE groups DROP COLUMN piece_cid_v2`)
+	require.NoError(t, err)
+
+	db, err = openRibsDB(dir, nil)
+	require.NoError(t, err)
+
+	gd, err := db.DescibeGroup(context.Background(), 1)
+	require.NoError(t, err)
+
+	expect, err := piececid.FromCommP(commp, pieceSize, carSize)
+	require.NoError(t, err)
+	require.Equal(t, expect, gd.PieceCidV2)
+
+	v1, size, payload, err := piececid.ToV1(gd.PieceCidV2)
+	require.NoError(t, err)
+	require.Equal(t, gd.PieceCid, v1)
+	require.Equal(t, abi.PaddedPieceSize(pieceSize), size)
+	require.Equal(t, uint64(carSize), payload)
+
+	gm, err := db.GroupMeta(1)
+	require.NoError(t, err)
+	require.Equal(t, expect.String(), gm.PieceCIDv2)
+}
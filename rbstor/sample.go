@@ -0,0 +1,111 @@
+package rbstor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/filecoin-project/go-state-types/abi"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
+	"golang.org/x/xerrors"
+)
+
+func (r *rbs) BlockSample(ctx context.Context, group iface.GroupKey, seed [32]byte, n int) ([]piecesample.Entry, error) {
+	var out []piecesample.Entry
+	err := r.withReadableGroup(ctx, group, func(g *Group) error {
+		points, err := g.samplePoints()
+		if err != nil {
+			return err
+		}
+
+		out = points.Sample(seed, n)
+		return nil
+	})
+
+	return out, err
+}
+
+func (r *rbs) ProveBlockSample(ctx context.Context, group iface.GroupKey, seed [32]byte, n int) ([]piecesample.BlockProof, error) {
+	gd, err := r.DescibeGroup(ctx, group)
+	if err != nil {
+		return nil, xerrors.Errorf("describe group: %w", err)
+	}
+	if !gd.PieceCidV2.Defined() {
+		return nil, xerrors.Errorf("group %d has no piece commitment", group)
+	}
+
+	_, pieceSize, payloadSize, err := piececid.ToV1(gd.PieceCidV2)
+	if err != nil {
+		return nil, xerrors.Errorf("group piece cid: %w", err)
+	}
+
+	sample, err := r.BlockSample(ctx, group, seed, n)
+	if err != nil {
+		return nil, xerrors.Errorf("getting block sample: %w", err)
+	}
+
+	tree, err := r.pieceTree(ctx, group, gd, pieceSize, int64(payloadSize))
+	if err != nil {
+		return nil, err
+	}
+
+	read := func(w io.Writer, off, size int64) error {
+		return r.ReadCarRange(ctx, group, off, size, w)
+	}
+
+	proofs := make([]piecesample.BlockProof, len(sample))
+	for i, e := range sample {
+		proofs[i], err = piecesample.Prove(tree, e, read)
+		if err != nil {
+			return nil, xerrors.Errorf("proving block at point %d: %w", e.Point, err)
+		}
+	}
+
+	return proofs, nil
+}
+
+// pieceTree returns the upper part of the group piece tree, needed for
+// proofs. It is saved when commP is computed, groups without a usable saved
+// tree get it computed from the whole car.
+func (r *rbs) pieceTree(ctx context.Context, group iface.GroupKey, gd iface.GroupDesc, pieceSize abi.PaddedPieceSize, payloadSize int64) (*datasegment.PieceTree, error) {
+	var tree *datasegment.PieceTree
+	err := r.withReadableGroup(ctx, group, func(g *Group) error {
+		var err error
+		tree, err = g.pieceTree()
+		return err
+	})
+	switch {
+	case err == nil:
+		pieceCid, err := tree.PieceCID()
+		if err == nil && pieceCid == gd.PieceCid && tree.PayloadSize() == payloadSize {
+			return tree, nil
+		}
+		log.Warnw("saved piece tree doesn't match the group piece, computing it from the car", "group", group, "err", err)
+	case !errors.Is(err, os.ErrNotExist):
+		log.Warnw("reading saved piece tree, computing it from the car", "group", group, "err", err)
+	}
+
+	tb, err := datasegment.NewPieceTreeBuilder(pieceSize)
+	if err != nil {
+		return nil, xerrors.Errorf("new piece tree builder: %w", err)
+	}
+	if err := r.ReadCarRange(ctx, group, 0, payloadSize, tb); err != nil {
+		return nil, xerrors.Errorf("reading group car: %w", err)
+	}
+	tree = tb.Tree()
+
+	pieceCid, err := tree.PieceCID()
+	if err != nil {
+		return nil, xerrors.Errorf("piece tree cid: %w", err)
+	}
+	if pieceCid != gd.PieceCid {
+		return nil, xerrors.Errorf("group %d car doesn't match its piece cid, expected %s, computed %s", group, gd.PieceCid, pieceCid)
+	}
+
+	return tree, nil
+}
@@ -0,0 +1,98 @@
+package rbstor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/carlog"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"github.com/lotus-web3/ribs/ributil/piecesample"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockSample(t *testing.T) {
+	defer func(n int64) { maxGroupBlocks = n }(maxGroupBlocks)
+	maxGroupBlocks = 64
+
+	ctx := context.Background()
+	r := openTestRbs(t)
+	sess := r.Session(ctx)
+
+	// fill the first group, so that it gets finalized and commP'd
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, randBlocks(t, 80, 16<<10)))
+	require.NoError(t, bt.Flush(ctx))
+
+	require.Eventually(t, func() bool {
+		gm, err := r.GroupMeta(1)
+		require.NoError(t, err)
+		return gm.State == iface.GroupStateLocalReadyForDeals
+	}, 10*time.Second, 20*time.Millisecond)
+
+	gd, err := r.DescibeGroup(ctx, 1)
+	require.NoError(t, err)
+	_, pieceSize, payloadSize, err := piececid.ToV1(gd.PieceCidV2)
+	require.NoError(t, err)
+
+	seed, err := piecesample.Seed(gd.PieceCid, 100, nil)
+	require.NoError(t, err)
+
+	sample, err := r.BlockSample(ctx, 1, seed, 4)
+	require.NoError(t, err)
+	require.Len(t, sample, 4)
+
+	// sampled blocks are stored at their car locations
+	for _, e := range sample {
+		locs, err := r.CarLocations(ctx, 1, []mh.Multihash{e.Cid.Hash()})
+		require.NoError(t, err)
+		require.Equal(t, iface.BlockLocation{Offset: e.Offset, Size: e.Size}, locs[0])
+	}
+
+	proofs, err := r.ProveBlockSample(ctx, 1, seed, 4)
+	require.NoError(t, err)
+	require.NoError(t, piecesample.VerifySample(gd.PieceCidV2, pieceSize, int64(payloadSize), seed, 4, proofs))
+
+	// proofs use the piece tree saved with commP, and can be made from the car
+	// when the saved tree is damaged or missing
+	idxPath := filepath.Join(r.root, "grp", strconv.FormatInt(1, 32), "blklog.meta")
+	treePath := filepath.Join(idxPath, carlog.PieceTree)
+	require.FileExists(t, treePath)
+
+	// the canonical car index is built in the commP pass
+	require.FileExists(t, filepath.Join(idxPath, carlog.BsstIndexCanon))
+
+	treeData, err := os.ReadFile(treePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(treePath, treeData[:len(treeData)/2], 0644))
+
+	proofs2, err := r.ProveBlockSample(ctx, 1, seed, 4)
+	require.NoError(t, err)
+	require.Equal(t, proofs, proofs2)
+
+	require.NoError(t, os.Remove(treePath))
+	proofs2, err = r.ProveBlockSample(ctx, 1, seed, 4)
+	require.NoError(t, err)
+	require.Equal(t, proofs, proofs2)
+
+	// damaged sample points are reported, but not as missing
+	pointsPath := filepath.Join(idxPath, carlog.SamplePoints)
+	pointsData, err := os.ReadFile(pointsPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(pointsPath, pointsData[:len(pointsData)/2], 0644))
+
+	_, err = r.BlockSample(ctx, 1, seed, 4)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, os.ErrNotExist))
+
+	// another epoch picks other points
+	seed2, err := piecesample.Seed(gd.PieceCid, 101, nil)
+	require.NoError(t, err)
+	require.Error(t, piecesample.VerifySample(gd.PieceCidV2, pieceSize, int64(payloadSize), seed2, 4, proofs))
+}
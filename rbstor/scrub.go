@@ -0,0 +1,179 @@
+package rbstor
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/carlog"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// ScrubStartDelay is the time after Start before the scrubber starts
+	// checking groups
+	ScrubStartDelay = 10 * time.Minute
+
+	// ScrubCheckInterval is how often the scrubber looks for groups to scrub
+	// when no group is due
+	ScrubCheckInterval = time.Minute
+
+	// ScrubIdle is how long the scrubber waits after the last foreground read
+	// before reading data
+	ScrubIdle = time.Second
+
+	DefaultScrubInterval = 7 * 24 * time.Hour
+	DefaultScrubRate     = int64(32 << 20)
+)
+
+// WithScrubInterval sets how often local writable and finalized groups are
+// checked for corruption in the background, 0 disables scrubbing.
+func WithScrubInterval(interval time.Duration) OpenOption {
+	return func(o *openOptions) {
+		o.scrubInterval = interval
+	}
+}
+
+// WithScrubRate limits the bytes per second read by the scrubber
+func WithScrubRate(bytesPerSec int64) OpenOption {
+	return func(o *openOptions) {
+		o.scrubRate = bytesPerSec
+	}
+}
+
+func (r *rbs) scrubber(ctx context.Context) {
+	defer r.bgWg.Done()
+
+	select {
+	case <-time.After(ScrubStartDelay):
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		scrubbed, err := r.scrubNext(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorw("scrubbing group", "error", err)
+		}
+
+		if scrubbed && err == nil {
+			continue
+		}
+
+		select {
+		case <-time.After(ScrubCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scrubNext scrubs the group which is due for scrubbing for the longest time
+func (r *rbs) scrubNext(ctx context.Context) (bool, error) {
+	group, err := r.db.GetScrubCandidate(time.Now().Add(-r.scrubInterval).Unix())
+	if err != nil {
+		return false, err
+	}
+	if group == iface.UndefGroupKey {
+		return false, nil
+	}
+
+	return true, r.scrubGroup(ctx, group)
+}
+
+// scrubGroup checks group data, and records the result. Corruption is reported
+// with GroupEventCorrupted.
+func (r *rbs) scrubGroup(ctx context.Context, group iface.GroupKey) error {
+	log.Infow("scrubbing group", "group", group)
+
+	th := &scrubThrottle{
+		rate:     r.scrubRate,
+		lastRead: &r.lastRead,
+	}
+
+	var st carlog.ScrubStats
+	err := r.withReadableGroup(ctx, group, func(g *Group) error {
+		var err error
+		st, err = g.scrub(ctx, th.wait)
+		return err
+	})
+
+	var scrubErr string
+	switch {
+	case err == nil:
+	case errors.Is(err, carlog.ErrCorrupted):
+		// reported by withReadableGroup
+		scrubErr = err.Error()
+	case errors.Is(err, ErrOffloaded):
+		// offloaded since selected
+		return nil
+	default:
+		return xerrors.Errorf("scrub group %d: %w", group, err)
+	}
+
+	log.Infow("scrubbed group", "group", group, "blocks", st.Blocks, "bytes", st.Bytes, "error", scrubErr)
+
+	return r.db.RecordScrub(ctx, group, time.Now(), st.Blocks, st.Bytes, scrubErr)
+}
+
+// noteForegroundRead makes the scrubber yield to reads
+func (r *rbs) noteForegroundRead() {
+	r.lastRead.Store(time.Now().UnixNano())
+}
+
+// scrubThrottle limits scrubber IO, and pauses it while foreground reads are
+// happening
+type scrubThrottle struct {
+	rate     int64
+	lastRead *atomic.Int64
+
+	start time.Time
+	read  int64
+}
+
+func (t *scrubThrottle) wait(ctx context.Context, n int64) error {
+	yielded := false
+	for {
+		since := time.Since(time.Unix(0, t.lastRead.Load()))
+		if since >= ScrubIdle {
+			break
+		}
+
+		yielded = true
+		if err := sleepCtx(ctx, ScrubIdle-since); err != nil {
+			return err
+		}
+	}
+
+	if t.start.IsZero() || yielded {
+		t.start = time.Now()
+		t.read = 0
+	}
+
+	t.read += n
+	if t.rate <= 0 {
+		return ctx.Err()
+	}
+
+	ahead := time.Duration(float64(t.read)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if ahead < 10*time.Millisecond {
+		// don't sleep for every small block
+		return ctx.Err()
+	}
+
+	return sleepCtx(ctx, ahead)
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	tm := time.NewTimer(d)
+	defer tm.Stop()
+
+	select {
+	case <-tm.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
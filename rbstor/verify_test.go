@@ -0,0 +1,144 @@
+package rbstor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/carlog"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := openTestRbs(t, WithVerifyReads(true))
+	sess := r.Session(ctx)
+
+	evs, err := r.SubscribeEvents(ctx, iface.GroupEventSeqLatest, iface.GroupEventFilter{
+		Types: []iface.GroupEventType{iface.GroupEventCorrupted},
+	})
+	require.NoError(t, err)
+
+	// more blocks than the carlog write cache holds, so that early blocks are
+	// read from disk
+	blks := randBlocks(t, 256, 64)
+
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, blks))
+	require.NoError(t, bt.Flush(ctx))
+
+	dataFile := filepath.Join(r.root, "grp", strconv.FormatInt(1, 32), carlog.BlockLog)
+	data, err := os.ReadFile(dataFile)
+	require.NoError(t, err)
+	at := bytes.Index(data, blks[0].RawData())
+	require.Greater(t, at, 0)
+	data[at] ^= 1
+	require.NoError(t, os.WriteFile(dataFile, data, 0666))
+
+	view := func(i int) error {
+		return sess.View(ctx, []mh.Multihash{blks[i].Cid().Hash()}, func(int, []byte) {})
+	}
+
+	require.NoError(t, view(1))
+	require.ErrorIs(t, view(0), carlog.ErrCorrupted)
+
+	ev := recvEvent(t, evs)
+	require.Equal(t, iface.GroupKey(1), ev.Group)
+	require.Contains(t, ev.Error, "corrupted")
+
+	// corruption is reported once per group
+	require.ErrorIs(t, view(0), carlog.ErrCorrupted)
+	r.sendEvent(iface.GroupEvent{Group: 2, Type: iface.GroupEventCorrupted})
+	require.Equal(t, iface.GroupKey(2), recvEvent(t, evs).Group)
+}
+
+func TestScrub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := openTestRbs(t)
+	sess := r.Session(ctx)
+
+	evs, err := r.SubscribeEvents(ctx, iface.GroupEventSeqLatest, iface.GroupEventFilter{
+		Types: []iface.GroupEventType{iface.GroupEventCorrupted},
+	})
+	require.NoError(t, err)
+
+	blks := randBlocks(t, 16, 64)
+	bt := sess.Batch(ctx)
+	require.NoError(t, bt.Put(ctx, blks))
+	require.NoError(t, bt.Flush(ctx))
+
+	due := func() iface.GroupKey {
+		g, err := r.db.GetScrubCandidate(time.Now().Add(time.Second).Unix())
+		require.NoError(t, err)
+		return g
+	}
+
+	// never scrubbed groups are due
+	require.Equal(t, iface.GroupKey(1), due())
+
+	scrubbed, err := r.scrubNext(ctx)
+	require.NoError(t, err)
+	require.True(t, scrubbed)
+
+	gm, err := r.GroupMeta(1)
+	require.NoError(t, err)
+	require.NotZero(t, gm.LastScrub)
+	require.Empty(t, gm.ScrubError)
+
+	scrubbed, err = r.scrubNext(ctx)
+	require.NoError(t, err)
+	require.False(t, scrubbed)
+
+	dataFile := filepath.Join(r.root, "grp", strconv.FormatInt(1, 32), carlog.BlockLog)
+	data, err := os.ReadFile(dataFile)
+	require.NoError(t, err)
+	data[bytes.Index(data, blks[5].RawData())] ^= 1
+	require.NoError(t, os.WriteFile(dataFile, data, 0666))
+
+	require.NoError(t, r.scrubGroup(ctx, 1))
+
+	gm, err = r.GroupMeta(1)
+	require.NoError(t, err)
+	require.Contains(t, gm.ScrubError, "corrupted")
+	require.Equal(t, iface.GroupKey(1), recvEvent(t, evs).Group)
+}
+
+func TestScrubThrottle(t *testing.T) {
+	ctx := context.Background()
+
+	defer func(d time.Duration) {
+		ScrubIdle = d
+	}(ScrubIdle)
+	ScrubIdle = 50 * time.Millisecond
+
+	var lastRead atomic.Int64
+	th := &scrubThrottle{
+		rate:     1 << 20,
+		lastRead: &lastRead,
+	}
+
+	start := time.Now()
+	require.NoError(t, th.wait(ctx, 100<<10))
+	require.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+
+	// yields to foreground reads
+	lastRead.Store(time.Now().UnixNano())
+	start = time.Now()
+	require.NoError(t, th.wait(ctx, 1))
+	require.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, th.wait(cctx, 1<<20), context.Canceled)
+}
@@ -0,0 +1,269 @@
+// Package datasegment implements aggregation of pieces into one deal piece
+// following the FRC-0058 data segment layout.
+//
+// Sub-pieces are placed at offsets aligned to their size, and the end of the
+// deal holds a segment index describing each sub-piece, so that sub-pieces
+// can be found in the aggregate and proven to be a part of it. Range proofs
+// prove that any part of a piece payload is a part of the piece.
+package datasegment
+
+import (
+	"io"
+	"math/bits"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/storage/sealer/fr32"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// Aggregate is a deal piece made of sub-pieces with a segment index
+type Aggregate struct {
+	DealSize abi.PaddedPieceSize
+
+	// Index holds entries for all sub-pieces, in order of the pieces passed to
+	// NewAggregate
+	Index []SegmentDesc
+
+	tree *sparseTree
+}
+
+// NewAggregate places pieces in a deal of dealSize, in the order given, each
+// at the first offset aligned to its size. Pieces sorted by decreasing size
+// are placed without gaps.
+func NewAggregate(dealSize abi.PaddedPieceSize, pieces []abi.PieceInfo) (*Aggregate, error) {
+	if err := dealSize.Validate(); err != nil {
+		return nil, xerrors.Errorf("invalid deal size: %w", err)
+	}
+	if uint64(dealSize) < 2*uint64(MaxIndexEntries(dealSize))*EntrySize {
+		return nil, xerrors.Errorf("deal size %d too small for the segment index", dealSize)
+	}
+	if len(pieces) > MaxIndexEntries(dealSize) {
+		return nil, xerrors.Errorf("too many pieces (%d) for deal size %d, max %d", len(pieces), dealSize, MaxIndexEntries(dealSize))
+	}
+
+	a := &Aggregate{
+		DealSize: dealSize,
+		Index:    make([]SegmentDesc, len(pieces)),
+		tree:     newSparseTree(bits.TrailingZeros64(uint64(dealSize) / NodeSize)),
+	}
+
+	indexStart := IndexStart(dealSize)
+
+	var at uint64
+	for i, p := range pieces {
+		if err := p.Size.Validate(); err != nil {
+			return nil, xerrors.Errorf("invalid size of piece %d: %w", i, err)
+		}
+
+		commDs, err := commcid.CIDToPieceCommitmentV1(p.PieceCID)
+		if err != nil {
+			return nil, xerrors.Errorf("piece %d commitment: %w", i, err)
+		}
+
+		size := uint64(p.Size)
+		at = (at + size - 1) / size * size
+		if at+size > indexStart {
+			return nil, xerrors.Errorf("piece %d (size %d) doesn't fit before the segment index at %d", i, size, indexStart)
+		}
+
+		var n Node
+		copy(n[:], commDs)
+
+		a.Index[i] = NewSegmentDesc(n, at, size)
+		a.tree.set(bits.TrailingZeros64(size/NodeSize), at/size, n)
+
+		at += size
+	}
+
+	for i := range a.Index {
+		l, r := a.Index[i].leaves()
+		leaf := indexStart/NodeSize + uint64(i)*EntrySize/NodeSize
+		a.tree.set(0, leaf, l)
+		a.tree.set(0, leaf+1, r)
+	}
+
+	a.tree.build()
+
+	return a, nil
+}
+
+// PieceCID returns the commitment of the whole aggregate
+func (a *Aggregate) PieceCID() (cid.Cid, error) {
+	root := a.tree.root()
+	return commcid.PieceCommitmentV1ToCID(root[:])
+}
+
+// InclusionProof returns the proof that sub-piece i is a part of the aggregate
+// and described in its segment index
+func (a *Aggregate) InclusionProof(i int) (InclusionProof, error) {
+	if i < 0 || i >= len(a.Index) {
+		return InclusionProof{}, xerrors.Errorf("piece %d not in the aggregate", i)
+	}
+
+	sd := a.Index[i]
+	entryIdx := IndexStart(a.DealSize)/EntrySize + uint64(i)
+
+	return InclusionProof{
+		ProofSubtree: a.tree.proof(bits.TrailingZeros64(sd.Size/NodeSize), sd.Offset/sd.Size),
+		ProofIndex:   a.tree.proof(1, entryIdx),
+	}, nil
+}
+
+// UnpaddedOffset returns the offset of sub-piece i payload in the unpadded
+// aggregate payload
+func (a *Aggregate) UnpaddedOffset(i int) int64 {
+	return int64(abi.PaddedPieceSize(a.Index[i].Offset).Unpadded())
+}
+
+// indexUnpadded returns the unpadded bytes of the non-zero part of the
+// segment index
+func (a *Aggregate) indexUnpadded() []byte {
+	used := uint64(len(a.Index)) * EntrySize
+	if used < 128 {
+		used = 128
+	}
+	padded := make([]byte, 1<<log2Ceil(used))
+
+	for i := range a.Index {
+		a.Index[i].marshalTo(padded[i*EntrySize:])
+	}
+
+	out := make([]byte, abi.PaddedPieceSize(len(padded)).Unpadded())
+	fr32.Unpad(padded, out)
+	return out
+}
+
+// SegmentWriter writes size bytes of sub-piece seg payload starting at off.
+// It may write less than size bytes when the payload is shorter than its
+// piece, the rest of the range is filled with zeros.
+type SegmentWriter func(w io.Writer, seg int, off, size int64) (int64, error)
+
+// WritePayloadRange writes size bytes of the unpadded aggregate payload
+// starting at off. The payload is what clients transfer to providers, its
+// commitment is the aggregate PieceCID.
+func (a *Aggregate) WritePayloadRange(w io.Writer, off, size int64, segw SegmentWriter) (int64, error) {
+	total := int64(a.DealSize.Unpadded())
+	if off < 0 || size < 0 || off+size > total {
+		return 0, xerrors.Errorf("range %d+%d outside of aggregate payload (%d bytes)", off, size, total)
+	}
+
+	type region struct {
+		start, end int64
+		seg        int // -1 for the index
+	}
+
+	regions := make([]region, 0, len(a.Index)+1)
+	for i, sd := range a.Index {
+		start := a.UnpaddedOffset(i)
+		regions = append(regions, region{start: start, end: start + int64(abi.PaddedPieceSize(sd.Size).Unpadded()), seg: i})
+	}
+	idxStart := int64(abi.PaddedPieceSize(IndexStart(a.DealSize)).Unpadded())
+	regions = append(regions, region{start: idxStart, end: total, seg: -1})
+
+	var idxData []byte
+
+	end := off + size
+	var wrote int64
+	at := off
+
+	for _, r := range regions {
+		if at >= end {
+			break
+		}
+		if r.end <= at {
+			continue
+		}
+
+		// zeros before the region
+		if at < r.start {
+			gapEnd := r.start
+			if gapEnd > end {
+				gapEnd = end
+			}
+			n, err := writeZeros(w, gapEnd-at)
+			wrote += n
+			if err != nil {
+				return wrote, err
+			}
+			at = gapEnd
+			if at >= end {
+				break
+			}
+		}
+
+		toWrite := r.end - at
+		if toWrite > end-at {
+			toWrite = end - at
+		}
+
+		if r.seg == -1 {
+			if idxData == nil {
+				idxData = a.indexUnpadded()
+			}
+
+			var n int64
+			rel := at - r.start
+			if rel < int64(len(idxData)) {
+				data := idxData[rel:]
+				if int64(len(data)) > toWrite {
+					data = data[:toWrite]
+				}
+				wn, err := w.Write(data)
+				n = int64(wn)
+				wrote += n
+				if err != nil {
+					return wrote, err
+				}
+			}
+
+			zn, err := writeZeros(w, toWrite-n)
+			wrote += zn
+			if err != nil {
+				return wrote, err
+			}
+
+			at += toWrite
+			continue
+		}
+
+		n, err := segw(w, r.seg, at-r.start, toWrite)
+		wrote += n
+		if err != nil {
+			return wrote, xerrors.Errorf("writing segment %d: %w", r.seg, err)
+		}
+		if n > toWrite {
+			return wrote, xerrors.Errorf("segment %d writer wrote %d bytes, requested %d", r.seg, n, toWrite)
+		}
+
+		zn, err := writeZeros(w, toWrite-n)
+		wrote += zn
+		if err != nil {
+			return wrote, err
+		}
+
+		at += toWrite
+	}
+
+	return wrote, nil
+}
+
+var zeroBuf [64 << 10]byte
+
+func writeZeros(w io.Writer, n int64) (int64, error) {
+	var wrote int64
+	for wrote < n {
+		chunk := n - wrote
+		if chunk > int64(len(zeroBuf)) {
+			chunk = int64(len(zeroBuf))
+		}
+
+		wn, err := w.Write(zeroBuf[:chunk])
+		wrote += int64(wn)
+		if err != nil {
+			return wrote, err
+		}
+	}
+	return wrote, nil
+}
@@ -0,0 +1,134 @@
+package datasegment
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/require"
+)
+
+func pieceOf(t *testing.T, data []byte) abi.PieceInfo {
+	var cp commp.Calc
+	_, err := cp.Write(data)
+	require.NoError(t, err)
+
+	raw, size, err := cp.Digest()
+	require.NoError(t, err)
+
+	c, err := commcid.PieceCommitmentV1ToCID(raw)
+	require.NoError(t, err)
+
+	return abi.PieceInfo{Size: abi.PaddedPieceSize(size), PieceCID: c}
+}
+
+func TestAggregate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	payloads := [][]byte{
+		make([]byte, 2000),
+		make([]byte, 1000),
+		make([]byte, 300),
+		make([]byte, 100),
+	}
+
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 1, 0, 2}} {
+		var pieces []abi.PieceInfo
+		var data [][]byte
+		for _, i := range order {
+			rng.Read(payloads[i])
+			pieces = append(pieces, pieceOf(t, payloads[i]))
+			data = append(data, payloads[i])
+		}
+
+		const dealSize = abi.PaddedPieceSize(8 << 10)
+
+		a, err := NewAggregate(dealSize, pieces)
+		require.NoError(t, err)
+
+		segw := func(w io.Writer, seg int, off, size int64) (int64, error) {
+			d := data[seg]
+			if off >= int64(len(d)) {
+				return 0, nil
+			}
+			d = d[off:]
+			if int64(len(d)) > size {
+				d = d[:size]
+			}
+			n, err := w.Write(d)
+			return int64(n), err
+		}
+
+		// the commitment of the payload is the aggregate commitment
+		var payload bytes.Buffer
+		n, err := a.WritePayloadRange(&payload, 0, int64(dealSize.Unpadded()), segw)
+		require.NoError(t, err)
+		require.Equal(t, int64(dealSize.Unpadded()), n)
+
+		agg, err := a.PieceCID()
+		require.NoError(t, err)
+		require.Equal(t, pieceOf(t, payload.Bytes()), abi.PieceInfo{Size: dealSize, PieceCID: agg})
+
+		// ranges match the full payload
+		for _, r := range [][2]int64{{0, 10}, {1900, 300}, {3000, 2000}, {7800, 328}, {int64(dealSize.Unpadded()) - 1, 1}, {500, 0}} {
+			var buf bytes.Buffer
+			n, err := a.WritePayloadRange(&buf, r[0], r[1], segw)
+			require.NoError(t, err)
+			require.Equal(t, r[1], n)
+			require.True(t, bytes.Equal(payload.Bytes()[r[0]:r[0]+r[1]], buf.Bytes()), "range %d+%d", r[0], r[1])
+		}
+
+		_, err = a.WritePayloadRange(io.Discard, 8000, 200, segw)
+		require.Error(t, err)
+
+		// sub-pieces are aligned, and proofs verify
+		for i, p := range pieces {
+			require.Equal(t, uint64(0), a.Index[i].Offset%uint64(p.Size))
+			require.NoError(t, a.Index[i].Validate())
+
+			ip, err := a.InclusionProof(i)
+			require.NoError(t, err)
+
+			pb, err := ip.MarshalBinary()
+			require.NoError(t, err)
+
+			var ip2 InclusionProof
+			require.NoError(t, ip2.UnmarshalBinary(pb))
+			require.Equal(t, ip, ip2)
+
+			require.NoError(t, ip2.Verify(agg, dealSize, p.PieceCID, p.Size))
+
+			// wrong sub-piece
+			other := pieces[(i+1)%len(pieces)]
+			require.Error(t, ip2.Verify(agg, dealSize, other.PieceCID, p.Size))
+
+			// wrong index entry
+			ip2.ProofIndex.Index++
+			require.Error(t, ip2.Verify(agg, dealSize, p.PieceCID, p.Size))
+		}
+	}
+}
+
+func TestAggregateLimits(t *testing.T) {
+	require.Equal(t, 4, MaxIndexEntries(8<<10))
+	require.Equal(t, 1<<20, MaxIndexEntries(32<<30))
+	require.Equal(t, uint64(32<<30)-64<<20, IndexStart(32<<30))
+
+	p := pieceOf(t, make([]byte, 2000))
+
+	// doesn't fit before the index
+	_, err := NewAggregate(4<<10, []abi.PieceInfo{p, p})
+	require.Error(t, err)
+
+	// too many entries
+	small := pieceOf(t, make([]byte, 100))
+	_, err = NewAggregate(8<<10, []abi.PieceInfo{small, small, small, small, small})
+	require.Error(t, err)
+
+	_, err = NewAggregate(8<<10, []abi.PieceInfo{small, small, small, small})
+	require.NoError(t, err)
+}
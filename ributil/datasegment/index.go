@@ -0,0 +1,124 @@
+package datasegment
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/minio/sha256-simd"
+	"golang.org/x/xerrors"
+)
+
+// EntrySize is the size of one segment index entry in padded (fr32) space
+const EntrySize = 64
+
+const checksumSize = 16
+
+// SegmentDesc is a data segment index entry, describing one sub-piece of the
+// aggregate. Offset and Size are in padded (fr32) space.
+type SegmentDesc struct {
+	CommDs   Node
+	Offset   uint64
+	Size     uint64
+	Checksum [checksumSize]byte
+}
+
+// MaxIndexEntries returns the number of index entries reserved at the end of
+// a deal of the given size
+func MaxIndexEntries(dealSize abi.PaddedPieceSize) int {
+	res := 4 << log2Ceil(uint64(dealSize)/2048/EntrySize)
+	if res < 4 {
+		return 4
+	}
+	return res
+}
+
+// IndexStart returns the padded offset of the segment index in a deal of the
+// given size
+func IndexStart(dealSize abi.PaddedPieceSize) uint64 {
+	return uint64(dealSize) - uint64(MaxIndexEntries(dealSize))*EntrySize
+}
+
+func log2Ceil(x uint64) int {
+	if x <= 1 {
+		return 0
+	}
+	return bits.Len64(x - 1)
+}
+
+// NewSegmentDesc creates an index entry with a valid checksum
+func NewSegmentDesc(commDs Node, offset, size uint64) SegmentDesc {
+	sd := SegmentDesc{
+		CommDs: commDs,
+		Offset: offset,
+		Size:   size,
+	}
+	sd.Checksum = sd.computeChecksum()
+	return sd
+}
+
+func (sd *SegmentDesc) computeChecksum() [checksumSize]byte {
+	var buf [EntrySize]byte
+	sd.marshalTo(buf[:])
+
+	sum := sha256.Sum256(buf[:EntrySize-checksumSize])
+
+	var out [checksumSize]byte
+	copy(out[:], sum[:checksumSize])
+	out[checksumSize-1] &= 0x3f // keep the entry a valid fr32 node
+
+	return out
+}
+
+func (sd *SegmentDesc) marshalTo(buf []byte) {
+	copy(buf[:32], sd.CommDs[:])
+	binary.LittleEndian.PutUint64(buf[32:40], sd.Offset)
+	binary.LittleEndian.PutUint64(buf[40:48], sd.Size)
+	copy(buf[48:EntrySize], sd.Checksum[:])
+}
+
+// MarshalBinary encodes the entry as it is stored in the padded index
+func (sd *SegmentDesc) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, EntrySize)
+	sd.marshalTo(buf)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes an entry from the padded index
+func (sd *SegmentDesc) UnmarshalBinary(data []byte) error {
+	if len(data) != EntrySize {
+		return xerrors.Errorf("segment desc must be %d bytes, got %d", EntrySize, len(data))
+	}
+
+	copy(sd.CommDs[:], data[:32])
+	sd.Offset = binary.LittleEndian.Uint64(data[32:40])
+	sd.Size = binary.LittleEndian.Uint64(data[40:48])
+	copy(sd.Checksum[:], data[48:EntrySize])
+	return nil
+}
+
+// Validate checks the entry checksum and that the segment is a valid
+// aligned sub-piece
+func (sd *SegmentDesc) Validate() error {
+	if sd.Checksum != sd.computeChecksum() {
+		return xerrors.Errorf("segment desc checksum mismatch")
+	}
+	if sd.Size < 128 || bits.OnesCount64(sd.Size) != 1 {
+		return xerrors.Errorf("segment size %d is not a valid piece size", sd.Size)
+	}
+	if sd.Offset%sd.Size != 0 {
+		return xerrors.Errorf("segment offset %d not aligned to size %d", sd.Offset, sd.Size)
+	}
+	return nil
+}
+
+// leaves returns the two merkle leaves of the entry
+func (sd *SegmentDesc) leaves() (Node, Node) {
+	var buf [EntrySize]byte
+	sd.marshalTo(buf[:])
+
+	var a, b Node
+	copy(a[:], buf[:32])
+	copy(b[:], buf[32:])
+	return a, b
+}
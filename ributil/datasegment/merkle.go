@@ -0,0 +1,161 @@
+package datasegment
+
+import (
+	"encoding/binary"
+
+	"github.com/minio/sha256-simd"
+	"golang.org/x/xerrors"
+)
+
+// NodeSize is the size of a piece commitment tree node
+const NodeSize = 32
+
+// Node is a piece commitment tree node
+type Node [NodeSize]byte
+
+// maxDepth covers trees of pieces up to 2^(maxDepth+5) bytes
+const maxDepth = 58
+
+// zeroNodes[l] is the root of an all-zero subtree with 2^l leaves
+var zeroNodes = func() [maxDepth + 1]Node {
+	var out [maxDepth + 1]Node
+	for l := 1; l <= maxDepth; l++ {
+		out[l] = hashNodes(out[l-1], out[l-1])
+	}
+	return out
+}()
+
+// hashNodes computes the parent of two nodes with the truncated sha256 used
+// for piece commitments
+func hashNodes(left, right Node) Node {
+	h := sha256.New()
+	_, _ = h.Write(left[:])
+	_, _ = h.Write(right[:])
+
+	var out Node
+	h.Sum(out[:0])
+	out[NodeSize-1] &= 0x3f
+	return out
+}
+
+// sparseTree is a piece commitment tree where only some subtrees are known,
+// everything else is zero
+type sparseTree struct {
+	depth  int
+	levels []map[uint64]Node // levels[0] are leaves
+}
+
+func newSparseTree(depth int) *sparseTree {
+	t := &sparseTree{
+		depth:  depth,
+		levels: make([]map[uint64]Node, depth+1),
+	}
+	for i := range t.levels {
+		t.levels[i] = map[uint64]Node{}
+	}
+	return t
+}
+
+// set sets the root of the subtree at the given level and index, must be
+// called for all known subtrees before build
+func (t *sparseTree) set(level int, idx uint64, n Node) {
+	t.levels[level][idx] = n
+}
+
+func (t *sparseTree) node(level int, idx uint64) Node {
+	if n, ok := t.levels[level][idx]; ok {
+		return n
+	}
+	return zeroNodes[level]
+}
+
+// build computes all nodes above known subtrees
+func (t *sparseTree) build() {
+	for l := 0; l < t.depth; l++ {
+		for idx := range t.levels[l] {
+			parent := idx >> 1
+			if _, ok := t.levels[l+1][parent]; ok {
+				continue
+			}
+			t.levels[l+1][parent] = hashNodes(t.node(l, parent<<1), t.node(l, parent<<1|1))
+		}
+	}
+}
+
+func (t *sparseTree) root() Node {
+	return t.node(t.depth, 0)
+}
+
+func (t *sparseTree) proof(level int, idx uint64) ProofData {
+	pd := ProofData{Index: idx}
+	for l := level; l < t.depth; l++ {
+		pd.Path = append(pd.Path, t.node(l, idx^1))
+		idx >>= 1
+	}
+	return pd
+}
+
+// ProofData is a merkle path from a node to the tree root. Index is the
+// position of the node in its tree level.
+type ProofData struct {
+	Index uint64
+	Path  []Node
+}
+
+// ComputeRoot computes the root of the tree the node is proven to be in
+func (pd *ProofData) ComputeRoot(n Node) (Node, error) {
+	if len(pd.Path) > maxDepth {
+		return Node{}, xerrors.Errorf("proof path too long (%d)", len(pd.Path))
+	}
+	if len(pd.Path) < 64 && pd.Index>>len(pd.Path) != 0 {
+		return Node{}, xerrors.Errorf("proof index %d out of range for depth %d", pd.Index, len(pd.Path))
+	}
+
+	idx := pd.Index
+	for _, sib := range pd.Path {
+		if idx&1 == 0 {
+			n = hashNodes(n, sib)
+		} else {
+			n = hashNodes(sib, n)
+		}
+		idx >>= 1
+	}
+
+	return n, nil
+}
+
+func (pd *ProofData) appendBinary(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, pd.Index)
+	buf = binary.AppendUvarint(buf, uint64(len(pd.Path)))
+	for _, n := range pd.Path {
+		buf = append(buf, n[:]...)
+	}
+	return buf
+}
+
+func (pd *ProofData) readBinary(data []byte) ([]byte, error) {
+	idx, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, xerrors.Errorf("reading proof index")
+	}
+	data = data[n:]
+
+	plen, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, xerrors.Errorf("reading proof path length")
+	}
+	data = data[n:]
+
+	if plen > maxDepth || uint64(len(data)) < plen*NodeSize {
+		return nil, xerrors.Errorf("invalid proof path length %d", plen)
+	}
+
+	pd.Index = idx
+	pd.Path = make([]Node, plen)
+	for i := range pd.Path {
+		copy(pd.Path[i][:], data[:NodeSize])
+		data = data[NodeSize:]
+	}
+
+	return data, nil
+}
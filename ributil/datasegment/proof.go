@@ -0,0 +1,105 @@
+package datasegment
+
+import (
+	"math/bits"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// InclusionProof proves that a sub-piece is a part of an aggregate, and that
+// the aggregate segment index describes it
+type InclusionProof struct {
+	// ProofSubtree proves the sub-piece commitment is a node of the
+	// aggregate tree
+	ProofSubtree ProofData
+
+	// ProofIndex proves the segment index entry describing the sub-piece is a
+	// node of the aggregate tree
+	ProofIndex ProofData
+}
+
+// Verify checks that the sub-piece with commitment subPiece and size subSize
+// is included in the aggregate with commitment aggregate and size aggSize
+func (ip *InclusionProof) Verify(aggregate cid.Cid, aggSize abi.PaddedPieceSize, subPiece cid.Cid, subSize abi.PaddedPieceSize) error {
+	if err := aggSize.Validate(); err != nil {
+		return xerrors.Errorf("invalid aggregate size: %w", err)
+	}
+	if err := subSize.Validate(); err != nil {
+		return xerrors.Errorf("invalid sub-piece size: %w", err)
+	}
+
+	aggRaw, err := commcid.CIDToPieceCommitmentV1(aggregate)
+	if err != nil {
+		return xerrors.Errorf("aggregate commitment: %w", err)
+	}
+	subRaw, err := commcid.CIDToPieceCommitmentV1(subPiece)
+	if err != nil {
+		return xerrors.Errorf("sub-piece commitment: %w", err)
+	}
+
+	var aggRoot, subRoot Node
+	copy(aggRoot[:], aggRaw)
+	copy(subRoot[:], subRaw)
+
+	// sub-piece subtree
+	depth := bits.TrailingZeros64(uint64(aggSize) / NodeSize)
+	subLevel := bits.TrailingZeros64(uint64(subSize) / NodeSize)
+	if len(ip.ProofSubtree.Path) != depth-subLevel {
+		return xerrors.Errorf("subtree proof length %d, expected %d", len(ip.ProofSubtree.Path), depth-subLevel)
+	}
+
+	root, err := ip.ProofSubtree.ComputeRoot(subRoot)
+	if err != nil {
+		return xerrors.Errorf("computing subtree proof root: %w", err)
+	}
+	if root != aggRoot {
+		return xerrors.Errorf("subtree proof doesn't match the aggregate commitment")
+	}
+
+	// index entry
+	if len(ip.ProofIndex.Path) != depth-1 {
+		return xerrors.Errorf("index proof length %d, expected %d", len(ip.ProofIndex.Path), depth-1)
+	}
+	if ip.ProofIndex.Index < IndexStart(aggSize)/EntrySize {
+		return xerrors.Errorf("index proof entry %d is outside of the segment index", ip.ProofIndex.Index)
+	}
+
+	entry := NewSegmentDesc(subRoot, ip.ProofSubtree.Index*uint64(subSize), uint64(subSize))
+	l, r := entry.leaves()
+
+	root, err = ip.ProofIndex.ComputeRoot(hashNodes(l, r))
+	if err != nil {
+		return xerrors.Errorf("computing index proof root: %w", err)
+	}
+	if root != aggRoot {
+		return xerrors.Errorf("index proof doesn't match the aggregate commitment")
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the proof as two merkle paths, each an uvarint
+// index, an uvarint path length and the path nodes
+func (ip *InclusionProof) MarshalBinary() ([]byte, error) {
+	buf := ip.ProofSubtree.appendBinary(nil)
+	return ip.ProofIndex.appendBinary(buf), nil
+}
+
+// UnmarshalBinary decodes a proof encoded with MarshalBinary
+func (ip *InclusionProof) UnmarshalBinary(data []byte) error {
+	rest, err := ip.ProofSubtree.readBinary(data)
+	if err != nil {
+		return xerrors.Errorf("reading subtree proof: %w", err)
+	}
+	rest, err = ip.ProofIndex.readBinary(rest)
+	if err != nil {
+		return xerrors.Errorf("reading index proof: %w", err)
+	}
+	if len(rest) != 0 {
+		return xerrors.Errorf("%d trailing bytes after inclusion proof", len(rest))
+	}
+	return nil
+}
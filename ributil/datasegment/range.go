@@ -0,0 +1,454 @@
+package datasegment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/storage/sealer/fr32"
+	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"golang.org/x/xerrors"
+)
+
+// chunkSize is the size of an unpadded fr32 chunk, which is padded to 4 tree
+// leaves, so chunks are the nodes at chunkLevel
+const (
+	chunkSize  = 127
+	chunkLevel = 2
+)
+
+// treeCacheLevel is the level of nodes kept by PieceTree, nodes below it are
+// computed from the payload when proving ranges
+var treeCacheLevel = 15
+
+func spanAt(level int) int64 {
+	return chunkSize << (level - chunkLevel)
+}
+
+// subtreeLevels computes the piece tree over unpadded data, which must be a
+// power of two number of chunks. Levels start at chunk nodes and end with
+// the subtree root.
+func subtreeLevels(unpadded []byte) [][]Node {
+	padded := make([]byte, len(unpadded)/chunkSize*(chunkSize+1))
+	fr32.Pad(unpadded, padded)
+
+	level := make([]Node, len(padded)/NodeSize)
+	for i := range level {
+		copy(level[i][:], padded[i*NodeSize:])
+	}
+
+	var out [][]Node
+	for l := 0; ; l++ {
+		if l >= chunkLevel {
+			out = append(out, level)
+		}
+		if len(level) == 1 {
+			return out
+		}
+
+		next := make([]Node, len(level)/2)
+		for i := range next {
+			next[i] = hashNodes(level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+}
+
+// PayloadReader writes size bytes of the unpadded piece payload starting at
+// off
+type PayloadReader func(w io.Writer, off, size int64) error
+
+// PieceTreeBuilder computes a PieceTree from the unpadded piece payload
+// written to it
+type PieceTreeBuilder struct {
+	size  abi.PaddedPieceSize
+	level int
+
+	buf     []byte
+	nodes   []Node
+	written int64
+}
+
+func NewPieceTreeBuilder(size abi.PaddedPieceSize) (*PieceTreeBuilder, error) {
+	if err := size.Validate(); err != nil {
+		return nil, xerrors.Errorf("invalid piece size: %w", err)
+	}
+
+	level := treeCacheLevel
+	if depth := bits.TrailingZeros64(uint64(size) / NodeSize); level > depth {
+		level = depth
+	}
+
+	return &PieceTreeBuilder{
+		size:  size,
+		level: level,
+		buf:   make([]byte, 0, spanAt(level)),
+	}, nil
+}
+
+func (b *PieceTreeBuilder) Write(p []byte) (int, error) {
+	if b.written+int64(len(p)) > int64(b.size.Unpadded()) {
+		return 0, xerrors.Errorf("payload larger than piece size %d", b.size)
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		take := cap(b.buf) - len(b.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+
+		b.buf = append(b.buf, p[:take]...)
+		p = p[take:]
+
+		if len(b.buf) == cap(b.buf) {
+			b.flush()
+		}
+	}
+
+	b.written += int64(n)
+	return n, nil
+}
+
+func (b *PieceTreeBuilder) flush() {
+	levels := subtreeLevels(b.buf)
+	b.nodes = append(b.nodes, levels[len(levels)-1][0])
+	b.buf = b.buf[:0]
+}
+
+// Tree returns the tree of the payload written so far, followed by zeros up
+// to the piece size
+func (b *PieceTreeBuilder) Tree() *PieceTree {
+	return b.tree(b.size, b.level)
+}
+
+// TreeOf returns the tree of a piece of size, which may be smaller than the
+// builder size, so that trees can be built while the piece size isn't known
+// yet. The payload written so far must fit in the piece.
+func (b *PieceTreeBuilder) TreeOf(size abi.PaddedPieceSize) (*PieceTree, error) {
+	if err := size.Validate(); err != nil {
+		return nil, xerrors.Errorf("invalid piece size: %w", err)
+	}
+	if size > b.size {
+		return nil, xerrors.Errorf("piece size %d larger than builder size %d", size, b.size)
+	}
+	if b.written > int64(size.Unpadded()) {
+		return nil, xerrors.Errorf("payload of %d bytes larger than piece size %d", b.written, size)
+	}
+
+	level := b.level
+	if depth := bits.TrailingZeros64(uint64(size) / NodeSize); level > depth {
+		level = depth
+	}
+
+	return b.tree(size, level), nil
+}
+
+func (b *PieceTreeBuilder) tree(size abi.PaddedPieceSize, level int) *PieceTree {
+	var nodes []Node
+	if level < b.level {
+		// the piece is smaller than a builder node, so the whole payload is
+		// still buffered
+		buf := make([]byte, spanAt(level))
+		copy(buf, b.buf)
+		levels := subtreeLevels(buf)
+		nodes = levels[len(levels)-1]
+	} else {
+		if n := len(b.buf); n > 0 {
+			b.buf = b.buf[:cap(b.buf)]
+			clear(b.buf[n:])
+			b.flush()
+		}
+		nodes = b.nodes
+	}
+
+	return &PieceTree{
+		size:        size,
+		payloadSize: b.written,
+		level:       level,
+		levels:      upperLevels(nodes, uint64(size)/NodeSize>>level, level),
+	}
+}
+
+// upperLevels pads nodes at level with zero nodes to count nodes, and
+// computes all levels up to the root
+func upperLevels(nodes []Node, count uint64, level int) [][]Node {
+	for uint64(len(nodes)) < count {
+		nodes = append(nodes, zeroNodes[level])
+	}
+
+	levels := [][]Node{nodes}
+	for len(nodes) > 1 {
+		next := make([]Node, len(nodes)/2)
+		for i := range next {
+			next[i] = hashNodes(nodes[2*i], nodes[2*i+1])
+		}
+		levels = append(levels, next)
+		nodes = next
+	}
+	return levels
+}
+
+// PieceTree keeps the upper levels of a piece commitment tree, so that range
+// proofs only need to read the payload around the proven range
+type PieceTree struct {
+	size        abi.PaddedPieceSize
+	payloadSize int64
+
+	level  int
+	levels [][]Node // levels[0] are nodes at level
+}
+
+// PieceCID returns the commitment of the piece
+func (t *PieceTree) PieceCID() (cid.Cid, error) {
+	root := t.levels[len(t.levels)-1][0]
+	return commcid.PieceCommitmentV1ToCID(root[:])
+}
+
+// PayloadSize returns the size of the payload the tree was built from
+func (t *PieceTree) PayloadSize() int64 {
+	return t.payloadSize
+}
+
+// MarshalBinary encodes the tree as uvarint piece size, payload size and
+// node level, followed by the nodes at that level covering the payload.
+// Upper levels are computed again when decoding.
+func (t *PieceTree) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(t.size))
+	buf = binary.AppendUvarint(buf, uint64(t.payloadSize))
+	buf = binary.AppendUvarint(buf, uint64(t.level))
+
+	for _, n := range t.levels[0][:t.payloadNodes()] {
+		buf = append(buf, n[:]...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a tree encoded with MarshalBinary
+func (t *PieceTree) UnmarshalBinary(data []byte) error {
+	var f [3]uint64
+	for i := range f {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return xerrors.Errorf("reading tree header field %d", i)
+		}
+		f[i] = v
+		data = data[n:]
+	}
+
+	size := abi.PaddedPieceSize(f[0])
+	if err := size.Validate(); err != nil {
+		return xerrors.Errorf("invalid piece size: %w", err)
+	}
+	if f[1] > uint64(size.Unpadded()) {
+		return xerrors.Errorf("payload of %d bytes larger than piece size %d", f[1], size)
+	}
+	depth := bits.TrailingZeros64(uint64(size) / NodeSize)
+	if f[2] < chunkLevel || f[2] > uint64(depth) {
+		return xerrors.Errorf("invalid node level %d for piece size %d", f[2], size)
+	}
+
+	t.size, t.payloadSize, t.level = size, int64(f[1]), int(f[2])
+
+	nodes := make([]Node, t.payloadNodes())
+	if len(data) != len(nodes)*NodeSize {
+		return xerrors.Errorf("%d bytes of tree nodes, expected %d", len(data), len(nodes)*NodeSize)
+	}
+	for i := range nodes {
+		copy(nodes[i][:], data[i*NodeSize:])
+	}
+
+	t.levels = upperLevels(nodes, uint64(size)/NodeSize>>t.level, t.level)
+	return nil
+}
+
+// payloadNodes returns the number of nodes at the tree level which cover the
+// payload, the rest are zero nodes
+func (t *PieceTree) payloadNodes() int {
+	span := spanAt(t.level)
+	return int((t.payloadSize + span - 1) / span)
+}
+
+// ProveRange proves that size bytes of the unpadded payload starting at off
+// are a part of the piece. read must return the same payload the tree was
+// built from.
+func (t *PieceTree) ProveRange(off, size int64, read PayloadReader) (*RangeProof, error) {
+	if off < 0 || size <= 0 || off+size > int64(t.size.Unpadded()) {
+		return nil, xerrors.Errorf("range %d+%d outside of piece payload", off, size)
+	}
+
+	lo := uint64(off / chunkSize)
+	hi := uint64((off + size + chunkSize - 1) / chunkSize)
+
+	data, err := t.readPayload(int64(lo)*chunkSize, int64(hi-lo)*chunkSize, read)
+	if err != nil {
+		return nil, err
+	}
+
+	// levels below the cached level, only needed for subtrees at range edges
+	lower := map[uint64][][]Node{}
+	node := func(level int, idx uint64) (Node, error) {
+		if level >= t.level {
+			return t.levels[level-t.level][idx], nil
+		}
+
+		sub := idx >> (t.level - level)
+		ls, ok := lower[sub]
+		if !ok {
+			span := spanAt(t.level)
+			sd, err := t.readPayload(int64(sub)*span, span, read)
+			if err != nil {
+				return Node{}, err
+			}
+			ls = subtreeLevels(sd)
+			lower[sub] = ls
+		}
+
+		return ls[level-chunkLevel][idx-sub<<(t.level-level)], nil
+	}
+
+	rp := &RangeProof{
+		Start: int64(lo) * chunkSize,
+		Data:  data,
+	}
+
+	depth := bits.TrailingZeros64(uint64(t.size) / NodeSize)
+	for level := chunkLevel; level < depth; level++ {
+		if lo&1 == 1 {
+			n, err := node(level, lo-1)
+			if err != nil {
+				return nil, err
+			}
+			rp.Siblings = append(rp.Siblings, n)
+			lo--
+		}
+		if hi&1 == 1 {
+			n, err := node(level, hi)
+			if err != nil {
+				return nil, err
+			}
+			rp.Siblings = append(rp.Siblings, n)
+			hi++
+		}
+		lo >>= 1
+		hi >>= 1
+	}
+
+	return rp, nil
+}
+
+// readPayload reads the unpadded payload, zeros after the end of the payload
+func (t *PieceTree) readPayload(off, size int64, read PayloadReader) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+
+	n := size
+	if off+n > t.payloadSize {
+		n = t.payloadSize - off
+	}
+	if n > 0 {
+		if err := read(buf, off, n); err != nil {
+			return nil, xerrors.Errorf("reading payload range %d+%d: %w", off, n, err)
+		}
+		if int64(buf.Len()) != n {
+			return nil, xerrors.Errorf("read %d bytes of payload range %d+%d", buf.Len(), off, n)
+		}
+	}
+
+	return append(buf.Bytes(), make([]byte, size-int64(buf.Len()))...), nil
+}
+
+// RangeProof proves that a range of the unpadded payload is a part of a piece
+type RangeProof struct {
+	// Start is the payload offset of Data, a multiple of 127
+	Start int64
+
+	// Data is the unpadded payload of all fr32 chunks covering the range
+	Data []byte
+
+	// Siblings are the nodes needed to compute the piece commitment from
+	// Data, lowest level first, left sibling before right sibling
+	Siblings []Node
+}
+
+// Verify checks that the proof data is a part of the piece with v1 or v2
+// piece CID piece and padded size size
+func (rp *RangeProof) Verify(piece cid.Cid, size abi.PaddedPieceSize) error {
+	if err := size.Validate(); err != nil {
+		return xerrors.Errorf("invalid piece size: %w", err)
+	}
+
+	v1, err := piececid.Normalize(piece)
+	if err != nil {
+		return err
+	}
+	commP, err := commcid.CIDToPieceCommitmentV1(v1)
+	if err != nil {
+		return xerrors.Errorf("piece commitment: %w", err)
+	}
+
+	if rp.Start < 0 || rp.Start%chunkSize != 0 || len(rp.Data) == 0 || len(rp.Data)%chunkSize != 0 {
+		return xerrors.Errorf("proof data %d+%d not aligned to fr32 chunks", rp.Start, len(rp.Data))
+	}
+
+	depth := bits.TrailingZeros64(uint64(size) / NodeSize)
+	lo := uint64(rp.Start / chunkSize)
+	hi := lo + uint64(len(rp.Data)/chunkSize)
+	if hi > 1<<(depth-chunkLevel) {
+		return xerrors.Errorf("proof data outside of piece payload")
+	}
+
+	nodes := make([]Node, 0, hi-lo)
+	for at := 0; at < len(rp.Data); at += chunkSize {
+		nodes = append(nodes, subtreeLevels(rp.Data[at : at+chunkSize])[0][0])
+	}
+
+	sibs := rp.Siblings
+	for level := chunkLevel; level < depth; level++ {
+		if lo&1 == 1 {
+			if len(sibs) == 0 {
+				return xerrors.Errorf("missing left sibling at level %d", level)
+			}
+			nodes = append([]Node{sibs[0]}, nodes...)
+			sibs = sibs[1:]
+			lo--
+		}
+		if hi&1 == 1 {
+			if len(sibs) == 0 {
+				return xerrors.Errorf("missing right sibling at level %d", level)
+			}
+			nodes = append(nodes, sibs[0])
+			sibs = sibs[1:]
+			hi++
+		}
+
+		next := make([]Node, len(nodes)/2)
+		for i := range next {
+			next[i] = hashNodes(nodes[2*i], nodes[2*i+1])
+		}
+		nodes = next
+		lo >>= 1
+		hi >>= 1
+	}
+
+	if len(sibs) != 0 {
+		return xerrors.Errorf("%d unused siblings in proof", len(sibs))
+	}
+	if !bytes.Equal(nodes[0][:], commP) {
+		return xerrors.Errorf("range proof doesn't match the piece commitment")
+	}
+
+	return nil
+}
+
+// Bytes returns size bytes of the payload starting at off, the range must be
+// covered by the proof
+func (rp *RangeProof) Bytes(off, size int64) ([]byte, error) {
+	if off < rp.Start || size < 0 || off+size > rp.Start+int64(len(rp.Data)) {
+		return nil, xerrors.Errorf("range %d+%d not covered by the proof", off, size)
+	}
+	return rp.Data[off-rp.Start : off-rp.Start+size], nil
+}
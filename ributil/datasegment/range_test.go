@@ -0,0 +1,147 @@
+package datasegment
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeProof(t *testing.T) {
+	defer func(l int) { treeCacheLevel = l }(treeCacheLevel)
+
+	for _, cacheLevel := range []int{4, 15} {
+		treeCacheLevel = cacheLevel
+
+		rng := rand.New(rand.NewSource(2))
+		payload := make([]byte, 20000)
+		rng.Read(payload)
+
+		const size = abi.PaddedPieceSize(32 << 10)
+
+		p := pieceOf(t, payload)
+		require.Equal(t, size, p.Size)
+
+		b, err := NewPieceTreeBuilder(size)
+		require.NoError(t, err)
+
+		// odd write sizes
+		for at := 0; at < len(payload); at += 333 {
+			end := at + 333
+			if end > len(payload) {
+				end = len(payload)
+			}
+			_, err := b.Write(payload[at:end])
+			require.NoError(t, err)
+		}
+
+		tree := b.Tree()
+		c, err := tree.PieceCID()
+		require.NoError(t, err)
+		require.Equal(t, p.PieceCID, c)
+
+		var reads int
+		read := func(w io.Writer, off, size int64) error {
+			reads++
+			_, err := w.Write(payload[off : off+size])
+			return err
+		}
+
+		for _, r := range [][2]int64{{0, 1}, {126, 2}, {1000, 5000}, {19990, 10}, {19000, 3000}, {30000, 100}, {0, int64(size.Unpadded())}} {
+			rp, err := tree.ProveRange(r[0], r[1], read)
+			require.NoError(t, err)
+			require.NoError(t, rp.Verify(p.PieceCID, size), "range %d+%d", r[0], r[1])
+
+			data, err := rp.Bytes(r[0], r[1])
+			require.NoError(t, err)
+
+			expect := make([]byte, r[1])
+			if r[0] < int64(len(payload)) {
+				copy(expect, payload[r[0]:])
+			}
+			require.True(t, bytes.Equal(expect, data), "range %d+%d", r[0], r[1])
+
+			_, err = rp.Bytes(r[0]-chunkSize, r[1])
+			require.Error(t, err)
+
+			// wrong piece size
+			require.Error(t, rp.Verify(p.PieceCID, size*2))
+
+			// tampered data
+			rp.Data[len(rp.Data)/2] ^= 1
+			require.Error(t, rp.Verify(p.PieceCID, size))
+			rp.Data[len(rp.Data)/2] ^= 1
+
+			// tampered sibling
+			if len(rp.Siblings) > 0 {
+				rp.Siblings[0][0] ^= 1
+				require.Error(t, rp.Verify(p.PieceCID, size))
+			}
+		}
+		require.NotZero(t, reads)
+
+		_, err = tree.ProveRange(int64(size.Unpadded())-10, 20, read)
+		require.Error(t, err)
+
+		_, err = b.Write(make([]byte, size))
+		require.Error(t, err)
+	}
+}
+
+func TestPieceTreeOf(t *testing.T) {
+	defer func(l int) { treeCacheLevel = l }(treeCacheLevel)
+
+	const maxSize = abi.PaddedPieceSize(1 << 20)
+
+	for _, cacheLevel := range []int{4, 15} {
+		treeCacheLevel = cacheLevel
+
+		// pieces both smaller and larger than a cached node
+		for _, n := range []int{200, 1500, 20000} {
+			rng := rand.New(rand.NewSource(int64(n)))
+			payload := make([]byte, n)
+			rng.Read(payload)
+
+			p := pieceOf(t, payload)
+
+			b, err := NewPieceTreeBuilder(maxSize)
+			require.NoError(t, err)
+			_, err = b.Write(payload)
+			require.NoError(t, err)
+
+			_, err = b.TreeOf(p.Size / 2)
+			require.Error(t, err)
+			_, err = b.TreeOf(maxSize * 2)
+			require.Error(t, err)
+
+			tree, err := b.TreeOf(p.Size)
+			require.NoError(t, err)
+			require.Equal(t, int64(n), tree.PayloadSize())
+
+			c, err := tree.PieceCID()
+			require.NoError(t, err)
+			require.Equal(t, p.PieceCID, c, "level %d, payload %d", cacheLevel, n)
+
+			data, err := tree.MarshalBinary()
+			require.NoError(t, err)
+
+			var dec PieceTree
+			require.NoError(t, dec.UnmarshalBinary(data))
+			require.Equal(t, tree, &dec)
+
+			read := func(w io.Writer, off, size int64) error {
+				_, err := w.Write(payload[off : off+size])
+				return err
+			}
+			rp, err := dec.ProveRange(int64(n)/2, 10, read)
+			require.NoError(t, err)
+			require.NoError(t, rp.Verify(p.PieceCID, p.Size))
+
+			require.Error(t, dec.UnmarshalBinary(data[:len(data)-1]))
+			require.Error(t, dec.UnmarshalBinary(append(data, 0)))
+		}
+	}
+}
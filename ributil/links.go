@@ -0,0 +1,53 @@
+package ributil
+
+import (
+	"bytes"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+var ErrUnsupportedCodec = xerrors.New("unsupported codec")
+
+// BlockLinks calls cb for each CID linked from the block. Supports dag-pb,
+// dag-cbor and raw blocks.
+func BlockLinks(c cid.Cid, data []byte, cb func(cid.Cid)) error {
+	switch c.Prefix().Codec {
+	case cid.Raw:
+		return nil
+	case cid.DagProtobuf:
+		nd, err := merkledag.DecodeProtobuf(data)
+		if err != nil {
+			return xerrors.Errorf("decoding dag-pb block %s: %w", c, err)
+		}
+
+		for _, l := range nd.Links() {
+			cb(l.Cid)
+		}
+		return nil
+	case cid.DagCBOR:
+		if err := cbg.ScanForLinks(bytes.NewReader(data), cb); err != nil {
+			return xerrors.Errorf("scanning dag-cbor block %s: %w", c, err)
+		}
+		return nil
+	default:
+		return xerrors.Errorf("block %s (codec 0x%x): %w", c, c.Prefix().Codec, ErrUnsupportedCodec)
+	}
+}
+
+// InlineData returns data of identity-hashed CIDs, which isn't stored in blockstores
+func InlineData(c cid.Cid) ([]byte, bool) {
+	if c.Prefix().MhType != mh.IDENTITY {
+		return nil, false
+	}
+
+	dmh, err := mh.Decode(c.Hash())
+	if err != nil {
+		return nil, false
+	}
+
+	return dmh.Digest, true
+}
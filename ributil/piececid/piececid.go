@@ -0,0 +1,120 @@
+// Package piececid converts between v1 (commP) and v2 (FRC-0069) piece CIDs.
+//
+// v1 piece CIDs carry only the piece commitment. v2 piece CIDs also carry the
+// piece tree height and the amount of padding after the payload, so the
+// padded piece size and the payload size can be recovered from the CID alone.
+package piececid
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// FR32Sha256Trunc254Padbintree is the multihash code of v2 piece CIDs
+const FR32Sha256Trunc254Padbintree = 0x1011
+
+const commSize = 32
+
+// FromCommP returns the v2 piece CID of a piece with commitment commP, padded
+// size paddedSize and payloadSize bytes of payload
+func FromCommP(commP []byte, paddedSize abi.PaddedPieceSize, payloadSize uint64) (cid.Cid, error) {
+	if len(commP) != commSize {
+		return cid.Undef, xerrors.Errorf("commP must be %d bytes, got %d", commSize, len(commP))
+	}
+	if err := paddedSize.Validate(); err != nil {
+		return cid.Undef, xerrors.Errorf("invalid piece size: %w", err)
+	}
+
+	unpadded := uint64(paddedSize.Unpadded())
+	if payloadSize > unpadded {
+		return cid.Undef, xerrors.Errorf("payload size %d larger than unpadded piece size %d", payloadSize, unpadded)
+	}
+
+	height := bits.TrailingZeros64(uint64(paddedSize) / commSize)
+
+	digest := binary.AppendUvarint(nil, unpadded-payloadSize)
+	digest = append(digest, byte(height))
+	digest = append(digest, commP...)
+
+	mh, err := multihash.Encode(digest, FR32Sha256Trunc254Padbintree)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("encoding multihash: %w", err)
+	}
+
+	return cid.NewCidV1(uint64(multicodec.Raw), mh), nil
+}
+
+// FromV1 returns the v2 piece CID of a piece with v1 piece CID c
+func FromV1(c cid.Cid, paddedSize abi.PaddedPieceSize, payloadSize uint64) (cid.Cid, error) {
+	commP, err := commcid.CIDToPieceCommitmentV1(c)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("v1 piece cid: %w", err)
+	}
+
+	return FromCommP(commP, paddedSize, payloadSize)
+}
+
+// IsV2 returns whether c is a v2 piece CID
+func IsV2(c cid.Cid) bool {
+	return c.Defined() && c.Prefix().Codec == uint64(multicodec.Raw) && c.Prefix().MhType == FR32Sha256Trunc254Padbintree
+}
+
+// ToV1 returns the v1 piece CID, the padded piece size and the payload size
+// of a v2 piece CID
+func ToV1(c cid.Cid) (cid.Cid, abi.PaddedPieceSize, uint64, error) {
+	if !IsV2(c) {
+		return cid.Undef, 0, 0, xerrors.Errorf("%s is not a v2 piece cid", c)
+	}
+
+	dmh, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return cid.Undef, 0, 0, xerrors.Errorf("decoding multihash: %w", err)
+	}
+
+	padding, n := binary.Uvarint(dmh.Digest)
+	if n <= 0 {
+		return cid.Undef, 0, 0, xerrors.Errorf("reading padding")
+	}
+	rest := dmh.Digest[n:]
+	if len(rest) != 1+commSize {
+		return cid.Undef, 0, 0, xerrors.Errorf("invalid v2 piece cid digest length")
+	}
+
+	height := int(rest[0])
+	if height < 2 || height > 58 {
+		return cid.Undef, 0, 0, xerrors.Errorf("invalid piece tree height %d", height)
+	}
+
+	paddedSize := abi.PaddedPieceSize(commSize << height)
+	unpadded := uint64(paddedSize.Unpadded())
+	if padding > unpadded {
+		return cid.Undef, 0, 0, xerrors.Errorf("padding %d larger than unpadded piece size %d", padding, unpadded)
+	}
+
+	v1, err := commcid.PieceCommitmentV1ToCID(rest[1:])
+	if err != nil {
+		return cid.Undef, 0, 0, xerrors.Errorf("v1 piece cid: %w", err)
+	}
+
+	return v1, paddedSize, unpadded - padding, nil
+}
+
+// Normalize returns the v1 piece CID of a v1 or v2 piece CID
+func Normalize(c cid.Cid) (cid.Cid, error) {
+	if IsV2(c) {
+		v1, _, _, err := ToV1(c)
+		return v1, err
+	}
+
+	if _, err := commcid.CIDToPieceCommitmentV1(c); err != nil {
+		return cid.Undef, xerrors.Errorf("%s is not a piece cid: %w", c, err)
+	}
+	return c, nil
+}
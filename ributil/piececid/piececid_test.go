@@ -0,0 +1,72 @@
+package piececid
+
+import (
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceCIDv2(t *testing.T) {
+	commP := make([]byte, 32)
+	for i := range commP {
+		commP[i] = byte(i)
+	}
+	commP[31] &= 0x3f
+
+	v1, err := commcid.PieceCommitmentV1ToCID(commP)
+	require.NoError(t, err)
+
+	const size = abi.PaddedPieceSize(32 << 20)
+	payload := uint64(size.Unpadded()) - 1000
+
+	v2, err := FromV1(v1, size, payload)
+	require.NoError(t, err)
+	require.True(t, IsV2(v2))
+	require.False(t, IsV2(v1))
+
+	// padding (1000) as uvarint, height, commP
+	dmh, err := multihash.Decode(v2.Hash())
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{0xe8, 0x07, 20}, commP...), dmh.Digest)
+
+	// string round trip
+	parsed, err := cid.Parse(v2.String())
+	require.NoError(t, err)
+	require.Equal(t, v2, parsed)
+
+	gotV1, gotSize, gotPayload, err := ToV1(parsed)
+	require.NoError(t, err)
+	require.Equal(t, v1, gotV1)
+	require.Equal(t, size, gotSize)
+	require.Equal(t, payload, gotPayload)
+
+	n, err := Normalize(v2)
+	require.NoError(t, err)
+	require.Equal(t, v1, n)
+
+	n, err = Normalize(v1)
+	require.NoError(t, err)
+	require.Equal(t, v1, n)
+
+	_, _, _, err = ToV1(v1)
+	require.Error(t, err)
+
+	_, err = Normalize(cid.NewCidV1(cid.Raw, v1.Hash()))
+	require.Error(t, err)
+
+	// payload doesn't fit in the piece
+	_, err = FromCommP(commP, size, uint64(size))
+	require.Error(t, err)
+
+	// full piece has no padding
+	full, err := FromCommP(commP, 128, 127)
+	require.NoError(t, err)
+	_, gotSize, gotPayload, err = ToV1(full)
+	require.NoError(t, err)
+	require.Equal(t, abi.PaddedPieceSize(128), gotSize)
+	require.Equal(t, uint64(127), gotPayload)
+}
@@ -0,0 +1,294 @@
+// Package piecesample implements deterministic, verifiable sampling of blocks
+// in a piece whose payload is a CARv1.
+//
+// Sample points are evenly spaced positions in the piece payload, derived
+// only from the payload size. The block entries covering sample points are
+// recorded when the car is written. Samples are picked from sample points with
+// a seed derived from the piece CID, a chain epoch and a beacon, so anyone
+// knowing the piece can check which blocks a sample should contain, and block
+// proofs show that sampled blocks are at their sample points in the piece.
+package piecesample
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"github.com/minio/sha256-simd"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// MinStride is the smallest distance between sample points
+	MinStride = 4 << 10
+
+	// MaxPoints is the maximum number of sample points in a piece
+	MaxPoints = 2048
+)
+
+const seedDomain = "ribs/piecesample/v1"
+
+// Stride returns the distance between sample points of a payload, the
+// smallest power of two multiple of MinStride giving at most MaxPoints points
+func Stride(payloadSize int64) int64 {
+	stride := int64(MinStride)
+	for (payloadSize-1)/stride > MaxPoints {
+		stride *= 2
+	}
+	return stride
+}
+
+// PointCount returns the number of sample points of a payload. Sample point
+// i is at (i+1)*Stride(payloadSize).
+func PointCount(payloadSize int64) int {
+	if payloadSize <= 0 {
+		return 0
+	}
+	return int((payloadSize - 1) / Stride(payloadSize))
+}
+
+// Seed derives a sample seed from a v1 or v2 piece CID, a chain epoch and a
+// beacon, e.g. the chain randomness at that epoch
+func Seed(piece cid.Cid, epoch int64, beacon []byte) ([32]byte, error) {
+	v1, err := piececid.Normalize(piece)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	h := sha256.New()
+	_, _ = h.Write([]byte(seedDomain))
+	_, _ = h.Write(v1.Bytes())
+	_ = binary.Write(h, binary.BigEndian, epoch)
+	_, _ = h.Write(beacon)
+
+	var out [32]byte
+	h.Sum(out[:0])
+	return out, nil
+}
+
+// Pick returns indexes of n distinct sample points out of count picked with
+// seed. All points are returned, in picking order, when n >= count.
+func Pick(seed [32]byte, count, n int) []int {
+	if n > count {
+		n = count
+	}
+
+	out := make([]int, 0, n)
+	seen := make(map[int]struct{}, n)
+
+	var buf [40]byte
+	copy(buf[:], seed[:])
+	for i := uint64(0); len(out) < n; i++ {
+		binary.BigEndian.PutUint64(buf[32:], i)
+		h := sha256.Sum256(buf[:])
+
+		idx := int(binary.BigEndian.Uint64(h[:8]) % uint64(count))
+		if _, ok := seen[idx]; ok {
+			continue
+		}
+		seen[idx] = struct{}{}
+		out = append(out, idx)
+	}
+
+	return out
+}
+
+// Entry is the car block entry covering a sample point
+type Entry struct {
+	Point int64
+
+	// Offset and Size locate the whole entry, including the length prefix
+	Offset, Size int64
+	Cid          cid.Cid
+}
+
+// Points are the entries covering all sample points of a payload
+type Points struct {
+	PayloadSize int64
+	Entries     []Entry
+}
+
+// Sample returns the entries at n sample points picked with seed
+func (p *Points) Sample(seed [32]byte, n int) []Entry {
+	idx := Pick(seed, len(p.Entries), n)
+
+	out := make([]Entry, len(idx))
+	for i, ix := range idx {
+		out[i] = p.Entries[ix]
+	}
+	return out
+}
+
+// MarshalBinary encodes points as uvarint fields, entries are only stored
+// once for consecutive points they cover
+func (p *Points) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(p.PayloadSize))
+	buf = binary.AppendUvarint(buf, uint64(len(p.Entries)))
+
+	for i, e := range p.Entries {
+		if i > 0 && p.Entries[i-1].Offset == e.Offset {
+			buf = append(buf, 0)
+			continue
+		}
+
+		buf = append(buf, 1)
+		buf = binary.AppendUvarint(buf, uint64(e.Offset))
+		buf = binary.AppendUvarint(buf, uint64(e.Size))
+		buf = binary.AppendUvarint(buf, uint64(e.Cid.ByteLen()))
+		buf = append(buf, e.Cid.Bytes()...)
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes points encoded with MarshalBinary
+func (p *Points) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return xerrors.Errorf("reading payload size: %w", err)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return xerrors.Errorf("reading entry count: %w", err)
+	}
+
+	p.PayloadSize = int64(size)
+	if n != uint64(PointCount(p.PayloadSize)) {
+		return xerrors.Errorf("%d entries, payload of %d bytes has %d sample points", n, size, PointCount(p.PayloadSize))
+	}
+
+	stride := Stride(p.PayloadSize)
+	p.Entries = make([]Entry, n)
+
+	for i := range p.Entries {
+		p.Entries[i].Point = int64(i+1) * stride
+
+		same, err := r.ReadByte()
+		if err != nil {
+			return xerrors.Errorf("reading entry %d: %w", i, err)
+		}
+		if same == 0 {
+			if i == 0 {
+				return xerrors.Errorf("first entry can't repeat a previous entry")
+			}
+			e := p.Entries[i-1]
+			p.Entries[i].Offset, p.Entries[i].Size, p.Entries[i].Cid = e.Offset, e.Size, e.Cid
+			continue
+		}
+
+		var f [3]uint64
+		for fi := range f {
+			f[fi], err = binary.ReadUvarint(r)
+			if err != nil {
+				return xerrors.Errorf("reading entry %d: %w", i, err)
+			}
+		}
+		if f[2] > uint64(r.Len()) {
+			return xerrors.Errorf("entry %d cid length %d too large", i, f[2])
+		}
+
+		cb := make([]byte, f[2])
+		_, _ = r.Read(cb)
+
+		_, c, err := cid.CidFromBytes(cb)
+		if err != nil {
+			return xerrors.Errorf("entry %d cid: %w", i, err)
+		}
+
+		p.Entries[i].Offset, p.Entries[i].Size, p.Entries[i].Cid = int64(f[0]), int64(f[1]), c
+	}
+
+	if r.Len() != 0 {
+		return xerrors.Errorf("%d trailing bytes after sample points", r.Len())
+	}
+	return nil
+}
+
+// BlockProof proves that a block entry covers a sample point in a piece
+type BlockProof struct {
+	Entry
+
+	// Range proves the whole entry is a part of the piece
+	Range datasegment.RangeProof
+}
+
+// Prove proves that entry e covers its sample point in the piece of tree
+func Prove(tree *datasegment.PieceTree, e Entry, read datasegment.PayloadReader) (BlockProof, error) {
+	rp, err := tree.ProveRange(e.Offset, e.Size, read)
+	if err != nil {
+		return BlockProof{}, xerrors.Errorf("proving entry range: %w", err)
+	}
+
+	return BlockProof{Entry: e, Range: *rp}, nil
+}
+
+// Verify checks that the proven entry is a valid block entry covering a
+// sample point of the piece with v1 or v2 piece CID piece, padded size
+// pieceSize and payloadSize bytes of payload
+func (bp *BlockProof) Verify(piece cid.Cid, pieceSize abi.PaddedPieceSize, payloadSize int64) error {
+	if bp.Point <= 0 || bp.Point >= payloadSize || bp.Point%Stride(payloadSize) != 0 {
+		return xerrors.Errorf("%d is not a sample point", bp.Point)
+	}
+	if bp.Point < bp.Offset || bp.Point >= bp.Offset+bp.Size {
+		return xerrors.Errorf("entry %d+%d doesn't cover sample point %d", bp.Offset, bp.Size, bp.Point)
+	}
+
+	ent, err := bp.Range.Bytes(bp.Offset, bp.Size)
+	if err != nil {
+		return err
+	}
+
+	entLen, n := binary.Uvarint(ent)
+	if n <= 0 || entLen != uint64(len(ent)-n) {
+		return xerrors.Errorf("invalid entry length")
+	}
+
+	cn, c, err := cid.CidFromBytes(ent[n:])
+	if err != nil {
+		return xerrors.Errorf("parsing entry cid: %w", err)
+	}
+	if c != bp.Cid {
+		return xerrors.Errorf("entry cid %s, expected %s", c, bp.Cid)
+	}
+
+	check, err := c.Prefix().Sum(ent[n+cn:])
+	if err != nil {
+		return xerrors.Errorf("hashing entry data: %w", err)
+	}
+	if !check.Equals(c) {
+		return xerrors.Errorf("entry data doesn't match cid %s", c)
+	}
+
+	if err := bp.Range.Verify(piece, pieceSize); err != nil {
+		return xerrors.Errorf("verifying range proof: %w", err)
+	}
+
+	return nil
+}
+
+// VerifySample checks that proofs are valid block proofs for the n sample
+// points picked with seed
+func VerifySample(piece cid.Cid, pieceSize abi.PaddedPieceSize, payloadSize int64, seed [32]byte, n int, proofs []BlockProof) error {
+	stride := Stride(payloadSize)
+	idx := Pick(seed, PointCount(payloadSize), n)
+
+	if len(proofs) != len(idx) {
+		return xerrors.Errorf("got %d block proofs, expected %d", len(proofs), len(idx))
+	}
+
+	for i, ix := range idx {
+		if expect := int64(ix+1) * stride; proofs[i].Point != expect {
+			return xerrors.Errorf("proof %d is for point %d, expected %d", i, proofs[i].Point, expect)
+		}
+		if err := proofs[i].Verify(piece, pieceSize, payloadSize); err != nil {
+			return xerrors.Errorf("block proof %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
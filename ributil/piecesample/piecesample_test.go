@@ -0,0 +1,151 @@
+package piecesample
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/lotus-web3/ribs/ributil/datasegment"
+	"github.com/lotus-web3/ribs/ributil/piececid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+
+	// ~10MiB car, enough to thin out sample points
+	var carBuf bytes.Buffer
+	var blks []blocks.Block
+	for carBuf.Len() < 10<<20 {
+		data := make([]byte, 100+rng.Intn(100<<10))
+		rng.Read(data)
+		b := blocks.NewBlock(data)
+		blks = append(blks, b)
+
+		if carBuf.Len() == 0 {
+			require.NoError(t, car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{b.Cid()}, Version: 1}, &carBuf))
+		}
+		require.NoError(t, carutil.LdWrite(&carBuf, b.Cid().Bytes(), b.RawData()))
+	}
+	payload := carBuf.Bytes()
+	payloadSize := int64(len(payload))
+
+	require.Greater(t, Stride(payloadSize), int64(MinStride))
+
+	rec := NewRecorder()
+	for at := 0; at < len(payload); {
+		n := 1 + rng.Intn(70000)
+		if at+n > len(payload) {
+			n = len(payload) - at
+		}
+		_, err := rec.Write(payload[at : at+n])
+		require.NoError(t, err)
+		at += n
+	}
+
+	pts, err := rec.Points()
+	require.NoError(t, err)
+	require.Equal(t, payloadSize, pts.PayloadSize)
+	require.Len(t, pts.Entries, PointCount(payloadSize))
+	require.LessOrEqual(t, len(pts.Entries), MaxPoints)
+
+	// entries cover their points
+	for i, e := range pts.Entries {
+		require.Equal(t, int64(i+1)*Stride(payloadSize), e.Point)
+		require.True(t, e.Offset <= e.Point && e.Point < e.Offset+e.Size)
+
+		c, _, err := carutil.ReadNode(bufio.NewReader(bytes.NewReader(payload[e.Offset : e.Offset+e.Size])))
+		require.NoError(t, err)
+		require.Equal(t, e.Cid, c)
+	}
+
+	enc, err := pts.MarshalBinary()
+	require.NoError(t, err)
+	var pts2 Points
+	require.NoError(t, pts2.UnmarshalBinary(enc))
+	require.Equal(t, *pts, pts2)
+
+	// piece tree
+	size := abi.PaddedPieceSize(32 << 20)
+	tb, err := datasegment.NewPieceTreeBuilder(size)
+	require.NoError(t, err)
+	_, err = tb.Write(payload)
+	require.NoError(t, err)
+	tree := tb.Tree()
+
+	piece, err := tree.PieceCID()
+	require.NoError(t, err)
+	pieceV2, err := piececid.FromV1(piece, size, uint64(payloadSize))
+	require.NoError(t, err)
+
+	read := func(w io.Writer, off, size int64) error {
+		_, err := w.Write(payload[off : off+size])
+		return err
+	}
+
+	seed, err := Seed(piece, 1000, []byte("beacon"))
+	require.NoError(t, err)
+
+	// v1 and v2 piece cids give the same seed, epochs give different seeds
+	seed2, err := Seed(pieceV2, 1000, []byte("beacon"))
+	require.NoError(t, err)
+	require.Equal(t, seed, seed2)
+	seed2, err = Seed(piece, 1001, []byte("beacon"))
+	require.NoError(t, err)
+	require.NotEqual(t, seed, seed2)
+
+	sample := pts.Sample(seed, 8)
+	require.Len(t, sample, 8)
+	require.Equal(t, sample, pts.Sample(seed, 8))
+
+	var proofs []BlockProof
+	for _, e := range sample {
+		bp, err := Prove(tree, e, read)
+		require.NoError(t, err)
+		require.NoError(t, bp.Verify(pieceV2, size, payloadSize))
+		proofs = append(proofs, bp)
+	}
+
+	require.NoError(t, VerifySample(piece, size, payloadSize, seed, 8, proofs))
+
+	// proofs for a different seed
+	require.Error(t, VerifySample(piece, size, payloadSize, seed2, 8, proofs))
+
+	// entry not covering the point
+	bad := proofs[0]
+	bad.Point += Stride(payloadSize) * 100
+	require.Error(t, bad.Verify(piece, size, payloadSize))
+
+	// wrong cid
+	bad = proofs[0]
+	bad.Cid = blks[0].Cid()
+	if bad.Cid == proofs[0].Cid {
+		bad.Cid = blks[1].Cid()
+	}
+	require.Error(t, bad.Verify(piece, size, payloadSize))
+
+	// incomplete car
+	rec = NewRecorder()
+	_, err = rec.Write(payload[:len(payload)-1])
+	require.NoError(t, err)
+	_, err = rec.Points()
+	require.Error(t, err)
+}
+
+func TestPick(t *testing.T) {
+	var seed [32]byte
+	require.Equal(t, []int{}, Pick(seed, 0, 5))
+
+	all := Pick(seed, 5, 10)
+	require.Len(t, all, 5)
+	require.ElementsMatch(t, []int{0, 1, 2, 3, 4}, all)
+
+	require.Equal(t, all[:3], Pick(seed, 5, 3))
+}
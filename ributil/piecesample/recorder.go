@@ -0,0 +1,176 @@
+package piecesample
+
+import (
+	"encoding/binary"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// maxCidPrefix is the number of entry bytes kept to parse the entry cid
+const maxCidPrefix = 256
+
+// Recorder records entries covering sample points of a CARv1 written to it.
+// The payload size doesn't need to be known upfront, points are thinned out
+// as the car grows.
+type Recorder struct {
+	stride int64
+	next   int64
+
+	at     int64
+	entEnd int64
+	header bool
+
+	lenBuf   []byte
+	entStart int64
+	capture  []byte
+
+	entries []Entry
+	err     error
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		stride: MinStride,
+		next:   MinStride,
+	}
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		if r.at < r.entEnd {
+			take := r.entEnd - r.at
+			if take > int64(len(p)) {
+				take = int64(len(p))
+			}
+
+			if r.capture != nil && len(r.capture) < maxCidPrefix {
+				c := int64(maxCidPrefix - len(r.capture))
+				if c > take {
+					c = take
+				}
+				r.capture = append(r.capture, p[:c]...)
+			}
+
+			r.at += take
+			p = p[take:]
+
+			if r.at == r.entEnd {
+				if err := r.finishEntry(); err != nil {
+					r.err = err
+					return 0, err
+				}
+			}
+			continue
+		}
+
+		// entry length prefix
+		r.lenBuf = append(r.lenBuf, p[0])
+		r.at++
+		p = p[1:]
+
+		if r.lenBuf[len(r.lenBuf)-1]&0x80 != 0 {
+			if len(r.lenBuf) >= binary.MaxVarintLen64 {
+				r.err = xerrors.Errorf("invalid entry length at %d", r.at-int64(len(r.lenBuf)))
+				return 0, r.err
+			}
+			continue
+		}
+
+		l, _ := binary.Uvarint(r.lenBuf)
+		r.entStart = r.at - int64(len(r.lenBuf))
+		r.entEnd = r.at + int64(l)
+		r.lenBuf = r.lenBuf[:0]
+
+		if l == 0 {
+			r.err = xerrors.Errorf("empty entry at %d", r.entStart)
+			return 0, r.err
+		}
+
+		if !r.header {
+			// car header, sample points are never in the header
+			r.header = true
+			if r.next < r.entEnd {
+				r.err = xerrors.Errorf("car header larger than sample stride")
+				return 0, r.err
+			}
+			continue
+		}
+
+		for r.next < r.entEnd {
+			r.entries = append(r.entries, Entry{
+				Point:  r.next,
+				Offset: r.entStart,
+				Size:   r.entEnd - r.entStart,
+			})
+			r.next += r.stride
+
+			if len(r.entries) > MaxPoints {
+				r.thin()
+			}
+		}
+
+		if len(r.entries) > 0 && r.entries[len(r.entries)-1].Offset == r.entStart {
+			r.capture = make([]byte, 0, maxCidPrefix)
+		}
+	}
+
+	return n, nil
+}
+
+// thin doubles the stride, dropping points which aren't its multiples
+func (r *Recorder) thin() {
+	r.stride *= 2
+
+	kept := r.entries[:0]
+	for _, e := range r.entries {
+		if e.Point%r.stride == 0 {
+			kept = append(kept, e)
+		}
+	}
+	r.entries = kept
+
+	r.next = (r.next + r.stride - 1) / r.stride * r.stride
+}
+
+func (r *Recorder) finishEntry() error {
+	if r.capture == nil {
+		return nil
+	}
+
+	_, c, err := cid.CidFromBytes(r.capture)
+	if err != nil {
+		return xerrors.Errorf("parsing cid of entry at %d: %w", r.entStart, err)
+	}
+
+	for i := len(r.entries) - 1; i >= 0 && r.entries[i].Offset == r.entStart; i-- {
+		r.entries[i].Cid = c
+	}
+
+	r.capture = nil
+	return nil
+}
+
+// Points returns the recorded points of the whole car
+func (r *Recorder) Points() (*Points, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.at != r.entEnd || len(r.lenBuf) != 0 || !r.header {
+		return nil, xerrors.Errorf("car ends with an incomplete entry")
+	}
+
+	if r.stride != Stride(r.at) || len(r.entries) != PointCount(r.at) {
+		return nil, xerrors.Errorf("recorded %d sample points with stride %d, expected %d with stride %d", len(r.entries), r.stride, PointCount(r.at), Stride(r.at))
+	}
+
+	return &Points{
+		PayloadSize: r.at,
+		Entries:     r.entries,
+	}, nil
+}
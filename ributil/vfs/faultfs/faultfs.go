@@ -0,0 +1,488 @@
+// Package faultfs implements a vfs.FS which simulates crashes for testing
+// crash consistency.
+//
+// Files are read and written through the OS, and the FS tracks which writes
+// were made durable with Sync (or O_SYNC). Crash simulates a power loss: each
+// write which wasn't synced is either lost, persisted, or torn at sector
+// granularity, and the files on disk are rewritten to match.
+//
+// File creation, removal and renames are treated as immediately durable.
+package faultfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lotus-web3/ribs/ributil/vfs"
+	"golang.org/x/xerrors"
+)
+
+// ErrCrashed is returned by all operations after a simulated crash, until
+// Crash is called
+var ErrCrashed = errors.New("faultfs: crashed")
+
+// ErrSyncFailed is returned by injected Sync failures
+var ErrSyncFailed = errors.New("faultfs: sync failed")
+
+// SectorSize is the granularity of torn writes
+const SectorSize = 512
+
+type FS struct {
+	lk  sync.Mutex
+	rng *rand.Rand
+
+	files map[string]*fileState
+
+	// gen is incremented by Crash, handles from older generations are dead
+	gen     int
+	crashed bool
+
+	// crashAfter is the number of mutating operations before a crash, -1 if
+	// no crash is scheduled
+	crashAfter int64
+	ops        int64
+
+	syncFailRate float64
+}
+
+var _ vfs.FS = &FS{}
+
+type fileState struct {
+	// durable is the content which survives a crash
+	durable []byte
+
+	// pending are writes which were not synced yet
+	pending []op
+}
+
+type op struct {
+	truncate bool
+	off      int64
+	data     []byte
+}
+
+func New(seed int64) *FS {
+	return &FS{
+		rng:        rand.New(rand.NewSource(seed)),
+		files:      map[string]*fileState{},
+		crashAfter: -1,
+	}
+}
+
+// CrashAfter schedules a crash on the n-th following mutating operation
+// (0 = the next one). Writes, truncates, syncs, removes and renames are
+// mutating operations. The crashing operation fails with ErrCrashed, and a
+// crashing write may still be partially persisted.
+func (fs *FS) CrashAfter(n int64) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	fs.crashAfter = n
+}
+
+// FailSyncs makes Sync calls fail with probability p. Like on Linux, writes
+// which a failed Sync was supposed to persist are not retried by later Syncs,
+// and are lost on crash.
+func (fs *FS) FailSyncs(p float64) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	fs.syncFailRate = p
+}
+
+// Ops returns the number of mutating operations done so far
+func (fs *FS) Ops() int64 {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	return fs.ops
+}
+
+// Crashed returns whether a scheduled crash happened
+func (fs *FS) Crashed() bool {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	return fs.crashed
+}
+
+// Crash simulates a power loss followed by a restart. Unsynced writes are
+// resolved and written to disk, and the FS accepts operations again. Files
+// opened before the crash stay unusable.
+func (fs *FS) Crash() error {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	for path, st := range fs.files {
+		content := bytes.Clone(st.durable)
+		for _, o := range st.pending {
+			content = fs.persistPartial(content, o)
+		}
+
+		if err := os.WriteFile(path, content, 0666); err != nil {
+			return xerrors.Errorf("writing crashed file %s: %w", path, err)
+		}
+
+		st.durable = content
+		st.pending = nil
+	}
+
+	fs.gen++
+	fs.crashed = false
+	fs.crashAfter = -1
+
+	return nil
+}
+
+// persistPartial applies the parts of an unsynced operation which made it to
+// disk before the crash
+func (fs *FS) persistPartial(content []byte, o op) []byte {
+	if o.truncate {
+		if fs.rng.Intn(2) == 0 {
+			return content
+		}
+		return apply(content, o)
+	}
+
+	switch fs.rng.Intn(3) {
+	case 0: // lost
+		return content
+	case 1: // persisted
+		return apply(content, o)
+	}
+
+	// torn, each sector is written independently
+	end := o.off + int64(len(o.data))
+	for start := o.off; start < end; {
+		next := (start/SectorSize + 1) * SectorSize
+		if next > end {
+			next = end
+		}
+
+		if fs.rng.Intn(2) == 0 {
+			content = apply(content, op{off: start, data: o.data[start-o.off : next-o.off]})
+		}
+		start = next
+	}
+
+	return content
+}
+
+func apply(content []byte, o op) []byte {
+	if o.truncate {
+		if o.off <= int64(len(content)) {
+			return content[:o.off]
+		}
+		return append(content, make([]byte, o.off-int64(len(content)))...)
+	}
+
+	end := o.off + int64(len(o.data))
+	if end > int64(len(content)) {
+		content = append(content, make([]byte, end-int64(len(content)))...)
+	}
+	copy(content[o.off:], o.data)
+	return content
+}
+
+// mutation checks whether the FS can do a mutating operation. If a scheduled
+// crash happens on this operation, crashNow is true. Called with lk held.
+func (fs *FS) mutation() (crashNow bool, err error) {
+	if fs.crashed {
+		return false, ErrCrashed
+	}
+
+	fs.ops++
+
+	switch {
+	case fs.crashAfter < 0:
+		return false, nil
+	case fs.crashAfter == 0:
+		fs.crashed = true
+		return true, nil
+	default:
+		fs.crashAfter--
+		return false, nil
+	}
+}
+
+func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	if fs.crashed {
+		return nil, ErrCrashed
+	}
+
+	name = filepath.Clean(name)
+
+	f, err := os.OpenFile(name, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	h := &handle{fs: fs, f: f, name: name, gen: fs.gen, sync: flag&os.O_SYNC != 0}
+	if fi.IsDir() {
+		h.dir = true
+		return h, nil
+	}
+
+	if _, ok := fs.files[name]; !ok {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			_ = f.Close()
+			return nil, xerrors.Errorf("reading initial content: %w", err)
+		}
+
+		fs.files[name] = &fileState{durable: content}
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		if err := f.Truncate(0); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		h.record(op{truncate: true})
+	}
+
+	return h, nil
+}
+
+func (fs *FS) Remove(name string) error {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	crashNow, err := fs.mutation()
+	if err != nil {
+		return err
+	}
+	if crashNow {
+		return ErrCrashed
+	}
+
+	name = filepath.Clean(name)
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *FS) Rename(oldpath, newpath string) error {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+
+	crashNow, err := fs.mutation()
+	if err != nil {
+		return err
+	}
+	if crashNow {
+		return ErrCrashed
+	}
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	delete(fs.files, newpath)
+	if st, ok := fs.files[oldpath]; ok {
+		fs.files[newpath] = st
+		delete(fs.files, oldpath)
+	}
+	return nil
+}
+
+type handle struct {
+	fs   *FS
+	f    *os.File
+	name string
+	gen  int
+
+	// sync is set for files opened with O_SYNC, writes to which are durable
+	// when they return
+	sync bool
+	dir  bool
+}
+
+var _ vfs.File = &handle{}
+
+// alive checks that the handle can be used. Called with fs.lk held.
+func (h *handle) alive() error {
+	if h.fs.crashed || h.gen != h.fs.gen {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// record tracks a write done to the file. Called with fs.lk held.
+func (h *handle) record(o op) {
+	st := h.fs.files[h.name]
+	if st == nil {
+		// removed or renamed over
+		return
+	}
+
+	if h.sync {
+		st.durable = apply(st.durable, o)
+		return
+	}
+	st.pending = append(st.pending, o)
+}
+
+func (h *handle) write(off int64, p []byte, do func() (int, error)) (int, error) {
+	h.fs.lk.Lock()
+	defer h.fs.lk.Unlock()
+
+	if err := h.alive(); err != nil {
+		return 0, err
+	}
+
+	crashNow, err := h.fs.mutation()
+	if err != nil {
+		return 0, err
+	}
+	if crashNow {
+		// the write was in flight, parts of it may persist
+		if st := h.fs.files[h.name]; st != nil {
+			st.pending = append(st.pending, op{off: off, data: bytes.Clone(p)})
+		}
+		return 0, ErrCrashed
+	}
+
+	n, err := do()
+	if n > 0 {
+		h.record(op{off: off, data: bytes.Clone(p[:n])})
+	}
+	return n, err
+}
+
+func (h *handle) Write(p []byte) (int, error) {
+	if err := h.check(); err != nil {
+		return 0, err
+	}
+
+	off, err := h.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.write(off, p, func() (int, error) {
+		return h.f.Write(p)
+	})
+}
+
+func (h *handle) WriteAt(p []byte, off int64) (int, error) {
+	return h.write(off, p, func() (int, error) {
+		return h.f.WriteAt(p, off)
+	})
+}
+
+func (h *handle) Truncate(size int64) error {
+	h.fs.lk.Lock()
+	defer h.fs.lk.Unlock()
+
+	if err := h.alive(); err != nil {
+		return err
+	}
+
+	crashNow, err := h.fs.mutation()
+	if err != nil {
+		return err
+	}
+	if crashNow {
+		return ErrCrashed
+	}
+
+	if err := h.f.Truncate(size); err != nil {
+		return err
+	}
+	h.record(op{truncate: true, off: size})
+	return nil
+}
+
+func (h *handle) Sync() error {
+	h.fs.lk.Lock()
+	defer h.fs.lk.Unlock()
+
+	if err := h.alive(); err != nil {
+		return err
+	}
+
+	crashNow, err := h.fs.mutation()
+	if err != nil {
+		return err
+	}
+	if crashNow {
+		return ErrCrashed
+	}
+
+	st := h.fs.files[h.name]
+	if h.dir || st == nil {
+		return nil
+	}
+
+	if h.fs.syncFailRate > 0 && h.fs.rng.Float64() < h.fs.syncFailRate {
+		// writeback failed, the pages are marked clean, and the data is
+		// never written
+		st.pending = nil
+		return ErrSyncFailed
+	}
+
+	for _, o := range st.pending {
+		st.durable = apply(st.durable, o)
+	}
+	st.pending = nil
+	return nil
+}
+
+func (h *handle) Read(p []byte) (int, error) {
+	if err := h.check(); err != nil {
+		return 0, err
+	}
+	return h.f.Read(p)
+}
+
+func (h *handle) ReadAt(p []byte, off int64) (int, error) {
+	if err := h.check(); err != nil {
+		return 0, err
+	}
+	return h.f.ReadAt(p, off)
+}
+
+func (h *handle) Seek(offset int64, whence int) (int64, error) {
+	if err := h.check(); err != nil {
+		return 0, err
+	}
+	return h.f.Seek(offset, whence)
+}
+
+func (h *handle) Stat() (os.FileInfo, error) {
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+	return h.f.Stat()
+}
+
+// Close always releases the OS file, so that crashed stores can be closed
+// before Crash
+func (h *handle) Close() error {
+	return h.f.Close()
+}
+
+func (h *handle) check() error {
+	h.fs.lk.Lock()
+	defer h.fs.lk.Unlock()
+
+	return h.alive()
+}
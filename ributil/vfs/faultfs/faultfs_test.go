@@ -0,0 +1,93 @@
+package faultfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrash(t *testing.T) {
+	dir := t.TempDir()
+	fs := New(0)
+
+	synced := bytes.Repeat([]byte{1}, 4*SectorSize)
+	unsynced := bytes.Repeat([]byte{2}, 64*SectorSize)
+
+	f, err := fs.OpenFile(filepath.Join(dir, "data"), os.O_RDWR|os.O_CREATE, 0666)
+	require.NoError(t, err)
+
+	_, err = f.Write(synced)
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+
+	_, err = f.Write(unsynced)
+	require.NoError(t, err)
+
+	// crash on the next operation
+	fs.CrashAfter(0)
+	require.ErrorIs(t, f.Sync(), ErrCrashed)
+	_, err = f.Write(unsynced)
+	require.ErrorIs(t, err, ErrCrashed)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, fs.Crash())
+
+	data, err := os.ReadFile(filepath.Join(dir, "data"))
+	require.NoError(t, err)
+	require.Equal(t, synced, data[:len(synced)])
+
+	// unsynced sectors are either written or holes
+	rest := data[len(synced):]
+	require.LessOrEqual(t, len(rest), len(unsynced))
+	for i := 0; i < len(rest); i += SectorSize {
+		sector := rest[i:min(i+SectorSize, len(rest))]
+		if sector[0] == 2 {
+			require.Equal(t, unsynced[:len(sector)], sector)
+		} else {
+			require.Equal(t, make([]byte, len(sector)), sector)
+		}
+	}
+
+	// the fs is usable after the crash, old files aren't
+	_, err = f.Write(synced)
+	require.ErrorIs(t, err, ErrCrashed)
+
+	f, err = fs.OpenFile(filepath.Join(dir, "data"), os.O_RDWR|os.O_SYNC, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt(unsynced, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// O_SYNC writes survive crashes
+	require.NoError(t, fs.Crash())
+	data, err = os.ReadFile(filepath.Join(dir, "data"))
+	require.NoError(t, err)
+	require.Equal(t, unsynced, data[:len(unsynced)])
+}
+
+func TestFailSyncs(t *testing.T) {
+	dir := t.TempDir()
+	fs := New(0)
+	fs.FailSyncs(1)
+
+	f, err := fs.OpenFile(filepath.Join(dir, "data"), os.O_RDWR|os.O_CREATE, 0666)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("lost"))
+	require.NoError(t, err)
+	require.ErrorIs(t, f.Sync(), ErrSyncFailed)
+
+	// a later successful sync doesn't persist writes from the failed sync
+	fs.FailSyncs(0)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Close())
+
+	require.NoError(t, fs.Crash())
+
+	data, err := os.ReadFile(filepath.Join(dir, "data"))
+	require.NoError(t, err)
+	require.Empty(t, data)
+}